@@ -0,0 +1,299 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/backend"
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/boxboat/dockhand-lru-registry/pkg/config"
+	"github.com/boxboat/dockhand-lru-registry/pkg/proxy"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	proxyConfig      *config.Config
+	proxyConfigViper *viper.Viper
+	proxyConfigFlags []*pflag.FlagSet
+	showSecrets      bool
+	reloadLock       sync.Mutex
+)
+
+// configFile returns the config file given with --config or found in the home directory
+func configFile() string {
+	if CfgFile != "" {
+		return CfgFile
+	}
+	return viper.ConfigFileUsed()
+}
+
+// configFlags are the flag sets the configuration of cmd is read with, keys without a
+// flag on cmd fall back to the flags of the start command and the persistent flags
+func configFlags(cmd *cobra.Command) []*pflag.FlagSet {
+	return []*pflag.FlagSet{cmd.Flags(), startProxyCmd.Flags(), rootCmd.PersistentFlags()}
+}
+
+// loadConfig reads the proxy configuration with the flags of cmd
+func loadConfig(cmd *cobra.Command) (*config.Config, *viper.Viper, error) {
+	return config.Load(configFile(), configFlags(cmd)...)
+}
+
+// loadProxyConfig reads and validates the configuration and applies it to proxyArgs
+func loadProxyConfig(cmd *cobra.Command, args []string) error {
+	cfg, v, err := loadConfig(cmd)
+	if err != nil {
+		return err
+	}
+	proxyConfig, proxyConfigViper, proxyConfigFlags = cfg, v, configFlags(cmd)
+	applyLogLevel(cfg)
+	applyConfig(&proxyArgs, cfg)
+	return proxyArgs.parse()
+}
+
+// applyConfig copies the configuration into the proxy arguments
+func applyConfig(args *ProxyArgs, cfg *config.Config) {
+	args.serverPort = cfg.Server.Port
+	args.serverCert = cfg.Server.Cert
+	args.serverKey = cfg.Server.Key
+	args.UseForwardedHeaders = cfg.Server.UseForwardedHeaders
+	args.notReadyDuringGC = cfg.Server.NotReadyDuringGC
+	args.ShutdownArgs.DrainTimeout = time.Duration(cfg.Server.DrainTimeout)
+	args.ShutdownArgs.GCPolicy = proxy.GCShutdownPolicy(cfg.Cleanup.GCOnShutdown)
+
+	args.registryHost = cfg.Backend.RegistryHost
+	args.registryScheme = cfg.Backend.RegistryScheme
+	args.backendType = cfg.Backend.Type
+	args.gcPollInterval = time.Duration(cfg.Backend.GCPollInterval)
+	args.gcPollTimeout = time.Duration(cfg.Backend.GCPollTimeout)
+	args.registryBinary = cfg.Backend.RegistryBinary
+	args.registryConfig = cfg.Backend.RegistryConfig
+	args.registryDir = cfg.Backend.RegistryDir
+	args.separateDisk = cfg.Backend.SeparateDisk
+	args.usage = cfg.Backend.Usage
+	args.usageRescanInterval = time.Duration(cfg.Backend.UsageRescanInterval)
+	args.usageMaxWatches = cfg.Backend.UsageMaxWatches
+	args.s3 = backend.S3{
+		Endpoint:     cfg.Backend.S3.Endpoint,
+		Region:       cfg.Backend.S3.Region,
+		Bucket:       cfg.Backend.S3.Bucket,
+		Prefix:       cfg.Backend.S3.Prefix,
+		AccessKey:    cfg.Backend.S3.AccessKey,
+		SecretKey:    cfg.Backend.S3.SecretKey,
+		SessionToken: cfg.Backend.S3.SessionToken,
+		PathStyle:    cfg.Backend.S3.PathStyle,
+		ListInterval: time.Duration(cfg.Backend.S3.ListInterval),
+	}
+	args.databaseDir = cfg.Backend.DatabaseDir
+	args.SnapshotArgs.Dir = cfg.Backend.SnapshotDir
+	args.SnapshotArgs.CronSchedule = cfg.Backend.SnapshotCron
+	args.SnapshotArgs.Keep = cfg.Backend.SnapshotKeep
+	args.superviseRegistry = cfg.Backend.Supervise
+	args.registryStartTimeout = time.Duration(cfg.Backend.RegistryStartTimeout)
+	args.registryPreflight = cfg.Backend.RegistryPreflight
+
+	args.CleanupArgs.CronSchedule = cfg.Cleanup.Cron
+	args.CleanupArgs.TimeZone = cfg.Cleanup.TimeZone
+	args.TargetDiskSizeByteString = cfg.Cleanup.TargetDiskUsage
+	args.CleanupArgs.CleanTagsPercentage = cfg.Cleanup.CleanTagsPercentage
+	args.HardDiskLimitByteString = cfg.Cleanup.HardDiskLimit
+	args.CleanupArgs.HardLimitCheckInterval = time.Duration(cfg.Cleanup.HardLimitCheckInterval)
+	args.CleanupArgs.HistoryRetention = time.Duration(cfg.Cleanup.HistoryRetention)
+	args.CleanupArgs.HistoryMaxRuns = cfg.Cleanup.HistoryMaxRuns
+	args.CleanupArgs.OfflineGC = cfg.Cleanup.OfflineGC
+	args.CleanupArgs.Forecast = proxy.ForecastSettings{
+		SampleInterval: time.Duration(cfg.Cleanup.ForecastInterval),
+		Window:         time.Duration(cfg.Cleanup.ForecastWindow),
+		Reschedule:     cfg.Cleanup.ForecastReschedule,
+		Headroom:       cfg.Cleanup.ForecastHeadroom,
+	}
+
+	args.CleanupArgs.EvictionLimits = proxy.EvictionLimits{
+		MaxTags:            cfg.Policy.MaxEvictTags,
+		MaxTagsPercentage:  cfg.Policy.MaxEvictTagsPercentage,
+		MaxBytesPercentage: cfg.Policy.MaxEvictBytesPercentage,
+		Override:           cfg.Policy.OverrideEvictionLimits,
+	}
+	args.MaxEvictByteString = cfg.Policy.MaxEvictBytes
+
+	args.adminToken = cfg.Auth.AdminToken
+	args.notificationSecret = cfg.Auth.NotificationSecret
+
+	args.notificationWindow = time.Duration(cfg.Observability.NotificationDedupWindow)
+	args.eventFile = cfg.Observability.Events.File
+	args.eventWebhookURL = cfg.Observability.Events.WebhookURL
+	args.eventWebhookSecret = cfg.Observability.Events.WebhookSecret
+	args.eventWebhookRetries = cfg.Observability.Events.WebhookRetries
+	args.eventStdout = cfg.Observability.Events.Stdout
+	args.ReportArgs = proxy.ReportSettings{
+		Dir:               cfg.Observability.Reports.Dir,
+		CronSchedule:      cfg.Observability.Reports.Cron,
+		Window:            time.Duration(cfg.Observability.Reports.Window),
+		Format:            cfg.Observability.Reports.Format,
+		ActivityRetention: time.Duration(cfg.Observability.Reports.ActivityRetention),
+	}
+}
+
+func applyLogLevel(cfg *config.Config) {
+	if cfg.Observability.Debug {
+		common.Log.SetLevel(log.DebugLevel)
+	} else {
+		common.Log.SetLevel(log.InfoLevel)
+	}
+}
+
+// watchConfig applies changes of the config file to a running proxy as they are written
+func watchConfig(registryProxy *proxy.Proxy) {
+	if proxyConfigViper == nil || proxyConfigViper.ConfigFileUsed() == "" {
+		return
+	}
+	config.Watch(proxyConfigViper, func(cfg *config.Config) {
+		common.LogIfError(applyReloadedConfig(registryProxy, cfg))
+	})
+}
+
+// reloadConfig reads the configuration again and applies it to a running proxy
+func reloadConfig(registryProxy *proxy.Proxy) error {
+	cfg, _, err := config.Load(configFile(), proxyConfigFlags...)
+	if err != nil {
+		return err
+	}
+	return applyReloadedConfig(registryProxy, cfg)
+}
+
+// applyReloadedConfig applies the cleanup and policy sections of a configuration to a
+// running proxy, changes to other sections are logged and take effect on restart
+func applyReloadedConfig(registryProxy *proxy.Proxy, cfg *config.Config) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	args := proxyArgs
+	applyConfig(&args, cfg)
+	if err := args.parse(); err != nil {
+		return err
+	}
+	if err := registryProxy.UpdateCleanSettings(args.CleanupArgs); err != nil {
+		return err
+	}
+	applyLogLevel(cfg)
+
+	debug := cfg.Observability.Debug
+	cfg.Observability.Debug = proxyConfig.Observability.Debug
+	if cfg.Server != proxyConfig.Server || cfg.Backend != proxyConfig.Backend ||
+		cfg.Auth != proxyConfig.Auth || cfg.Observability != proxyConfig.Observability {
+		common.Log.Warnf("changes to the server, backend, auth and observability sections take effect on restart")
+	}
+	cfg.Observability.Debug = debug
+	// later reloads warn about sections changed since this one only
+	proxyConfig = cfg
+	common.Log.Infof("applied cleanup and policy configuration")
+	return nil
+}
+
+func validateConfig(cmd *cobra.Command) {
+	cfg, _, err := loadConfig(cmd)
+	if err != nil {
+		if problems, ok := err.(config.ValidationError); ok {
+			for _, problem := range problems {
+				fmt.Fprintln(os.Stderr, problem)
+			}
+			os.Exit(1)
+		}
+		common.ExitIfError(err)
+	}
+	applyConfig(&proxyArgs, cfg)
+	if proxyArgs.registryPreflight && proxyArgs.backendType != backend.TypeAPI {
+		problems, warnings, err := registryConfigProblems()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to read registry config, skipping preflight: %v\n", err)
+		}
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "registry config %s: %s\n", proxyArgs.registryConfig, problem)
+		}
+		for _, warning := range warnings {
+			fmt.Fprintf(os.Stderr, "registry config %s: warning: %s\n", proxyArgs.registryConfig, warning)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+	}
+	if file := configFile(); file != "" {
+		fmt.Printf("%s is valid\n", file)
+	} else {
+		fmt.Println("configuration is valid")
+	}
+}
+
+func printConfig(cmd *cobra.Command) {
+	cfg, _, err := loadConfig(cmd)
+	common.ExitIfError(err)
+	if !showSecrets {
+		redacted := cfg.Redacted()
+		cfg = &redacted
+	}
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	common.ExitIfError(encoder.Encode(cfg))
+	common.ExitIfError(encoder.Close())
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "check the proxy configuration",
+	Long: `validate or print the configuration of the proxy, merged from the config file,
+LRU_ environment variables and the flags of the start command`,
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "validate the configuration",
+	Long: `check the cron schedules, timezone, byte sizes, percentages and urls of the configuration and list every invalid setting,
+and the registry config for settings that do not match the proxy unless registry-preflight is disabled`,
+	Run: func(cmd *cobra.Command, args []string) {
+		validateConfig(cmd)
+	},
+}
+
+var configPrintCmd = &cobra.Command{
+	Use:   "print",
+	Short: "print the effective configuration",
+	Long:  `print the configuration the proxy would start with as yaml, secrets are redacted unless --show-secrets is set`,
+	Run: func(cmd *cobra.Command, args []string) {
+		printConfig(cmd)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configValidateCmd)
+	configCmd.AddCommand(configPrintCmd)
+
+	configPrintCmd.Flags().BoolVar(
+		&showSecrets,
+		"show-secrets",
+		false,
+		"print secrets instead of redacting them")
+
+	_ = viper.BindPFlags(configPrintCmd.Flags())
+}
@@ -0,0 +1,417 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/api"
+	"github.com/boxboat/dockhand-lru-registry/pkg/client"
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+type CtlArgs struct {
+	server             string
+	token              string
+	caCert             string
+	clientCert         string
+	clientKey          string
+	insecureSkipVerify bool
+	output             string
+	unpin              bool
+	leaseDuration      time.Duration
+	reportWindow       time.Duration
+}
+
+var (
+	ctlArgs CtlArgs
+)
+
+// newClient returns an admin api client configured by the ctl flags
+func newClient() *client.Client {
+	tlsConfig := &tls.Config{InsecureSkipVerify: ctlArgs.insecureSkipVerify}
+	if ctlArgs.caCert != "" {
+		pem, err := os.ReadFile(ctlArgs.caCert)
+		common.ExitIfError(err)
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			common.ExitIfError(fmt.Errorf("no certificates found in %s", ctlArgs.caCert))
+		}
+	}
+	if ctlArgs.clientCert != "" {
+		certificate, err := tls.LoadX509KeyPair(ctlArgs.clientCert, ctlArgs.clientKey)
+		common.ExitIfError(err)
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return client.New(ctlArgs.server, adminToken(), tlsConfig)
+}
+
+// adminToken returns the admin api token of the token flag, LRU_ADMIN_TOKEN or the
+// proxy configuration
+func adminToken() string {
+	if ctlArgs.token != "" {
+		return ctlArgs.token
+	}
+	if token := os.Getenv("LRU_ADMIN_TOKEN"); token != "" {
+		return token
+	}
+	return proxyArgs.adminToken
+}
+
+func printTagStatus(status *api.TagStatus) error {
+	leaseExpiry := ""
+	if status.LeaseExpiry != nil {
+		leaseExpiry = status.LeaseExpiry.Format(time.RFC3339)
+	}
+	return printRecords(
+		ctlArgs.output,
+		[]string{"tag", "last access", "pinned", "lease expiry"},
+		[][]string{{status.Image, status.AccessTime.Format(time.RFC3339), strconv.FormatBool(status.Pinned), leaseExpiry}},
+		status)
+}
+
+func printCleanupStatus(status *api.CleanupStatus) error {
+	startTime := ""
+	if status.StartTime != nil {
+		startTime = status.StartTime.Format(time.RFC3339)
+	}
+	return printRecords(
+		ctlArgs.output,
+		[]string{"running", "trigger", "start", "breaker open", "breaker reason", "emergency", "read only"},
+		[][]string{{
+			strconv.FormatBool(status.Running),
+			status.Trigger,
+			startTime,
+			strconv.FormatBool(status.BreakerOpen),
+			string(status.BreakerReason),
+			strconv.FormatBool(status.Emergency),
+			strconv.FormatBool(status.ReadOnly),
+		}},
+		status)
+}
+
+func printReadOnly(enabled bool) error {
+	return printRecords(
+		ctlArgs.output,
+		[]string{"read only"},
+		[][]string{{strconv.FormatBool(enabled)}},
+		api.ReadOnlyStatus{Enabled: enabled})
+}
+
+func printForecast(forecast *api.Forecast) error {
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	free := ""
+	if forecast.FreeBytes != nil {
+		free = strconv.FormatUint(*forecast.FreeBytes, 10)
+	}
+	return printRecords(
+		ctlArgs.output,
+		[]string{"samples", "used bytes", "target bytes", "free bytes", "growth bytes/h", "pushed bytes/h",
+			"target reached", "disk full", "next cleanup", "forecast cleanup", "headroom bytes"},
+		[][]string{{
+			strconv.Itoa(forecast.Samples),
+			strconv.FormatUint(forecast.UsedBytes, 10),
+			strconv.FormatUint(forecast.TargetBytes, 10),
+			free,
+			strconv.FormatFloat(forecast.GrowthBytesPerHour, 'f', 0, 64),
+			strconv.FormatFloat(forecast.PushedBytesPerHour, 'f', 0, 64),
+			formatTime(forecast.TargetTime),
+			formatTime(forecast.FullTime),
+			formatTime(forecast.NextCleanup),
+			formatTime(forecast.EarlyCleanup),
+			strconv.FormatUint(forecast.HeadroomBytes, 10),
+		}},
+		forecast)
+}
+
+var ctlCmd = &cobra.Command{
+	Use:   "ctl",
+	Short: "control a running proxy",
+	Long: `control a running proxy through its admin api, the proxy must be started with --admin-token.
+the token may also be provided with the LRU_ADMIN_TOKEN environment variable`,
+}
+
+var ctlEvictCmd = &cobra.Command{
+	Use:   "evict <repo:tag>",
+	Short: "evict a cached tag",
+	Long:  `delete a cached tag from the registry and usage.db, blobs are freed by the next garbage collection`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		status, err := newClient().Evict(cmd.Context(), args[0])
+		common.ExitIfError(err)
+		common.ExitIfError(printTagStatus(status))
+	},
+}
+
+var ctlPinCmd = &cobra.Command{
+	Use:   "pin <repo:tag>",
+	Short: "protect a cached tag from eviction",
+	Long:  `pin a cached tag so clean cycles never evict it, use --unpin to remove the pin`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		status, err := newClient().Pin(cmd.Context(), args[0], !ctlArgs.unpin)
+		common.ExitIfError(err)
+		common.ExitIfError(printTagStatus(status))
+	},
+}
+
+var ctlLeaseCmd = &cobra.Command{
+	Use:   "lease <repo:tag>",
+	Short: "protect a cached tag from eviction for a duration",
+	Long:  `lease a cached tag so clean cycles do not evict it until the lease expires, a duration of 0 clears the lease`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		status, err := newClient().Lease(cmd.Context(), args[0], ctlArgs.leaseDuration)
+		common.ExitIfError(err)
+		common.ExitIfError(printTagStatus(status))
+	},
+}
+
+var ctlCleanupCmd = &cobra.Command{
+	Use:   "cleanup",
+	Short: "manage clean cycles",
+}
+
+var ctlCleanupRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "start a clean cycle",
+	Long:  `start a clean cycle in the background, use cleanup status to follow it and history for the outcome`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		status, err := newClient().RunCleanup(cmd.Context())
+		common.ExitIfError(err)
+		common.ExitIfError(printCleanupStatus(status))
+	},
+}
+
+var ctlCleanupCancelCmd = &cobra.Command{
+	Use:   "cancel",
+	Short: "cancel the clean cycle in progress",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		status, err := newClient().CancelCleanup(cmd.Context())
+		common.ExitIfError(err)
+		common.ExitIfError(printCleanupStatus(status))
+	},
+}
+
+var ctlCleanupStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "show the clean cycle in progress",
+	Long:  `show the clean cycle in progress, the circuit breaker and the read only and emergency state of the proxy`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		status, err := newClient().CleanupStatus(cmd.Context())
+		common.ExitIfError(err)
+		common.ExitIfError(printCleanupStatus(status))
+	},
+}
+
+var ctlCleanupResetBreakerCmd = &cobra.Command{
+	Use:   "reset-breaker",
+	Short: "reset the cleanup circuit breaker",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		status, err := newClient().ResetBreaker(cmd.Context())
+		common.ExitIfError(err)
+		common.ExitIfError(printCleanupStatus(status))
+	},
+}
+
+var ctlCleanupPlanCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "dry run a clean cycle on the proxy",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		plan, err := newClient().Plan(cmd.Context())
+		common.ExitIfError(err)
+		planOutput = ctlArgs.output
+		common.ExitIfError(printPlan(plan))
+	},
+}
+
+var ctlReadOnlyCmd = &cobra.Command{
+	Use:       "readonly [on|off]",
+	Short:     "show or set read only mode",
+	Long:      `while read only the proxy rejects pushes and deletes with 503, pulls are served and clean cycles still run`,
+	Args:      cobra.MatchAll(cobra.MaximumNArgs(1), cobra.OnlyValidArgs),
+	ValidArgs: []string{"on", "off"},
+	Run: func(cmd *cobra.Command, args []string) {
+		var enabled bool
+		var err error
+		if len(args) == 0 {
+			enabled, err = newClient().ReadOnly(cmd.Context())
+		} else {
+			enabled, err = newClient().SetReadOnly(cmd.Context(), args[0] == "on")
+		}
+		common.ExitIfError(err)
+		common.ExitIfError(printReadOnly(enabled))
+	},
+}
+
+var ctlHistoryCmd = &cobra.Command{
+	Use:   "history",
+	Short: "show clean cycle history of the proxy",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		runs, err := newClient().History(cmd.Context(), historyArgs.limit)
+		common.ExitIfError(err)
+		historyArgs.output = ctlArgs.output
+		common.ExitIfError(printHistory(runs))
+	},
+}
+
+var ctlForecastCmd = &cobra.Command{
+	Use:   "forecast",
+	Short: "show the usage forecast of the proxy",
+	Long:  `show the usage growth fitted to the samples in usage.db and when usage is forecast to reach the target and fill the disk`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		forecast, err := newClient().Forecast(cmd.Context())
+		common.ExitIfError(err)
+		common.ExitIfError(printForecast(forecast))
+	},
+}
+
+var ctlReportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "report usage per namespace and repository from the proxy",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		report, err := newClient().Report(cmd.Context(), ctlArgs.reportWindow)
+		common.ExitIfError(err)
+		common.ExitIfError(printReport(report, ctlArgs.output))
+	},
+}
+
+var ctlBackupCmd = &cobra.Command{
+	Use:   "backup <file>",
+	Short: "hot backup usage.db of the proxy",
+	Long:  `write a consistent copy of usage.db of a running proxy to a file, restore it with db restore`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		backupRemote(cmd.Context(), args[0])
+	},
+}
+
+// backupRemote writes a hot backup to a file next to path and renames it into place once complete
+func backupRemote(ctx context.Context, path string) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	common.ExitIfError(err)
+
+	written, err := newClient().Backup(ctx, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		// an incomplete backup never replaces path
+		common.LogIfError(os.Remove(file.Name()))
+		common.ExitIfError(err)
+	}
+	common.Log.Infof("wrote %d bytes to %s", written, path)
+}
+
+func init() {
+	rootCmd.AddCommand(ctlCmd)
+	ctlCmd.AddCommand(ctlEvictCmd, ctlPinCmd, ctlLeaseCmd, ctlCleanupCmd, ctlReadOnlyCmd, ctlHistoryCmd, ctlForecastCmd, ctlReportCmd, ctlBackupCmd)
+	ctlCleanupCmd.AddCommand(ctlCleanupRunCmd, ctlCleanupCancelCmd, ctlCleanupStatusCmd, ctlCleanupResetBreakerCmd, ctlCleanupPlanCmd)
+
+	ctlCmd.PersistentFlags().StringVar(
+		&ctlArgs.server,
+		"server",
+		"http://localhost:3000",
+		"url of the proxy")
+
+	ctlCmd.PersistentFlags().StringVar(
+		&ctlArgs.token,
+		"token",
+		"",
+		"admin api token, defaults to LRU_ADMIN_TOKEN")
+
+	ctlCmd.PersistentFlags().StringVar(
+		&ctlArgs.caCert,
+		"ca-cert",
+		"",
+		"ca certificate to verify the proxy certificate")
+
+	ctlCmd.PersistentFlags().StringVar(
+		&ctlArgs.clientCert,
+		"client-cert",
+		"",
+		"client certificate for mutual tls")
+
+	ctlCmd.PersistentFlags().StringVar(
+		&ctlArgs.clientKey,
+		"client-key",
+		"",
+		"client key for mutual tls")
+
+	ctlCmd.PersistentFlags().BoolVar(
+		&ctlArgs.insecureSkipVerify,
+		"insecure-skip-verify",
+		false,
+		"do not verify the proxy certificate")
+
+	ctlCmd.PersistentFlags().StringVar(
+		&ctlArgs.output,
+		"output",
+		"table",
+		"output format, table or json, report also supports csv")
+
+	ctlPinCmd.Flags().BoolVar(
+		&ctlArgs.unpin,
+		"unpin",
+		false,
+		"remove the pin")
+
+	ctlLeaseCmd.Flags().DurationVar(
+		&ctlArgs.leaseDuration,
+		"duration",
+		24*time.Hour,
+		"how long the tag is protected, 0 clears the lease")
+
+	ctlHistoryCmd.Flags().IntVar(
+		&historyArgs.limit,
+		"limit",
+		10,
+		"number of clean cycles to show, 0 shows every clean cycle")
+
+	ctlReportCmd.Flags().DurationVar(
+		&ctlArgs.reportWindow,
+		"window",
+		24*time.Hour,
+		"how far back the report counts pulls, pushes and byte-hours, from the start of the day in UTC")
+
+	_ = viper.BindPFlags(ctlCmd.PersistentFlags())
+}
@@ -0,0 +1,273 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// compactTxMaxSize is the number of bytes copied per transaction while compacting
+	compactTxMaxSize = 64 * 1024 * 1024
+)
+
+type DbArgs struct {
+	output        string
+	compactOutput string
+	force         bool
+}
+
+var (
+	dbArgs DbArgs
+)
+
+// openExclusive opens usage.db with the write lock, failing if a proxy is running
+func openExclusive() *bolt.DB {
+	return openDatabaseFile(databasePath(), &bolt.Options{Timeout: dbTimeout})
+}
+
+// backupPath returns the path the previous usage.db is kept at before it is modified
+func backupPath() string {
+	return fmt.Sprintf("%s.%s.bak", databasePath(), time.Now().UTC().Format("20060102T150405Z"))
+}
+
+// backupDatabase writes a copy of usage.db to path, a running proxy holding the write
+// lock writes a hot backup through its admin api
+func backupDatabase(ctx context.Context, path string) {
+	db, locked := openUnlessLocked()
+	if locked {
+		backupRemote(ctx, path)
+		return
+	}
+	defer db.Close()
+
+	written, err := (&lru.Cache{Db: db}).BackupFile(path)
+	common.ExitIfError(err)
+	common.Log.Infof("wrote %d bytes to %s", written, path)
+}
+
+func restoreDatabase(path string) {
+	backup := openDatabaseFile(path, &bolt.Options{ReadOnly: true, Timeout: dbTimeout})
+	report, err := (&lru.Cache{Db: backup}).Verify()
+	common.ExitIfError(err)
+	if len(report.Problems) > 0 && !dbArgs.force {
+		common.LogIfError(backup.Close())
+		common.ExitIfError(printVerifyReport(report))
+		common.ExitIfError(fmt.Errorf("%s has %d problems, use --force to restore it anyway", path, len(report.Problems)))
+	}
+
+	// hold the write lock on the current db so a proxy cannot start while it is replaced
+	current := openExclusive()
+	defer current.Close()
+	previous := backupPath()
+	written, err := (&lru.Cache{Db: current}).BackupFile(previous)
+	common.ExitIfError(err)
+	common.Log.Infof("kept the previous usage.db as %s, %d bytes", previous, written)
+
+	written, err = (&lru.Cache{Db: backup}).BackupFile(databasePath())
+	common.LogIfError(backup.Close())
+	common.ExitIfError(err)
+	common.Log.Infof("restored %d bytes from %s with %d tags", written, path, report.Images)
+}
+
+func compactDatabase() {
+	src := openExclusive()
+	defer src.Close()
+
+	output := dbArgs.compactOutput
+	if output == "" {
+		output = databasePath()
+	}
+	file, err := os.CreateTemp(filepath.Dir(output), filepath.Base(output)+".*.tmp")
+	common.ExitIfError(err)
+	common.LogIfError(file.Close())
+	defer os.Remove(file.Name())
+
+	dst, err := bolt.Open(file.Name(), 0600, nil)
+	common.ExitIfError(err)
+	err = bolt.Compact(dst, src, compactTxMaxSize)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	common.ExitIfError(err)
+
+	srcSize, dstSize := fileSize(databasePath()), fileSize(file.Name())
+	common.ExitIfError(os.Rename(file.Name(), output))
+	common.Log.Infof("compacted usage.db from %d to %d bytes into %s", srcSize, dstSize, output)
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	common.ExitIfError(err)
+	return info.Size()
+}
+
+func verifyDatabase() {
+	db := openDatabase(true)
+	defer db.Close()
+
+	report, err := (&lru.Cache{Db: db}).Verify()
+	common.ExitIfError(err)
+	common.ExitIfError(printVerifyReport(report))
+	if len(report.Problems) > 0 {
+		common.ExitIfError(fmt.Errorf("usage.db has %d problems, fix them with db repair", len(report.Problems)))
+	}
+}
+
+func printVerifyReport(report *lru.VerifyReport) error {
+	if dbArgs.output != "json" {
+		fmt.Printf("images: %d\naccess entries: %d\nmetadata: %d\nclean cycles: %d\nproblems: %d\n\n",
+			report.Images, report.AccessEntries, report.Metadata, report.CleanupRuns, len(report.Problems))
+		if len(report.Problems) == 0 {
+			return nil
+		}
+	}
+	return printProblems(report.Problems, report)
+}
+
+func printProblems(problems []lru.Problem, value interface{}) error {
+	var rows [][]string
+	for _, problem := range problems {
+		rows = append(rows, []string{problem.Bucket, problem.Key, problem.Problem})
+	}
+	return printRecords(dbArgs.output, []string{"bucket", "key", "problem"}, rows, value)
+}
+
+func repairDatabase() {
+	db := openExclusive()
+	defer db.Close()
+
+	cache := &lru.Cache{Db: db}
+	previous := backupPath()
+	written, err := cache.BackupFile(previous)
+	common.ExitIfError(err)
+	common.Log.Infof("kept the previous usage.db as %s, %d bytes", previous, written)
+
+	fixes, err := cache.Repair()
+	common.ExitIfError(err)
+	common.ExitIfError(printProblems(fixes, fixes))
+	common.Log.Infof("applied %d fixes to usage.db", len(fixes))
+}
+
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "maintain usage.db",
+	Long: `backup, restore, compact, verify and repair usage.db. commands that modify usage.db take the write lock and
+fail while a proxy is running, use ctl backup for a hot backup of a running proxy`,
+}
+
+var dbBackupCmd = &cobra.Command{
+	Use:   "backup <file>",
+	Short: "backup usage.db",
+	Long: `write a consistent copy of usage.db to a file. the db is opened read only with a shared lock, when a running
+proxy holds the write lock a hot backup is written through its admin api with --token`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		backupDatabase(cmd.Context(), args[0])
+	},
+}
+
+var dbRestoreCmd = &cobra.Command{
+	Use:   "restore <file>",
+	Short: "restore usage.db from a backup",
+	Long: `verify a backup or snapshot and replace usage.db with it, the previous usage.db is kept next to it
+with a .bak suffix`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		restoreDatabase(args[0])
+	},
+}
+
+var dbCompactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "compact usage.db",
+	Long: `copy usage.db into a new file without free pages, bolt never shrinks a db file on its own.
+usage.db is replaced by the compacted copy unless --output is set`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		compactDatabase()
+	},
+}
+
+var dbVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "verify usage.db",
+	Long: `check that every key and value in usage.db parses and that the images and access buckets index each other,
+exits non zero when problems are found. when a running proxy holds the write lock a hot backup is verified through
+its admin api with --token`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		verifyDatabase()
+	},
+}
+
+var dbRepairCmd = &cobra.Command{
+	Use:   "repair",
+	Short: "repair usage.db",
+	Long: `rebuild the access index from the images bucket and remove entries that do not parse. tags accessed within
+the same second are moved a second apart so every tag is in the index. the previous usage.db is kept next to it
+with a .bak suffix`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		repairDatabase()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(dbCmd)
+	dbCmd.AddCommand(dbBackupCmd, dbRestoreCmd, dbCompactCmd, dbVerifyCmd, dbRepairCmd)
+
+	for _, cmd := range []*cobra.Command{dbBackupCmd, dbRestoreCmd, dbCompactCmd, dbVerifyCmd, dbRepairCmd} {
+		addDatabaseFlag(cmd)
+	}
+	addAdminFlags(dbBackupCmd)
+	addAdminFlags(dbVerifyCmd)
+
+	for _, cmd := range []*cobra.Command{dbVerifyCmd, dbRepairCmd, dbRestoreCmd} {
+		cmd.Flags().StringVar(
+			&dbArgs.output,
+			"output",
+			"table",
+			"output format, table, json or csv")
+	}
+
+	dbRestoreCmd.Flags().BoolVar(
+		&dbArgs.force,
+		"force",
+		false,
+		"restore a backup that fails verification")
+
+	dbCompactCmd.Flags().StringVar(
+		&dbArgs.compactOutput,
+		"output",
+		"",
+		"write the compacted db to this file instead of replacing usage.db")
+
+	for _, cmd := range []*cobra.Command{dbBackupCmd, dbRestoreCmd, dbCompactCmd, dbVerifyCmd, dbRepairCmd} {
+		_ = viper.BindPFlags(cmd.Flags())
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+type HistoryArgs struct {
+	limit  int
+	output string
+}
+
+var (
+	historyArgs HistoryArgs
+)
+
+func showHistory() {
+	db := openDatabase(true)
+	defer db.Close()
+
+	cache := &lru.Cache{Db: db}
+	runs, err := cache.GetCleanupRuns(historyArgs.limit)
+	common.ExitIfError(err)
+	common.ExitIfError(printHistory(runs))
+}
+
+func printHistory(runs []lru.CleanupRun) error {
+	switch historyArgs.output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(runs)
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "START\tDURATION\tTRIGGER\tSTART BYTES\tEND BYTES\tITERATIONS\tEVICTED\tFAILED\tGC RUNS\tSTOP REASON")
+		for _, run := range runs {
+			fmt.Fprintf(
+				w,
+				"%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n",
+				run.StartTime.Format(time.RFC3339),
+				run.EndTime.Sub(run.StartTime).Round(time.Second),
+				run.Trigger,
+				run.StartBytes,
+				run.EndBytes,
+				len(run.Iterations),
+				len(run.Evicted),
+				len(run.DeleteFailures),
+				len(run.GarbageCollections),
+				run.StopReason)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unsupported output %s, must be table or json", historyArgs.output)
+	}
+}
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "show clean cycle history",
+	Long:  `show the clean cycles recorded in usage.db, newest first, use json output for evicted tags and gc output`,
+	Run: func(cmd *cobra.Command, args []string) {
+		showHistory()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+
+	addDatabaseFlag(historyCmd)
+	addAdminFlags(historyCmd)
+
+	historyCmd.Flags().IntVar(
+		&historyArgs.limit,
+		"limit",
+		10,
+		"number of clean cycles to show, 0 shows every clean cycle")
+
+	historyCmd.Flags().StringVar(
+		&historyArgs.output,
+		"output",
+		"table",
+		"output format, table or json")
+
+	_ = viper.BindPFlags(historyCmd.Flags())
+}
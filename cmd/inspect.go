@@ -0,0 +1,284 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+type InspectArgs struct {
+	output    string
+	repo      string
+	tagRegex  string
+	olderThan time.Duration
+}
+
+// TagRecord is a cached tag as shown by the inspection commands
+type TagRecord struct {
+	Rank         int       `json:"rank"`
+	Image        string    `json:"image"`
+	AccessTime   time.Time `json:"accessTime"`
+	Age          string    `json:"age"`
+	LastAccessor string    `json:"lastAccessor,omitempty"`
+	Digest       string    `json:"digest,omitempty"`
+}
+
+// RepoStats counts the cached tags of a repository
+type RepoStats struct {
+	Repo         string    `json:"repo"`
+	Tags         int       `json:"tags"`
+	OldestAccess time.Time `json:"oldestAccess"`
+	NewestAccess time.Time `json:"newestAccess"`
+}
+
+// AgeBucket counts the cached tags last accessed within an age range
+type AgeBucket struct {
+	Age  string `json:"age"`
+	Tags int    `json:"tags"`
+}
+
+// CacheStats summarizes the cached tags
+type CacheStats struct {
+	Tags         int         `json:"tags"`
+	Repos        []RepoStats `json:"repos"`
+	AgeHistogram []AgeBucket `json:"ageHistogram"`
+}
+
+var (
+	inspectArgs InspectArgs
+	ageBuckets  = []struct {
+		name   string
+		maxAge time.Duration
+	}{
+		{"< 1h", time.Hour},
+		{"< 1d", 24 * time.Hour},
+		{"< 7d", 7 * 24 * time.Hour},
+		{"< 30d", 30 * 24 * time.Hour},
+		{"< 90d", 90 * 24 * time.Hour},
+		{">= 90d", 0},
+	}
+)
+
+// tagRecords returns every cached tag in least recently used order with its metadata
+func tagRecords(cache *lru.Cache) []TagRecord {
+	metadata := cache.GetAllMetadata()
+	var records []TagRecord
+	for idx, image := range cache.GetLruList() {
+		records = append(records, TagRecord{
+			Rank:         idx + 1,
+			Image:        image.Name(),
+			AccessTime:   image.AccessTime,
+			Age:          time.Since(image.AccessTime).Round(time.Second).String(),
+			LastAccessor: metadata[image.Name()].LastAccessor,
+			Digest:       metadata[image.Name()].Digest,
+		})
+	}
+	return records
+}
+
+func tagRows(records []TagRecord) [][]string {
+	var rows [][]string
+	for _, record := range records {
+		rows = append(rows, []string{
+			strconv.Itoa(record.Rank),
+			record.Image,
+			record.AccessTime.Format(time.RFC3339),
+			record.Age,
+			record.LastAccessor,
+			record.Digest,
+		})
+	}
+	return rows
+}
+
+var tagHeader = []string{"rank", "tag", "last access", "age", "last accessor", "digest"}
+
+func listTags() {
+	db := openDatabase(true)
+	defer db.Close()
+
+	tagRegex, err := regexp.Compile(inspectArgs.tagRegex)
+	common.ExitIfError(err)
+
+	records := []TagRecord{}
+	for _, record := range tagRecords(&lru.Cache{Db: db}) {
+		repo, tag, _ := strings.Cut(record.Image, ":")
+		if inspectArgs.repo != "" && repo != inspectArgs.repo {
+			continue
+		}
+		if !tagRegex.MatchString(tag) {
+			continue
+		}
+		if inspectArgs.olderThan > 0 && time.Since(record.AccessTime) < inspectArgs.olderThan {
+			continue
+		}
+		records = append(records, record)
+	}
+	common.ExitIfError(printRecords(inspectArgs.output, tagHeader, tagRows(records), records))
+}
+
+func inspectTag(name string) {
+	db := openDatabase(true)
+	defer db.Close()
+
+	for _, record := range tagRecords(&lru.Cache{Db: db}) {
+		if record.Image == name {
+			common.ExitIfError(printRecords(inspectArgs.output, tagHeader, tagRows([]TagRecord{record}), record))
+			return
+		}
+	}
+	common.ExitIfError(fmt.Errorf("%s not found in usage.db", name))
+}
+
+func cacheStats() {
+	db := openDatabase(true)
+	defer db.Close()
+
+	stats := CacheStats{}
+	repos := map[string]*RepoStats{}
+	histogram := make([]int, len(ageBuckets))
+	for _, image := range (&lru.Cache{Db: db}).GetLruList() {
+		stats.Tags++
+		repo, ok := repos[image.Repo]
+		if !ok {
+			repo = &RepoStats{Repo: image.Repo, OldestAccess: image.AccessTime}
+			repos[image.Repo] = repo
+		}
+		repo.Tags++
+		if image.AccessTime.Before(repo.OldestAccess) {
+			repo.OldestAccess = image.AccessTime
+		}
+		if image.AccessTime.After(repo.NewestAccess) {
+			repo.NewestAccess = image.AccessTime
+		}
+
+		age := time.Since(image.AccessTime)
+		for idx, bucket := range ageBuckets {
+			if bucket.maxAge == 0 || age < bucket.maxAge {
+				histogram[idx]++
+				break
+			}
+		}
+	}
+
+	stats.Repos = []RepoStats{}
+	for _, repo := range repos {
+		stats.Repos = append(stats.Repos, *repo)
+	}
+	sort.Slice(stats.Repos, func(i, j int) bool {
+		return stats.Repos[i].Tags > stats.Repos[j].Tags
+	})
+	for idx, bucket := range ageBuckets {
+		stats.AgeHistogram = append(stats.AgeHistogram, AgeBucket{Age: bucket.name, Tags: histogram[idx]})
+	}
+
+	if inspectArgs.output == "json" {
+		common.ExitIfError(printRecords(inspectArgs.output, nil, nil, stats))
+		return
+	}
+
+	var rows [][]string
+	for _, repo := range stats.Repos {
+		rows = append(rows, []string{
+			"repo",
+			repo.Repo,
+			strconv.Itoa(repo.Tags),
+			repo.OldestAccess.Format(time.RFC3339),
+			repo.NewestAccess.Format(time.RFC3339),
+		})
+	}
+	for _, bucket := range stats.AgeHistogram {
+		rows = append(rows, []string{"age", bucket.Age, strconv.Itoa(bucket.Tags), "", ""})
+	}
+	rows = append(rows, []string{"total", "", strconv.Itoa(stats.Tags), "", ""})
+	common.ExitIfError(printRecords(inspectArgs.output, []string{"kind", "name", "tags", "oldest access", "newest access"}, rows, stats))
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list cached tags",
+	Long: `list the tags in usage.db, least recently used first. the db is opened read only with a shared lock,
+when a running proxy holds the write lock a hot backup is read through its admin api with --token, without a token
+the command waits up to --db-timeout for the lock`,
+	Run: func(cmd *cobra.Command, args []string) {
+		listTags()
+	},
+}
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect <repo:tag>",
+	Short: "inspect a cached tag",
+	Long:  `show the access time, lru rank and metadata of a tag in usage.db`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		inspectTag(args[0])
+	},
+}
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "show cache statistics",
+	Long:  `show the number of cached tags per repository and a histogram of tag ages`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cacheStats()
+	},
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{listCmd, inspectCmd, statsCmd} {
+		rootCmd.AddCommand(cmd)
+		addDatabaseFlag(cmd)
+		addAdminFlags(cmd)
+		cmd.Flags().StringVar(
+			&inspectArgs.output,
+			"output",
+			"table",
+			"output format, table, json or csv")
+	}
+
+	listCmd.Flags().StringVar(
+		&inspectArgs.repo,
+		"repo",
+		"",
+		"only list tags of this repository")
+
+	listCmd.Flags().StringVar(
+		&inspectArgs.tagRegex,
+		"tag-regex",
+		"",
+		"only list tags matching this regular expression")
+
+	listCmd.Flags().DurationVar(
+		&inspectArgs.olderThan,
+		"older-than",
+		0,
+		"only list tags last accessed longer ago than this duration")
+
+	for _, cmd := range []*cobra.Command{listCmd, inspectCmd, statsCmd} {
+		_ = viper.BindPFlags(cmd.Flags())
+	}
+}
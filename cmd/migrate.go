@@ -0,0 +1,193 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+	"github.com/boxboat/dockhand-lru-registry/pkg/migrate"
+	"github.com/regclient/regclient"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+type MigrateArgs struct {
+	sourceHost     string
+	sourceScheme   string
+	sourceUsername string
+	sourcePassword string
+	sourceDb       string
+	repoRegex      string
+	tagRegex       string
+	concurrency    int
+	stateFile      string
+	dryRun         bool
+}
+
+var (
+	migrateArgs MigrateArgs
+)
+
+func migrateRegistry(ctx context.Context) {
+	if migrateArgs.sourceHost == "" {
+		common.ExitIfError(fmt.Errorf("--source-host is required"))
+	}
+	sourceHost := registryHost(migrateArgs.sourceHost, migrateArgs.sourceScheme)
+	sourceHost.User = migrateArgs.sourceUsername
+	sourceHost.Pass = migrateArgs.sourcePassword
+	if sourceHost.Pass == "" {
+		sourceHost.Pass = os.Getenv("LRU_SOURCE_PASSWORD")
+	}
+
+	migrator := &migrate.Migrator{
+		RegClient: regclient.New(
+			regclient.WithConfigHost(sourceHost),
+			regclient.WithConfigHost(registryHost(proxyArgs.registryHost, proxyArgs.registryScheme))),
+		SourceHost:  migrateArgs.sourceHost,
+		TargetHost:  proxyArgs.registryHost,
+		Concurrency: migrateArgs.concurrency,
+		StatePath:   migrateArgs.stateFile,
+		DryRun:      migrateArgs.dryRun,
+	}
+	if migrator.StatePath == "" {
+		migrator.StatePath = filepath.Join(proxyArgs.databaseDir, "migrate-state.jsonl")
+	}
+	if migrateArgs.repoRegex != "" {
+		repoFilter, err := regexp.Compile(migrateArgs.repoRegex)
+		common.ExitIfError(err)
+		migrator.RepoFilter = repoFilter
+	}
+	if migrateArgs.tagRegex != "" {
+		tagFilter, err := regexp.Compile(migrateArgs.tagRegex)
+		common.ExitIfError(err)
+		migrator.TagFilter = tagFilter
+	}
+
+	if migrateArgs.sourceDb != "" {
+		sourceDb := openDatabaseFile(migrateArgs.sourceDb, &bolt.Options{ReadOnly: true, Timeout: dbTimeout})
+		defer sourceDb.Close()
+		migrator.SourceCache = &lru.Cache{Db: sourceDb}
+	}
+
+	// a dry run copies nothing and leaves usage.db alone, it may run next to the proxy
+	if !migrateArgs.dryRun {
+		db := openExclusive()
+		defer db.Close()
+		migrator.Cache = &lru.Cache{Db: db}
+		common.ExitIfError(migrator.Cache.Init())
+	}
+
+	result, err := migrator.Run(ctx)
+	if result == nil {
+		common.ExitIfError(err)
+	}
+	common.Log.Infof("migration finished: %d copied, %d up to date, %d already migrated, %d failed",
+		result.Copied, result.UpToDate, result.Resumed, result.Failed)
+	if err == nil && result.Failed > 0 {
+		err = fmt.Errorf("%d tags failed to migrate, run migrate again to retry them", result.Failed)
+	}
+	common.ExitIfError(err)
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "copy images from another registry",
+	Long: `copy the repositories and tags of a source registry into the registry and seed usage.db with their access
+times, from the usage.db of the source instance when --source-db is set, or the image created time otherwise.
+tags already migrated are recorded in --state-file, so an interrupted migration resumes where it stopped.
+takes the usage.db write lock, run it while the proxy is stopped and the registry is running`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		migrateRegistry(cmd.Context())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+
+	addDatabaseFlag(migrateCmd)
+	addRegistryFlags(migrateCmd)
+
+	migrateCmd.Flags().StringVar(
+		&migrateArgs.sourceHost,
+		"source-host",
+		"",
+		"source registry host")
+
+	migrateCmd.Flags().StringVar(
+		&migrateArgs.sourceScheme,
+		"source-scheme",
+		"https",
+		"source registry scheme")
+
+	migrateCmd.Flags().StringVar(
+		&migrateArgs.sourceUsername,
+		"source-username",
+		"",
+		"source registry username")
+
+	migrateCmd.Flags().StringVar(
+		&migrateArgs.sourcePassword,
+		"source-password",
+		"",
+		"source registry password, defaults to LRU_SOURCE_PASSWORD")
+
+	migrateCmd.Flags().StringVar(
+		&migrateArgs.sourceDb,
+		"source-db",
+		"",
+		"usage.db of the source instance to seed access times from")
+
+	migrateCmd.Flags().StringVar(
+		&migrateArgs.repoRegex,
+		"repo-regex",
+		"",
+		"only migrate repositories matching this regular expression")
+
+	migrateCmd.Flags().StringVar(
+		&migrateArgs.tagRegex,
+		"tag-regex",
+		"",
+		"only migrate tags matching this regular expression")
+
+	migrateCmd.Flags().IntVar(
+		&migrateArgs.concurrency,
+		"concurrency",
+		4,
+		"number of tags copied at the same time")
+
+	migrateCmd.Flags().StringVar(
+		&migrateArgs.stateFile,
+		"state-file",
+		"",
+		"file recording migrated tags to resume from (default \"<db-dir>/migrate-state.jsonl\")")
+
+	migrateCmd.Flags().BoolVar(
+		&migrateArgs.dryRun,
+		"dry-run",
+		false,
+		"list the tags that would be copied without copying them or opening usage.db")
+
+	_ = viper.BindPFlags(migrateCmd.Flags())
+}
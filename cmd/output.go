@@ -0,0 +1,101 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// printRecords writes rows as a table or csv with a header, or value as json
+func printRecords(format string, header []string, rows [][]string, value interface{}) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		if err := w.Write(header); err != nil {
+			return err
+		}
+		if err := w.WriteAll(rows); err != nil {
+			return err
+		}
+		w.Flush()
+		return w.Error()
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, strings.ToUpper(strings.Join(header, "\t")))
+		for _, row := range rows {
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unsupported output %s, must be table, json or csv", format)
+	}
+}
+
+// addDatabaseFlag adds the db directory flag to commands that read usage.db
+func addDatabaseFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(
+		&proxyArgs.databaseDir,
+		"db-dir",
+		"/var/lib/registry",
+		"db directory")
+
+	cmd.Flags().DurationVar(
+		&dbTimeout,
+		"db-timeout",
+		5*time.Second,
+		"how long to wait for the usage.db lock")
+}
+
+// addAdminFlags adds the admin api flags read only commands use to read usage.db of a
+// running proxy holding its lock
+func addAdminFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(
+		&ctlArgs.server,
+		"server",
+		"http://localhost:3000",
+		"url of the proxy holding the usage.db lock")
+
+	cmd.Flags().StringVar(
+		&ctlArgs.token,
+		"token",
+		"",
+		"admin api token to read usage.db of a running proxy, defaults to LRU_ADMIN_TOKEN")
+
+	cmd.Flags().StringVar(
+		&ctlArgs.caCert,
+		"ca-cert",
+		"",
+		"ca certificate to verify the proxy certificate")
+
+	cmd.Flags().BoolVar(
+		&ctlArgs.insecureSkipVerify,
+		"insecure-skip-verify",
+		false,
+		"do not verify the proxy certificate")
+}
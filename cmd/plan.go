@@ -0,0 +1,98 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/api"
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	planOutput string
+)
+
+func planCleanup(ctx context.Context) {
+	db := openDatabase(true)
+	defer db.Close()
+
+	plan := newProxy(db, false).Plan(ctx)
+	common.ExitIfError(printPlan(plan))
+}
+
+func printPlan(plan *api.CleanupPlan) error {
+	switch planOutput {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plan)
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ITERATION\tTAG\tLAST ACCESS\tESTIMATED BYTES")
+		for _, eviction := range plan.Evictions {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%d\n", eviction.Iteration, eviction.Image, eviction.AccessTime.Format(time.RFC3339), eviction.EstimatedBytes)
+		}
+		for _, skipped := range plan.Skipped {
+			fmt.Fprintf(w, "-\t%s\tskipped: %s\t-\n", skipped.Image, skipped.Reason)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		fmt.Printf("\nused bytes: %d\ntarget bytes: %d\nestimated freed bytes: %d\n", plan.UsedBytes, plan.TargetBytes, plan.EstimatedFreedBytes)
+		fmt.Printf("tags removed: %d\ntags with unknown size: %d\niterations: %d\nstop reason: %s\n", len(plan.Evictions), plan.UnknownSizeTags, plan.Iterations, plan.StopReason)
+		if plan.UntrackedTags != nil {
+			fmt.Printf("untracked tags: %d\n", *plan.UntrackedTags)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported output %s, must be table or json", planOutput)
+	}
+}
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "dry run a clean cycle",
+	Long: `show the tags a clean cycle would remove with the provided settings, based on the current usage.db and disk usage.
+no tags are deleted and garbage collection does not run`,
+	Run: func(cmd *cobra.Command, args []string) {
+		planCleanup(cmd.Context())
+	},
+	PreRunE: loadProxyConfig,
+}
+
+func init() {
+	rootCmd.AddCommand(planCmd)
+
+	planCmd.Flags().StringVar(
+		&planOutput,
+		"output",
+		"table",
+		"output format, table or json")
+
+	addCleanupFlags(planCmd)
+	addAdminFlags(planCmd)
+
+	_ = viper.BindPFlags(planCmd.Flags())
+}
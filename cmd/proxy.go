@@ -19,15 +19,22 @@ package cmd
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"math"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/boxboat/dockhand-lru-registry/pkg/backend"
 	"github.com/boxboat/dockhand-lru-registry/pkg/common"
 	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
 	"github.com/boxboat/dockhand-lru-registry/pkg/proxy"
+	"github.com/boxboat/dockhand-lru-registry/pkg/supervisor"
 	"github.com/regclient/regclient"
 	"github.com/regclient/regclient/config"
 	"github.com/spf13/cobra"
@@ -42,53 +49,276 @@ type ProxyArgs struct {
 	databaseDir              string
 	registryHost             string
 	registryScheme           string
+	registryBinary           string
+	registryConfig           string
+	registryDir              string
+	separateDisk             bool
+	usage                    string
+	usageRescanInterval      time.Duration
+	usageMaxWatches          int
+	s3                       backend.S3
+	backendType              string
+	gcPollInterval           time.Duration
+	gcPollTimeout            time.Duration
 	CleanupArgs              proxy.CleanSettings
+	SnapshotArgs             proxy.SnapshotSettings
+	ReportArgs               proxy.ReportSettings
+	ShutdownArgs             proxy.ShutdownSettings
 	TargetDiskSizeByteString string
+	HardDiskLimitByteString  string
+	MaxEvictByteString       string
 	UseForwardedHeaders      bool
+	notReadyDuringGC         bool
+	superviseRegistry        bool
+	registryStartTimeout     time.Duration
+	registryPreflight        bool
+	adminToken               string
+	eventFile                string
+	eventWebhookURL          string
+	eventWebhookSecret       string
+	eventWebhookRetries      int
+	eventStdout              bool
+	notificationSecret       string
+	notificationWindow       time.Duration
 }
 
 var (
 	proxyArgs ProxyArgs
+	dbTimeout = 5 * time.Second
 )
 
-func startProxy(ctx context.Context) {
-	db, err := bolt.Open(fmt.Sprintf("%s/%s", proxyArgs.databaseDir, "usage.db"), 0600, nil)
-	common.ExitIfError(err)
-	defer db.Close()
+const (
+	// lockProbeTimeout is how long read only commands wait for the usage.db lock before
+	// reading usage.db of the running proxy holding it through the admin api
+	lockProbeTimeout = 100 * time.Millisecond
+)
 
-	registryTarget, err := url.Parse(fmt.Sprintf("%s://%s", proxyArgs.registryScheme, proxyArgs.registryHost))
+// openDatabase opens usage.db in the db directory. read only databases use a shared
+// lock, when a running proxy holds the write lock they are read from a hot backup
+// through its admin api, without an admin token the open gives up after the timeout
+func openDatabase(readOnly bool) *bolt.DB {
+	if !readOnly {
+		return openDatabaseFile(databasePath(), &bolt.Options{Timeout: 0})
+	}
+	db, locked := openUnlessLocked()
+	if locked {
+		return openLiveDatabase()
+	}
+	return db
+}
+
+// openUnlessLocked opens usage.db read only, locked is set instead when a running proxy
+// holds the write lock and usage.db can be read through its admin api
+func openUnlessLocked() (db *bolt.DB, locked bool) {
+	if adminToken() == "" {
+		return openDatabaseFile(databasePath(), &bolt.Options{ReadOnly: true, Timeout: dbTimeout}), false
+	}
+	db, err := bolt.Open(databasePath(), 0600, &bolt.Options{ReadOnly: true, Timeout: lockProbeTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, true
+	}
+	common.ExitIfError(databaseError(databasePath(), err))
+	return db, false
+}
+
+// openLiveDatabase opens a hot backup of usage.db of the running proxy, the backup is
+// removed once it is open
+func openLiveDatabase() *bolt.DB {
+	common.Log.Debugf("usage.db is locked, reading a hot backup from %s", ctlArgs.server)
+	file, err := os.CreateTemp("", "usage.db.*.tmp")
 	common.ExitIfError(err)
 
+	_, err = newClient().Backup(context.Background(), file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	var db *bolt.DB
+	if err == nil {
+		db, err = bolt.Open(file.Name(), 0600, &bolt.Options{ReadOnly: true})
+	} else {
+		err = fmt.Errorf("usage.db is locked by a running proxy and reading it through the admin api at %s failed: %w", ctlArgs.server, err)
+	}
+	common.LogIfError(os.Remove(file.Name()))
+	common.ExitIfError(databaseError(file.Name(), err))
+	return db
+}
+
+func databasePath() string {
+	return filepath.Join(proxyArgs.databaseDir, "usage.db")
+}
+
+// openDatabaseFile opens a bolt db, explaining lock timeouts and corrupted files
+func openDatabaseFile(path string, options *bolt.Options) *bolt.DB {
+	db, err := bolt.Open(path, 0600, options)
+	common.ExitIfError(databaseError(path, err))
+	return db
+}
+
+// databaseError explains lock timeouts and corrupted files
+func databaseError(path string, err error) error {
+	if errors.Is(err, bolt.ErrTimeout) {
+		return fmt.Errorf("%s is locked by another process, pass --token to read it through the admin api of a running proxy: %w", filepath.Base(path), err)
+	} else if errors.Is(err, bolt.ErrInvalid) || errors.Is(err, bolt.ErrChecksum) || errors.Is(err, bolt.ErrVersionMismatch) {
+		return fmt.Errorf("%s is corrupted, restore a snapshot with db restore or move it aside to start with an empty cache: %w", path, err)
+	}
+	return err
+}
+
+// registryHost returns the regclient configuration of a registry
+func registryHost(host string, registryScheme string) config.Host {
 	tlsSetting := config.TLSDisabled
-	if proxyArgs.registryScheme == "https" {
+	if registryScheme == "https" {
 		tlsSetting = config.TLSEnabled
 	}
+	return config.Host{
+		Name: host,
+		TLS:  tlsSetting,
+	}
+}
+
+// usageType returns the usage provider selected by the usage flag, statfs with
+// separate-disk and walk otherwise
+func usageType() string {
+	switch {
+	case proxyArgs.usage != "":
+		return proxyArgs.usage
+	case proxyArgs.separateDisk:
+		return backend.UsageStatfs
+	default:
+		return backend.UsageWalk
+	}
+}
+
+// limitsEvictedBytes reports whether a byte eviction limit is set, it checks the recorded
+// size of every tag before evicting it
+func limitsEvictedBytes() bool {
+	limits := proxyArgs.CleanupArgs.EvictionLimits
+	return !limits.Override && (limits.MaxBytes > 0 || limits.MaxBytesPercentage > 0)
+}
+
+// newUsageProvider creates the usage provider selected by the usage flag, a running
+// proxy tracks the usage of walk in memory instead of walking for every measurement
+func newUsageProvider(cache *lru.Cache, track bool) backend.UsageProvider {
+	switch usageType() {
+	case backend.UsageStatfs:
+		return &backend.Statfs{Dir: proxyArgs.registryDir}
+	case backend.UsageS3:
+		return backend.NewS3(registryS3())
+	case backend.UsageCache:
+		return &backend.CacheSum{Cache: cache}
+	default:
+		if track && proxyArgs.usageRescanInterval > 0 {
+			return backend.NewTracker(proxyArgs.registryDir, registryRootDirectory(), proxyArgs.usageRescanInterval, proxyArgs.usageMaxWatches)
+		}
+		return &backend.DirWalk{Dir: proxyArgs.registryDir}
+	}
+}
+
+// newBackend creates the backend selected by the backend flag
+func newBackend(rc *regclient.RegClient, usage backend.UsageProvider) backend.Backend {
+	switch proxyArgs.backendType {
+	case backend.TypeDistributionNative:
+		return backend.NewDistributionNative(rc, proxyArgs.registryHost, registryRootDirectory(), usage)
+	case backend.TypeAPI:
+		return backend.NewAPI(rc, proxyArgs.registryHost, usage, proxyArgs.gcPollInterval, proxyArgs.gcPollTimeout)
+	default:
+		return backend.NewDistribution(rc, proxyArgs.registryHost, proxyArgs.registryBinary, proxyArgs.registryConfig, usage)
+	}
+}
 
-	registryProxy := &proxy.Proxy{
+// newProxy creates a proxy for the registry with the settings from proxyArgs, usage is
+// tracked in memory when trackUsage is set
+func newProxy(db *bolt.DB, trackUsage bool) *proxy.Proxy {
+	registryTarget, err := url.Parse(fmt.Sprintf("%s://%s", proxyArgs.registryScheme, proxyArgs.registryHost))
+	common.ExitIfError(err)
+
+	rc := regclient.New(regclient.WithConfigHost(registryHost(proxyArgs.registryHost, proxyArgs.registryScheme)))
+	cache := &lru.Cache{Db: db}
+	usage := newUsageProvider(cache, trackUsage)
+	tracker, _ := usage.(*backend.Tracker)
+	freeSpace, _ := usage.(backend.FreeSpace)
+	return &proxy.Proxy{
 		Server: &http.Server{
 			Addr: fmt.Sprintf(":%v", proxyArgs.serverPort),
 		},
-		RegistryHost:  proxyArgs.registryHost,
-		RegistryProxy: httputil.NewSingleHostReverseProxy(registryTarget),
-		Cache:         &lru.Cache{Db: db},
-		RegClient: regclient.New(
-			regclient.WithConfigHost(
-				config.Host{
-					Name: proxyArgs.registryHost,
-					TLS:  tlsSetting,
-				})),
+		RegistryHost:        proxyArgs.registryHost,
+		RegistryProxy:       httputil.NewSingleHostReverseProxy(registryTarget),
+		Cache:               cache,
+		RegClient:           rc,
+		Backend:             newBackend(rc, usage),
+		RecordSizes:         (trackUsage && reportsScheduled()) || usageType() == backend.UsageCache || limitsEvictedBytes(),
+		UsageTracker:        tracker,
+		FreeSpace:           freeSpace,
 		CleanSettings:       proxyArgs.CleanupArgs,
 		UseForwardedHeaders: proxyArgs.UseForwardedHeaders,
+		AdminToken:          proxyArgs.adminToken,
+	}
+}
+
+// eventSinks creates the event sinks enabled by the event flags
+func eventSinks() []proxy.EventSink {
+	var sinks []proxy.EventSink
+	if proxyArgs.eventFile != "" {
+		sinks = append(sinks, &proxy.JSONLinesSink{Path: proxyArgs.eventFile})
+	}
+	if proxyArgs.eventWebhookURL != "" {
+		sinks = append(sinks, &proxy.WebhookSink{
+			URL:     proxyArgs.eventWebhookURL,
+			Secret:  proxyArgs.eventWebhookSecret,
+			Retries: proxyArgs.eventWebhookRetries,
+		})
 	}
+	if proxyArgs.eventStdout {
+		sinks = append(sinks, &proxy.CloudEventsSink{
+			Writer: os.Stdout,
+			Source: fmt.Sprintf("/dockhand-lru-registry/%s", proxyArgs.registryHost),
+		})
+	}
+	return sinks
+}
+
+func startProxy(ctx context.Context) {
+	db := openDatabase(false)
+	defer db.Close()
+
+	registryProxy := newProxy(db, true)
+	registryProxy.EventSinks = eventSinks()
+	registryProxy.NotificationSecret = proxyArgs.notificationSecret
+	registryProxy.NotificationWindow = proxyArgs.notificationWindow
+	registryProxy.SnapshotSettings = proxyArgs.SnapshotArgs
+	registryProxy.ReportSettings = proxyArgs.ReportArgs
+	registryProxy.ShutdownSettings = proxyArgs.ShutdownArgs
+	registryProxy.NotReadyDuringGC = proxyArgs.notReadyDuringGC
 
 	if proxyArgs.serverCert != "" && proxyArgs.serverKey != "" {
-		tlsPair, err := tls.LoadX509KeyPair(proxyArgs.serverCert, proxyArgs.serverKey)
+		certificate, err := proxy.LoadCertificate(proxyArgs.serverCert, proxyArgs.serverKey)
 		common.ExitIfError(err)
+		registryProxy.Certificate = certificate
 		registryProxy.Server.TLSConfig = &tls.Config{
-			Certificates: []tls.Certificate{tlsPair},
+			GetCertificate: certificate.GetCertificate,
 		}
 	}
 
+	if proxyArgs.registryPreflight {
+		// the registry config of the api backend is not a Distribution config
+		if proxyArgs.backendType != backend.TypeAPI {
+			checkRegistryConfig()
+		}
+		registryProxy.DeleteProbe = true
+	}
+
+	if proxyArgs.superviseRegistry {
+		registryProxy.Supervisor = &supervisor.Supervisor{
+			Binary:       proxyArgs.registryBinary,
+			Config:       proxyArgs.registryConfig,
+			StartTimeout: proxyArgs.registryStartTimeout,
+		}
+	}
+
+	registryProxy.Reload = func() error {
+		return reloadConfig(registryProxy)
+	}
+	watchConfig(registryProxy)
 	registryProxy.RunProxy(ctx)
 
 }
@@ -100,118 +330,454 @@ var startProxyCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		startProxy(cmd.Context())
 	},
-	PreRunE: func(cmd *cobra.Command, args []string) error {
+}
+
+// parse normalizes percentages and parses byte strings from the cleanup settings
+func (args *ProxyArgs) parse() error {
+	if args.CleanupArgs.CleanTagsPercentage > 100 ||
+		args.CleanupArgs.CleanTagsPercentage < 0 {
+		common.Log.Warnf("clean-tags-percentage invalid range - will be overridden ")
+	}
+	args.CleanupArgs.CleanTagsPercentage = math.Max(0, math.Min(args.CleanupArgs.CleanTagsPercentage/100, 1.0))
+
+	bytes, err := common.ParseByteString(args.TargetDiskSizeByteString)
+	if err != nil {
+		return err
+	}
+	common.Log.Debugf("target usage bytes: %d", bytes)
+	args.CleanupArgs.TargetUsageBytes = bytes
+
+	limits := &args.CleanupArgs.EvictionLimits
+	limits.MaxTagsPercentage = math.Max(0, math.Min(limits.MaxTagsPercentage/100, 1.0))
+	limits.MaxBytesPercentage = math.Max(0, math.Min(limits.MaxBytesPercentage/100, 1.0))
 
-		if proxyArgs.CleanupArgs.CleanTagsPercentage > 100 ||
-			proxyArgs.CleanupArgs.CleanTagsPercentage < 0 {
-			common.Log.Warnf("clean-tags-percentage invalid range - will be overridden ")
+	limits.MaxBytes = 0
+	if args.MaxEvictByteString != "" {
+		if limits.MaxBytes, err = common.ParseByteString(args.MaxEvictByteString); err != nil {
+			return err
 		}
-		proxyArgs.CleanupArgs.CleanTagsPercentage = math.Max(0, math.Min(proxyArgs.CleanupArgs.CleanTagsPercentage/100, 1.0))
+		common.Log.Debugf("max evict bytes: %d", limits.MaxBytes)
+	}
 
-		if bytes, err := common.ParseByteString(proxyArgs.TargetDiskSizeByteString); err == nil {
-			common.Log.Debugf("target usage bytes: %d", bytes)
-			proxyArgs.CleanupArgs.TargetUsageBytes = bytes
-		} else {
-			common.ExitIfError(err)
+	args.CleanupArgs.HardLimitBytes = 0
+	if args.HardDiskLimitByteString != "" {
+		if args.CleanupArgs.HardLimitBytes, err = common.ParseByteString(args.HardDiskLimitByteString); err != nil {
+			return err
 		}
+		common.Log.Debugf("hard limit bytes: %d", args.CleanupArgs.HardLimitBytes)
+	}
 
-		return nil
-	},
+	return nil
 }
 
-// setup command
-func init() {
-	rootCmd.AddCommand(startProxyCmd)
-
-	startProxyCmd.Flags().IntVar(
-		&proxyArgs.serverPort,
-		"port",
-		3000,
-		"")
-
-	startProxyCmd.Flags().StringVar(
-		&proxyArgs.serverCert,
-		"cert",
-		"",
-		"x509 server certificate")
+// addRegistryFlags adds the flags locating the registry api
+func addRegistryFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(
+		&proxyArgs.registryHost,
+		"registry-host",
+		"127.0.0.1:5000",
+		"registry host")
 
-	startProxyCmd.Flags().StringVar(
-		&proxyArgs.serverKey,
-		"key",
-		"",
-		"x509 server key")
+	cmd.Flags().StringVar(
+		&proxyArgs.registryScheme,
+		"registry-scheme",
+		"http",
+		"registry scheme")
+}
 
-	startProxyCmd.Flags().StringVar(
+// addCleanupFlags adds the registry and cleanup settings shared by commands
+// that run or plan a clean cycle
+func addCleanupFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(
 		&proxyArgs.databaseDir,
 		"db-dir",
 		"/var/lib/registry",
 		"db directory")
 
-	startProxyCmd.Flags().StringVar(
-		&proxyArgs.CleanupArgs.RegistryBinary,
+	cmd.Flags().StringVar(
+		&proxyArgs.backendType,
+		"backend",
+		backend.TypeDistribution,
+		fmt.Sprintf("registry backend, one of %s", strings.Join(backend.Types, ", ")))
+
+	cmd.Flags().StringVar(
+		&proxyArgs.registryBinary,
 		"registry-bin",
 		"/registry/bin/registry",
 		"registry binary")
 
-	startProxyCmd.Flags().StringVar(
-		&proxyArgs.CleanupArgs.RegistryConfig,
+	cmd.Flags().StringVar(
+		&proxyArgs.registryConfig,
 		"registry-conf",
 		"/etc/docker/registry/config.yml",
 		"registry config")
 
-	startProxyCmd.Flags().StringVar(
-		&proxyArgs.registryHost,
-		"registry-host",
-		"127.0.0.1:5000",
-		"registry host")
-
-	startProxyCmd.Flags().StringVar(
-		&proxyArgs.registryScheme,
-		"registry-scheme",
-		"http",
-		"registry scheme")
+	addRegistryFlags(cmd)
 
-	startProxyCmd.Flags().StringVar(
-		&proxyArgs.CleanupArgs.RegistryDir,
+	cmd.Flags().StringVar(
+		&proxyArgs.registryDir,
 		"registry-dir",
 		"/var/lib/registry",
 		"registry directory")
 
-	startProxyCmd.Flags().StringVar(
+	cmd.Flags().StringVar(
 		&proxyArgs.TargetDiskSizeByteString,
 		"target-disk-usage",
 		"50Gi",
 		"target usage of disk for a clean cycle, a scheduled clean cycle will clean tags until this threshold is met")
 
-	startProxyCmd.Flags().Float64Var(
+	cmd.Flags().Float64Var(
 		&proxyArgs.CleanupArgs.CleanTagsPercentage,
 		"clean-tags-percentage",
 		10.0,
 		"percentage of least recently used tags to remove each iteration of a clean cycle until the target-percentage is achieved")
 
-	startProxyCmd.Flags().BoolVar(
-		&proxyArgs.UseForwardedHeaders,
-		"use-forwarded-headers",
+	cmd.Flags().IntVar(
+		&proxyArgs.CleanupArgs.EvictionLimits.MaxTags,
+		"max-evict-tags",
+		0,
+		"maximum number of tags a single clean cycle may remove before the circuit breaker trips (0 for no limit)")
+
+	cmd.Flags().Float64Var(
+		&proxyArgs.CleanupArgs.EvictionLimits.MaxTagsPercentage,
+		"max-evict-tags-percentage",
+		0,
+		"maximum percentage of tags a single clean cycle may remove before the circuit breaker trips (0 for no limit)")
+
+	cmd.Flags().StringVar(
+		&proxyArgs.MaxEvictByteString,
+		"max-evict-bytes",
+		"",
+		"maximum bytes a single clean cycle may free before the circuit breaker trips (no limit by default)")
+
+	cmd.Flags().Float64Var(
+		&proxyArgs.CleanupArgs.EvictionLimits.MaxBytesPercentage,
+		"max-evict-bytes-percentage",
+		0,
+		"maximum percentage of used bytes a single clean cycle may free before the circuit breaker trips (0 for no limit)")
+
+	cmd.Flags().BoolVar(
+		&proxyArgs.CleanupArgs.EvictionLimits.Override,
+		"override-eviction-limits",
 		false,
-		"use x-forwarded headers")
+		"ignore the max-evict limits and reset the circuit breaker, allowing a clean cycle to remove every tag")
 
-	startProxyCmd.Flags().BoolVar(
-		&proxyArgs.CleanupArgs.UseOptimizedDiskCalculation,
+	cmd.Flags().BoolVar(
+		&proxyArgs.separateDisk,
 		"separate-disk",
 		false,
 		"registry on separate disk or mount - use optimized disk size calculation")
 
-	startProxyCmd.Flags().StringVar(
+	cmd.Flags().StringVar(
+		&proxyArgs.usage,
+		"usage",
+		"",
+		fmt.Sprintf("how registry usage is measured, one of %s (statfs with separate-disk, walk otherwise)", strings.Join(backend.UsageTypes, ", ")))
+
+	cmd.Flags().StringVar(
+		&proxyArgs.s3.Endpoint,
+		"s3-endpoint",
+		"",
+		"url of the s3 compatible object store measured by --usage s3, AWS when empty")
+
+	cmd.Flags().StringVar(
+		&proxyArgs.s3.Region,
+		"s3-region",
+		"",
+		"region of the s3 bucket")
+
+	cmd.Flags().StringVar(
+		&proxyArgs.s3.Bucket,
+		"s3-bucket",
+		"",
+		"s3 bucket measured by --usage s3, the storage.s3 section of registry-conf is used when empty")
+
+	cmd.Flags().StringVar(
+		&proxyArgs.s3.Prefix,
+		"s3-prefix",
+		"",
+		"prefix of the registry objects in the s3 bucket, the rootdirectory of the s3 storage driver")
+
+	cmd.Flags().StringVar(
+		&proxyArgs.s3.AccessKey,
+		"s3-access-key",
+		"",
+		"s3 access key, requests are anonymous without one")
+
+	cmd.Flags().StringVar(
+		&proxyArgs.s3.SecretKey,
+		"s3-secret-key",
+		"",
+		"s3 secret key")
+
+	cmd.Flags().StringVar(
+		&proxyArgs.s3.SessionToken,
+		"s3-session-token",
+		"",
+		"s3 session token of temporary credentials, sent as X-Amz-Security-Token")
+
+	cmd.Flags().BoolVar(
+		&proxyArgs.s3.PathStyle,
+		"s3-path-style",
+		false,
+		"address the bucket in the url path instead of the host name, as MinIO expects")
+
+	cmd.Flags().DurationVar(
+		&proxyArgs.s3.ListInterval,
+		"s3-list-interval",
+		5*time.Minute,
+		"how long the listed usage of the s3 bucket is used before it is listed again, garbage collection subtracts the blobs it deleted in between")
+
+	cmd.Flags().StringVar(
 		&proxyArgs.CleanupArgs.TimeZone,
 		"timezone",
 		"Local",
 		"timezone string to use for scheduling based on the cron-string")
 
-	startProxyCmd.Flags().StringVar(
+	cmd.Flags().StringVar(
 		&proxyArgs.CleanupArgs.CronSchedule,
 		"cleanup-cron",
 		"0 0 * * *",
 		"cron schedule for cleaning up the least recently used tags default is 0:00:00")
+}
+
+// setup command
+func init() {
+	rootCmd.AddCommand(startProxyCmd)
+	// set here, loadProxyConfig reads the flags of startProxyCmd
+	startProxyCmd.PreRunE = loadProxyConfig
+
+	startProxyCmd.Flags().IntVar(
+		&proxyArgs.serverPort,
+		"port",
+		3000,
+		"")
+
+	startProxyCmd.Flags().StringVar(
+		&proxyArgs.serverCert,
+		"cert",
+		"",
+		"x509 server certificate")
+
+	startProxyCmd.Flags().StringVar(
+		&proxyArgs.serverKey,
+		"key",
+		"",
+		"x509 server key")
+
+	startProxyCmd.Flags().StringVar(
+		&proxyArgs.adminToken,
+		"admin-token",
+		"",
+		"bearer token required by the /admin/ api, the admin api is disabled when empty")
+
+	startProxyCmd.Flags().DurationVar(
+		&proxyArgs.CleanupArgs.HistoryRetention,
+		"history-retention",
+		30*24*time.Hour,
+		"how long clean cycles are kept in the history, 0 keeps every clean cycle")
+
+	startProxyCmd.Flags().IntVar(
+		&proxyArgs.CleanupArgs.HistoryMaxRuns,
+		"history-max-runs",
+		500,
+		"maximum number of clean cycles kept in the history, 0 keeps every clean cycle")
+
+	startProxyCmd.Flags().DurationVar(
+		&proxyArgs.CleanupArgs.Forecast.SampleInterval,
+		"forecast-interval",
+		15*time.Minute,
+		"how often usage is sampled to forecast when it reaches the target and fills the disk, 0 disables forecasting")
+
+	startProxyCmd.Flags().DurationVar(
+		&proxyArgs.CleanupArgs.Forecast.Window,
+		"forecast-window",
+		7*24*time.Hour,
+		"how long usage samples are kept and fitted by the forecast")
+
+	startProxyCmd.Flags().BoolVar(
+		&proxyArgs.CleanupArgs.Forecast.Reschedule,
+		"forecast-reschedule",
+		false,
+		"start a clean cycle when usage is forecast to reach the target before the next scheduled clean cycle")
+
+	startProxyCmd.Flags().BoolVar(
+		&proxyArgs.CleanupArgs.Forecast.Headroom,
+		"forecast-headroom",
+		false,
+		"when usage is forecast to reach the target before the next scheduled clean cycle, free the growth forecast until the clean cycle after it below the target")
+
+	startProxyCmd.Flags().StringVar(
+		&proxyArgs.SnapshotArgs.Dir,
+		"db-snapshot-dir",
+		"",
+		"directory for scheduled usage.db snapshots, snapshots are disabled when empty")
+
+	startProxyCmd.Flags().StringVar(
+		&proxyArgs.SnapshotArgs.CronSchedule,
+		"db-snapshot-cron",
+		"0 * * * *",
+		"cron schedule for usage.db snapshots default is hourly")
+
+	startProxyCmd.Flags().IntVar(
+		&proxyArgs.SnapshotArgs.Keep,
+		"db-snapshot-keep",
+		24,
+		"number of usage.db snapshots to keep, 0 keeps every snapshot")
+
+	startProxyCmd.Flags().StringVar(
+		&proxyArgs.eventFile,
+		"event-file",
+		"",
+		"append push, pull, eviction and gc events to this file as json lines")
+
+	startProxyCmd.Flags().StringVar(
+		&proxyArgs.eventWebhookURL,
+		"event-webhook-url",
+		"",
+		"post push, pull, eviction and gc events to this url as json")
+
+	startProxyCmd.Flags().StringVar(
+		&proxyArgs.eventWebhookSecret,
+		"event-webhook-secret",
+		"",
+		"secret used to sign webhook events with HMAC-SHA256 in the X-Dockhand-Signature header")
+
+	startProxyCmd.Flags().IntVar(
+		&proxyArgs.eventWebhookRetries,
+		"event-webhook-retries",
+		3,
+		"number of times a failed webhook event is retried with exponential backoff")
+
+	startProxyCmd.Flags().BoolVar(
+		&proxyArgs.eventStdout,
+		"event-stdout",
+		false,
+		"write push, pull, eviction and gc events to stdout in the CloudEvents format")
+
+	startProxyCmd.Flags().StringVar(
+		&proxyArgs.ReportArgs.Dir,
+		"report-dir",
+		"",
+		"directory for scheduled usage reports, scheduled reports are disabled when empty")
+
+	startProxyCmd.Flags().StringVar(
+		&proxyArgs.ReportArgs.CronSchedule,
+		"report-cron",
+		"0 0 * * *",
+		"cron schedule for usage reports default is 0:00:00")
+
+	startProxyCmd.Flags().StringVar(
+		&proxyArgs.ReportArgs.Format,
+		"report-format",
+		proxy.ReportCSV,
+		"format of scheduled usage reports, csv or json")
+
+	startProxyCmd.Flags().DurationVar(
+		&proxyArgs.ReportArgs.ActivityRetention,
+		"activity-retention",
+		90*24*time.Hour,
+		"how long the pulls, pushes and byte-hours of repositories are kept for usage reports, 0 keeps them forever")
+
+	addReportWindowFlag(startProxyCmd)
+
+	startProxyCmd.Flags().StringVar(
+		&proxyArgs.notificationSecret,
+		"notification-secret",
+		"",
+		"shared secret registry notifications must send as a bearer token to /events, the receiver is disabled when empty")
+
+	startProxyCmd.Flags().DurationVar(
+		&proxyArgs.notificationWindow,
+		"notification-dedup-window",
+		time.Minute,
+		"registry notifications for a push or pull the proxy recorded within this window are ignored")
+
+	startProxyCmd.Flags().StringVar(
+		&proxyArgs.HardDiskLimitByteString,
+		"hard-disk-limit",
+		"",
+		"hard limit on disk usage, when exceeded new blob uploads are rejected and an emergency clean cycle is started (disabled by default)")
+
+	startProxyCmd.Flags().DurationVar(
+		&proxyArgs.CleanupArgs.HardLimitCheckInterval,
+		"hard-limit-check-interval",
+		30*time.Second,
+		"minimum interval between disk usage measurements for the hard-disk-limit check")
+
+	startProxyCmd.Flags().DurationVar(
+		&proxyArgs.ShutdownArgs.DrainTimeout,
+		"drain-timeout",
+		30*time.Second,
+		"how long shutdown waits for in-flight requests and, with --gc-on-shutdown wait, a running garbage collection")
+
+	startProxyCmd.Flags().StringVar(
+		(*string)(&proxyArgs.ShutdownArgs.GCPolicy),
+		"gc-on-shutdown",
+		string(proxy.GCShutdownAbort),
+		"what shutdown does with a running garbage collection, wait for it within the drain timeout or abort it")
+
+	startProxyCmd.Flags().DurationVar(
+		&proxyArgs.gcPollInterval,
+		"gc-poll-interval",
+		30*time.Second,
+		"how often the api backend measures usage while waiting for the registry to collect garbage")
+
+	startProxyCmd.Flags().DurationVar(
+		&proxyArgs.gcPollTimeout,
+		"gc-poll-timeout",
+		30*time.Minute,
+		"how long the api backend waits for usage to drop after deleting tags")
+
+	startProxyCmd.Flags().DurationVar(
+		&proxyArgs.usageRescanInterval,
+		"usage-rescan-interval",
+		6*time.Hour,
+		"how often usage tracked in memory is corrected by walking registry-dir with --usage walk, 0 walks registry-dir for every measurement")
+
+	startProxyCmd.Flags().IntVar(
+		&proxyArgs.usageMaxWatches,
+		"usage-max-watches",
+		0,
+		"how many directories of registry-dir are watched with inotify before usage is tracked from pushes and garbage collection, 0 uses half of fs.inotify.max_user_watches")
+
+	startProxyCmd.Flags().BoolVar(
+		&proxyArgs.registryPreflight,
+		"registry-preflight",
+		true,
+		"check at startup that registry-conf matches the proxy settings and that the registry accepts deletes")
+
+	startProxyCmd.Flags().BoolVar(
+		&proxyArgs.superviseRegistry,
+		"supervise-registry",
+		false,
+		"run registry-bin serve registry-conf as a child process, restarting it when it exits")
+
+	startProxyCmd.Flags().DurationVar(
+		&proxyArgs.registryStartTimeout,
+		"registry-start-timeout",
+		time.Minute,
+		"how long to wait for the supervised registry to become healthy before accepting traffic")
+
+	startProxyCmd.Flags().BoolVar(
+		&proxyArgs.CleanupArgs.OfflineGC,
+		"offline-gc",
+		false,
+		"stop the supervised registry while garbage collection runs, requests are rejected until it is back")
+
+	startProxyCmd.Flags().BoolVar(
+		&proxyArgs.notReadyDuringGC,
+		"not-ready-during-gc",
+		false,
+		"report the proxy as not ready on /readyz while garbage collection blocks pushes")
+
+	startProxyCmd.Flags().BoolVar(
+		&proxyArgs.UseForwardedHeaders,
+		"use-forwarded-headers",
+		false,
+		"use x-forwarded headers")
+
+	addCleanupFlags(startProxyCmd)
 
 	_ = viper.BindPFlags(startProxyCmd.Flags())
 }
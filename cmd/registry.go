@@ -0,0 +1,196 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/backend"
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/boxboat/dockhand-lru-registry/pkg/distribution"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	registryConfigOutput    string
+	registryTLSCert         string
+	registryTLSKey          string
+	registryNotificationURL string
+)
+
+func registrySettings() distribution.Settings {
+	return distribution.Settings{
+		Backend:        proxyArgs.backendType,
+		Usage:          usageType(),
+		RegistryDir:    proxyArgs.registryDir,
+		RegistryHost:   proxyArgs.registryHost,
+		RegistryScheme: proxyArgs.registryScheme,
+		S3Bucket:       proxyArgs.s3.Bucket,
+	}
+}
+
+// registryConfigProblems lists the settings of the registry config that do not match
+// the proxy and the settings that are warned about, it fails when the registry config
+// cannot be read
+func registryConfigProblems() ([]string, []string, error) {
+	cfg, err := distribution.Load(proxyArgs.registryConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg.Check(registrySettings()), cfg.Warnings(), nil
+}
+
+// registryRootDirectory returns the filesystem root of the registry config, or the
+// registry directory when the config cannot be read
+func registryRootDirectory() string {
+	cfg, err := distribution.Load(proxyArgs.registryConfig)
+	if err != nil {
+		common.Log.Warnf("unable to read registry config, using %s as the storage root: %v", proxyArgs.registryDir, err)
+		return proxyArgs.registryDir
+	}
+	return cfg.RootDirectory(proxyArgs.registryDir)
+}
+
+// registryS3 returns the bucket measured by the s3 usage provider, the storage.s3
+// section of the registry config fills in the settings when no bucket is set
+func registryS3() backend.S3 {
+	s3 := proxyArgs.s3
+	if s3.Bucket == "" {
+		cfg, err := distribution.Load(proxyArgs.registryConfig)
+		common.ExitIfError(err)
+		storage, ok := cfg.S3()
+		if !ok {
+			common.ExitIfError(fmt.Errorf("--usage s3 requires --s3-bucket or the s3 storage driver in %s", proxyArgs.registryConfig))
+		}
+		s3.Bucket = storage.Bucket
+		if s3.Endpoint == "" {
+			s3.Endpoint = storage.RegionEndpoint
+			s3.PathStyle = s3.PathStyle || storage.PathStyle
+		}
+		if s3.Region == "" {
+			s3.Region = storage.Region
+		}
+		if s3.Prefix == "" {
+			s3.Prefix = storage.RootDirectory
+		}
+		if s3.AccessKey == "" {
+			s3.AccessKey, s3.SecretKey, s3.SessionToken = storage.AccessKey, storage.SecretKey, storage.SessionToken
+		}
+	}
+	return s3
+}
+
+// checkRegistryConfig logs the settings of the registry config that do not match the proxy
+func checkRegistryConfig() {
+	path := proxyArgs.registryConfig
+	problems, warnings, err := registryConfigProblems()
+	if err != nil {
+		common.Log.Warnf("unable to read registry config, skipping preflight: %v", err)
+		return
+	}
+	for _, problem := range problems {
+		common.Log.Errorf("registry config %s: %s", path, problem)
+	}
+	for _, warning := range warnings {
+		common.Log.Warnf("registry config %s: %s", path, warning)
+	}
+	if len(problems) == 0 {
+		common.Log.Infof("registry config %s matches the proxy settings", path)
+	}
+}
+
+func generateRegistryConfig() {
+	notificationURL := registryNotificationURL
+	if notificationURL == "" {
+		scheme := "http"
+		if proxyArgs.serverCert != "" {
+			scheme = "https"
+		}
+		notificationURL = fmt.Sprintf("%s://127.0.0.1:%d/events", scheme, proxyArgs.serverPort)
+	}
+
+	cfg, err := distribution.Generate(distribution.GenerateSettings{
+		Settings:           registrySettings(),
+		TLSCertificate:     registryTLSCert,
+		TLSKey:             registryTLSKey,
+		NotificationURL:    notificationURL,
+		NotificationSecret: proxyArgs.notificationSecret,
+	})
+	common.ExitIfError(err)
+	content, err := cfg.Marshal()
+	common.ExitIfError(err)
+
+	if registryConfigOutput == "" {
+		_, err = os.Stdout.Write(content)
+		common.ExitIfError(err)
+		return
+	}
+	common.ExitIfError(os.WriteFile(registryConfigOutput, content, 0600))
+	common.Log.Infof("wrote registry config %s", registryConfigOutput)
+}
+
+var generateRegistryConfigCmd = &cobra.Command{
+	Use:   "generate-registry-config",
+	Short: "generate the registry config",
+	Long: `generate a distribution registry config matching the proxy settings, with deletes enabled,
+the filesystem root at registry-dir, listening on the port of registry-host and sending notifications
+to the proxy when a notification secret is set`,
+	Run: func(cmd *cobra.Command, args []string) {
+		generateRegistryConfig()
+	},
+	PreRunE: loadProxyConfig,
+}
+
+func init() {
+	rootCmd.AddCommand(generateRegistryConfigCmd)
+
+	generateRegistryConfigCmd.Flags().StringVar(
+		&registryConfigOutput,
+		"output",
+		"",
+		"file to write the registry config to, stdout when empty")
+
+	generateRegistryConfigCmd.Flags().StringVar(
+		&registryTLSCert,
+		"registry-tls-cert",
+		"",
+		"x509 certificate of the registry, required with --registry-scheme https")
+
+	generateRegistryConfigCmd.Flags().StringVar(
+		&registryTLSKey,
+		"registry-tls-key",
+		"",
+		"x509 key of the registry, required with --registry-scheme https")
+
+	generateRegistryConfigCmd.Flags().StringVar(
+		&registryNotificationURL,
+		"notification-url",
+		"",
+		"url of the proxy /events receiver, defaults to the proxy port on 127.0.0.1")
+
+	generateRegistryConfigCmd.Flags().StringVar(
+		&proxyArgs.registryDir,
+		"registry-dir",
+		"/var/lib/registry",
+		"registry directory")
+
+	addRegistryFlags(generateRegistryConfigCmd)
+
+	_ = viper.BindPFlags(generateRegistryConfigCmd.Flags())
+}
@@ -0,0 +1,86 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/api"
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	reportOutput string
+)
+
+func usageReport(ctx context.Context) {
+	db := openDatabase(true)
+	defer db.Close()
+
+	report, err := newProxy(db, false).Report(ctx, proxyArgs.ReportArgs.Window)
+	common.ExitIfError(err)
+	common.ExitIfError(printReport(report, reportOutput))
+}
+
+func printReport(report *api.UsageReport, output string) error {
+	header, rows := report.Records()
+	return printRecords(output, header, rows, report)
+}
+
+// reportsScheduled reports whether the proxy writes usage reports to a directory
+func reportsScheduled() bool {
+	return proxyArgs.ReportArgs.Dir != ""
+}
+
+// addReportWindowFlag adds the window of the activity counted by usage reports
+func addReportWindowFlag(cmd *cobra.Command) {
+	cmd.Flags().DurationVar(
+		&proxyArgs.ReportArgs.Window,
+		"report-window",
+		24*time.Hour,
+		"how far back usage reports count pulls, pushes and byte-hours, from the start of the day in UTC")
+}
+
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "report usage per namespace and repository",
+	Long: `report the stored, unique and shared bytes, tags, pulls, pushes and byte-hours of each namespace and repository,
+based on usage.db and the manifests in the registry. the first path component of a repository is its namespace`,
+	Run: func(cmd *cobra.Command, args []string) {
+		usageReport(cmd.Context())
+	},
+	PreRunE: loadProxyConfig,
+}
+
+func init() {
+	rootCmd.AddCommand(reportCmd)
+
+	reportCmd.Flags().StringVar(
+		&reportOutput,
+		"output",
+		"table",
+		"output format, table, json or csv")
+
+	addReportWindowFlag(reportCmd)
+	addCleanupFlags(reportCmd)
+	addAdminFlags(reportCmd)
+
+	_ = viper.BindPFlags(reportCmd.Flags())
+}
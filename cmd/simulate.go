@@ -0,0 +1,236 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/boxboat/dockhand-lru-registry/pkg/simulate"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+type SimulateArgs struct {
+	budget      string
+	sizes       string
+	sizesFormat string
+	seed        bool
+	defaultSize string
+	policies    []string
+	output      string
+}
+
+var (
+	simulateArgs SimulateArgs
+)
+
+// parsePolicy parses a policy of comma separated key=value settings, the
+// target defaults to the disk budget
+func parsePolicy(spec string, idx int, budget uint64) (simulate.Policy, error) {
+	policy := simulate.Policy{
+		Name:                fmt.Sprintf("policy-%d", idx+1),
+		Interval:            24 * time.Hour,
+		TargetBytes:         budget,
+		CleanTagsPercentage: 0.1,
+	}
+	for _, setting := range strings.Split(spec, ",") {
+		if setting == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			return policy, fmt.Errorf("policy setting %s must be key=value", setting)
+		}
+		var err error
+		switch key {
+		case "name":
+			policy.Name = value
+		case "interval":
+			policy.Interval, err = time.ParseDuration(value)
+		case "target":
+			policy.TargetBytes, err = common.ParseByteString(value)
+		case "hard-limit":
+			policy.HardLimitBytes, err = common.ParseByteString(value)
+		case "percentage":
+			var percentage float64
+			percentage, err = strconv.ParseFloat(value, 64)
+			policy.CleanTagsPercentage = percentage / 100
+		default:
+			err = fmt.Errorf("unknown setting, must be name, interval, target, hard-limit or percentage")
+		}
+		if err != nil {
+			return policy, fmt.Errorf("policy setting %s: %w", setting, err)
+		}
+	}
+	return policy, nil
+}
+
+func readAccessLogs(paths []string) []simulate.Access {
+	var accesses []simulate.Access
+	for _, path := range paths {
+		r := io.Reader(os.Stdin)
+		if path != "-" {
+			file, err := os.Open(path)
+			common.ExitIfError(err)
+			defer file.Close()
+			r = file
+		}
+		fileAccesses, skipped, err := simulate.ParseLog(r)
+		common.ExitIfError(err)
+		common.Log.Infof("read %d accesses from %s, skipped %d other lines", len(fileAccesses), path, skipped)
+		accesses = append(accesses, fileAccesses...)
+	}
+	sort.SliceStable(accesses, func(i, j int) bool {
+		return accesses[i].Time.Before(accesses[j].Time)
+	})
+	return accesses
+}
+
+func simulatePolicies(paths []string) {
+	budget, err := common.ParseByteString(simulateArgs.budget)
+	common.ExitIfError(err)
+	defaultSize, err := common.ParseByteString(simulateArgs.defaultSize)
+	common.ExitIfError(err)
+
+	simulator := &simulate.Simulator{
+		Sizes:       map[string]int64{},
+		DefaultSize: int64(defaultSize),
+	}
+	if simulateArgs.sizes != "" {
+		file, err := os.Open(simulateArgs.sizes)
+		common.ExitIfError(err)
+		transferArgs.format = simulateArgs.sizesFormat
+		records, err := readRecords(file)
+		file.Close()
+		common.ExitIfError(err)
+		for _, record := range records {
+			if record.Size > 0 {
+				simulator.Sizes[record.Image] = record.Size
+			}
+		}
+		if simulateArgs.seed {
+			simulator.Seed = records
+		}
+	}
+
+	specs := simulateArgs.policies
+	if len(specs) == 0 {
+		specs = []string{""}
+	}
+	var policies []simulate.Policy
+	for idx, spec := range specs {
+		policy, err := parsePolicy(spec, idx, budget)
+		common.ExitIfError(err)
+		policies = append(policies, policy)
+	}
+
+	accesses := readAccessLogs(paths)
+	var reports []*simulate.Report
+	var rows [][]string
+	for _, policy := range policies {
+		common.Log.Infof("simulating %s", policy.Name)
+		report, err := simulator.Run(accesses, policy)
+		common.ExitIfError(err)
+		reports = append(reports, report)
+		rows = append(rows, []string{
+			report.Policy,
+			strconv.Itoa(report.Pulls),
+			strconv.FormatFloat(report.HitRatio, 'f', 4, 64),
+			strconv.Itoa(report.Pushes),
+			strconv.Itoa(report.RePushes),
+			strconv.Itoa(report.EvictedTags),
+			strconv.FormatUint(report.EvictedBytes, 10),
+			strconv.FormatUint(report.PeakBytes, 10),
+			strconv.FormatUint(report.FinalBytes, 10),
+			strconv.Itoa(report.CleanCycles),
+			strconv.Itoa(report.EmergencyCleanCycles),
+		})
+	}
+	header := []string{"policy", "pulls", "hit ratio", "pushes", "re-pushes", "evicted tags", "evicted bytes",
+		"peak bytes", "final bytes", "clean cycles", "emergency clean cycles"}
+	common.ExitIfError(printRecords(simulateArgs.output, header, rows, reports))
+}
+
+var simulateCmd = &cobra.Command{
+	Use:   "simulate <log>...",
+	Short: "simulate eviction policies against recorded traffic",
+	Long: `replay the pushes and pulls of proxy logs or audit events (- for stdin) with a virtual clock against each
+--policy and report the hit ratio, bytes evicted, re-pushed tags and peak usage. a policy is a comma separated list
+of settings: name, interval (time between clean cycles, default 24h), target (default --budget), hard-limit and
+percentage (clean-tags-percentage, default 10), e.g. --policy name=hourly,interval=1h,percentage=5.
+tags are ranked and selected for eviction by the same code as the proxy. tag sizes come from an export file,
+blobs shared between tags are counted once per tag`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		simulatePolicies(args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(simulateCmd)
+
+	simulateCmd.Flags().StringVar(
+		&simulateArgs.budget,
+		"budget",
+		"50Gi",
+		"disk budget, the default target of every policy")
+
+	simulateCmd.Flags().StringVar(
+		&simulateArgs.sizes,
+		"sizes",
+		"",
+		"export file with the size of each tag, see export --sizes")
+
+	simulateCmd.Flags().StringVar(
+		&simulateArgs.sizesFormat,
+		"sizes-format",
+		"jsonl",
+		"format of the sizes file, jsonl or csv")
+
+	simulateCmd.Flags().BoolVar(
+		&simulateArgs.seed,
+		"seed",
+		false,
+		"start with the tags of the sizes file cached, at their recorded access times")
+
+	simulateCmd.Flags().StringVar(
+		&simulateArgs.defaultSize,
+		"default-size",
+		"100Mi",
+		"size of tags missing from the sizes file")
+
+	simulateCmd.Flags().StringArrayVar(
+		&simulateArgs.policies,
+		"policy",
+		nil,
+		"policy settings to simulate, repeat to compare policies")
+
+	simulateCmd.Flags().StringVar(
+		&simulateArgs.output,
+		"output",
+		"table",
+		"output format, table, json or csv")
+
+	_ = viper.BindPFlags(simulateCmd.Flags())
+}
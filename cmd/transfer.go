@@ -0,0 +1,268 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+type TransferArgs struct {
+	format string
+	file   string
+	merge  string
+	sizes  bool
+}
+
+var (
+	transferArgs TransferArgs
+	recordHeader = []string{"image", "accessTime", "digest", "size", "lastAccessor", "pinned", "leaseExpiry"}
+)
+
+func exportCache(ctx context.Context) {
+	db := openDatabase(true)
+	defer db.Close()
+
+	records, err := (&lru.Cache{Db: db}).Export()
+	common.ExitIfError(err)
+	if transferArgs.sizes {
+		registryProxy := newProxy(db, false)
+		for idx := range records {
+			repo, tag, _ := lru.ParseName(records[idx].Image)
+			size, err := registryProxy.ImageSize(ctx, &lru.Image{Repo: repo, Tag: tag})
+			if err != nil {
+				common.Log.Warnf("unable to determine size of %s: %v", records[idx].Image, err)
+				continue
+			}
+			records[idx].Size = size
+		}
+	}
+
+	w := io.Writer(os.Stdout)
+	if transferArgs.file != "-" {
+		file, err := os.Create(transferArgs.file)
+		common.ExitIfError(err)
+		defer file.Close()
+		w = file
+	}
+	buffered := bufio.NewWriter(w)
+	common.ExitIfError(writeRecords(buffered, records))
+	common.ExitIfError(buffered.Flush())
+	common.Log.Debugf("exported %d tags", len(records))
+}
+
+func writeRecords(w io.Writer, records []lru.Record) error {
+	switch transferArgs.format {
+	case "jsonl":
+		encoder := json.NewEncoder(w)
+		for _, record := range records {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "csv":
+		csvWriter := csv.NewWriter(w)
+		if err := csvWriter.Write(recordHeader); err != nil {
+			return err
+		}
+		for _, record := range records {
+			leaseExpiry := ""
+			if record.LeaseExpiry != nil {
+				leaseExpiry = record.LeaseExpiry.Format(time.RFC3339)
+			}
+			row := []string{
+				record.Image,
+				record.AccessTime.Format(time.RFC3339),
+				record.Digest,
+				strconv.FormatInt(record.Size, 10),
+				record.LastAccessor,
+				strconv.FormatBool(record.Pinned),
+				leaseExpiry,
+			}
+			if err := csvWriter.Write(row); err != nil {
+				return err
+			}
+		}
+		csvWriter.Flush()
+		return csvWriter.Error()
+	default:
+		return fmt.Errorf("unsupported format %s, must be jsonl or csv", transferArgs.format)
+	}
+}
+
+func readRecords(r io.Reader) ([]lru.Record, error) {
+	var records []lru.Record
+	switch transferArgs.format {
+	case "jsonl":
+		decoder := json.NewDecoder(r)
+		for {
+			record := lru.Record{}
+			if err := decoder.Decode(&record); errors.Is(err, io.EOF) {
+				return records, nil
+			} else if err != nil {
+				return nil, fmt.Errorf("record %d: %w", len(records)+1, err)
+			}
+			records = append(records, record)
+		}
+	case "csv":
+		csvReader := csv.NewReader(r)
+		csvReader.FieldsPerRecord = len(recordHeader)
+		rows, err := csvReader.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for idx, row := range rows {
+			if idx == 0 && row[0] == recordHeader[0] {
+				continue
+			}
+			record, err := parseRecordRow(row)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", idx+1, err)
+			}
+			records = append(records, record)
+		}
+		return records, nil
+	default:
+		return nil, fmt.Errorf("unsupported format %s, must be jsonl or csv", transferArgs.format)
+	}
+}
+
+func parseRecordRow(row []string) (lru.Record, error) {
+	record := lru.Record{
+		Image:        row[0],
+		Digest:       row[2],
+		LastAccessor: row[4],
+	}
+	var err error
+	if record.AccessTime, err = time.Parse(time.RFC3339, row[1]); err != nil {
+		return record, err
+	}
+	if row[3] != "" {
+		if record.Size, err = strconv.ParseInt(row[3], 10, 64); err != nil {
+			return record, err
+		}
+	}
+	if row[5] != "" {
+		if record.Pinned, err = strconv.ParseBool(row[5]); err != nil {
+			return record, err
+		}
+	}
+	if row[6] != "" {
+		leaseExpiry, err := time.Parse(time.RFC3339, row[6])
+		if err != nil {
+			return record, err
+		}
+		record.LeaseExpiry = &leaseExpiry
+	}
+	return record, nil
+}
+
+func importCache(path string) {
+	r := io.Reader(os.Stdin)
+	if path != "-" {
+		file, err := os.Open(path)
+		common.ExitIfError(err)
+		defer file.Close()
+		r = file
+	}
+	records, err := readRecords(bufio.NewReader(r))
+	common.ExitIfError(err)
+
+	db := openExclusive()
+	defer db.Close()
+	cache := &lru.Cache{Db: db}
+	common.ExitIfError(cache.Init())
+	result, err := cache.Import(records, lru.MergeMode(transferArgs.merge))
+	common.ExitIfError(err)
+	common.Log.Infof("imported %d tags from %s: %d added, %d updated, %d skipped",
+		len(records), path, result.Added, result.Updated, result.Skipped)
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "export the cache state",
+	Long: `write every cached tag with its access time, digest, size, last accessor, pin and lease as json lines or csv,
+least recently used first. sizes are those recorded in usage.db unless --sizes reads them from the registry`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		exportCache(cmd.Context())
+	},
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import <file>",
+	Short: "import the cache state",
+	Long: `merge tags exported from another usage.db, or - for stdin. with --merge newest a cached tag is only replaced
+by a tag accessed later, pins from either side and the later lease are kept. with --merge overwrite imported tags
+replace cached tags. takes the write lock and fails while a proxy is running`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		importCache(args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd, importCmd)
+
+	for _, cmd := range []*cobra.Command{exportCmd, importCmd} {
+		addDatabaseFlag(cmd)
+		cmd.Flags().StringVar(
+			&transferArgs.format,
+			"format",
+			"jsonl",
+			"file format, jsonl or csv")
+	}
+
+	exportCmd.Flags().StringVar(
+		&transferArgs.file,
+		"file",
+		"-",
+		"file to write, - for stdout")
+
+	exportCmd.Flags().BoolVar(
+		&transferArgs.sizes,
+		"sizes",
+		false,
+		"read the size of each tag from the registry")
+
+	addRegistryFlags(exportCmd)
+	addAdminFlags(exportCmd)
+
+	importCmd.Flags().StringVar(
+		&transferArgs.merge,
+		"merge",
+		string(lru.MergeNewest),
+		"merge mode, newest keeps the latest access of a tag, overwrite replaces cached tags")
+
+	for _, cmd := range []*cobra.Command{exportCmd, importCmd} {
+		_ = viper.BindPFlags(cmd.Flags())
+	}
+}
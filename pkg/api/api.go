@@ -0,0 +1,171 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"strconv"
+	"time"
+)
+
+// AdminPrefix is the path the admin api is served under
+const AdminPrefix = "/admin/v1"
+
+// StopReason records why a cleanup run stopped evicting tags
+type StopReason string
+
+const (
+	StopTargetReached   StopReason = "target usage reached"
+	StopNoTagsRemaining StopReason = "no tags remaining to remove"
+	StopTagLimit        StopReason = "per-run tag eviction limit reached"
+	StopByteLimit       StopReason = "per-run byte eviction limit reached"
+	StopBreakerOpen     StopReason = "eviction circuit breaker open"
+	StopCanceled        StopReason = "cleanup canceled"
+	StopShutdown        StopReason = "proxy shutting down"
+	StopRecovered       StopReason = "interrupted cleanup recovered"
+)
+
+// TagRequest selects a cached tag, Pinned is used by the pin endpoint and
+// Duration by the lease endpoint, a zero lease duration clears the lease
+type TagRequest struct {
+	Image    string `json:"image"`
+	Pinned   bool   `json:"pinned,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// TagStatus is a cached tag and its eviction protection
+type TagStatus struct {
+	Image       string     `json:"image"`
+	AccessTime  time.Time  `json:"accessTime"`
+	Pinned      bool       `json:"pinned"`
+	LeaseExpiry *time.Time `json:"leaseExpiry,omitempty"`
+}
+
+// CleanupStatus reports the cleanup in progress and the state of the proxy
+type CleanupStatus struct {
+	Running       bool       `json:"running"`
+	Trigger       string     `json:"trigger,omitempty"`
+	StartTime     *time.Time `json:"startTime,omitempty"`
+	BreakerOpen   bool       `json:"breakerOpen"`
+	BreakerReason StopReason `json:"breakerReason,omitempty"`
+	Emergency     bool       `json:"emergency"`
+	ReadOnly      bool       `json:"readOnly"`
+}
+
+// ReadOnlyStatus reports or sets whether the proxy rejects pushes and deletes
+type ReadOnlyStatus struct {
+	Enabled bool `json:"enabled"`
+}
+
+// PlannedEviction is a tag a clean cycle would remove
+type PlannedEviction struct {
+	Image          string    `json:"image"`
+	AccessTime     time.Time `json:"accessTime"`
+	Iteration      int       `json:"iteration"`
+	EstimatedBytes uint64    `json:"estimatedBytes"`
+}
+
+// SkippedTag is a tag a clean cycle would not remove because it is protected
+// or beyond an eviction limit
+type SkippedTag struct {
+	Image  string `json:"image"`
+	Reason string `json:"reason"`
+}
+
+// CleanupPlan is the outcome of a dry run of a clean cycle
+type CleanupPlan struct {
+	UsedBytes           uint64 `json:"usedBytes"`
+	TargetBytes         uint64 `json:"targetBytes"`
+	EstimatedFreedBytes uint64 `json:"estimatedFreedBytes"`
+	UnknownSizeTags     int    `json:"unknownSizeTags"`
+	// UntrackedTags counts the tags of the registry usage.db does not track, clean
+	// cycles never evict them. it is nil when the registry catalog cannot be listed
+	UntrackedTags *int              `json:"untrackedTags,omitempty"`
+	Iterations    int               `json:"iterations"`
+	StopReason    StopReason        `json:"stopReason"`
+	Evictions     []PlannedEviction `json:"evictions"`
+	Skipped       []SkippedTag      `json:"skipped"`
+}
+
+// Forecast is the usage growth fitted to the samples in usage.db and when it crosses
+// the target and fills the disk
+type Forecast struct {
+	Samples             int        `json:"samples"`
+	SampleTime          *time.Time `json:"sampleTime,omitempty"`
+	UsedBytes           uint64     `json:"usedBytes"`
+	TargetBytes         uint64     `json:"targetBytes"`
+	FreeBytes           *uint64    `json:"freeBytes,omitempty"`
+	GrowthBytesPerHour  float64    `json:"growthBytesPerHour"`
+	PushedBytesPerHour  float64    `json:"pushedBytesPerHour"`
+	TargetTime          *time.Time `json:"targetTime,omitempty"`
+	FullTime            *time.Time `json:"fullTime,omitempty"`
+	NextCleanup         *time.Time `json:"nextCleanup,omitempty"`
+	TargetBeforeCleanup bool       `json:"targetBeforeCleanup"`
+	EarlyCleanup        *time.Time `json:"earlyCleanup,omitempty"`
+	HeadroomBytes       uint64     `json:"headroomBytes"`
+}
+
+// UsageReport is the storage and activity of each namespace and repository
+type UsageReport struct {
+	GeneratedAt time.Time `json:"generatedAt"`
+	// Since is the start of the window of the activity, the day the window starts in UTC
+	Since           time.Time          `json:"since"`
+	UnknownSizeTags int                `json:"unknownSizeTags"`
+	Namespaces      []UsageReportEntry `json:"namespaces"`
+	Repositories    []UsageReportEntry `json:"repositories"`
+}
+
+// UsageReportEntry is the usage of a namespace or repository. unique bytes are the blobs
+// no other namespace or repository references. pulls, pushes and byte-hours are counted
+// in the window of the report, evicted repositories are reported without stored bytes
+type UsageReportEntry struct {
+	Name        string  `json:"name"`
+	Namespace   string  `json:"namespace,omitempty"`
+	StoredBytes uint64  `json:"storedBytes"`
+	UniqueBytes uint64  `json:"uniqueBytes"`
+	SharedBytes uint64  `json:"sharedBytes"`
+	Tags        int     `json:"tags"`
+	Pulls       int64   `json:"pulls"`
+	Pushes      int64   `json:"pushes"`
+	ByteHours   float64 `json:"byteHours"`
+}
+
+// Records returns the header and a row for each namespace and repository of the report
+func (report *UsageReport) Records() ([]string, [][]string) {
+	header := []string{"level", "name", "namespace", "stored bytes", "unique bytes", "shared bytes", "tags", "pulls", "pushes", "byte hours"}
+	var rows [][]string
+	row := func(level string, entry UsageReportEntry) []string {
+		return []string{
+			level,
+			entry.Name,
+			entry.Namespace,
+			strconv.FormatUint(entry.StoredBytes, 10),
+			strconv.FormatUint(entry.UniqueBytes, 10),
+			strconv.FormatUint(entry.SharedBytes, 10),
+			strconv.Itoa(entry.Tags),
+			strconv.FormatInt(entry.Pulls, 10),
+			strconv.FormatInt(entry.Pushes, 10),
+			strconv.FormatFloat(entry.ByteHours, 'f', 0, 64),
+		}
+	}
+	for _, entry := range report.Namespaces {
+		rows = append(rows, row("namespace", entry))
+	}
+	for _, entry := range report.Repositories {
+		rows = append(rows, row("repository", entry))
+	}
+	return header, rows
+}
@@ -0,0 +1,263 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/opencontainers/go-digest"
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/types"
+	"github.com/regclient/regclient/types/ref"
+)
+
+// API deletes tags through the registry api of a registry that collects its own
+// garbage, such as Zot. garbage collection waits for the registry to free space by
+// polling usage until it drops below the usage measured before the wait, or while usage
+// is accounted, by polling the blobs of the deleted tags until the registry deleted them
+type API struct {
+	registryAPI
+	UsageProvider
+	PollInterval time.Duration
+	PollTimeout  time.Duration
+
+	// deleted counts the tags deleted since the last garbage collection
+	deleted atomic.Int64
+	// blobs holds the blobs of the tags deleted while usage is accounted
+	blobs *tagBlobs
+}
+
+// tagBlobs are the configs and layers of deleted tags by repository and digest with
+// their size
+type tagBlobs struct {
+	lock  sync.Mutex
+	repos map[string]map[string]int64
+	// unknown is set when the blobs of a deleted tag could not be read
+	unknown bool
+}
+
+func NewAPI(rc *regclient.RegClient, host string, usage UsageProvider, pollInterval time.Duration, pollTimeout time.Duration) *API {
+	return &API{
+		registryAPI:   registryAPI{RegClient: rc, Host: host},
+		UsageProvider: usage,
+		PollInterval:  pollInterval,
+		PollTimeout:   pollTimeout,
+		blobs:         &tagBlobs{repos: map[string]map[string]int64{}},
+	}
+}
+
+func (api *API) Name() string {
+	return TypeAPI
+}
+
+func (api *API) DeleteTag(ctx context.Context, repo string, tag string) error {
+	if _, ok := accounting(api.UsageProvider); ok {
+		api.recordBlobs(ctx, repo, tag)
+	}
+	if err := api.registryAPI.DeleteTag(ctx, repo, tag); err != nil {
+		return err
+	}
+	api.deleted.Add(1)
+	return nil
+}
+
+// recordBlobs records the configs and layers of a tag before it is deleted, usage is
+// measured again after garbage collection when they cannot be read
+func (api *API) recordBlobs(ctx context.Context, repo string, tag string) {
+	r, err := ref.New(fmt.Sprintf("%s/%s:%s", api.Host, repo, tag))
+	blobs := map[string]int64{}
+	manifests := map[string]bool{}
+	if err == nil {
+		err = ManifestBlobs(ctx, api.RegClient, r, blobs, manifests)
+	}
+	api.blobs.lock.Lock()
+	defer api.blobs.lock.Unlock()
+	if err != nil {
+		common.Log.Debugf("unable to read the blobs of %s:%s: %v", repo, tag, err)
+		api.blobs.unknown = true
+		return
+	}
+	if api.blobs.repos[repo] == nil {
+		api.blobs.repos[repo] = map[string]int64{}
+	}
+	// manifests are no longer served as blobs once their tag is deleted, their storage
+	// is corrected by the next rescan
+	for digest, size := range blobs {
+		if !manifests[digest] {
+			api.blobs.repos[repo][digest] = size
+		}
+	}
+}
+
+// GarbageCollect waits until the registry frees the storage of the deleted tags or
+// PollTimeout passes, it returns right away when no tag was deleted since the last
+// garbage collection or usage is summed from usage.db
+func (api *API) GarbageCollect(ctx context.Context) (string, error) {
+	deleted := api.deleted.Swap(0)
+	if deleted == 0 {
+		return "no tags deleted, not waiting for the registry garbage collection", nil
+	}
+	// usage.db drops the deleted tags right away, it never sees the registry free space
+	if _, ok := api.UsageProvider.(*CacheSum); ok {
+		return "usage summed from usage.db, not waiting for the registry garbage collection", nil
+	}
+	if _, ok := accounting(api.UsageProvider); ok {
+		return api.waitForBlobs(ctx, deleted)
+	}
+	return api.waitForUsage(ctx, deleted)
+}
+
+// waitForUsage polls usage until it drops below the usage measured before the wait
+func (api *API) waitForUsage(ctx context.Context, deleted int64) (string, error) {
+	startBytes, err := api.Usage(ctx)
+	if err != nil {
+		return "", err
+	}
+	common.Log.Infof("waiting up to %s for the registry to free the storage of %d deleted tags", api.PollTimeout, deleted)
+
+	startTime := time.Now()
+	timeout := time.After(api.PollTimeout)
+	for {
+		select {
+		case <-ctx.Done():
+			api.deleted.Add(deleted)
+			return "", ctx.Err()
+		case <-timeout:
+			// the next garbage collection waits for the storage of these tags again
+			api.deleted.Add(deleted)
+			return "", fmt.Errorf("registry still using %d bytes %s after deleting %d tags", startBytes, api.PollTimeout, deleted)
+		case <-time.After(api.PollInterval):
+		}
+		usedBytes, err := api.Usage(ctx)
+		if err != nil {
+			common.LogIfError(err)
+			continue
+		}
+		if usedBytes < startBytes {
+			output := fmt.Sprintf("registry usage dropped from %d to %d bytes after %s", startBytes, usedBytes, time.Since(startTime).Round(time.Second))
+			common.Log.Infof("gc: %s", output)
+			return output, nil
+		}
+	}
+}
+
+// waitForBlobs polls the blobs of the deleted tags through the registry api and accounts
+// the deleted blobs. blobs shared with other tags are never deleted, so it stops once
+// the registry deleted all of them or some of them and the next poll found no more
+func (api *API) waitForBlobs(ctx context.Context, deleted int64) (string, error) {
+	api.blobs.lock.Lock()
+	repos, unknown := api.blobs.repos, api.blobs.unknown
+	api.blobs.repos, api.blobs.unknown = map[string]map[string]int64{}, false
+	api.blobs.lock.Unlock()
+	if unknown || len(repos) == 0 {
+		accountFreed(api.UsageProvider, nil)
+		return "blobs of the deleted tags unknown, measuring usage again", nil
+	}
+	common.Log.Infof("waiting up to %s for the registry to delete the blobs of %d deleted tags", api.PollTimeout, deleted)
+
+	startTime := time.Now()
+	timeout := time.After(api.PollTimeout)
+	freed := map[string]int64{}
+	for {
+		select {
+		case <-ctx.Done():
+			api.restoreBlobs(repos, deleted)
+			accountFreed(api.UsageProvider, freed)
+			return "", ctx.Err()
+		case <-timeout:
+			api.restoreBlobs(repos, deleted)
+			accountFreed(api.UsageProvider, freed)
+			if len(freed) > 0 {
+				return api.blobsOutput(freed, startTime), nil
+			}
+			return "", fmt.Errorf("registry still stores the blobs of %d deleted tags %s after deleting them", deleted, api.PollTimeout)
+		case <-time.After(api.PollInterval):
+		}
+		found := api.pollBlobs(ctx, repos, freed)
+		if len(repos) == 0 || len(freed) > 0 && found == 0 {
+			accountFreed(api.UsageProvider, freed)
+			output := api.blobsOutput(freed, startTime)
+			common.Log.Infof("gc: %s", output)
+			return output, nil
+		}
+	}
+}
+
+// pollBlobs moves the blobs the registry deleted from repos to freed and returns how
+// many were found deleted
+func (api *API) pollBlobs(ctx context.Context, repos map[string]map[string]int64, freed map[string]int64) int {
+	found := 0
+	for repo, blobs := range repos {
+		r, err := ref.New(fmt.Sprintf("%s/%s", api.Host, repo))
+		if err != nil {
+			delete(repos, repo)
+			continue
+		}
+		for blobDigest, size := range blobs {
+			parsed, err := digest.Parse(blobDigest)
+			if err != nil {
+				delete(blobs, blobDigest)
+				continue
+			}
+			blob, err := api.RegClient.BlobHead(ctx, r, types.Descriptor{Digest: parsed})
+			if err == nil {
+				_ = blob.Close()
+				continue
+			}
+			if !errors.Is(err, types.ErrNotFound) {
+				common.Log.Debugf("unable to check blob %s of %s: %v", blobDigest, repo, err)
+				continue
+			}
+			freed[blobDigest] = size
+			delete(blobs, blobDigest)
+			found++
+		}
+		if len(blobs) == 0 {
+			delete(repos, repo)
+		}
+	}
+	return found
+}
+
+// restoreBlobs keeps the blobs the registry has not deleted for the next garbage collection
+func (api *API) restoreBlobs(repos map[string]map[string]int64, deleted int64) {
+	api.deleted.Add(deleted)
+	api.blobs.lock.Lock()
+	defer api.blobs.lock.Unlock()
+	for repo, blobs := range repos {
+		if api.blobs.repos[repo] == nil {
+			api.blobs.repos[repo] = map[string]int64{}
+		}
+		for blobDigest, size := range blobs {
+			api.blobs.repos[repo][blobDigest] = size
+		}
+	}
+}
+
+func (api *API) blobsOutput(freed map[string]int64, startTime time.Time) string {
+	var bytes int64
+	for _, size := range freed {
+		bytes += size
+	}
+	return fmt.Sprintf("registry deleted %d blobs of %d bytes after %s", len(freed), bytes, time.Since(startTime).Round(time.Second))
+}
@@ -0,0 +1,174 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/scheme"
+	"github.com/regclient/regclient/types"
+	"github.com/regclient/regclient/types/manifest"
+	"github.com/regclient/regclient/types/ref"
+)
+
+const (
+	// TypeDistribution deletes through the registry api and runs registry garbage-collect
+	TypeDistribution = "distribution"
+	// TypeDistributionNative deletes through the registry api and collects garbage in
+	// the filesystem storage of the registry without the registry binary
+	TypeDistributionNative = "distribution-native"
+	// TypeAPI deletes through the registry api of a registry that collects its own
+	// garbage, such as Zot
+	TypeAPI = "api"
+
+	catalogPageSize = 1000
+)
+
+// Types lists the supported backends
+var Types = []string{TypeDistribution, TypeDistributionNative, TypeAPI}
+
+// Backend is the registry the proxy evicts tags from
+type Backend interface {
+	// Name describes the backend in logs
+	Name() string
+	// DeleteTag deletes a tag, a tag that is already gone is not an error
+	DeleteTag(ctx context.Context, repo string, tag string) error
+	// GarbageCollect frees the storage of deleted tags and returns its output
+	GarbageCollect(ctx context.Context) (string, error)
+	// Usage returns the bytes used by the registry
+	Usage(ctx context.Context) (uint64, error)
+	// Catalog calls fn with the tags of each repository of the registry
+	Catalog(ctx context.Context, fn func(repo string, tags []string) error) error
+}
+
+// registryAPI deletes and lists tags through the registry api
+type registryAPI struct {
+	RegClient *regclient.RegClient
+	Host      string
+}
+
+// DeleteTag deletes a tag, when the delete fails but the tag is gone it succeeded
+func (api *registryAPI) DeleteTag(ctx context.Context, repo string, tag string) error {
+	r, err := ref.New(fmt.Sprintf("%s/%s:%s", api.Host, repo, tag))
+	if err != nil {
+		return err
+	}
+	if err = api.RegClient.TagDelete(ctx, r); err != nil && !errors.Is(err, types.ErrNotFound) {
+		if _, manifestErr := api.RegClient.ManifestHead(ctx, r); manifestErr == nil || !errors.Is(manifestErr, types.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Catalog pages through the repositories and tags of the registry
+func (api *registryAPI) Catalog(ctx context.Context, fn func(repo string, tags []string) error) error {
+	last := ""
+	for {
+		repoList, err := api.RegClient.RepoList(ctx, api.Host, scheme.WithRepoLimit(catalogPageSize), scheme.WithRepoLast(last))
+		if err != nil {
+			return err
+		}
+		repos, err := repoList.GetRepos()
+		if err != nil {
+			return err
+		}
+		for _, repo := range repos {
+			tags, err := api.tags(ctx, repo)
+			if err != nil {
+				return err
+			}
+			if err = fn(repo, tags); err != nil {
+				return err
+			}
+		}
+		if len(repos) < catalogPageSize {
+			return nil
+		}
+		last = repos[len(repos)-1]
+	}
+}
+
+func (api *registryAPI) tags(ctx context.Context, repo string) ([]string, error) {
+	r, err := ref.New(fmt.Sprintf("%s/%s", api.Host, repo))
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	last := ""
+	for {
+		tagList, err := api.RegClient.TagList(ctx, r, scheme.WithTagLimit(catalogPageSize), scheme.WithTagLast(last))
+		if err != nil {
+			return nil, fmt.Errorf("listing tags of %s: %w", repo, err)
+		}
+		page, err := tagList.GetTags()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, page...)
+		if len(page) < catalogPageSize {
+			return tags, nil
+		}
+		last = page[len(page)-1]
+	}
+}
+
+// ManifestBlobs adds the manifest r, the manifests of an index and their configs and
+// layers to blobs with their size, manifests are also added to manifests when it is not nil
+func ManifestBlobs(ctx context.Context, rc *regclient.RegClient, r ref.Ref, blobs map[string]int64, manifests map[string]bool) error {
+	m, err := rc.ManifestGet(ctx, r)
+	if err != nil {
+		return err
+	}
+	descriptor := m.GetDescriptor()
+	blobs[descriptor.Digest.String()] = descriptor.Size
+	if manifests != nil {
+		manifests[descriptor.Digest.String()] = true
+	}
+
+	if index, ok := m.(manifest.Indexer); ok {
+		children, err := index.GetManifestList()
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			childRef := r
+			childRef.Tag = ""
+			childRef.Digest = child.Digest.String()
+			if err := ManifestBlobs(ctx, rc, childRef, blobs, manifests); err != nil {
+				return err
+			}
+		}
+	} else if image, ok := m.(manifest.Imager); ok {
+		config, err := image.GetConfig()
+		if err != nil {
+			return err
+		}
+		blobs[config.Digest.String()] = config.Size
+		layers, err := image.GetLayers()
+		if err != nil {
+			return err
+		}
+		for _, layer := range layers {
+			blobs[layer.Digest.String()] = layer.Size
+		}
+	}
+	return nil
+}
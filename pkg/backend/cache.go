@@ -0,0 +1,43 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"context"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+)
+
+// CacheSum estimates usage from the sizes stored per tag in usage.db, for storage that
+// cannot be measured directly. blobs shared by different manifests are counted once per
+// manifest and tags without a stored size are not counted, so it is an estimate that
+// depends on the proxy seeing every push
+type CacheSum struct {
+	Cache *lru.Cache
+}
+
+func (sum *CacheSum) Usage(_ context.Context) (uint64, error) {
+	total, unknown, err := sum.Cache.TotalSize()
+	if err != nil {
+		return 0, err
+	}
+	if unknown > 0 {
+		common.Log.Debugf("usage of %d tags without a stored size is not counted", unknown)
+	}
+	return total, nil
+}
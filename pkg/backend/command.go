@@ -0,0 +1,67 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+)
+
+const (
+	// gcAbortGrace is how long an aborted garbage collection may take to exit after
+	// SIGTERM before it is killed
+	gcAbortGrace = 10 * time.Second
+)
+
+// runCommand runs a command in its own process group until it exits, when ctx ends
+// first the group gets SIGTERM to stop safely and is killed if it has not exited
+// after gcAbortGrace
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-exited:
+		return err
+	case <-ctx.Done():
+	}
+
+	common.Log.Warnf("stopping %s", cmd.Path)
+	common.LogIfError(syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM))
+	var err error
+	select {
+	case err = <-exited:
+	case <-time.After(gcAbortGrace):
+		common.Log.Warnf("%s did not exit within %s, killing it", cmd.Path, gcAbortGrace)
+		common.LogIfError(syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL))
+		err = <-exited
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,94 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"regexp"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/regclient/regclient"
+)
+
+var (
+	// gcSummaryMatch matches the line registry garbage-collect prints before deleting blobs
+	gcSummaryMatch = regexp.MustCompile(`(?m)^\d+ blobs marked, \d+ blobs and \d+ manifests eligible for deletion$`)
+	// gcBlobMatch matches a blob registry garbage-collect deletes
+	gcBlobMatch = regexp.MustCompile(`(?m)blob eligible for deletion: (\S+)$`)
+)
+
+// Distribution deletes tags through the registry api and collects garbage by running
+// registry garbage-collect
+type Distribution struct {
+	registryAPI
+	UsageProvider
+	Binary string
+	Config string
+}
+
+func NewDistribution(rc *regclient.RegClient, host string, binary string, config string, usage UsageProvider) *Distribution {
+	return &Distribution{
+		registryAPI:   registryAPI{RegClient: rc, Host: host},
+		UsageProvider: usage,
+		Binary:        binary,
+		Config:        config,
+	}
+}
+
+func (distribution *Distribution) Name() string {
+	return TypeDistribution
+}
+
+// GarbageCollect runs registry garbage-collect --delete-untagged in its own process
+// group, it is stopped when ctx ends
+func (distribution *Distribution) GarbageCollect(ctx context.Context) (string, error) {
+	gc := exec.Command(
+		distribution.Binary,
+		"garbage-collect",
+		"--delete-untagged",
+		distribution.Config)
+
+	var combinedOutput bytes.Buffer
+	gc.Stdout = &combinedOutput
+	gc.Stderr = &combinedOutput
+
+	if err := runCommand(ctx, gc); err != nil {
+		// blobs listed before the failure may still exist
+		accountFreed(distribution.UsageProvider, nil)
+		common.Log.Warnf("gc: %s", combinedOutput.String())
+		return combinedOutput.String(), err
+	}
+	common.Log.Infof("gc: %s", combinedOutput.String())
+	accountFreed(distribution.UsageProvider, deletedBlobs(combinedOutput.String()))
+
+	return combinedOutput.String(), nil
+}
+
+// deletedBlobs returns the blobs registry garbage-collect deleted with an unknown size,
+// nil when the output does not list them
+func deletedBlobs(output string) map[string]int64 {
+	if !gcSummaryMatch.MatchString(output) {
+		return nil
+	}
+	blobs := map[string]int64{}
+	for _, match := range gcBlobMatch.FindAllStringSubmatch(output, -1) {
+		blobs[match[1]] = -1
+	}
+	return blobs
+}
@@ -0,0 +1,261 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/config"
+)
+
+// gcFixture is what a test pushed, the blobs of tags that must survive garbage
+// collection and the blobs of a deleted tag that must not
+type gcFixture struct {
+	tagged  []string
+	garbage []string
+}
+
+func pushBlob(t *testing.T, registry *testRegistry, repo string, content []byte) string {
+	t.Helper()
+	resp, err := http.Post(fmt.Sprintf("%s/v2/%s/blobs/uploads/", registry.URL, repo), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	digest := sha256Digest(content)
+	request, err := http.NewRequest(http.MethodPut, registry.URL+resp.Header.Get("Location")+"?digest="+digest, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err = http.DefaultClient.Do(request); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("pushing blob %s: %s", digest, resp.Status)
+	}
+	return digest
+}
+
+func pushManifest(t *testing.T, registry *testRegistry, repo string, reference string, manifest interface{}) string {
+	t.Helper()
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/v2/%s/manifests/%s", registry.URL, repo, reference), bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("pushing manifest %s: %s", reference, resp.Status)
+	}
+	return resp.Header.Get("Docker-Content-Digest")
+}
+
+func descriptorOf(mediaType string, digest string) map[string]interface{} {
+	return map[string]interface{}{"mediaType": mediaType, "digest": digest, "size": 1}
+}
+
+// pushImage pushes a manifest with a config and layers and returns its digest and blobs
+func pushImage(t *testing.T, registry *testRegistry, repo string, reference string, mediaType string, name string) (string, []string) {
+	t.Helper()
+	configDigest := pushBlob(t, registry, repo, []byte(`{"config":"`+name+`"}`))
+	blobs := []string{configDigest}
+	var layers []interface{}
+	for i := 0; i < 2; i++ {
+		layer := pushBlob(t, registry, repo, []byte(fmt.Sprintf("layer %d of %s", i, name)))
+		blobs = append(blobs, layer)
+		layers = append(layers, descriptorOf("application/vnd.oci.image.layer.v1.tar+gzip", layer))
+	}
+	digest := pushManifest(t, registry, repo, reference, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     mediaType,
+		"config":        descriptorOf("application/vnd.oci.image.config.v1+json", configDigest),
+		"layers":        layers,
+	})
+	return digest, append(blobs, digest)
+}
+
+// pushFixture pushes a schema2 image, an OCI index, a schema1 image and an artifact
+// to team/app and a tag that is deleted to team/old
+func pushFixture(t *testing.T, registry *testRegistry) gcFixture {
+	fixture := gcFixture{}
+
+	schema2, blobs := pushImage(t, registry, "team/app", "schema2", mediaTypeDocker2Manifest, "schema2")
+	fixture.tagged = append(fixture.tagged, blobs...)
+
+	var children []interface{}
+	for _, platform := range []string{"amd64", "arm64"} {
+		child, blobs := pushImage(t, registry, "team/app", "", mediaTypeOCI1Manifest, platform)
+		fixture.tagged = append(fixture.tagged, blobs...)
+		children = append(children, descriptorOf(mediaTypeOCI1Manifest, child))
+	}
+	// the untagged children of an index are only kept through the index
+	index := pushManifest(t, registry, "team/app", "index", map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     mediaTypeOCI1Index,
+		"manifests":     children,
+	})
+	fixture.tagged = append(fixture.tagged, index)
+
+	var fsLayers []interface{}
+	for i := 0; i < 2; i++ {
+		layer := pushBlob(t, registry, "team/app", []byte(fmt.Sprintf("schema1 layer %d", i)))
+		fixture.tagged = append(fixture.tagged, layer)
+		fsLayers = append(fsLayers, map[string]string{"blobSum": layer})
+	}
+	schema1 := pushManifest(t, registry, "team/app", "schema1", map[string]interface{}{
+		"schemaVersion": 1,
+		"name":          "team/app",
+		"tag":           "schema1",
+		"architecture":  "amd64",
+		"fsLayers":      fsLayers,
+		"history":       []interface{}{map[string]string{"v1Compatibility": "{}"}, map[string]string{"v1Compatibility": "{}"}},
+		"signatures":    []interface{}{},
+	})
+	fixture.tagged = append(fixture.tagged, schema1)
+
+	signature := pushBlob(t, registry, "team/app", []byte("signature"))
+	artifact := pushManifest(t, registry, "team/app", "artifact", map[string]interface{}{
+		"mediaType":    mediaTypeOCI1Artifact,
+		"artifactType": "application/vnd.example.signature",
+		"blobs":        []interface{}{descriptorOf("application/octet-stream", signature)},
+		"subject":      descriptorOf(mediaTypeDocker2Manifest, schema2),
+	})
+	fixture.tagged = append(fixture.tagged, signature, artifact)
+
+	_, blobs = pushImage(t, registry, "team/old", "v1", mediaTypeDocker2Manifest, "old")
+	fixture.garbage = append(fixture.garbage, blobs...)
+	return fixture
+}
+
+func (fixture gcFixture) check(t *testing.T, registry *testRegistry) {
+	t.Helper()
+	for _, digest := range fixture.tagged {
+		if !registry.HasBlob(digest) {
+			t.Errorf("tagged blob %s was deleted", digest)
+		}
+	}
+	for _, digest := range fixture.garbage {
+		if registry.HasBlob(digest) {
+			t.Errorf("blob %s of the deleted tag was kept", digest)
+		}
+	}
+}
+
+func testRegClient(registry *testRegistry) *regclient.RegClient {
+	return regclient.New(regclient.WithConfigHost(config.Host{Name: registry.Host(), TLS: config.TLSDisabled}))
+}
+
+func deleteOldTag(t *testing.T, ctx context.Context, backend Backend) {
+	t.Helper()
+	if err := backend.DeleteTag(ctx, "team/old", "v1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDistributionGarbageCollect(t *testing.T) {
+	ctx := context.Background()
+	registry := newTestRegistry(t)
+	fixture := pushFixture(t, registry)
+
+	binary := os.Getenv("REGISTRY_BIN")
+	if binary == "" {
+		binary = os.Args[0]
+		t.Setenv(fakeRegistryEnv, "1")
+	}
+	distribution := NewDistribution(testRegClient(registry), registry.Host(), binary, registry.writeConfig(t), &DirWalk{Dir: registry.Root})
+	deleteOldTag(t, ctx, distribution)
+	if output, err := distribution.GarbageCollect(ctx); err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+	fixture.check(t, registry)
+}
+
+func TestDistributionNativeGarbageCollect(t *testing.T) {
+	ctx := context.Background()
+	registry := newTestRegistry(t)
+	fixture := pushFixture(t, registry)
+
+	native := NewDistributionNative(testRegClient(registry), registry.Host(), registry.Root, &DirWalk{Dir: registry.Root})
+	deleteOldTag(t, ctx, native)
+	output, err := native.GarbageCollect(ctx)
+	if err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+	fixture.check(t, registry)
+	if !strings.Contains(output, fmt.Sprintf("%d blobs deleted", len(fixture.garbage))) {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+func TestDistributionNativeUnknownMediaType(t *testing.T) {
+	ctx := context.Background()
+	registry := newTestRegistry(t)
+	fixture := pushFixture(t, registry)
+	layer := pushBlob(t, registry, "team/unknown", []byte("unknown layer"))
+	pushManifest(t, registry, "team/unknown", "v1", map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.example.manifest.v1+json",
+		"parts":         []interface{}{descriptorOf("application/octet-stream", layer)},
+	})
+
+	native := NewDistributionNative(testRegClient(registry), registry.Host(), registry.Root, &DirWalk{Dir: registry.Root})
+	deleteOldTag(t, ctx, native)
+	if _, err := native.GarbageCollect(ctx); err == nil || !strings.Contains(err.Error(), "unknown media type") {
+		t.Fatalf("expected an unknown media type error, got %v", err)
+	}
+	for _, digest := range append(append(fixture.tagged, fixture.garbage...), layer) {
+		if !registry.HasBlob(digest) {
+			t.Errorf("blob %s was deleted by a garbage collection that stopped", digest)
+		}
+	}
+}
+
+func TestAPIGarbageCollect(t *testing.T) {
+	ctx := context.Background()
+	registry := newTestRegistry(t)
+	fixture := pushFixture(t, registry)
+	registry.CollectAfter = 50 * time.Millisecond
+
+	api := NewAPI(testRegClient(registry), registry.Host(), &DirWalk{Dir: registry.Root}, 10*time.Millisecond, 10*time.Second)
+	deleteOldTag(t, ctx, api)
+	if output, err := api.GarbageCollect(ctx); err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+	registry.WaitCollected()
+	fixture.check(t, registry)
+
+	if output, err := api.GarbageCollect(ctx); err != nil || !strings.HasPrefix(output, "no tags deleted") {
+		t.Errorf("expected no wait without deleted tags, got %q, %v", output, err)
+	}
+}
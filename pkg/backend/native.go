@@ -0,0 +1,425 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/regclient/regclient"
+)
+
+// DistributionNative deletes tags through the registry api and collects garbage in the
+// filesystem storage of Distribution without the registry binary. like registry
+// garbage-collect --delete-untagged it keeps the manifests referenced by tags, their
+// children and blobs, and deletes every other manifest and blob
+type DistributionNative struct {
+	registryAPI
+	UsageProvider
+	// Root is the rootdirectory of the filesystem storage driver
+	Root string
+}
+
+// media types of the manifests Distribution stores
+const (
+	mediaTypeDocker1Manifest       = "application/vnd.docker.distribution.manifest.v1+json"
+	mediaTypeDocker1ManifestSigned = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	mediaTypeDocker2Manifest       = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDocker2ManifestList   = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCI1Manifest          = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCI1Index             = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCI1Artifact          = "application/vnd.oci.artifact.manifest.v1+json"
+)
+
+// descriptor references a manifest or blob by digest
+type descriptor struct {
+	Digest string `json:"digest"`
+}
+
+// manifestReferences are the fields of schema1 and schema2 manifests, OCI manifests,
+// indexes and artifacts that reference other manifests and blobs
+type manifestReferences struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        *descriptor  `json:"config"`
+	Layers        []descriptor `json:"layers"`
+	Blobs         []descriptor `json:"blobs"`
+	Manifests     []descriptor `json:"manifests"`
+	Subject       *descriptor  `json:"subject"`
+	FSLayers      []struct {
+		BlobSum string `json:"blobSum"`
+	} `json:"fsLayers"`
+}
+
+// mediaType returns the media type of a manifest, OCI manifests and indexes may omit it
+func (references *manifestReferences) mediaType() string {
+	switch {
+	case references.MediaType != "":
+		return references.MediaType
+	case references.SchemaVersion == 1:
+		return mediaTypeDocker1Manifest
+	case references.SchemaVersion == 2 && references.Manifests != nil:
+		return mediaTypeOCI1Index
+	case references.SchemaVersion == 2 && references.Config != nil:
+		return mediaTypeOCI1Manifest
+	}
+	return ""
+}
+
+// blobs returns the digests of the blobs a manifest references
+func (references *manifestReferences) blobs() []string {
+	var digests []string
+	if references.Config != nil {
+		digests = append(digests, references.Config.Digest)
+	}
+	for _, layer := range references.Layers {
+		digests = append(digests, layer.Digest)
+	}
+	for _, blob := range references.Blobs {
+		digests = append(digests, blob.Digest)
+	}
+	for _, layer := range references.FSLayers {
+		digests = append(digests, layer.BlobSum)
+	}
+	return digests
+}
+
+// gcStats counts what a native garbage collection removed
+type gcStats struct {
+	repositories     int
+	markedBlobs      int
+	deletedManifests int
+	deletedBlobs     int
+	freedBytes       int64
+	// swept holds the size of every deleted blob by digest
+	swept map[string]int64
+}
+
+func NewDistributionNative(rc *regclient.RegClient, host string, root string, usage UsageProvider) *DistributionNative {
+	return &DistributionNative{
+		registryAPI:   registryAPI{RegClient: rc, Host: host},
+		UsageProvider: usage,
+		Root:          root,
+	}
+}
+
+func (native *DistributionNative) Name() string {
+	return TypeDistributionNative
+}
+
+// GarbageCollect marks the blobs of tagged manifests in every repository, then deletes
+// untagged manifests and the blobs nothing references. it stops without deleting
+// anything when a tagged manifest cannot be read or has an unknown media type
+func (native *DistributionNative) GarbageCollect(ctx context.Context) (string, error) {
+	stats := gcStats{swept: map[string]int64{}}
+	output, err := native.collect(ctx, &stats)
+	// blobs swept before an error are freed as well
+	accountFreed(native.UsageProvider, stats.swept)
+	return output, err
+}
+
+func (native *DistributionNative) collect(ctx context.Context, stats *gcStats) (string, error) {
+	storage := filepath.Join(native.Root, "docker", "registry", "v2")
+	repos, err := native.repositories(storage)
+	if err != nil {
+		return "", err
+	}
+
+	stats.repositories = len(repos)
+	marked := map[string]bool{}
+	untagged := map[string][]string{}
+	for _, repo := range repos {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		kept := map[string]bool{}
+		if err = native.markRepository(storage, repo, kept, marked); err != nil {
+			return "", fmt.Errorf("marking %s: %w", native.repoName(storage, repo), err)
+		}
+		untagged[repo], err = native.untaggedManifests(repo, kept)
+		if err != nil {
+			return "", err
+		}
+	}
+	stats.markedBlobs = len(marked)
+
+	for repo, digests := range untagged {
+		for _, digest := range digests {
+			if ctx.Err() != nil {
+				return native.output(*stats), ctx.Err()
+			}
+			common.LogIfError(native.deleteManifest(repo, digest))
+			stats.deletedManifests++
+		}
+	}
+
+	if err = native.sweepBlobs(ctx, storage, marked, stats); err != nil {
+		return native.output(*stats), err
+	}
+	for _, repo := range repos {
+		common.LogIfError(native.deleteLayerLinks(repo, stats.swept))
+	}
+
+	output := native.output(*stats)
+	common.Log.Infof("gc: %s", output)
+	return output, nil
+}
+
+func (native *DistributionNative) output(stats gcStats) string {
+	return fmt.Sprintf(
+		"%d repositories, %d blobs marked, %d untagged manifests deleted, %d blobs deleted, %d bytes freed",
+		stats.repositories,
+		stats.markedBlobs,
+		stats.deletedManifests,
+		stats.deletedBlobs,
+		stats.freedBytes)
+}
+
+// repositories returns the directories of the repositories, a repository is a
+// directory with a _manifests directory
+func (native *DistributionNative) repositories(storage string) ([]string, error) {
+	var repos []string
+	root := filepath.Join(storage, "repositories")
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && path == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), "_") {
+			if entry.Name() == "_manifests" {
+				repos = append(repos, filepath.Dir(path))
+			}
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return repos, err
+}
+
+func (native *DistributionNative) repoName(storage string, repo string) string {
+	name, err := filepath.Rel(filepath.Join(storage, "repositories"), repo)
+	if err != nil {
+		return repo
+	}
+	return filepath.ToSlash(name)
+}
+
+// markRepository marks the manifests referenced by the tags of a repository
+func (native *DistributionNative) markRepository(storage string, repo string, kept map[string]bool, marked map[string]bool) error {
+	tags, err := os.ReadDir(filepath.Join(repo, "_manifests", "tags"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, tag := range tags {
+		link, err := os.ReadFile(filepath.Join(repo, "_manifests", "tags", tag.Name(), "current", "link"))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err = native.markManifest(storage, strings.TrimSpace(string(link)), kept, marked); err != nil {
+			return fmt.Errorf("tag %s: %w", tag.Name(), err)
+		}
+	}
+	return nil
+}
+
+// markManifest marks a manifest, the blobs it references, the manifests of an index and
+// the subject of an artifact. it fails on a manifest of an unknown media type, its blobs
+// cannot be told apart from garbage
+func (native *DistributionNative) markManifest(storage string, digest string, kept map[string]bool, marked map[string]bool) error {
+	if kept[digest] {
+		return nil
+	}
+	kept[digest] = true
+	marked[digest] = true
+
+	path, err := blobPath(storage, digest)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	references := manifestReferences{}
+	if err = json.Unmarshal(content, &references); err != nil {
+		return fmt.Errorf("manifest %s: %w", digest, err)
+	}
+	switch mediaType := references.mediaType(); mediaType {
+	case mediaTypeDocker1Manifest, mediaTypeDocker1ManifestSigned, mediaTypeDocker2Manifest,
+		mediaTypeDocker2ManifestList, mediaTypeOCI1Manifest, mediaTypeOCI1Index, mediaTypeOCI1Artifact:
+	default:
+		return fmt.Errorf("manifest %s has unknown media type %q", digest, mediaType)
+	}
+
+	for _, blob := range references.blobs() {
+		if blob != "" {
+			marked[blob] = true
+		}
+	}
+	for _, child := range references.Manifests {
+		if err = native.markManifest(storage, child.Digest, kept, marked); err != nil {
+			return err
+		}
+	}
+	if references.Subject != nil && references.Subject.Digest != "" {
+		// an artifact may be pushed before its subject
+		subject, err := blobPath(storage, references.Subject.Digest)
+		if err != nil {
+			return err
+		}
+		if _, err = os.Stat(subject); errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return native.markManifest(storage, references.Subject.Digest, kept, marked)
+	}
+	return nil
+}
+
+// untaggedManifests returns the manifest revisions of a repository that are not kept
+func (native *DistributionNative) untaggedManifests(repo string, kept map[string]bool) ([]string, error) {
+	var digests []string
+	revisions := filepath.Join(repo, "_manifests", "revisions")
+	algorithms, err := os.ReadDir(revisions)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, algorithm := range algorithms {
+		hashes, err := os.ReadDir(filepath.Join(revisions, algorithm.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, hash := range hashes {
+			digest := algorithm.Name() + ":" + hash.Name()
+			if !kept[digest] {
+				digests = append(digests, digest)
+			}
+		}
+	}
+	return digests, nil
+}
+
+// deleteManifest removes a manifest revision and its entries in the tag indexes
+func (native *DistributionNative) deleteManifest(repo string, digest string) error {
+	algorithm, hash, _ := strings.Cut(digest, ":")
+	if err := os.RemoveAll(filepath.Join(repo, "_manifests", "revisions", algorithm, hash)); err != nil {
+		return err
+	}
+	tags, err := os.ReadDir(filepath.Join(repo, "_manifests", "tags"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, tag := range tags {
+		if err = os.RemoveAll(filepath.Join(repo, "_manifests", "tags", tag.Name(), "index", algorithm, hash)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sweepBlobs deletes the blobs that are not marked and adds them to the swept blobs
+func (native *DistributionNative) sweepBlobs(ctx context.Context, storage string, marked map[string]bool, stats *gcStats) error {
+	blobs := filepath.Join(storage, "blobs")
+	algorithms, err := os.ReadDir(blobs)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, algorithm := range algorithms {
+		prefixes, err := os.ReadDir(filepath.Join(blobs, algorithm.Name()))
+		if err != nil {
+			return err
+		}
+		for _, prefix := range prefixes {
+			hashes, err := os.ReadDir(filepath.Join(blobs, algorithm.Name(), prefix.Name()))
+			if err != nil {
+				return err
+			}
+			for _, hash := range hashes {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				digest := algorithm.Name() + ":" + hash.Name()
+				if marked[digest] {
+					continue
+				}
+				dir := filepath.Join(blobs, algorithm.Name(), prefix.Name(), hash.Name())
+				size := int64(-1)
+				if info, err := os.Stat(filepath.Join(dir, "data")); err == nil {
+					size = info.Size()
+					stats.freedBytes += size
+				}
+				if err = os.RemoveAll(dir); err != nil {
+					return err
+				}
+				stats.swept[digest] = size
+				stats.deletedBlobs++
+			}
+		}
+	}
+	return nil
+}
+
+// deleteLayerLinks removes the links of a repository to deleted blobs
+func (native *DistributionNative) deleteLayerLinks(repo string, swept map[string]int64) error {
+	layers := filepath.Join(repo, "_layers")
+	algorithms, err := os.ReadDir(layers)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, algorithm := range algorithms {
+		hashes, err := os.ReadDir(filepath.Join(layers, algorithm.Name()))
+		if err != nil {
+			return err
+		}
+		for _, hash := range hashes {
+			if _, deleted := swept[algorithm.Name()+":"+hash.Name()]; deleted {
+				if err = os.RemoveAll(filepath.Join(layers, algorithm.Name(), hash.Name())); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// blobPath returns the data file of a blob in the filesystem storage
+func blobPath(storage string, digest string) (string, error) {
+	algorithm, hash, ok := strings.Cut(digest, ":")
+	if !ok || len(hash) < 2 || strings.ContainsAny(algorithm+hash, `/\.`) {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return filepath.Join(storage, "blobs", algorithm, hash[:2], hash, "data"), nil
+}
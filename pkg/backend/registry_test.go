@@ -0,0 +1,371 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fakeRegistryEnv makes the test binary run as registry garbage-collect for the
+// distribution backend, REGISTRY_BIN runs a real registry binary instead
+const fakeRegistryEnv = "LRU_TEST_FAKE_REGISTRY"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeRegistryEnv) != "" {
+		os.Exit(fakeGarbageCollect(os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// fakeGarbageCollect collects the garbage of the rootdirectory in the config passed as
+// registry garbage-collect --delete-untagged <config>
+func fakeGarbageCollect(args []string) int {
+	if len(args) != 3 || args[0] != "garbage-collect" || args[1] != "--delete-untagged" {
+		fmt.Fprintf(os.Stderr, "unexpected arguments %v\n", args)
+		return 2
+	}
+	content, err := os.ReadFile(args[2])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	config := struct {
+		Storage struct {
+			Filesystem struct {
+				RootDirectory string `yaml:"rootdirectory"`
+			} `yaml:"filesystem"`
+		} `yaml:"storage"`
+	}{}
+	if err = yaml.Unmarshal(content, &config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	stats := &gcStats{swept: map[string]int64{}}
+	output, err := (&DistributionNative{Root: config.Storage.Filesystem.RootDirectory}).collect(context.Background(), stats)
+	fmt.Println(output)
+	// the summary of registry garbage-collect lets the distribution backend account the deleted blobs
+	for blobDigest := range stats.swept {
+		fmt.Printf("blob eligible for deletion: %s\n", blobDigest)
+	}
+	fmt.Printf("%d blobs marked, %d blobs and %d manifests eligible for deletion\n", stats.markedBlobs, stats.deletedBlobs, stats.deletedManifests)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// testRegistry is an in-process stand-in for Distribution that stores pushed blobs and
+// manifests in the layout of the filesystem storage driver
+type testRegistry struct {
+	*httptest.Server
+	Root string
+	// CollectAfter makes the registry collect its own garbage this long after a
+	// manifest is deleted, like a registry of the api backend
+	CollectAfter time.Duration
+
+	lock       sync.Mutex
+	collecting sync.WaitGroup
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	registry := &testRegistry{Root: t.TempDir()}
+	registry.Server = httptest.NewServer(registry)
+	t.Cleanup(registry.Close)
+	return registry
+}
+
+// Host is the host of the registry for regclient
+func (registry *testRegistry) Host() string {
+	return strings.TrimPrefix(registry.URL, "http://")
+}
+
+func (registry *testRegistry) storage() string {
+	return filepath.Join(registry.Root, "docker", "registry", "v2")
+}
+
+func (registry *testRegistry) repo(name string) string {
+	return filepath.Join(registry.storage(), "repositories", filepath.FromSlash(name))
+}
+
+// HasBlob reports whether the data of a blob is stored
+func (registry *testRegistry) HasBlob(digest string) bool {
+	path, err := blobPath(registry.storage(), digest)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+func (registry *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case r.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case path == "_catalog":
+		registry.catalog(w)
+	case strings.HasSuffix(path, "/tags/list"):
+		registry.tagList(w, strings.TrimSuffix(path, "/tags/list"))
+	case strings.Contains(path, "/blobs/uploads/"):
+		name, upload, _ := cut(path, "/blobs/uploads/")
+		registry.upload(w, r, name, upload)
+	case strings.Contains(path, "/blobs/"):
+		name, digest, _ := cut(path, "/blobs/")
+		registry.blob(w, r, name, digest)
+	case strings.Contains(path, "/manifests/"):
+		name, reference, _ := cut(path, "/manifests/")
+		registry.manifest(w, r, name, reference)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// cut splits a path at the last separator, repository names contain slashes
+func cut(path string, separator string) (string, string, bool) {
+	index := strings.LastIndex(path, separator)
+	if index < 0 {
+		return path, "", false
+	}
+	return path[:index], path[index+len(separator):], true
+}
+
+func (registry *testRegistry) catalog(w http.ResponseWriter) {
+	repos, _ := (&DistributionNative{}).repositories(registry.storage())
+	names := []string{}
+	for _, repo := range repos {
+		names = append(names, (&DistributionNative{}).repoName(registry.storage(), repo))
+	}
+	sort.Strings(names)
+	_ = json.NewEncoder(w).Encode(map[string][]string{"repositories": names})
+}
+
+func (registry *testRegistry) tagList(w http.ResponseWriter, name string) {
+	entries, _ := os.ReadDir(filepath.Join(registry.repo(name), "_manifests", "tags"))
+	tags := []string{}
+	for _, entry := range entries {
+		tags = append(tags, entry.Name())
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "tags": tags})
+}
+
+// upload accepts monolithic blob uploads, a POST followed by a PUT with the digest
+func (registry *testRegistry) upload(w http.ResponseWriter, r *http.Request, name string, upload string) {
+	switch r.Method {
+	case http.MethodPost:
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%d", name, time.Now().UnixNano()))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		content, err := io.ReadAll(r.Body)
+		if err != nil || upload == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		digest := r.URL.Query().Get("digest")
+		if digest != sha256Digest(content) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err = registry.writeBlob(content); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err = writeLink(filepath.Join(registry.repo(name), "_layers"), digest); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (registry *testRegistry) blob(w http.ResponseWriter, r *http.Request, name string, digest string) {
+	if _, err := os.Stat(linkPath(filepath.Join(registry.repo(name), "_layers"), digest)); err != nil || !registry.HasBlob(digest) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	path, _ := blobPath(registry.storage(), digest)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(content)
+	}
+}
+
+func (registry *testRegistry) manifest(w http.ResponseWriter, r *http.Request, name string, reference string) {
+	repo := registry.repo(name)
+	tagged := !strings.Contains(reference, ":")
+	switch r.Method {
+	case http.MethodPut:
+		content, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		digest := sha256Digest(content)
+		if err = registry.writeBlob(content); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err = writeLink(filepath.Join(repo, "_manifests", "revisions"), digest); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if tagged {
+			tag := filepath.Join(repo, "_manifests", "tags", reference)
+			if err = os.MkdirAll(filepath.Join(tag, "current"), 0o755); err == nil {
+				err = os.WriteFile(filepath.Join(tag, "current", "link"), []byte(digest), 0o644)
+			}
+			if err == nil {
+				err = writeLink(filepath.Join(tag, "index"), digest)
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet, http.MethodHead:
+		digest := reference
+		if tagged {
+			link, err := os.ReadFile(filepath.Join(repo, "_manifests", "tags", reference, "current", "link"))
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			digest = string(link)
+		}
+		if _, err := os.Stat(linkPath(filepath.Join(repo, "_manifests", "revisions"), digest)); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		path, _ := blobPath(registry.storage(), digest)
+		content, err := os.ReadFile(path)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		references := manifestReferences{}
+		_ = json.Unmarshal(content, &references)
+		mediaType := references.mediaType()
+		if mediaType == mediaTypeDocker1Manifest {
+			mediaType = mediaTypeDocker1ManifestSigned
+		}
+		w.Header().Set("Content-Type", mediaType)
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(content)
+		}
+	case http.MethodDelete:
+		if tagged {
+			if err := os.RemoveAll(filepath.Join(repo, "_manifests", "tags", reference)); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		} else if err := (&DistributionNative{}).deleteManifest(repo, reference); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if registry.CollectAfter > 0 {
+			registry.collecting.Add(1)
+			time.AfterFunc(registry.CollectAfter, registry.collect)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// collect removes the manifests and blobs no tag references
+func (registry *testRegistry) collect() {
+	defer registry.collecting.Done()
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	_, _ = (&DistributionNative{Root: registry.Root}).collect(context.Background(), &gcStats{swept: map[string]int64{}})
+}
+
+// WaitCollected waits until the garbage collections started by deletes finished, usage
+// may drop before a collection removed every blob
+func (registry *testRegistry) WaitCollected() {
+	registry.collecting.Wait()
+}
+
+func (registry *testRegistry) writeBlob(content []byte) error {
+	path, err := blobPath(registry.storage(), sha256Digest(content))
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0o644)
+}
+
+// linkPath is the link file of a digest below a _layers, revisions or tag index directory
+func linkPath(dir string, digest string) string {
+	algorithm, hash, _ := strings.Cut(digest, ":")
+	return filepath.Join(dir, algorithm, hash, "link")
+}
+
+func writeLink(dir string, digest string) error {
+	path := linkPath(dir, digest)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(digest), 0o644)
+}
+
+func sha256Digest(content []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
+
+// writeConfig writes a registry config with the filesystem storage of the registry
+func (registry *testRegistry) writeConfig(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	config := fmt.Sprintf("version: 0.1\nstorage:\n  filesystem:\n    rootdirectory: %s\n  delete:\n    enabled: true\n", registry.Root)
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,323 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	s3DefaultRegion = "us-east-1"
+	s3Algorithm     = "AWS4-HMAC-SHA256"
+	// s3EmptyPayload is the sha256 of the empty body of a list request
+	s3EmptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3 sums the size of the objects below Prefix in an S3 compatible bucket, such as the
+// storage of Distribution with the s3 driver. requests are signed with signature
+// version 4 when AccessKey is set and sent anonymously otherwise. the listed total is
+// kept for ListInterval and corrected by the blobs garbage collection deleted
+type S3 struct {
+	// Endpoint is the url of the object store, e.g. http://minio:9000, the AWS endpoint
+	// of Region is used when it is empty
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// SessionToken is sent as X-Amz-Security-Token with temporary credentials
+	SessionToken string
+	// PathStyle puts the bucket in the path instead of the host name, MinIO and most
+	// self hosted stores need it
+	PathStyle bool
+	// ListInterval is how long a listed total is used before the bucket is listed
+	// again, 0 lists it for every measurement
+	ListInterval time.Duration
+	Client       *http.Client
+
+	listing *s3Listing
+}
+
+// s3Listing is the total of the last listing of the bucket
+type s3Listing struct {
+	lock     sync.Mutex
+	total    int64
+	listedAt time.Time
+	stale    bool
+}
+
+// NewS3 returns an s3 usage provider that keeps the listed total of the bucket in settings
+func NewS3(settings S3) *S3 {
+	settings.listing = &s3Listing{}
+	return &settings
+}
+
+// listBucketResult is the part of a ListObjectsV2 response the usage is summed from
+type listBucketResult struct {
+	Contents []struct {
+		Size int64 `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// Usage returns the listed total while it is younger than ListInterval and lists the
+// bucket again otherwise, concurrent measurements wait for a single listing
+func (s3 *S3) Usage(ctx context.Context) (uint64, error) {
+	if s3.listing == nil {
+		return s3.listTotal(ctx)
+	}
+	listing := s3.listing
+	listing.lock.Lock()
+	defer listing.lock.Unlock()
+	if listing.stale || listing.listedAt.IsZero() || time.Since(listing.listedAt) >= s3.ListInterval {
+		total, err := s3.listTotal(ctx)
+		if err != nil {
+			return 0, err
+		}
+		listing.total, listing.listedAt, listing.stale = int64(total), time.Now(), false
+	}
+	if listing.total < 0 {
+		return 0, nil
+	}
+	return uint64(listing.total), nil
+}
+
+// Accounting reports whether the listed total is kept and corrected by garbage collection
+func (s3 *S3) Accounting() bool {
+	return s3.listing != nil
+}
+
+// Added adds a stored blob to the listed total
+func (s3 *S3) Added(_ string, size int64) {
+	s3.listing.lock.Lock()
+	defer s3.listing.lock.Unlock()
+	s3.listing.total += size
+}
+
+// Freed subtracts the blobs a garbage collection deleted from the listed total, the
+// bucket is listed again when the size of one is unknown
+func (s3 *S3) Freed(blobs map[string]int64) {
+	s3.listing.lock.Lock()
+	defer s3.listing.lock.Unlock()
+	for _, size := range blobs {
+		if size < 0 {
+			s3.listing.stale = true
+			return
+		}
+		s3.listing.total -= size
+	}
+}
+
+// Stale makes the next measurement list the bucket
+func (s3 *S3) Stale() {
+	s3.listing.lock.Lock()
+	defer s3.listing.lock.Unlock()
+	s3.listing.stale = true
+}
+
+// listTotal lists every object below Prefix, one request per 1000 objects
+func (s3 *S3) listTotal(ctx context.Context) (uint64, error) {
+	var size uint64
+	token := ""
+	for {
+		page, err := s3.list(ctx, token)
+		if err != nil {
+			return 0, err
+		}
+		for _, object := range page.Contents {
+			size += uint64(object.Size)
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return size, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s3 *S3) region() string {
+	if s3.Region == "" {
+		return s3DefaultRegion
+	}
+	return s3.Region
+}
+
+// bucketURL returns the url of the bucket in path or virtual host style
+func (s3 *S3) bucketURL() (*url.URL, error) {
+	endpoint := s3.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s3.region())
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("s3 endpoint %q must be an absolute url", s3.Endpoint)
+	}
+	if s3.PathStyle {
+		u.Path = "/" + s3.Bucket
+	} else {
+		u.Host = s3.Bucket + "." + u.Host
+		u.Path = "/"
+	}
+	return u, nil
+}
+
+// list requests a page of ListObjectsV2 starting at a continuation token
+func (s3 *S3) list(ctx context.Context, token string) (*listBucketResult, error) {
+	u, err := s3.bucketURL()
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	query.Set("list-type", "2")
+	if prefix := strings.TrimPrefix(s3.Prefix, "/"); prefix != "" {
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		query.Set("prefix", prefix)
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	s3.sign(req, time.Now().UTC())
+
+	client := s3.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		failure := s3Error{}
+		if xml.Unmarshal(body, &failure) == nil && failure.Code != "" {
+			return nil, fmt.Errorf("unable to list s3 bucket %s: %s: %s", s3.Bucket, failure.Code, failure.Message)
+		}
+		return nil, fmt.Errorf("unable to list s3 bucket %s: %s", s3.Bucket, res.Status)
+	}
+	result := &listBucketResult{}
+	if err = xml.Unmarshal(body, result); err != nil {
+		return nil, fmt.Errorf("unable to parse the listing of s3 bucket %s: %w", s3.Bucket, err)
+	}
+	return result, nil
+}
+
+// sign adds an AWS signature version 4 authorization header to a request, the payload
+// hash is read from x-amz-content-sha256 and defaults to the hash of an empty body
+func (s3 *S3) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("x-amz-date", amzDate)
+	payload := req.Header.Get("x-amz-content-sha256")
+	if payload == "" {
+		payload = s3EmptyPayload
+		req.Header.Set("x-amz-content-sha256", payload)
+	}
+	if s3.AccessKey == "" {
+		return
+	}
+	if s3.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", s3.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+
+	date := amzDate[:8]
+	scope := strings.Join([]string{date, s3.region(), "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{s3Algorithm, amzDate, scope, sha256Hex(canonicalRequest)}, "\n")
+
+	key := []byte("AWS4" + s3.SecretKey)
+	for _, part := range []string{date, s3.region(), "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s3.AccessKey, scope, signedHeaders, signature))
+}
+
+// canonicalQuery encodes a query with sorted keys and spaces as %20 as signature
+// version 4 expects
+func canonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+func sha256Hex(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,105 @@
+//go:build minio
+
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// the tests in this file run against MinIO with go test -tags minio, e.g. started with
+// docker run -p 9000:9000 minio/minio server /data. LRU_TEST_MINIO_ENDPOINT,
+// LRU_TEST_MINIO_ACCESS_KEY and LRU_TEST_MINIO_SECRET_KEY default to that container,
+// LRU_TEST_MINIO_SESSION_TOKEN with temporary credentials in the key variables tests
+// X-Amz-Security-Token
+
+func minioEnv(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// minioRequest sends a signed request to MinIO
+func minioRequest(t *testing.T, s3 *S3, method string, path string, body []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, s3.Endpoint+"/"+s3.Bucket+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("x-amz-content-sha256", sha256Hex(string(body)))
+	s3.sign(req, time.Now().UTC())
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 && res.StatusCode != http.StatusConflict {
+		message, _ := io.ReadAll(res.Body)
+		t.Fatalf("%s %s: %s: %s", method, path, res.Status, message)
+	}
+}
+
+func TestS3MinIO(t *testing.T) {
+	settings := S3{
+		Endpoint:     minioEnv("LRU_TEST_MINIO_ENDPOINT", "http://127.0.0.1:9000"),
+		Bucket:       fmt.Sprintf("lru-test-%d", time.Now().UnixNano()),
+		Prefix:       "registry",
+		AccessKey:    minioEnv("LRU_TEST_MINIO_ACCESS_KEY", "minioadmin"),
+		SecretKey:    minioEnv("LRU_TEST_MINIO_SECRET_KEY", "minioadmin"),
+		SessionToken: os.Getenv("LRU_TEST_MINIO_SESSION_TOKEN"),
+		PathStyle:    true,
+		ListInterval: time.Hour,
+	}
+	minioRequest(t, &settings, http.MethodPut, "", nil)
+
+	// more objects than one page, and one outside the prefix
+	var expected uint64
+	for i := 0; i < 1005; i++ {
+		content := bytes.Repeat([]byte{'x'}, i%7+1)
+		minioRequest(t, &settings, http.MethodPut, fmt.Sprintf("/registry/docker/registry/v2/blobs/%04d/data", i), content)
+		expected += uint64(len(content))
+	}
+	minioRequest(t, &settings, http.MethodPut, "/other/data", []byte("other"))
+
+	s3 := NewS3(settings)
+	usage, err := s3.Usage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage != expected {
+		t.Errorf("expected usage %d, got %d", expected, usage)
+	}
+
+	anonymous := NewS3(S3{Endpoint: settings.Endpoint, Bucket: settings.Bucket, PathStyle: true})
+	if _, err := anonymous.Usage(context.Background()); err == nil {
+		t.Error("expected an anonymous listing of a private bucket to fail")
+	}
+	wrongKey := settings
+	wrongKey.SecretKey += "x"
+	if _, err := NewS3(wrongKey).Usage(context.Background()); err == nil {
+		t.Error("expected a listing with the wrong secret key to fail")
+	}
+}
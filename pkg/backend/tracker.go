@@ -0,0 +1,501 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Accounting is implemented by usage providers that are told about changes to the
+// storage instead of measuring it for every request
+type Accounting interface {
+	// Accounting reports whether usage is tracked from the changes it is told about
+	Accounting() bool
+	// Added accounts a blob or manifest written to the storage
+	Added(digest string, size int64)
+	// Freed accounts the blobs and manifests garbage collection deleted, keyed by
+	// digest. a negative size is the size the blob was accounted or walked with
+	Freed(blobs map[string]int64)
+	// Stale makes the next measurement walk the storage, for garbage collections that
+	// freed an unknown number of bytes
+	Stale()
+}
+
+// accounting returns the usage provider when it tracks usage from the changes it is told about
+func accounting(usage UsageProvider) (Accounting, bool) {
+	accounting, ok := usage.(Accounting)
+	if !ok || !accounting.Accounting() {
+		return nil, false
+	}
+	return accounting, true
+}
+
+// accountFreed tells an accounting usage provider about the blobs a garbage collection
+// deleted, nil when they are unknown
+func accountFreed(usage UsageProvider, blobs map[string]int64) {
+	if accounting, ok := accounting(usage); ok {
+		if blobs == nil {
+			accounting.Stale()
+		} else {
+			accounting.Freed(blobs)
+		}
+	}
+}
+
+// Tracker keeps the size of the files below Dir in memory so usage is known without
+// walking the storage. it is seeded with a concurrent walk and kept up to date from
+// inotify events, or from Added and Freed when the directories cannot all be watched,
+// and walks the storage again every Rescan to correct drift
+type Tracker struct {
+	Dir string
+	// Root is the rootdirectory of the filesystem storage, blobs are accounted at their
+	// path below it
+	Root   string
+	Rescan time.Duration
+	// MaxWatches is the number of directories watched with inotify before usage is
+	// tracked from Added and Freed instead, NewTracker defaults it to half of
+	// fs.inotify.max_user_watches
+	MaxWatches int
+
+	lock    sync.Mutex
+	sizes   *fileSizes
+	watcher *fsnotify.Watcher
+	// pending collects the paths changed while a rescan walks the storage, they are
+	// applied again once the rescan replaced the sizes
+	pending map[string]bool
+	// stale is set when the freed bytes of a garbage collection are unknown
+	stale bool
+	// watches counts the watched directories
+	watches    atomic.Int64
+	rescanLock sync.Mutex
+	rescans    chan struct{}
+	seeded     chan struct{}
+}
+
+// fileSizes holds the size of every file and the number of files below every
+// directory, both keyed by a hash of the path to keep millions of blobs small
+type fileSizes struct {
+	root  string
+	files map[uint64]int64
+	dirs  map[uint64]int
+	total int64
+}
+
+func NewTracker(dir string, root string, rescan time.Duration, maxWatches int) *Tracker {
+	dir = filepath.Clean(dir)
+	if maxWatches == 0 {
+		maxWatches = inotifyWatchLimit() / 2
+	}
+	return &Tracker{
+		Dir:        dir,
+		Root:       root,
+		Rescan:     rescan,
+		MaxWatches: maxWatches,
+		sizes:      newFileSizes(dir),
+		rescans:    make(chan struct{}, 1),
+		seeded:     make(chan struct{}),
+	}
+}
+
+// Run seeds the tracker and applies inotify events and rescans until ctx ends
+func (tracker *Tracker) Run(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		common.Log.Warnf("unable to watch %s, tracking usage from pushes and garbage collection: %v", tracker.Dir, err)
+	} else {
+		tracker.watcher = watcher
+		defer tracker.stopWatching(nil)
+	}
+
+	var events chan fsnotify.Event
+	var watchErrors chan error
+	if watcher != nil {
+		events, watchErrors = watcher.Events, watcher.Errors
+	}
+	go func() {
+		tracker.rescan(ctx, false)
+		close(tracker.seeded)
+	}()
+
+	ticker := time.NewTicker(tracker.Rescan)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			go tracker.rescan(ctx, false)
+		case <-tracker.rescans:
+			go tracker.rescan(ctx, false)
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			tracker.handle(event)
+		case err, ok := <-watchErrors:
+			if !ok {
+				watchErrors = nil
+				continue
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				common.Log.Warnf("usage tracker missed inotify events, rescanning %s", tracker.Dir)
+				tracker.requestRescan()
+			} else {
+				common.LogIfError(err)
+			}
+		}
+	}
+}
+
+// Usage returns the tracked usage, it waits for the seeding walk and walks the storage
+// again only when a garbage collection freed an unknown number of bytes
+func (tracker *Tracker) Usage(ctx context.Context) (uint64, error) {
+	select {
+	case <-tracker.seeded:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	tracker.rescan(ctx, true)
+
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	if tracker.sizes.total < 0 {
+		return 0, nil
+	}
+	return uint64(tracker.sizes.total), nil
+}
+
+// Tracked returns the usage held in memory without walking stale directories, it
+// reports false until the first walk finished
+func (tracker *Tracker) Tracked() (uint64, bool) {
+	select {
+	case <-tracker.seeded:
+	default:
+		return 0, false
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	if tracker.sizes.total < 0 {
+		return 0, true
+	}
+	return uint64(tracker.sizes.total), true
+}
+
+func (tracker *Tracker) Free(_ context.Context) (uint64, error) {
+	return freeOnDisk(tracker.Dir)
+}
+
+// Watching reports whether the storage is watched with inotify
+func (tracker *Tracker) Watching() bool {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	return tracker.watcher != nil
+}
+
+// Accounting reports whether usage is tracked from pushes and garbage collection
+func (tracker *Tracker) Accounting() bool {
+	return !tracker.Watching()
+}
+
+// Added accounts a pushed blob or manifest at its path in the storage while the storage
+// is not watched, a blob pushed again is counted once
+func (tracker *Tracker) Added(digest string, size int64) {
+	path, err := blobPath(tracker.storage(), digest)
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	switch {
+	case tracker.watcher != nil:
+	case err != nil:
+		tracker.sizes.total += size
+	default:
+		tracker.sizes.set(path, size)
+	}
+}
+
+// Freed accounts the blobs a garbage collection deleted while the storage is not
+// watched. a blob is removed at its path in the storage, blobs the tracker never saw
+// there are subtracted by their size
+func (tracker *Tracker) Freed(blobs map[string]int64) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	if tracker.watcher != nil {
+		return
+	}
+	for digest, size := range blobs {
+		if path, err := blobPath(tracker.storage(), digest); err == nil && tracker.sizes.tracked(path) {
+			tracker.sizes.remove(path)
+		} else if size > 0 {
+			tracker.sizes.total -= size
+		}
+	}
+}
+
+// Stale makes the next measurement walk the storage while it is not watched
+func (tracker *Tracker) Stale() {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	if tracker.watcher == nil {
+		tracker.stale = true
+	}
+}
+
+func (tracker *Tracker) storage() string {
+	root := tracker.Root
+	if root == "" {
+		root = tracker.Dir
+	}
+	return filepath.Join(root, "docker", "registry", "v2")
+}
+
+func (tracker *Tracker) requestRescan() {
+	select {
+	case tracker.rescans <- struct{}{}:
+	default:
+	}
+}
+
+// rescan walks the storage and replaces the tracked sizes, with onlyStale it only
+// walks when the usage is stale
+func (tracker *Tracker) rescan(ctx context.Context, onlyStale bool) {
+	tracker.rescanLock.Lock()
+	defer tracker.rescanLock.Unlock()
+
+	tracker.lock.Lock()
+	if onlyStale && !tracker.stale {
+		tracker.lock.Unlock()
+		return
+	}
+	tracker.pending = map[string]bool{}
+	tracker.lock.Unlock()
+
+	startTime := time.Now()
+	scanned := newFileSizes(tracker.Dir)
+	var scannedLock sync.Mutex
+	tracker.watches.Store(0)
+	failures := walk(ctx, tracker.Dir, tracker.watch, func(path string, size int64) {
+		scannedLock.Lock()
+		scanned.set(path, size)
+		scannedLock.Unlock()
+	})
+	if ctx.Err() != nil {
+		tracker.lock.Lock()
+		tracker.pending = nil
+		tracker.lock.Unlock()
+		return
+	}
+
+	tracker.lock.Lock()
+	drift := scanned.total - tracker.sizes.total
+	seeding := tracker.seeding()
+	tracker.sizes = scanned
+	tracker.stale = false
+	pending := tracker.pending
+	tracker.pending = nil
+	watching := tracker.watcher != nil
+	tracker.lock.Unlock()
+
+	for path := range pending {
+		tracker.apply(path)
+	}
+
+	mode := "from pushes and garbage collection"
+	if watching {
+		mode = fmt.Sprintf("with inotify on %d directories", tracker.watches.Load())
+	}
+	duration := time.Since(startTime).Round(time.Millisecond)
+	if seeding {
+		common.Log.Infof("usage of %s is %d bytes in %d files, walked in %s, tracking %s",
+			tracker.Dir, scanned.total, len(scanned.files), duration, mode)
+	} else {
+		common.Log.Infof("usage rescan of %s found %d bytes in %d files in %s, drift %d bytes, tracking %s",
+			tracker.Dir, scanned.total, len(scanned.files), duration, drift, mode)
+	}
+	if failures > 0 {
+		common.Log.Warnf("usage rescan skipped %d unreadable directories in %s", failures, tracker.Dir)
+	}
+}
+
+// watch adds an inotify watch for a directory, tracking falls back to accounting when
+// MaxWatches directories are watched or the inotify watch limit is reached
+func (tracker *Tracker) watch(dir string) {
+	tracker.lock.Lock()
+	watcher := tracker.watcher
+	tracker.lock.Unlock()
+	if watcher == nil {
+		return
+	}
+	if tracker.MaxWatches > 0 && tracker.watches.Load() >= int64(tracker.MaxWatches) {
+		tracker.stopWatching(fmt.Errorf("more than %d directories, raise --usage-max-watches and fs.inotify.max_user_watches to watch them all", tracker.MaxWatches))
+		return
+	}
+	if err := watcher.Add(dir); err != nil {
+		if errors.Is(err, syscall.ENOSPC) {
+			tracker.stopWatching(fmt.Errorf("inotify watch limit reached, raise fs.inotify.max_user_watches: %w", err))
+		} else {
+			common.Log.Debugf("unable to watch %s: %v", dir, err)
+		}
+		return
+	}
+	tracker.watches.Add(1)
+}
+
+// inotifyWatchLimit returns fs.inotify.max_user_watches, 0 when it is unknown
+func inotifyWatchLimit() int {
+	limit, err := os.ReadFile("/proc/sys/fs/inotify/max_user_watches")
+	if err != nil {
+		return 0
+	}
+	watches, _ := strconv.Atoi(strings.TrimSpace(string(limit)))
+	return watches
+}
+
+// seeding reports whether the first walk of the storage is running
+func (tracker *Tracker) seeding() bool {
+	select {
+	case <-tracker.seeded:
+		return false
+	default:
+		return true
+	}
+}
+
+// stopWatching closes the inotify watcher, usage is tracked from pushes and garbage
+// collection afterwards
+func (tracker *Tracker) stopWatching(reason error) {
+	tracker.lock.Lock()
+	watcher := tracker.watcher
+	tracker.watcher = nil
+	tracker.lock.Unlock()
+	if watcher == nil {
+		return
+	}
+	if reason != nil {
+		common.Log.Warnf("unable to watch %s, tracking usage from pushes and garbage collection: %v", tracker.Dir, reason)
+	}
+	common.LogIfError(watcher.Close())
+}
+
+// handle applies an inotify event
+func (tracker *Tracker) handle(event fsnotify.Event) {
+	tracker.lock.Lock()
+	if tracker.pending != nil {
+		tracker.pending[event.Name] = true
+	}
+	watcher := tracker.watcher
+	tracker.lock.Unlock()
+	if event.Has(fsnotify.Rename) && watcher != nil {
+		// inotify keeps watching a directory moved out of the storage
+		_ = watcher.Remove(event.Name)
+	}
+	tracker.apply(event.Name)
+}
+
+// apply updates the tracked size of a path from the filesystem
+func (tracker *Tracker) apply(path string) {
+	info, err := os.Lstat(path)
+	switch {
+	case err != nil:
+		tracker.lock.Lock()
+		movedOut := tracker.sizes.remove(path)
+		tracker.lock.Unlock()
+		if movedOut {
+			// the files of a directory moved out of the storage are only found by a rescan
+			tracker.requestRescan()
+		}
+	case info.IsDir():
+		// a directory created or moved into the storage
+		walk(context.Background(), path, tracker.watch, func(path string, size int64) {
+			tracker.lock.Lock()
+			tracker.sizes.set(path, size)
+			tracker.lock.Unlock()
+		})
+	case info.Mode().IsRegular():
+		tracker.lock.Lock()
+		tracker.sizes.set(path, info.Size())
+		tracker.lock.Unlock()
+	}
+}
+
+func newFileSizes(root string) *fileSizes {
+	return &fileSizes{
+		root:  root,
+		files: map[uint64]int64{},
+		dirs:  map[uint64]int{},
+	}
+}
+
+func (sizes *fileSizes) set(path string, size int64) {
+	key := pathKey(path)
+	previous, tracked := sizes.files[key]
+	sizes.files[key] = size
+	sizes.total += size - previous
+	if !tracked {
+		sizes.count(path, 1)
+	}
+}
+
+// tracked reports whether the size of a file is tracked
+func (sizes *fileSizes) tracked(path string) bool {
+	_, tracked := sizes.files[pathKey(path)]
+	return tracked
+}
+
+// remove forgets a removed file, it reports whether path was a directory that still
+// holds tracked files
+func (sizes *fileSizes) remove(path string) bool {
+	key := pathKey(path)
+	if size, tracked := sizes.files[key]; tracked {
+		delete(sizes.files, key)
+		sizes.total -= size
+		sizes.count(path, -1)
+		return false
+	}
+	return sizes.dirs[key] > 0
+}
+
+// count adds delta to the file count of every directory holding path
+func (sizes *fileSizes) count(path string, delta int) {
+	for dir := filepath.Dir(path); len(dir) > len(sizes.root); dir = filepath.Dir(dir) {
+		key := pathKey(dir)
+		if count := sizes.dirs[key] + delta; count > 0 {
+			sizes.dirs[key] = count
+		} else {
+			delete(sizes.dirs, key)
+		}
+	}
+}
+
+func pathKey(path string) uint64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(path))
+	return hash.Sum64()
+}
@@ -0,0 +1,110 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+// accountingTracker returns a seeded tracker of the storage of registry that tracks
+// usage from pushes and garbage collection because it may watch a single directory
+func accountingTracker(t *testing.T, ctx context.Context, registry *testRegistry) *Tracker {
+	t.Helper()
+	tracker := NewTracker(registry.Root, registry.Root, time.Hour, 1)
+	go tracker.Run(ctx)
+	if _, err := tracker.Usage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !tracker.Accounting() {
+		t.Fatal("expected the tracker to stop watching after one directory")
+	}
+	return tracker
+}
+
+// checkFreed checks that the tracker subtracted the garbage blobs from usage without
+// walking the storage again
+func checkFreed(t *testing.T, ctx context.Context, tracker *Tracker, garbageBytes uint64, before uint64) {
+	t.Helper()
+	tracker.lock.Lock()
+	stale := tracker.stale
+	tracker.lock.Unlock()
+	if stale {
+		t.Error("garbage collection marked the tracker stale")
+	}
+	after, err := tracker.Usage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freed := before - after; freed != garbageBytes {
+		t.Errorf("expected %d bytes freed, tracked %d", garbageBytes, freed)
+	}
+}
+
+func TestTrackerAccountsGarbageCollect(t *testing.T) {
+	for _, name := range []string{TypeDistribution, TypeDistributionNative, TypeAPI} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			registry := newTestRegistry(t)
+			fixture := pushFixture(t, registry)
+			garbage := fixture.garbage
+			if name == TypeAPI {
+				// the api backend accounts configs and layers, the manifest is pushed last
+				garbage = garbage[:len(garbage)-1]
+			}
+			var garbageBytes uint64
+			for _, digest := range garbage {
+				path, err := blobPath(registry.storage(), digest)
+				if err != nil {
+					t.Fatal(err)
+				}
+				info, err := os.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				garbageBytes += uint64(info.Size())
+			}
+			tracker := accountingTracker(t, ctx, registry)
+			before, err := tracker.Usage(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var gc Backend
+			switch name {
+			case TypeDistribution:
+				t.Setenv(fakeRegistryEnv, "1")
+				gc = NewDistribution(testRegClient(registry), registry.Host(), os.Args[0], registry.writeConfig(t), tracker)
+			case TypeDistributionNative:
+				gc = NewDistributionNative(testRegClient(registry), registry.Host(), registry.Root, tracker)
+			case TypeAPI:
+				registry.CollectAfter = 50 * time.Millisecond
+				gc = NewAPI(testRegClient(registry), registry.Host(), tracker, 10*time.Millisecond, 10*time.Second)
+			}
+			deleteOldTag(t, ctx, gc)
+			if output, err := gc.GarbageCollect(ctx); err != nil {
+				t.Fatalf("%v: %s", err, output)
+			}
+			registry.WaitCollected()
+			fixture.check(t, registry)
+			checkFreed(t, ctx, tracker, garbageBytes, before)
+		})
+	}
+}
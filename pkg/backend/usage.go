@@ -0,0 +1,109 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	UsageStatfs = "statfs"
+	UsageWalk   = "walk"
+	UsageS3     = "s3"
+	UsageCache  = "cache"
+)
+
+// UsageTypes are the usage providers a backend can measure the registry storage with
+var UsageTypes = []string{UsageStatfs, UsageWalk, UsageS3, UsageCache}
+
+// UsageProvider measures the bytes used by the registry storage
+type UsageProvider interface {
+	Usage(ctx context.Context) (uint64, error)
+}
+
+// FreeSpace reports the bytes the registry storage can still grow by, it is
+// implemented by the usage providers that measure a local filesystem
+type FreeSpace interface {
+	Free(ctx context.Context) (uint64, error)
+}
+
+// Statfs measures the used bytes of the filesystem holding Dir, for registries with a
+// disk of their own
+type Statfs struct {
+	Dir string
+}
+
+func (statfs *Statfs) Usage(_ context.Context) (uint64, error) {
+	return sizeOfDisk(statfs.Dir)
+}
+
+func (statfs *Statfs) Free(_ context.Context) (uint64, error) {
+	return freeOnDisk(statfs.Dir)
+}
+
+// DirWalk sums the size of the files below Dir
+type DirWalk struct {
+	Dir string
+}
+
+func (dirWalk *DirWalk) Usage(_ context.Context) (uint64, error) {
+	return sizeOfDir(dirWalk.Dir)
+}
+
+func (dirWalk *DirWalk) Free(_ context.Context) (uint64, error) {
+	return freeOnDisk(dirWalk.Dir)
+}
+
+func sizeOfDisk(path string) (uint64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+
+	usedBytes := (stat.Blocks * uint64(stat.Bsize)) - (stat.Bfree * uint64(stat.Bsize))
+	return usedBytes, nil
+}
+
+// freeOnDisk returns the bytes available to unprivileged users on the filesystem holding path
+func freeOnDisk(path string) (uint64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// sizeOfDir sums the size of the files below path, files and directories that cannot
+// be read are skipped
+func sizeOfDir(path string) (uint64, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+	var size atomic.Int64
+	failures := walk(context.Background(), path, nil, func(_ string, fileSize int64) {
+		size.Add(fileSize)
+	})
+	if failures > 0 {
+		common.Log.Warnf("skipped %d unreadable directories measuring %s", failures, path)
+	}
+	return uint64(size.Load()), nil
+}
@@ -0,0 +1,102 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+)
+
+// walkWorkers is the number of directories read at the same time by a walk
+const walkWorkers = 16
+
+// walker reads the directories below a root concurrently. unreadable directories and
+// files that disappear during the walk are skipped and counted, a walk never fails
+type walker struct {
+	ctx context.Context
+	// visitDir is called before a directory is read
+	visitDir func(dir string)
+	// visitFile is called for every regular file, concurrently
+	visitFile func(path string, size int64)
+
+	workers  chan struct{}
+	wg       sync.WaitGroup
+	failures atomic.Int64
+}
+
+// walk visits every directory and regular file below root, it returns the number of
+// directories and files that could not be read
+func walk(ctx context.Context, root string, visitDir func(dir string), visitFile func(path string, size int64)) int64 {
+	w := &walker{
+		ctx:       ctx,
+		visitDir:  visitDir,
+		visitFile: visitFile,
+		workers:   make(chan struct{}, walkWorkers),
+	}
+	w.wg.Add(1)
+	w.walkDir(root)
+	w.wg.Wait()
+	return w.failures.Load()
+}
+
+func (w *walker) walkDir(dir string) {
+	defer w.wg.Done()
+	if w.ctx.Err() != nil {
+		return
+	}
+	if w.visitDir != nil {
+		w.visitDir(dir)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		common.Log.Debugf("walk: %v", err)
+		w.failures.Add(1)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			w.wg.Add(1)
+			select {
+			case w.workers <- struct{}{}:
+				go func() {
+					defer func() { <-w.workers }()
+					w.walkDir(path)
+				}()
+			default:
+				// every worker is busy, read the directory in this one
+				w.walkDir(path)
+			}
+			continue
+		}
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// removed since the directory was read
+			continue
+		}
+		w.visitFile(path, info.Size())
+	}
+}
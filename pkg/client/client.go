@@ -0,0 +1,217 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/api"
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+)
+
+// Client calls the admin api of a running proxy
+type Client struct {
+	BaseURL    string
+	Token      string
+	HTTPClient *http.Client
+}
+
+// Error is an error response from the admin api
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("admin api responded %d: %s", err.StatusCode, err.Message)
+}
+
+// New returns a client for the proxy at baseURL, tlsConfig may be nil for plain http
+// or the system roots
+func New(baseURL string, token string, tlsConfig *tls.Config) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &Client{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Token:   token,
+		HTTPClient: &http.Client{
+			Transport: transport,
+			Timeout:   time.Minute,
+		},
+	}
+}
+
+// Evict deletes a cached tag from the registry
+func (client *Client) Evict(ctx context.Context, image string) (*api.TagStatus, error) {
+	status := &api.TagStatus{}
+	return status, client.do(ctx, http.MethodPost, "/tags/evict", api.TagRequest{Image: image}, status)
+}
+
+// Pin protects a cached tag from eviction, or removes the protection
+func (client *Client) Pin(ctx context.Context, image string, pinned bool) (*api.TagStatus, error) {
+	status := &api.TagStatus{}
+	return status, client.do(ctx, http.MethodPost, "/tags/pin", api.TagRequest{Image: image, Pinned: pinned}, status)
+}
+
+// Lease protects a cached tag from eviction for a duration, a zero duration clears the lease
+func (client *Client) Lease(ctx context.Context, image string, duration time.Duration) (*api.TagStatus, error) {
+	status := &api.TagStatus{}
+	request := api.TagRequest{Image: image, Duration: duration.String()}
+	return status, client.do(ctx, http.MethodPost, "/tags/lease", request, status)
+}
+
+// RunCleanup starts a clean cycle, it returns once the clean cycle has started
+func (client *Client) RunCleanup(ctx context.Context) (*api.CleanupStatus, error) {
+	status := &api.CleanupStatus{}
+	return status, client.do(ctx, http.MethodPost, "/cleanup/run", nil, status)
+}
+
+// CancelCleanup stops the clean cycle in progress
+func (client *Client) CancelCleanup(ctx context.Context) (*api.CleanupStatus, error) {
+	status := &api.CleanupStatus{}
+	return status, client.do(ctx, http.MethodPost, "/cleanup/cancel", nil, status)
+}
+
+// CleanupStatus returns the clean cycle in progress and the state of the proxy
+func (client *Client) CleanupStatus(ctx context.Context) (*api.CleanupStatus, error) {
+	status := &api.CleanupStatus{}
+	return status, client.do(ctx, http.MethodGet, "/cleanup/status", nil, status)
+}
+
+// ResetBreaker closes the cleanup circuit breaker
+func (client *Client) ResetBreaker(ctx context.Context) (*api.CleanupStatus, error) {
+	status := &api.CleanupStatus{}
+	return status, client.do(ctx, http.MethodPost, "/cleanup/reset-breaker", nil, status)
+}
+
+// ReadOnly reports whether the proxy rejects pushes and deletes
+func (client *Client) ReadOnly(ctx context.Context) (bool, error) {
+	status := &api.ReadOnlyStatus{}
+	err := client.do(ctx, http.MethodGet, "/readonly", nil, status)
+	return status.Enabled, err
+}
+
+// SetReadOnly enables or disables read only mode
+func (client *Client) SetReadOnly(ctx context.Context, enabled bool) (bool, error) {
+	status := &api.ReadOnlyStatus{}
+	err := client.do(ctx, http.MethodPut, "/readonly", api.ReadOnlyStatus{Enabled: enabled}, status)
+	return status.Enabled, err
+}
+
+// History returns recorded clean cycles newest first, a limit of 0 returns every clean cycle
+func (client *Client) History(ctx context.Context, limit int) ([]lru.CleanupRun, error) {
+	var runs []lru.CleanupRun
+	return runs, client.do(ctx, http.MethodGet, fmt.Sprintf("/cleanup/history?limit=%d", limit), nil, &runs)
+}
+
+// Plan returns a dry run of a clean cycle
+func (client *Client) Plan(ctx context.Context) (*api.CleanupPlan, error) {
+	plan := &api.CleanupPlan{}
+	return plan, client.do(ctx, http.MethodGet, "/cleanup/plan", nil, plan)
+}
+
+// Forecast returns when usage is forecast to reach the target and fill the disk
+func (client *Client) Forecast(ctx context.Context) (*api.Forecast, error) {
+	forecast := &api.Forecast{}
+	return forecast, client.do(ctx, http.MethodGet, "/usage/forecast", nil, forecast)
+}
+
+// Report returns the usage of each namespace and repository with the activity of the window
+func (client *Client) Report(ctx context.Context, window time.Duration) (*api.UsageReport, error) {
+	report := &api.UsageReport{}
+	return report, client.do(ctx, http.MethodGet, "/usage/report?window="+url.QueryEscape(window.String()), nil, report)
+}
+
+// Backup writes a hot backup of usage.db to w, it fails when the proxy sent fewer bytes
+// than the size of the backup
+func (client *Client) Backup(ctx context.Context, w io.Writer) (int64, error) {
+	res, err := client.send(ctx, http.MethodGet, "/db/backup", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.ContentLength < 0 {
+		return 0, fmt.Errorf("backup response has no content length")
+	}
+	written, err := io.Copy(w, res.Body)
+	if err != nil {
+		return written, err
+	}
+	if written != res.ContentLength {
+		return written, fmt.Errorf("backup is incomplete, received %d of %d bytes", written, res.ContentLength)
+	}
+	return written, nil
+}
+
+func (client *Client) do(ctx context.Context, method string, path string, body interface{}, result interface{}) error {
+	res, err := client.send(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// send calls the admin api and returns the response, error responses are returned as an Error
+func (client *Client) send(ctx context.Context, method string, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, client.BaseURL+api.AdminPrefix+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+client.Token)
+
+	httpClient := client.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		apiError := struct {
+			Error string `json:"error"`
+		}{}
+		if err := json.NewDecoder(res.Body).Decode(&apiError); err != nil || apiError.Error == "" {
+			apiError.Error = res.Status
+		}
+		return nil, &Error{StatusCode: res.StatusCode, Message: apiError.Error}
+	}
+	return res, nil
+}
@@ -0,0 +1,529 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/backend"
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/fsnotify/fsnotify"
+	"github.com/mitchellh/mapstructure"
+	"github.com/robfig/cron/v3"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+const redacted = "<redacted>"
+
+// Config is the configuration of the proxy, every setting can also be provided as a
+// flag or as an LRU_ environment variable named after its key, e.g. LRU_CLEANUP_CRON
+type Config struct {
+	Server        Server        `yaml:"server" mapstructure:"server"`
+	Backend       Backend       `yaml:"backend" mapstructure:"backend"`
+	Cleanup       Cleanup       `yaml:"cleanup" mapstructure:"cleanup"`
+	Policy        Policy        `yaml:"policy" mapstructure:"policy"`
+	Auth          Auth          `yaml:"auth" mapstructure:"auth"`
+	Observability Observability `yaml:"observability" mapstructure:"observability"`
+}
+
+// Server configures the listener of the proxy
+type Server struct {
+	Port                int      `yaml:"port" mapstructure:"port"`
+	Cert                string   `yaml:"cert" mapstructure:"cert"`
+	Key                 string   `yaml:"key" mapstructure:"key"`
+	UseForwardedHeaders bool     `yaml:"use-forwarded-headers" mapstructure:"use-forwarded-headers"`
+	DrainTimeout        Duration `yaml:"drain-timeout" mapstructure:"drain-timeout"`
+	NotReadyDuringGC    bool     `yaml:"not-ready-during-gc" mapstructure:"not-ready-during-gc"`
+}
+
+// Backend locates the registry and usage.db
+type Backend struct {
+	Type           string `yaml:"type" mapstructure:"type"`
+	RegistryHost   string `yaml:"registry-host" mapstructure:"registry-host"`
+	RegistryScheme string `yaml:"registry-scheme" mapstructure:"registry-scheme"`
+	RegistryBinary string `yaml:"registry-bin" mapstructure:"registry-bin"`
+	RegistryConfig string `yaml:"registry-conf" mapstructure:"registry-conf"`
+	RegistryDir    string `yaml:"registry-dir" mapstructure:"registry-dir"`
+	SeparateDisk   bool   `yaml:"separate-disk" mapstructure:"separate-disk"`
+	DatabaseDir    string `yaml:"db-dir" mapstructure:"db-dir"`
+	SnapshotDir    string `yaml:"db-snapshot-dir" mapstructure:"db-snapshot-dir"`
+	SnapshotCron   string `yaml:"db-snapshot-cron" mapstructure:"db-snapshot-cron"`
+	SnapshotKeep   int    `yaml:"db-snapshot-keep" mapstructure:"db-snapshot-keep"`
+	// Supervise runs registry-bin serve registry-conf as a child process of the proxy
+	Supervise            bool     `yaml:"supervise" mapstructure:"supervise"`
+	RegistryStartTimeout Duration `yaml:"registry-start-timeout" mapstructure:"registry-start-timeout"`
+	// RegistryPreflight checks the registry config and that the registry accepts deletes at startup
+	RegistryPreflight bool `yaml:"registry-preflight" mapstructure:"registry-preflight"`
+	// GCPollInterval and GCPollTimeout configure how the api backend waits for the
+	// registry to collect garbage
+	GCPollInterval Duration `yaml:"gc-poll-interval" mapstructure:"gc-poll-interval"`
+	GCPollTimeout  Duration `yaml:"gc-poll-timeout" mapstructure:"gc-poll-timeout"`
+	// Usage selects how the registry storage is measured, statfs with separate-disk and
+	// walk otherwise when empty
+	Usage string `yaml:"usage" mapstructure:"usage"`
+	// UsageRescanInterval corrects the usage tracked in memory for walk, 0 walks for
+	// every measurement
+	UsageRescanInterval Duration `yaml:"usage-rescan-interval" mapstructure:"usage-rescan-interval"`
+	// UsageMaxWatches limits the directories walk watches with inotify, 0 uses half of
+	// fs.inotify.max_user_watches
+	UsageMaxWatches int `yaml:"usage-max-watches" mapstructure:"usage-max-watches"`
+	S3              S3  `yaml:"s3" mapstructure:"s3"`
+}
+
+// S3 locates the bucket measured by the s3 usage provider, the storage.s3 section of
+// registry-conf is used when bucket is empty
+type S3 struct {
+	Endpoint     string `yaml:"endpoint" mapstructure:"endpoint"`
+	Region       string `yaml:"region" mapstructure:"region"`
+	Bucket       string `yaml:"bucket" mapstructure:"bucket"`
+	Prefix       string `yaml:"prefix" mapstructure:"prefix"`
+	AccessKey    string `yaml:"access-key" mapstructure:"access-key"`
+	SecretKey    string `yaml:"secret-key" mapstructure:"secret-key"`
+	SessionToken string `yaml:"session-token" mapstructure:"session-token"`
+	PathStyle    bool   `yaml:"path-style" mapstructure:"path-style"`
+	// ListInterval is how long a listed total is used before the bucket is listed again
+	ListInterval Duration `yaml:"list-interval" mapstructure:"list-interval"`
+}
+
+// Cleanup configures when clean cycles run and how much they remove
+type Cleanup struct {
+	Cron                   string   `yaml:"cron" mapstructure:"cron"`
+	TimeZone               string   `yaml:"timezone" mapstructure:"timezone"`
+	TargetDiskUsage        string   `yaml:"target-disk-usage" mapstructure:"target-disk-usage"`
+	CleanTagsPercentage    float64  `yaml:"clean-tags-percentage" mapstructure:"clean-tags-percentage"`
+	HardDiskLimit          string   `yaml:"hard-disk-limit" mapstructure:"hard-disk-limit"`
+	HardLimitCheckInterval Duration `yaml:"hard-limit-check-interval" mapstructure:"hard-limit-check-interval"`
+	HistoryRetention       Duration `yaml:"history-retention" mapstructure:"history-retention"`
+	HistoryMaxRuns         int      `yaml:"history-max-runs" mapstructure:"history-max-runs"`
+	GCOnShutdown           string   `yaml:"gc-on-shutdown" mapstructure:"gc-on-shutdown"`
+	OfflineGC              bool     `yaml:"offline-gc" mapstructure:"offline-gc"`
+	// ForecastInterval is how often usage is sampled for the forecast, 0 disables it
+	ForecastInterval   Duration `yaml:"forecast-interval" mapstructure:"forecast-interval"`
+	ForecastWindow     Duration `yaml:"forecast-window" mapstructure:"forecast-window"`
+	ForecastReschedule bool     `yaml:"forecast-reschedule" mapstructure:"forecast-reschedule"`
+	ForecastHeadroom   bool     `yaml:"forecast-headroom" mapstructure:"forecast-headroom"`
+}
+
+// Policy configures the eviction limits of a clean cycle
+type Policy struct {
+	MaxEvictTags            int     `yaml:"max-evict-tags" mapstructure:"max-evict-tags"`
+	MaxEvictTagsPercentage  float64 `yaml:"max-evict-tags-percentage" mapstructure:"max-evict-tags-percentage"`
+	MaxEvictBytes           string  `yaml:"max-evict-bytes" mapstructure:"max-evict-bytes"`
+	MaxEvictBytesPercentage float64 `yaml:"max-evict-bytes-percentage" mapstructure:"max-evict-bytes-percentage"`
+	OverrideEvictionLimits  bool    `yaml:"override-eviction-limits" mapstructure:"override-eviction-limits"`
+}
+
+// Auth holds the secrets of the admin api and the notification receiver
+type Auth struct {
+	AdminToken         string `yaml:"admin-token" mapstructure:"admin-token"`
+	NotificationSecret string `yaml:"notification-secret" mapstructure:"notification-secret"`
+}
+
+// Observability configures logging and event sinks
+type Observability struct {
+	Debug                   bool     `yaml:"debug" mapstructure:"debug"`
+	NotificationDedupWindow Duration `yaml:"notification-dedup-window" mapstructure:"notification-dedup-window"`
+	Events                  Events   `yaml:"events" mapstructure:"events"`
+	Reports                 Reports  `yaml:"reports" mapstructure:"reports"`
+}
+
+// Events configures where push, pull, eviction and gc events are sent
+type Events struct {
+	File           string `yaml:"file" mapstructure:"file"`
+	WebhookURL     string `yaml:"webhook-url" mapstructure:"webhook-url"`
+	WebhookSecret  string `yaml:"webhook-secret" mapstructure:"webhook-secret"`
+	WebhookRetries int    `yaml:"webhook-retries" mapstructure:"webhook-retries"`
+	Stdout         bool   `yaml:"stdout" mapstructure:"stdout"`
+}
+
+// Reports configures scheduled usage reports, they are disabled when dir is empty
+type Reports struct {
+	Dir    string   `yaml:"dir" mapstructure:"dir"`
+	Cron   string   `yaml:"cron" mapstructure:"cron"`
+	Window Duration `yaml:"window" mapstructure:"window"`
+	Format string   `yaml:"format" mapstructure:"format"`
+	// ActivityRetention is how long the pulls, pushes and byte-hours of repositories are
+	// kept in usage.db, 0 keeps them forever
+	ActivityRetention Duration `yaml:"activity-retention" mapstructure:"activity-retention"`
+}
+
+// Duration is a time.Duration written as a duration string, e.g. 30s
+type Duration time.Duration
+
+func (duration Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(duration).String(), nil
+}
+
+// flagKeys maps the flags of the proxy to their configuration keys
+var flagKeys = map[string]string{
+	"port":                       "server.port",
+	"cert":                       "server.cert",
+	"key":                        "server.key",
+	"use-forwarded-headers":      "server.use-forwarded-headers",
+	"drain-timeout":              "server.drain-timeout",
+	"not-ready-during-gc":        "server.not-ready-during-gc",
+	"backend":                    "backend.type",
+	"registry-host":              "backend.registry-host",
+	"registry-scheme":            "backend.registry-scheme",
+	"registry-bin":               "backend.registry-bin",
+	"registry-conf":              "backend.registry-conf",
+	"registry-dir":               "backend.registry-dir",
+	"separate-disk":              "backend.separate-disk",
+	"db-dir":                     "backend.db-dir",
+	"db-snapshot-dir":            "backend.db-snapshot-dir",
+	"db-snapshot-cron":           "backend.db-snapshot-cron",
+	"db-snapshot-keep":           "backend.db-snapshot-keep",
+	"supervise-registry":         "backend.supervise",
+	"registry-start-timeout":     "backend.registry-start-timeout",
+	"registry-preflight":         "backend.registry-preflight",
+	"gc-poll-interval":           "backend.gc-poll-interval",
+	"gc-poll-timeout":            "backend.gc-poll-timeout",
+	"usage":                      "backend.usage",
+	"usage-rescan-interval":      "backend.usage-rescan-interval",
+	"usage-max-watches":          "backend.usage-max-watches",
+	"s3-endpoint":                "backend.s3.endpoint",
+	"s3-region":                  "backend.s3.region",
+	"s3-bucket":                  "backend.s3.bucket",
+	"s3-prefix":                  "backend.s3.prefix",
+	"s3-access-key":              "backend.s3.access-key",
+	"s3-secret-key":              "backend.s3.secret-key",
+	"s3-session-token":           "backend.s3.session-token",
+	"s3-list-interval":           "backend.s3.list-interval",
+	"s3-path-style":              "backend.s3.path-style",
+	"cleanup-cron":               "cleanup.cron",
+	"timezone":                   "cleanup.timezone",
+	"target-disk-usage":          "cleanup.target-disk-usage",
+	"clean-tags-percentage":      "cleanup.clean-tags-percentage",
+	"hard-disk-limit":            "cleanup.hard-disk-limit",
+	"hard-limit-check-interval":  "cleanup.hard-limit-check-interval",
+	"history-retention":          "cleanup.history-retention",
+	"history-max-runs":           "cleanup.history-max-runs",
+	"gc-on-shutdown":             "cleanup.gc-on-shutdown",
+	"offline-gc":                 "cleanup.offline-gc",
+	"forecast-interval":          "cleanup.forecast-interval",
+	"forecast-window":            "cleanup.forecast-window",
+	"forecast-reschedule":        "cleanup.forecast-reschedule",
+	"forecast-headroom":          "cleanup.forecast-headroom",
+	"max-evict-tags":             "policy.max-evict-tags",
+	"max-evict-tags-percentage":  "policy.max-evict-tags-percentage",
+	"max-evict-bytes":            "policy.max-evict-bytes",
+	"max-evict-bytes-percentage": "policy.max-evict-bytes-percentage",
+	"override-eviction-limits":   "policy.override-eviction-limits",
+	"admin-token":                "auth.admin-token",
+	"notification-secret":        "auth.notification-secret",
+	"debug":                      "observability.debug",
+	"notification-dedup-window":  "observability.notification-dedup-window",
+	"event-file":                 "observability.events.file",
+	"event-webhook-url":          "observability.events.webhook-url",
+	"event-webhook-secret":       "observability.events.webhook-secret",
+	"event-webhook-retries":      "observability.events.webhook-retries",
+	"event-stdout":               "observability.events.stdout",
+	"report-dir":                 "observability.reports.dir",
+	"report-cron":                "observability.reports.cron",
+	"report-window":              "observability.reports.window",
+	"report-format":              "observability.reports.format",
+	"activity-retention":         "observability.reports.activity-retention",
+}
+
+// Load reads the configuration from the config file, the environment and flags. flags
+// set on the command line take precedence over the environment, the environment over
+// the file and the file over flag defaults. each key is bound to the flag in the first
+// flag set that defines it, the config file is skipped when path is empty
+func Load(path string, flagSets ...*pflag.FlagSet) (*Config, *viper.Viper, error) {
+	v := viper.New()
+	v.SetEnvPrefix("lru")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
+	v.AutomaticEnv()
+
+	for name, key := range flagKeys {
+		for _, flags := range flagSets {
+			if flag := flags.Lookup(name); flag != nil {
+				if err := v.BindPFlag(key, flag); err != nil {
+					return nil, nil, err
+				}
+				break
+			}
+		}
+	}
+
+	if path != "" {
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, nil, fmt.Errorf("unable to read config file %s: %w", path, err)
+		}
+	}
+
+	cfg, err := decode(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, v, nil
+}
+
+// Watch calls reload with the new configuration whenever the config file changes,
+// invalid changes are logged and ignored
+func Watch(v *viper.Viper, reload func(cfg *Config)) {
+	v.OnConfigChange(func(event fsnotify.Event) {
+		cfg, err := decode(v)
+		if err != nil {
+			common.Log.Warnf("ignoring configuration change in %s: %v", event.Name, err)
+			return
+		}
+		common.Log.Infof("configuration changed in %s", event.Name)
+		reload(cfg)
+	})
+	v.WatchConfig()
+}
+
+// decode unmarshals and validates the configuration, unknown keys in the config file are errors
+func decode(v *viper.Viper) (*Config, error) {
+	cfg := &Config{}
+	if err := v.UnmarshalExact(cfg, viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		durationHook,
+		mapstructure.StringToSliceHookFunc(","),
+	))); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// durationHook decodes duration strings into Duration fields
+func durationHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != reflect.TypeOf(Duration(0)) {
+		return data, nil
+	}
+	switch value := data.(type) {
+	case string:
+		duration, err := time.ParseDuration(value)
+		return Duration(duration), err
+	case time.Duration:
+		return Duration(value), nil
+	}
+	return data, nil
+}
+
+// ValidationError lists every invalid setting of a configuration
+type ValidationError []string
+
+func (validation ValidationError) Error() string {
+	return fmt.Sprintf("invalid configuration: %s", strings.Join(validation, "; "))
+}
+
+// Validate checks the configuration, returning a ValidationError listing every invalid setting
+func (cfg *Config) Validate() error {
+	var problems ValidationError
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if cfg.Server.Port < 1 || cfg.Server.Port > 65535 {
+		invalid("server.port %d must be between 1 and 65535", cfg.Server.Port)
+	}
+	if (cfg.Server.Cert == "") != (cfg.Server.Key == "") {
+		invalid("server.cert and server.key must be set together")
+	}
+	if cfg.Server.DrainTimeout < 0 {
+		invalid("server.drain-timeout must not be negative")
+	}
+
+	if cfg.Backend.RegistryHost == "" {
+		invalid("backend.registry-host must be set")
+	}
+	if cfg.Backend.RegistryScheme != "http" && cfg.Backend.RegistryScheme != "https" {
+		invalid("backend.registry-scheme %q must be http or https", cfg.Backend.RegistryScheme)
+	}
+	if cfg.Backend.SnapshotDir != "" {
+		if _, err := cron.ParseStandard(cfg.Backend.SnapshotCron); err != nil {
+			invalid("backend.db-snapshot-cron %q: %v", cfg.Backend.SnapshotCron, err)
+		}
+	}
+	if cfg.Backend.SnapshotKeep < 0 {
+		invalid("backend.db-snapshot-keep must not be negative")
+	}
+	if !contains(backend.Types, cfg.Backend.Type) {
+		invalid("backend.type %q must be one of %s", cfg.Backend.Type, strings.Join(backend.Types, ", "))
+	}
+	if cfg.Backend.Type == backend.TypeAPI {
+		if cfg.Backend.GCPollInterval <= 0 {
+			invalid("backend.gc-poll-interval must be positive")
+		}
+		if cfg.Backend.GCPollTimeout <= 0 {
+			invalid("backend.gc-poll-timeout must be positive")
+		}
+	}
+	if cfg.Backend.Usage != "" && !contains(backend.UsageTypes, cfg.Backend.Usage) {
+		invalid("backend.usage %q must be one of %s", cfg.Backend.Usage, strings.Join(backend.UsageTypes, ", "))
+	}
+	if cfg.Backend.UsageRescanInterval < 0 {
+		invalid("backend.usage-rescan-interval must not be negative")
+	}
+	if cfg.Backend.UsageMaxWatches < 0 {
+		invalid("backend.usage-max-watches must not be negative")
+	}
+	if cfg.Backend.SeparateDisk && cfg.Backend.Usage != "" && cfg.Backend.Usage != backend.UsageStatfs {
+		invalid("backend.separate-disk measures usage with statfs and cannot be used with backend.usage %s", cfg.Backend.Usage)
+	}
+	if cfg.Backend.Usage == backend.UsageS3 && cfg.Backend.Type == backend.TypeDistributionNative {
+		invalid("backend.usage s3 cannot be used with the %s backend, it collects garbage in filesystem storage", backend.TypeDistributionNative)
+	}
+	if cfg.Backend.S3.Endpoint != "" {
+		if u, err := url.Parse(cfg.Backend.S3.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			invalid("backend.s3.endpoint %q must be an absolute url", cfg.Backend.S3.Endpoint)
+		}
+	}
+	if (cfg.Backend.S3.AccessKey == "") != (cfg.Backend.S3.SecretKey == "") {
+		invalid("backend.s3.access-key and backend.s3.secret-key must be set together")
+	}
+	if cfg.Backend.S3.SessionToken != "" && cfg.Backend.S3.AccessKey == "" {
+		invalid("backend.s3.session-token requires backend.s3.access-key and backend.s3.secret-key")
+	}
+	if cfg.Backend.S3.ListInterval < 0 {
+		invalid("backend.s3.list-interval must not be negative")
+	}
+	if cfg.Backend.Supervise && cfg.Backend.RegistryStartTimeout <= 0 {
+		invalid("backend.registry-start-timeout must be positive")
+	}
+
+	if _, err := cron.ParseStandard(cfg.Cleanup.Cron); err != nil {
+		invalid("cleanup.cron %q: %v", cfg.Cleanup.Cron, err)
+	}
+	if _, err := time.LoadLocation(cfg.Cleanup.TimeZone); err != nil {
+		invalid("cleanup.timezone %q: %v", cfg.Cleanup.TimeZone, err)
+	}
+	targetBytes, err := common.ParseByteString(cfg.Cleanup.TargetDiskUsage)
+	if err != nil {
+		invalid("cleanup.target-disk-usage %q: %v", cfg.Cleanup.TargetDiskUsage, err)
+	}
+	if cfg.Cleanup.CleanTagsPercentage < 0 || cfg.Cleanup.CleanTagsPercentage > 100 {
+		invalid("cleanup.clean-tags-percentage %v must be between 0 and 100", cfg.Cleanup.CleanTagsPercentage)
+	}
+	if cfg.Cleanup.HardDiskLimit != "" {
+		if hardLimitBytes, err := common.ParseByteString(cfg.Cleanup.HardDiskLimit); err != nil {
+			invalid("cleanup.hard-disk-limit %q: %v", cfg.Cleanup.HardDiskLimit, err)
+		} else if hardLimitBytes <= targetBytes {
+			invalid("cleanup.hard-disk-limit must be greater than cleanup.target-disk-usage")
+		}
+	}
+	if cfg.Cleanup.HardLimitCheckInterval < 0 {
+		invalid("cleanup.hard-limit-check-interval must not be negative")
+	}
+	if cfg.Cleanup.HistoryRetention < 0 {
+		invalid("cleanup.history-retention must not be negative")
+	}
+	if cfg.Cleanup.HistoryMaxRuns < 0 {
+		invalid("cleanup.history-max-runs must not be negative")
+	}
+	if cfg.Cleanup.GCOnShutdown != "wait" && cfg.Cleanup.GCOnShutdown != "abort" {
+		invalid("cleanup.gc-on-shutdown %q must be wait or abort", cfg.Cleanup.GCOnShutdown)
+	}
+	if cfg.Cleanup.OfflineGC && !cfg.Backend.Supervise {
+		invalid("cleanup.offline-gc requires backend.supervise")
+	}
+	if cfg.Cleanup.OfflineGC && cfg.Backend.Type == backend.TypeAPI {
+		invalid("cleanup.offline-gc cannot be used with the api backend, the registry collects its own garbage")
+	}
+	if cfg.Cleanup.ForecastInterval < 0 {
+		invalid("cleanup.forecast-interval must not be negative")
+	}
+	if cfg.Cleanup.ForecastInterval > 0 && cfg.Cleanup.ForecastWindow < 2*cfg.Cleanup.ForecastInterval {
+		invalid("cleanup.forecast-window must be at least twice cleanup.forecast-interval")
+	}
+	if cfg.Cleanup.ForecastInterval == 0 && (cfg.Cleanup.ForecastReschedule || cfg.Cleanup.ForecastHeadroom) {
+		invalid("cleanup.forecast-reschedule and cleanup.forecast-headroom require cleanup.forecast-interval")
+	}
+
+	if cfg.Policy.MaxEvictTags < 0 {
+		invalid("policy.max-evict-tags must not be negative")
+	}
+	if cfg.Policy.MaxEvictTagsPercentage < 0 || cfg.Policy.MaxEvictTagsPercentage > 100 {
+		invalid("policy.max-evict-tags-percentage %v must be between 0 and 100", cfg.Policy.MaxEvictTagsPercentage)
+	}
+	if cfg.Policy.MaxEvictBytes != "" {
+		if _, err := common.ParseByteString(cfg.Policy.MaxEvictBytes); err != nil {
+			invalid("policy.max-evict-bytes %q: %v", cfg.Policy.MaxEvictBytes, err)
+		}
+	}
+	if cfg.Policy.MaxEvictBytesPercentage < 0 || cfg.Policy.MaxEvictBytesPercentage > 100 {
+		invalid("policy.max-evict-bytes-percentage %v must be between 0 and 100", cfg.Policy.MaxEvictBytesPercentage)
+	}
+
+	if cfg.Observability.NotificationDedupWindow < 0 {
+		invalid("observability.notification-dedup-window must not be negative")
+	}
+	if cfg.Observability.Events.WebhookURL != "" {
+		if u, err := url.Parse(cfg.Observability.Events.WebhookURL); err != nil || u.Scheme == "" || u.Host == "" {
+			invalid("observability.events.webhook-url %q must be an absolute url", cfg.Observability.Events.WebhookURL)
+		}
+	}
+	if cfg.Observability.Events.WebhookRetries < 0 {
+		invalid("observability.events.webhook-retries must not be negative")
+	}
+	if cfg.Observability.Reports.Dir != "" {
+		if _, err := cron.ParseStandard(cfg.Observability.Reports.Cron); err != nil {
+			invalid("observability.reports.cron %q: %v", cfg.Observability.Reports.Cron, err)
+		}
+	}
+	if cfg.Observability.Reports.Window <= 0 {
+		invalid("observability.reports.window must be positive")
+	}
+	if cfg.Observability.Reports.Format != "csv" && cfg.Observability.Reports.Format != "json" {
+		invalid("observability.reports.format %q must be csv or json", cfg.Observability.Reports.Format)
+	}
+	if cfg.Observability.Reports.ActivityRetention < 0 {
+		invalid("observability.reports.activity-retention must not be negative")
+	} else if cfg.Observability.Reports.ActivityRetention > 0 && cfg.Observability.Reports.ActivityRetention < cfg.Observability.Reports.Window {
+		invalid("observability.reports.activity-retention must not be shorter than observability.reports.window")
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration with secrets replaced
+func (cfg Config) Redacted() Config {
+	for _, secret := range []*string{
+		&cfg.Backend.S3.SecretKey,
+		&cfg.Backend.S3.SessionToken,
+		&cfg.Auth.AdminToken,
+		&cfg.Auth.NotificationSecret,
+		&cfg.Observability.Events.WebhookSecret,
+	} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	return cfg
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
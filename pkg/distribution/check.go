@@ -0,0 +1,150 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distribution
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/backend"
+)
+
+// storageSections are the keys of the storage section that do not name the storage driver
+var storageSections = map[string]bool{
+	"delete":      true,
+	"cache":       true,
+	"maintenance": true,
+	"redirect":    true,
+	"tag":         true,
+}
+
+// Settings are the proxy settings a Distribution config has to match
+type Settings struct {
+	Backend        string
+	Usage          string
+	RegistryDir    string
+	RegistryHost   string
+	RegistryScheme string
+	// S3Bucket is the bucket measured by the s3 usage provider
+	S3Bucket string
+}
+
+// Check lists the settings of the config that keep the proxy from deleting tags or
+// measuring the registry, an empty list means the config matches the proxy
+func (cfg *Config) Check(settings Settings) []string {
+	var problems []string
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if enabled, _ := cfg.Storage["delete"]["enabled"].(bool); !enabled {
+		invalid("storage.delete.enabled is not true, the registry rejects the deletes of clean cycles")
+	}
+	if readOnly, ok := cfg.Storage["maintenance"]["readonly"].(map[string]interface{}); ok {
+		if enabled, _ := readOnly["enabled"].(bool); enabled {
+			invalid("storage.maintenance.readonly.enabled is true, the registry rejects the deletes of clean cycles")
+		}
+	}
+
+	driver := cfg.Storage.driver()
+	localUsage := settings.Usage == backend.UsageStatfs || settings.Usage == backend.UsageWalk
+	switch driver {
+	case "":
+		invalid("storage has no driver")
+	case "filesystem":
+		root := cfg.RootDirectory(DefaultRootDirectory)
+		if localUsage && !within(settings.RegistryDir, root) {
+			invalid("storage.filesystem.rootdirectory %s does not contain --registry-dir %s, disk usage is measured in the wrong directory", root, settings.RegistryDir)
+		}
+		if settings.Usage == backend.UsageS3 {
+			invalid("storage driver is filesystem, --usage s3 cannot measure its usage")
+		}
+	default:
+		if settings.Backend == backend.TypeDistributionNative {
+			invalid("storage driver %s is not filesystem, the %s backend only collects garbage in filesystem storage", driver, backend.TypeDistributionNative)
+		}
+		if localUsage {
+			invalid("storage driver %s is not filesystem, --registry-dir cannot measure its usage, use --usage s3 or cache", driver)
+		}
+		if settings.Usage == backend.UsageS3 {
+			if s3, ok := cfg.S3(); !ok {
+				invalid("storage driver %s is not s3, --usage s3 cannot measure its usage", driver)
+			} else if settings.S3Bucket != "" && settings.S3Bucket != s3.Bucket {
+				invalid("storage.s3.bucket %s is not --s3-bucket %s, usage is measured in the wrong bucket", s3.Bucket, settings.S3Bucket)
+			}
+		}
+	}
+
+	if port, ok := hostPort(settings.RegistryHost, settings.RegistryScheme); ok {
+		if _, addrPort, err := net.SplitHostPort(cfg.HTTP.Addr); err != nil {
+			invalid("http.addr %q is not a host:port address: %v", cfg.HTTP.Addr, err)
+		} else if addrPort != port {
+			invalid("http.addr %s does not listen on port %s of --registry-host %s", cfg.HTTP.Addr, port, settings.RegistryHost)
+		}
+	}
+
+	tls := cfg.HTTP.TLS != nil && (cfg.HTTP.TLS.Certificate != "" || len(cfg.HTTP.TLS.LetsEncrypt) > 0)
+	if tls && settings.RegistryScheme != "https" {
+		invalid("http.tls is configured but --registry-scheme is %s", settings.RegistryScheme)
+	} else if !tls && settings.RegistryScheme == "https" {
+		invalid("--registry-scheme is https but http.tls is not configured")
+	}
+	return problems
+}
+
+// Warnings lists the settings of the config that do not keep the proxy from deleting
+// tags but may break the registry once garbage collection runs
+func (cfg *Config) Warnings() []string {
+	var warnings []string
+	if descriptor, ok := cfg.Storage["cache"]["blobdescriptor"].(string); ok && descriptor != "" {
+		warnings = append(warnings, fmt.Sprintf("storage.cache.blobdescriptor is %s, the cache keeps blobs deleted by garbage collection "+
+			"and pushes of those blobs are skipped, leaving manifests with missing layers", descriptor))
+	}
+	return warnings
+}
+
+// driver returns the name of the storage driver
+func (storage Storage) driver() string {
+	for name := range storage {
+		if !storageSections[name] {
+			return name
+		}
+	}
+	return ""
+}
+
+// within reports whether dir is root or a directory below it
+func within(dir string, root string) bool {
+	rel, err := filepath.Rel(filepath.Clean(root), filepath.Clean(dir))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// hostPort returns the port of a registry host, defaulting to the port of the scheme
+func hostPort(host string, scheme string) (string, bool) {
+	if _, port, err := net.SplitHostPort(host); err == nil {
+		return port, true
+	}
+	if host == "" {
+		return "", false
+	}
+	if scheme == "https" {
+		return "443", true
+	}
+	return "80", true
+}
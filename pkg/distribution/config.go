@@ -0,0 +1,196 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distribution
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// DefaultRootDirectory is the filesystem root of Distribution when none is configured
+	DefaultRootDirectory = "/var/lib/registry"
+)
+
+// Config is the part of a Distribution configuration the proxy depends on, other
+// settings are ignored when a config is loaded
+type Config struct {
+	Version       string         `yaml:"version"`
+	Log           *Log           `yaml:"log,omitempty"`
+	Storage       Storage        `yaml:"storage"`
+	HTTP          HTTP           `yaml:"http"`
+	Health        *Health        `yaml:"health,omitempty"`
+	Notifications *Notifications `yaml:"notifications,omitempty"`
+}
+
+type Log struct {
+	Level     string `yaml:"level"`
+	Formatter string `yaml:"formatter"`
+}
+
+// Storage holds the storage driver and the delete, cache, maintenance, redirect and
+// tag sections, each keyed by its name
+type Storage map[string]map[string]interface{}
+
+type HTTP struct {
+	Addr    string              `yaml:"addr"`
+	Headers map[string][]string `yaml:"headers,omitempty"`
+	TLS     *TLS                `yaml:"tls,omitempty"`
+}
+
+type TLS struct {
+	Certificate string                 `yaml:"certificate,omitempty"`
+	Key         string                 `yaml:"key,omitempty"`
+	LetsEncrypt map[string]interface{} `yaml:"letsencrypt,omitempty"`
+}
+
+type Health struct {
+	StorageDriver HealthCheck `yaml:"storagedriver"`
+}
+
+type HealthCheck struct {
+	Enabled   bool   `yaml:"enabled"`
+	Interval  string `yaml:"interval"`
+	Threshold int    `yaml:"threshold"`
+}
+
+type Notifications struct {
+	Endpoints []Endpoint `yaml:"endpoints"`
+}
+
+type Endpoint struct {
+	Name      string              `yaml:"name"`
+	URL       string              `yaml:"url"`
+	Headers   map[string][]string `yaml:"headers,omitempty"`
+	Timeout   string              `yaml:"timeout"`
+	Threshold int                 `yaml:"threshold"`
+	Backoff   string              `yaml:"backoff"`
+}
+
+// Load reads a Distribution config file and applies the REGISTRY_ environment
+// variables Distribution would apply to the settings the proxy checks
+func Load(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err = yaml.Unmarshal(content, cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+	if cfg.Storage == nil {
+		cfg.Storage = Storage{}
+	}
+	cfg.applyEnv()
+	return cfg, nil
+}
+
+func (cfg *Config) applyEnv() {
+	if value, ok := os.LookupEnv("REGISTRY_STORAGE_DELETE_ENABLED"); ok {
+		enabled, _ := strconv.ParseBool(value)
+		cfg.Storage.set("delete", "enabled", enabled)
+	}
+	if value, ok := os.LookupEnv("REGISTRY_STORAGE_FILESYSTEM_ROOTDIRECTORY"); ok {
+		cfg.Storage.set("filesystem", "rootdirectory", value)
+	}
+	if _, ok := cfg.Storage["s3"]; ok {
+		for _, key := range []string{"region", "regionendpoint", "bucket", "rootdirectory", "accesskey", "secretkey", "sessiontoken"} {
+			if value, ok := os.LookupEnv("REGISTRY_STORAGE_S3_" + strings.ToUpper(key)); ok {
+				cfg.Storage.set("s3", key, value)
+			}
+		}
+	}
+	if value, ok := os.LookupEnv("REGISTRY_HTTP_ADDR"); ok {
+		cfg.HTTP.Addr = value
+	}
+	if value, ok := os.LookupEnv("REGISTRY_HTTP_TLS_CERTIFICATE"); ok {
+		if cfg.HTTP.TLS == nil {
+			cfg.HTTP.TLS = &TLS{}
+		}
+		cfg.HTTP.TLS.Certificate = value
+	}
+}
+
+func (storage Storage) set(section string, key string, value interface{}) {
+	if storage[section] == nil {
+		storage[section] = map[string]interface{}{}
+	}
+	storage[section][key] = value
+}
+
+// RootDirectory returns the root of the filesystem storage driver, or fallback when
+// the registry does not use the filesystem driver
+func (cfg *Config) RootDirectory(fallback string) string {
+	if _, ok := cfg.Storage["filesystem"]; !ok {
+		return fallback
+	}
+	if root, _ := cfg.Storage["filesystem"]["rootdirectory"].(string); root != "" {
+		return root
+	}
+	return DefaultRootDirectory
+}
+
+// S3Storage are the settings of the s3 storage driver the bucket usage is measured with
+type S3Storage struct {
+	RegionEndpoint string
+	Region         string
+	Bucket         string
+	RootDirectory  string
+	AccessKey      string
+	SecretKey      string
+	SessionToken   string
+	PathStyle      bool
+}
+
+// S3 returns the settings of the s3 storage driver, false when the registry does not use it
+func (cfg *Config) S3() (S3Storage, bool) {
+	params, ok := cfg.Storage["s3"]
+	if !ok {
+		return S3Storage{}, false
+	}
+	value := func(key string) string {
+		if value, ok := params[key]; ok && value != nil {
+			return fmt.Sprint(value)
+		}
+		return ""
+	}
+	storage := S3Storage{
+		RegionEndpoint: value("regionendpoint"),
+		Region:         value("region"),
+		Bucket:         value("bucket"),
+		RootDirectory:  value("rootdirectory"),
+		AccessKey:      value("accesskey"),
+		SecretKey:      value("secretkey"),
+		SessionToken:   value("sessiontoken"),
+	}
+	// Distribution addresses the bucket in the path when a region endpoint is set,
+	// unless forcepathstyle says otherwise
+	storage.PathStyle = storage.RegionEndpoint != ""
+	if forcePathStyle, err := strconv.ParseBool(value("forcepathstyle")); err == nil {
+		storage.PathStyle = forcePathStyle
+	}
+	return storage, true
+}
+
+// Marshal returns the config as yaml
+func (cfg *Config) Marshal() ([]byte, error) {
+	return yaml.Marshal(cfg)
+}
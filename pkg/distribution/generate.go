@@ -0,0 +1,93 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distribution
+
+import (
+	"fmt"
+	"net"
+)
+
+// GenerateSettings are the proxy settings a Distribution config is generated from
+type GenerateSettings struct {
+	Settings
+	TLSCertificate     string
+	TLSKey             string
+	NotificationURL    string
+	NotificationSecret string
+}
+
+// Generate returns a Distribution config that matches the proxy, with deletes enabled,
+// without a blob descriptor cache that would outlive garbage collection, and with
+// notifications sent to the proxy when a notification secret is set
+func Generate(settings GenerateSettings) (*Config, error) {
+	host, port, err := net.SplitHostPort(settings.RegistryHost)
+	if err != nil {
+		return nil, fmt.Errorf("--registry-host %s is not a host:port address: %w", settings.RegistryHost, err)
+	}
+	// a registry reached through the loopback only listens on the loopback
+	addr := ":" + port
+	if ip := net.ParseIP(host); (ip != nil && ip.IsLoopback()) || host == "localhost" {
+		addr = net.JoinHostPort(host, port)
+	}
+
+	cfg := &Config{
+		Version: "0.1",
+		Log: &Log{
+			Level:     "info",
+			Formatter: "text",
+		},
+		Storage: Storage{
+			"filesystem": {"rootdirectory": settings.RegistryDir},
+			"delete":     {"enabled": true},
+		},
+		HTTP: HTTP{
+			Addr:    addr,
+			Headers: map[string][]string{"X-Content-Type-Options": {"nosniff"}},
+		},
+		Health: &Health{
+			StorageDriver: HealthCheck{
+				Enabled:   true,
+				Interval:  "10s",
+				Threshold: 3,
+			},
+		},
+	}
+
+	if settings.RegistryScheme == "https" {
+		if settings.TLSCertificate == "" || settings.TLSKey == "" {
+			return nil, fmt.Errorf("--registry-scheme https requires a tls certificate and key")
+		}
+		cfg.HTTP.TLS = &TLS{
+			Certificate: settings.TLSCertificate,
+			Key:         settings.TLSKey,
+		}
+	}
+
+	if settings.NotificationSecret != "" {
+		cfg.Notifications = &Notifications{
+			Endpoints: []Endpoint{{
+				Name:      "dockhand-lru-registry",
+				URL:       settings.NotificationURL,
+				Headers:   map[string][]string{"Authorization": {"Bearer " + settings.NotificationSecret}},
+				Timeout:   "5s",
+				Threshold: 5,
+				Backoff:   "10s",
+			}},
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,139 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lru
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	ActivityBucket = []byte("activity")
+)
+
+const (
+	// activityDayFormat prefixes activity keys so they sort by day
+	activityDayFormat = "2006-01-02"
+)
+
+// Activity counts the pulls and pushes of a repository and the byte-hours its tags
+// were stored for
+type Activity struct {
+	Pulls     int64   `json:"pulls,omitempty"`
+	Pushes    int64   `json:"pushes,omitempty"`
+	ByteHours float64 `json:"byteHours,omitempty"`
+}
+
+// activityKey is the day in UTC followed by the repository
+func activityKey(day time.Time, repo string) []byte {
+	return []byte(day.UTC().Format(activityDayFormat) + "/" + repo)
+}
+
+func updateActivity(tx *bolt.Tx, key []byte, update func(activity *Activity)) error {
+	b, err := tx.CreateBucketIfNotExists(ActivityBucket)
+	if err != nil {
+		return err
+	}
+	activity := Activity{}
+	if v := b.Get(key); v != nil {
+		if err := json.Unmarshal(v, &activity); err != nil {
+			return err
+		}
+	}
+	update(&activity)
+	value, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
+
+// AddActivity adds the pulls, pushes and byte-hours of each repository to the activity
+// of the day
+func (cache *Cache) AddActivity(day time.Time, activities map[string]Activity) error {
+	return cache.Db.Update(func(tx *bolt.Tx) error {
+		for repo, added := range activities {
+			err := updateActivity(tx, activityKey(day, repo), func(activity *Activity) {
+				activity.Pulls += added.Pulls
+				activity.Pushes += added.Pushes
+				activity.ByteHours += added.ByteHours
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetActivity sums the activity of each repository from the day of since in UTC
+func (cache *Cache) GetActivity(since time.Time) (map[string]Activity, error) {
+	activities := map[string]Activity{}
+	err := cache.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ActivityBucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(since.UTC().Format(activityDayFormat))); k != nil; k, v = c.Next() {
+			_, repo, ok := strings.Cut(string(k), "/")
+			if !ok {
+				continue
+			}
+			activity := Activity{}
+			if err := json.Unmarshal(v, &activity); err != nil {
+				return err
+			}
+			total := activities[repo]
+			total.Pulls += activity.Pulls
+			total.Pushes += activity.Pushes
+			total.ByteHours += activity.ByteHours
+			activities[repo] = total
+		}
+		return nil
+	})
+	return activities, err
+}
+
+// PruneActivity removes the activity of the days before the day of the cutoff in UTC
+// and returns the number of entries removed
+func (cache *Cache) PruneActivity(cutoff time.Time) (int, error) {
+	pruned := 0
+	err := cache.Db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ActivityBucket)
+		if b == nil {
+			return nil
+		}
+		cutoffKey := cutoff.UTC().Format(activityDayFormat)
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < cutoffKey; k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			pruned++
+		}
+		return nil
+	})
+	return pruned, err
+}
@@ -0,0 +1,103 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lru
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func testCache(t *testing.T) *Cache {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "usage.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	cache := &Cache{Db: db}
+	if err = cache.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func TestActivitySumsDaysFromSince(t *testing.T) {
+	cache := testCache(t)
+	first := time.Date(2024, 3, 1, 23, 30, 0, 0, time.UTC)
+	second := first.Add(time.Hour)
+	for _, add := range []struct {
+		day        time.Time
+		activities map[string]Activity
+	}{
+		{first, map[string]Activity{"team/app": {Pulls: 2, ByteHours: 100}}},
+		{second, map[string]Activity{"team/app": {Pulls: 1, Pushes: 1}, "other": {Pulls: 3}}},
+		{second, map[string]Activity{"team/app": {ByteHours: 50}}},
+	} {
+		if err := cache.AddActivity(add.day, add.activities); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	activities, err := cache.GetActivity(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (Activity{Pulls: 3, Pushes: 1, ByteHours: 150}); activities["team/app"] != expected {
+		t.Errorf("expected %+v for team/app since the first day, got %+v", expected, activities["team/app"])
+	}
+
+	// since is truncated to the day, the first day is excluded from the second day on
+	activities, err = cache.GetActivity(second.Add(12 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (Activity{Pulls: 1, Pushes: 1, ByteHours: 50}); activities["team/app"] != expected {
+		t.Errorf("expected %+v for team/app since the second day, got %+v", expected, activities["team/app"])
+	}
+	if expected := (Activity{Pulls: 3}); activities["other"] != expected {
+		t.Errorf("expected %+v for other, got %+v", expected, activities["other"])
+	}
+}
+
+func TestPruneActivityRemovesDaysBeforeCutoff(t *testing.T) {
+	cache := testCache(t)
+	first := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	second := first.Add(24 * time.Hour)
+	for _, day := range []time.Time{first, second} {
+		if err := cache.AddActivity(day, map[string]Activity{"a": {Pulls: 1}, "b": {Pushes: 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pruned, err := cache.PruneActivity(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 2 {
+		t.Errorf("expected 2 entries pruned, pruned %d", pruned)
+	}
+	activities, err := cache.GetActivity(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if activities["a"].Pulls != 1 || activities["b"].Pushes != 1 {
+		t.Errorf("expected the activity of the second day to be kept, got %+v", activities)
+	}
+}
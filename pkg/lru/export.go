@@ -0,0 +1,200 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lru
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// MergeMode decides how an imported tag is merged with a tag already in the cache
+type MergeMode string
+
+const (
+	// MergeNewest keeps whichever of the imported and cached tag was accessed last
+	MergeNewest MergeMode = "newest"
+	// MergeOverwrite replaces cached tags with the imported tags
+	MergeOverwrite MergeMode = "overwrite"
+)
+
+// Record is the portable state of a cached tag
+type Record struct {
+	Image        string     `json:"image"`
+	AccessTime   time.Time  `json:"accessTime"`
+	Digest       string     `json:"digest,omitempty"`
+	Size         int64      `json:"size,omitempty"`
+	LastAccessor string     `json:"lastAccessor,omitempty"`
+	Pinned       bool       `json:"pinned,omitempty"`
+	LeaseExpiry  *time.Time `json:"leaseExpiry,omitempty"`
+}
+
+// ImportResult counts the records of an import by outcome
+type ImportResult struct {
+	Added   int `json:"added"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"`
+}
+
+// Export returns the state of every cached tag in least recently used order, tags
+// are read from the images bucket so tags missing from the access index are included
+func (cache *Cache) Export() ([]Record, error) {
+	records := []Record{}
+	err := cache.Db.View(func(tx *bolt.Tx) error {
+		imageBucket := tx.Bucket(ImageBucket)
+		if imageBucket == nil {
+			return nil
+		}
+		metadataBucket := tx.Bucket(MetadataBucket)
+		return imageBucket.ForEach(func(k, v []byte) error {
+			record := Record{Image: string(k)}
+			if err := record.AccessTime.UnmarshalText(v); err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+			metadata := Metadata{}
+			if metadataBucket != nil {
+				if value := metadataBucket.Get(k); value != nil {
+					if err := json.Unmarshal(value, &metadata); err != nil {
+						return fmt.Errorf("%s: %w", k, err)
+					}
+				}
+			}
+			record.Digest = metadata.Digest
+			record.Size = metadata.Size
+			record.LastAccessor = metadata.LastAccessor
+			record.Pinned = metadata.Pinned
+			record.LeaseExpiry = metadata.LeaseExpiry
+			records = append(records, record)
+			return nil
+		})
+	})
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].AccessTime.Before(records[j].AccessTime)
+	})
+	return records, err
+}
+
+// Import merges records into the cache in a single transaction. In MergeNewest mode a
+// cached tag is only replaced by a record accessed later, pins are kept from either
+// side and the later lease is kept.
+func (cache *Cache) Import(records []Record, mode MergeMode) (*ImportResult, error) {
+	if mode != MergeNewest && mode != MergeOverwrite {
+		return nil, fmt.Errorf("unsupported merge mode %s, must be %s or %s", mode, MergeNewest, MergeOverwrite)
+	}
+	result := &ImportResult{}
+	err := cache.Db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{ImageBucket, AccessBucket, MetadataBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		for idx, record := range records {
+			if err := importRecord(tx, record, mode, result); err != nil {
+				return fmt.Errorf("record %d %s: %w", idx+1, record.Image, err)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+func importRecord(tx *bolt.Tx, record Record, mode MergeMode, result *ImportResult) error {
+	repo, tag, ok := ParseName(record.Image)
+	if !ok {
+		return fmt.Errorf("image must be repo:tag")
+	}
+	if record.AccessTime.IsZero() {
+		return fmt.Errorf("access time is missing")
+	}
+	image := &Image{Repo: repo, Tag: tag, AccessTime: record.AccessTime.Truncate(time.Second)}
+
+	imageBucket := tx.Bucket(ImageBucket)
+	accessBucket := tx.Bucket(AccessBucket)
+	metadataBucket := tx.Bucket(MetadataBucket)
+	existing := Metadata{}
+	if v := metadataBucket.Get([]byte(image.Name())); v != nil {
+		if err := json.Unmarshal(v, &existing); err != nil {
+			existing = Metadata{}
+		}
+	}
+
+	cached := false
+	if v := imageBucket.Get([]byte(image.Name())); v != nil {
+		cached = true
+		accessTime := time.Time{}
+		if err := accessTime.UnmarshalText(v); err == nil && mode == MergeNewest && !accessTime.Before(image.AccessTime) {
+			result.Skipped++
+			return mergeProtection(tx, image, existing, record)
+		}
+		if name := accessBucket.Get(v); name != nil && string(name) == image.Name() {
+			if err := accessBucket.Delete(v); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := indexAccess(tx, image); err != nil {
+		return err
+	}
+	metadata := Metadata{
+		LastAccessor: record.LastAccessor,
+		Digest:       record.Digest,
+		Size:         record.Size,
+		Pinned:       record.Pinned,
+		LeaseExpiry:  record.LeaseExpiry,
+	}
+	if mode == MergeNewest {
+		metadata = mergedProtection(metadata, existing)
+		if metadata.Size == 0 && metadata.Digest == existing.Digest {
+			metadata.Size = existing.Size
+		}
+	}
+	value, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	if cached {
+		result.Updated++
+	} else {
+		result.Added++
+	}
+	return metadataBucket.Put([]byte(image.Name()), value)
+}
+
+// mergeProtection keeps the pin and the later lease of a record whose access time lost the merge
+func mergeProtection(tx *bolt.Tx, image *Image, existing Metadata, record Record) error {
+	merged := mergedProtection(existing, Metadata{Pinned: record.Pinned, LeaseExpiry: record.LeaseExpiry})
+	if merged.Pinned == existing.Pinned && merged.LeaseExpiry == existing.LeaseExpiry {
+		return nil
+	}
+	return updateMetadata(tx, image, func(metadata *Metadata) {
+		metadata.Pinned = merged.Pinned
+		metadata.LeaseExpiry = merged.LeaseExpiry
+	})
+}
+
+// mergedProtection returns metadata pinned if either side is pinned, with the later lease
+func mergedProtection(metadata Metadata, other Metadata) Metadata {
+	metadata.Pinned = metadata.Pinned || other.Pinned
+	if other.LeaseExpiry != nil && (metadata.LeaseExpiry == nil || other.LeaseExpiry.After(*metadata.LeaseExpiry)) {
+		metadata.LeaseExpiry = other.LeaseExpiry
+	}
+	return metadata
+}
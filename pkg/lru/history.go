@@ -0,0 +1,169 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lru
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	HistoryBucket = []byte("history")
+)
+
+const (
+	// historyKeyFormat is fixed width so keys sort by start time
+	historyKeyFormat = "2006-01-02T15:04:05.000000000Z"
+)
+
+// CleanupRun records a single clean cycle
+type CleanupRun struct {
+	Trigger            string              `json:"trigger"`
+	StartTime          time.Time           `json:"startTime"`
+	EndTime            time.Time           `json:"endTime"`
+	StartBytes         uint64              `json:"startBytes"`
+	EndBytes           uint64              `json:"endBytes"`
+	StopReason         string              `json:"stopReason"`
+	Iterations         []CleanupIteration  `json:"iterations"`
+	Evicted            []EvictedTag        `json:"evicted"`
+	DeleteFailures     []DeleteFailure     `json:"deleteFailures"`
+	GarbageCollections []GarbageCollection `json:"garbageCollections"`
+}
+
+// CleanupIteration records the tags removed by an iteration of a clean cycle
+type CleanupIteration struct {
+	Iteration int    `json:"iteration"`
+	Removed   int    `json:"removed"`
+	UsedBytes uint64 `json:"usedBytes"`
+}
+
+// EvictedTag is a tag removed by a clean cycle
+type EvictedTag struct {
+	Image      string    `json:"image"`
+	AccessTime time.Time `json:"accessTime"`
+}
+
+// DeleteFailure is a tag the registry failed to delete
+type DeleteFailure struct {
+	Image string `json:"image"`
+	Error string `json:"error"`
+}
+
+// GarbageCollection records a run of the registry garbage collector
+type GarbageCollection struct {
+	StartTime time.Time     `json:"startTime"`
+	Duration  time.Duration `json:"duration"`
+	Output    string        `json:"output"`
+	Error     string        `json:"error,omitempty"`
+}
+
+func (run *CleanupRun) key() []byte {
+	return []byte(run.StartTime.UTC().Format(historyKeyFormat))
+}
+
+// AddCleanupRun stores a clean cycle in the history bucket
+func (cache *Cache) AddCleanupRun(run *CleanupRun) error {
+	value, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	return cache.Db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(HistoryBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(run.key(), value)
+	})
+}
+
+// GetCleanupRuns returns up to limit clean cycles, newest first, a limit of 0 returns every run
+func (cache *Cache) GetCleanupRuns(limit int) ([]CleanupRun, error) {
+	runs := []CleanupRun{}
+	err := cache.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(HistoryBucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && (limit == 0 || len(runs) < limit); k, v = c.Prev() {
+			run := CleanupRun{}
+			if err := json.Unmarshal(v, &run); err != nil {
+				return err
+			}
+			runs = append(runs, run)
+		}
+		return nil
+	})
+	return runs, err
+}
+
+// TrimCleanupRuns removes the oldest clean cycles beyond the newest keep and returns the
+// number removed
+func (cache *Cache) TrimCleanupRuns(keep int) (int, error) {
+	pruned := 0
+	err := cache.Db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(HistoryBucket)
+		if b == nil {
+			return nil
+		}
+		var keys [][]byte
+		c := b.Cursor()
+		kept := 0
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			if kept < keep {
+				kept++
+				continue
+			}
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			pruned++
+		}
+		return nil
+	})
+	return pruned, err
+}
+
+// PruneCleanupRuns removes clean cycles that started before the cutoff and returns the number removed
+func (cache *Cache) PruneCleanupRuns(cutoff time.Time) (int, error) {
+	pruned := 0
+	err := cache.Db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(HistoryBucket)
+		if b == nil {
+			return nil
+		}
+		cutoffKey := []byte(cutoff.UTC().Format(historyKeyFormat))
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < string(cutoffKey); k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			pruned++
+		}
+		return nil
+	})
+	return pruned, err
+}
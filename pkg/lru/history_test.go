@@ -0,0 +1,47 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lru
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrimCleanupRunsKeepsNewest(t *testing.T) {
+	cache := testCache(t)
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		if err := cache.AddCleanupRun(&CleanupRun{Trigger: "scheduled", StartTime: start.Add(time.Duration(i) * time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pruned, err := cache.TrimCleanupRuns(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 3 {
+		t.Errorf("expected 3 runs pruned, pruned %d", pruned)
+	}
+	runs, err := cache.GetCleanupRuns(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 || !runs[0].StartTime.Equal(start.Add(4*time.Hour)) || !runs[1].StartTime.Equal(start.Add(3*time.Hour)) {
+		t.Errorf("expected the 2 newest runs, got %+v", runs)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lru
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	JournalBucket = []byte("journal")
+
+	journalRunKey      = []byte("run")
+	journalEvictPrefix = []byte("evict:")
+)
+
+// JournalRun records a clean cycle in progress, it remains in the journal when the
+// process dies before the cycle ends
+type JournalRun struct {
+	Trigger   string    `json:"trigger"`
+	StartTime time.Time `json:"startTime"`
+}
+
+// JournalEntry is the intent to evict a tag, written before the tag is deleted from
+// the registry and removed together with the tag from usage.db
+type JournalEntry struct {
+	Image      string    `json:"image"`
+	AccessTime time.Time `json:"accessTime"`
+	Reason     string    `json:"reason"`
+	Time       time.Time `json:"time"`
+}
+
+func journalEvictKey(image *Image) []byte {
+	return append(append([]byte{}, journalEvictPrefix...), image.Name()...)
+}
+
+func putJournal(tx *bolt.Tx, key []byte, value interface{}) error {
+	b, err := tx.CreateBucketIfNotExists(JournalBucket)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, encoded)
+}
+
+func deleteJournal(tx *bolt.Tx, key []byte) error {
+	b := tx.Bucket(JournalBucket)
+	if b == nil {
+		return nil
+	}
+	return b.Delete(key)
+}
+
+// BeginRun records the start of a clean cycle in the journal
+func (cache *Cache) BeginRun(run JournalRun) error {
+	return cache.Db.Update(func(tx *bolt.Tx) error {
+		return putJournal(tx, journalRunKey, run)
+	})
+}
+
+// EndRun removes the clean cycle from the journal
+func (cache *Cache) EndRun() error {
+	return cache.Db.Update(func(tx *bolt.Tx) error {
+		return deleteJournal(tx, journalRunKey)
+	})
+}
+
+// JournalEviction records the intent to evict an image
+func (cache *Cache) JournalEviction(image *Image, reason string) error {
+	return cache.Db.Update(func(tx *bolt.Tx) error {
+		return putJournal(tx, journalEvictKey(image), JournalEntry{
+			Image:      image.Name(),
+			AccessTime: image.AccessTime,
+			Reason:     reason,
+			Time:       time.Now(),
+		})
+	})
+}
+
+// CompleteEviction removes an image deleted from the registry and its eviction intent
+// in a single transaction
+func (cache *Cache) CompleteEviction(image *Image) error {
+	return cache.Db.Update(func(tx *bolt.Tx) error {
+		if err := removeImage(tx, image); err != nil {
+			return err
+		}
+		return deleteJournal(tx, journalEvictKey(image))
+	})
+}
+
+// RollbackEviction removes the eviction intent of an image that is kept
+func (cache *Cache) RollbackEviction(image *Image) error {
+	return cache.Db.Update(func(tx *bolt.Tx) error {
+		return deleteJournal(tx, journalEvictKey(image))
+	})
+}
+
+// Journal returns the interrupted clean cycle, nil if there is none, and the pending
+// eviction intents
+func (cache *Cache) Journal() (*JournalRun, []JournalEntry, error) {
+	var run *JournalRun
+	entries := []JournalEntry{}
+	err := cache.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(JournalBucket)
+		if b == nil {
+			return nil
+		}
+		if v := b.Get(journalRunKey); v != nil {
+			run = &JournalRun{}
+			if err := json.Unmarshal(v, run); err != nil {
+				return err
+			}
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(journalEvictPrefix); k != nil && bytes.HasPrefix(k, journalEvictPrefix); k, v = c.Next() {
+			entry := JournalEntry{}
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return run, entries, err
+}
@@ -17,16 +17,20 @@ limitations under the License.
 package lru
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/boxboat/dockhand-lru-registry/pkg/common"
 	bolt "go.etcd.io/bbolt"
+	"math"
 	"strings"
 	"time"
 )
 
 var (
-	ImageBucket  = []byte("images")
-	AccessBucket = []byte("access")
+	ImageBucket    = []byte("images")
+	AccessBucket   = []byte("access")
+	MetadataBucket = []byte("metadata")
 )
 
 type Cache struct {
@@ -37,6 +41,30 @@ type Image struct {
 	Repo       string
 	Tag        string
 	AccessTime time.Time
+	// Accessor identifies the client that accessed the image, it is stored as
+	// the last accessor when set
+	Accessor string
+}
+
+// Metadata is stored per image alongside the access time
+type Metadata struct {
+	LastAccessor string     `json:"lastAccessor,omitempty"`
+	Digest       string     `json:"digest,omitempty"`
+	Pinned       bool       `json:"pinned,omitempty"`
+	LeaseExpiry  *time.Time `json:"leaseExpiry,omitempty"`
+	// Size is the sum of the manifest and blob sizes of the image, 0 when unknown
+	Size int64 `json:"size,omitempty"`
+}
+
+// Protected reports whether the image must not be evicted and why
+func (metadata *Metadata) Protected(now time.Time) (string, bool) {
+	if metadata.Pinned {
+		return "pinned", true
+	}
+	if metadata.LeaseExpiry != nil && now.Before(*metadata.LeaseExpiry) {
+		return fmt.Sprintf("leased until %s", metadata.LeaseExpiry.Format(time.RFC3339)), true
+	}
+	return "", false
 }
 
 func (image *Image) Name() string {
@@ -57,6 +85,24 @@ func (cache *Cache) Init() error {
 	if err := cache.Db.Update(cache.createBucket(AccessBucket)); err != nil {
 		return err
 	}
+	if err := cache.Db.Update(cache.createBucket(HistoryBucket)); err != nil {
+		return err
+	}
+	if err := cache.Db.Update(cache.createBucket(MetadataBucket)); err != nil {
+		return err
+	}
+	if err := cache.Db.Update(cache.createBucket(StateBucket)); err != nil {
+		return err
+	}
+	if err := cache.Db.Update(cache.createBucket(JournalBucket)); err != nil {
+		return err
+	}
+	if err := cache.Db.Update(cache.createBucket(SampleBucket)); err != nil {
+		return err
+	}
+	if err := cache.Db.Update(cache.createBucket(ActivityBucket)); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -86,35 +132,264 @@ func (cache *Cache) getAccessTime(image *Image) *time.Time {
 
 func (cache *Cache) updateAccessTime(image *Image, oldAccessTime *time.Time) error {
 	_ = cache.Db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(AccessBucket)
-		if err := b.Delete([]byte(oldAccessTime.Format(time.RFC3339))); err != nil {
+		if err := unindexAccess(tx, image, oldAccessTime); err != nil {
 			return err
 		}
-		if err := b.Put([]byte(image.AccessTime.Format(time.RFC3339)), []byte(image.Name())); err != nil {
+		if err := indexAccess(tx, image); err != nil {
 			return err
 		}
-		b = tx.Bucket(ImageBucket)
-		if err := b.Put([]byte(image.Name()), []byte(image.AccessTime.Format(time.RFC3339))); err != nil {
-			return err
-		}
-		return nil
+		return putAccessor(tx, image)
 	})
 	return nil
 }
 
 func (cache *Cache) addImage(image *Image) error {
 	_ = cache.Db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(AccessBucket)
-		if err := b.Put([]byte(image.AccessTime.Format(time.RFC3339)), []byte(image.Name())); err != nil {
+		if err := indexAccess(tx, image); err != nil {
 			return err
 		}
-		b = tx.Bucket(ImageBucket)
-		if err := b.Put([]byte(image.Name()), []byte(image.AccessTime.Format(time.RFC3339))); err != nil {
+		return putAccessor(tx, image)
+	})
+	return nil
+}
+
+// unindexAccess deletes the access index entry of an image at accessTime, unless the
+// entry indexes another image accessed in the same second
+func unindexAccess(tx *bolt.Tx, image *Image, accessTime *time.Time) error {
+	b := tx.Bucket(AccessBucket)
+	key := []byte(accessTime.Format(time.RFC3339))
+	if name := b.Get(key); name == nil || string(name) != image.Name() {
+		return nil
+	}
+	return b.Delete(key)
+}
+
+func putAccessor(tx *bolt.Tx, image *Image) error {
+	if image.Accessor == "" {
+		return nil
+	}
+	return updateMetadata(tx, image, func(metadata *Metadata) {
+		metadata.LastAccessor = image.Accessor
+	})
+}
+
+// updateMetadata applies update to the stored metadata of an image
+func updateMetadata(tx *bolt.Tx, image *Image, update func(metadata *Metadata)) error {
+	b, err := tx.CreateBucketIfNotExists(MetadataBucket)
+	if err != nil {
+		return err
+	}
+	metadata := Metadata{}
+	if v := b.Get([]byte(image.Name())); v != nil {
+		if err := json.Unmarshal(v, &metadata); err != nil {
 			return err
 		}
+	}
+	update(&metadata)
+	value, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(image.Name()), value)
+}
+
+// UpdateMetadata applies update to the stored metadata of an image
+func (cache *Cache) UpdateMetadata(image *Image, update func(metadata *Metadata)) error {
+	return cache.Db.Update(func(tx *bolt.Tx) error {
+		return updateMetadata(tx, image, update)
+	})
+}
+
+// SetDigest records the manifest digest a tag points to, the stored size is cleared
+// when the tag points to a different manifest
+func (cache *Cache) SetDigest(image *Image, digest string) error {
+	return cache.Db.Update(func(tx *bolt.Tx) error {
+		return updateMetadata(tx, image, func(metadata *Metadata) {
+			if metadata.Digest != "" && metadata.Digest != digest {
+				metadata.Size = 0
+			}
+			metadata.Digest = digest
+		})
+	})
+}
+
+// SetSize records the size of a cached tag, it is ignored when the tag was removed or
+// points to a manifest other than digest since it was measured
+func (cache *Cache) SetSize(image *Image, digest string, size int64) error {
+	return cache.Db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(ImageBucket).Get([]byte(image.Name())) == nil {
+			return nil
+		}
+		return updateMetadata(tx, image, func(metadata *Metadata) {
+			if metadata.Digest == digest {
+				metadata.Size = size
+			}
+		})
+	})
+}
+
+// TotalSize sums the stored sizes of the cached tags, tags pointing to the same
+// manifest are counted once as the registry stores its blobs once. unknown counts the tags without a stored size
+func (cache *Cache) TotalSize() (total uint64, unknown int, err error) {
+	err = cache.Db.View(func(tx *bolt.Tx) error {
+		metadataBucket := tx.Bucket(MetadataBucket)
+		counted := map[string]bool{}
+		return tx.Bucket(ImageBucket).ForEach(func(k, _ []byte) error {
+			metadata := Metadata{}
+			if metadataBucket != nil {
+				if v := metadataBucket.Get(k); v != nil {
+					if err := json.Unmarshal(v, &metadata); err != nil {
+						return err
+					}
+				}
+			}
+			if metadata.Size <= 0 {
+				unknown++
+				return nil
+			}
+			if metadata.Digest != "" {
+				if counted[metadata.Digest] {
+					return nil
+				}
+				counted[metadata.Digest] = true
+			}
+			total += uint64(metadata.Size)
+			return nil
+		})
+	})
+	return total, unknown, err
+}
+
+// GetTagsByDigest returns the cached tags of a repository that point to a manifest digest
+func (cache *Cache) GetTagsByDigest(repo string, digest string) []Image {
+	var images []Image
+	_ = cache.Db.View(func(tx *bolt.Tx) error {
+		metadataBucket := tx.Bucket(MetadataBucket)
+		imageBucket := tx.Bucket(ImageBucket)
+		if metadataBucket == nil || imageBucket == nil {
+			return nil
+		}
+		prefix := []byte(repo + ":")
+		c := metadataBucket.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			metadata := Metadata{}
+			if err := json.Unmarshal(v, &metadata); err != nil || metadata.Digest != digest {
+				continue
+			}
+			image := Image{
+				Repo: repo,
+				Tag:  string(k[len(prefix):]),
+			}
+			if access := imageBucket.Get(k); access != nil {
+				if err := image.AccessTime.UnmarshalText(access); err == nil {
+					images = append(images, image)
+				}
+			}
+		}
 		return nil
 	})
-	return nil
+	return images
+}
+
+// GetTagsWithoutDigest returns the cached tags of a repository, or of every repository
+// when repo is empty, whose manifest digest was never recorded
+func (cache *Cache) GetTagsWithoutDigest(repo string) []Image {
+	var images []Image
+	_ = cache.Db.View(func(tx *bolt.Tx) error {
+		metadataBucket := tx.Bucket(MetadataBucket)
+		imageBucket := tx.Bucket(ImageBucket)
+		if metadataBucket == nil || imageBucket == nil {
+			return nil
+		}
+		var prefix []byte
+		if repo != "" {
+			prefix = []byte(repo + ":")
+		}
+		c := imageBucket.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			metadata := Metadata{}
+			if value := metadataBucket.Get(k); value != nil {
+				if err := json.Unmarshal(value, &metadata); err != nil {
+					continue
+				}
+			}
+			if metadata.Digest != "" {
+				continue
+			}
+			name := string(k)
+			separator := strings.LastIndex(name, ":")
+			if separator < 0 {
+				continue
+			}
+			image := Image{Repo: name[:separator], Tag: name[separator+1:]}
+			if err := image.AccessTime.UnmarshalText(v); err == nil {
+				images = append(images, image)
+			}
+		}
+		return nil
+	})
+	return images
+}
+
+// GetAllMetadata returns the stored metadata of every image by name
+func (cache *Cache) GetAllMetadata() map[string]Metadata {
+	all := map[string]Metadata{}
+	_ = cache.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(MetadataBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			metadata := Metadata{}
+			if err := json.Unmarshal(v, &metadata); err != nil {
+				common.LogIfError(err)
+				return nil
+			}
+			all[string(k)] = metadata
+			return nil
+		})
+	})
+	return all
+}
+
+// GetMetadata returns the stored metadata of an image
+func (cache *Cache) GetMetadata(image *Image) Metadata {
+	metadata := Metadata{}
+	_ = cache.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(MetadataBucket)
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(image.Name())); v != nil {
+			if err := json.Unmarshal(v, &metadata); err != nil {
+				common.LogIfError(err)
+				return err
+			}
+		}
+		return nil
+	})
+	return metadata
+}
+
+// Get returns the cached image for a tag and whether it is in the cache
+func (cache *Cache) Get(repo string, tag string) (*Image, bool) {
+	image := &Image{Repo: repo, Tag: tag}
+	found := false
+	_ = cache.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ImageBucket)
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(image.Name())); v != nil {
+			if err := image.AccessTime.UnmarshalText(v); err != nil {
+				common.LogIfError(err)
+				return err
+			}
+			found = true
+		}
+		return nil
+	})
+	return image, found
 }
 
 func (cache *Cache) AddOrUpdate(image *Image) {
@@ -129,25 +404,46 @@ func (cache *Cache) AddOrUpdate(image *Image) {
 
 func (cache *Cache) Remove(image *Image) {
 	_ = cache.Db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(AccessBucket)
-		if err := b.Delete([]byte(image.AccessTime.Format(time.RFC3339))); err != nil {
-			common.LogIfError(err)
-			return err
+		err := removeImage(tx, image)
+		common.LogIfError(err)
+		return err
+	})
+}
+
+// removeImage deletes an image from the access, image and metadata buckets
+func removeImage(tx *bolt.Tx, image *Image) error {
+	if err := unindexAccess(tx, image, &image.AccessTime); err != nil {
+		return err
+	}
+	b := tx.Bucket(ImageBucket)
+	if v := b.Get([]byte(image.Name())); v != nil {
+		accessTime := time.Time{}
+		if err := accessTime.UnmarshalText(v); err == nil {
+			if err := unindexAccess(tx, image, &accessTime); err != nil {
+				return err
+			}
 		}
+	}
+	if err := b.Delete([]byte(image.Name())); err != nil {
+		return err
+	}
 
-		b = tx.Bucket(ImageBucket)
+	if b = tx.Bucket(MetadataBucket); b != nil {
 		if err := b.Delete([]byte(image.Name())); err != nil {
-			common.LogIfError(err)
 			return err
 		}
-		return nil
-	})
+	}
+	return nil
 }
 
 func (cache *Cache) GetLruList() []Image {
 	var images []Image
 	cache.Db.View(func(tx *bolt.Tx) error {
-		c := tx.Bucket(AccessBucket).Cursor()
+		b := tx.Bucket(AccessBucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
 
 		for k, v := c.First(); k != nil; k, v = c.Next() {
 			access := time.Time{}
@@ -162,3 +458,16 @@ func (cache *Cache) GetLruList() []Image {
 	})
 	return images
 }
+
+// SelectRemovals returns the least recently used images removed by an iteration of a
+// clean cycle, a percentage of the images and at least one image after the first
+// iteration, capped at limit images unless limit is negative
+func SelectRemovals(lruImages []Image, percentage float64, iteration int, limit int) []Image {
+	minTagRemoval := math.Min(float64(iteration), 1)
+	percentageTagRemoval := math.Round(float64(len(lruImages)) * percentage)
+	removalTags := int(math.Min(math.Max(percentageTagRemoval, minTagRemoval), float64(len(lruImages))))
+	if limit >= 0 && removalTags > limit {
+		removalTags = limit
+	}
+	return lruImages[:removalTags]
+}
@@ -0,0 +1,303 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lru
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Problem is an inconsistency found in usage.db, or the fix applied to it by a repair
+type Problem struct {
+	Bucket  string `json:"bucket"`
+	Key     string `json:"key"`
+	Problem string `json:"problem"`
+}
+
+// VerifyReport counts the entries of usage.db and lists every problem found
+type VerifyReport struct {
+	Images        int       `json:"images"`
+	AccessEntries int       `json:"accessEntries"`
+	Metadata      int       `json:"metadata"`
+	CleanupRuns   int       `json:"cleanupRuns"`
+	Problems      []Problem `json:"problems"`
+}
+
+func (report *VerifyReport) add(bucket []byte, key []byte, format string, args ...interface{}) {
+	report.Problems = append(report.Problems, Problem{
+		Bucket:  string(bucket),
+		Key:     string(key),
+		Problem: fmt.Sprintf(format, args...),
+	})
+}
+
+// Backup writes a consistent copy of the db to w, it does not block writers
+func (cache *Cache) Backup(w io.Writer) (int64, error) {
+	return cache.BackupWithSize(w, nil)
+}
+
+// BackupWithSize calls size with the size of a consistent copy of the db, then writes
+// the copy to w
+func (cache *Cache) BackupWithSize(w io.Writer, size func(size int64)) (int64, error) {
+	var written int64
+	err := cache.Db.View(func(tx *bolt.Tx) error {
+		if size != nil {
+			size(tx.Size())
+		}
+		var err error
+		written, err = tx.WriteTo(w)
+		return err
+	})
+	return written, err
+}
+
+// BackupFile writes a consistent copy of the db to path, the file is written
+// next to path and renamed into place once complete
+func (cache *Cache) BackupFile(path string) (int64, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+
+	written, err := cache.Backup(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return written, err
+	}
+	return written, os.Rename(file.Name(), path)
+}
+
+// Verify checks that every key and value of usage.db parses and that the images
+// and access buckets index each other
+func (cache *Cache) Verify() (*VerifyReport, error) {
+	report := &VerifyReport{Problems: []Problem{}}
+	err := cache.Db.View(func(tx *bolt.Tx) error {
+		imageBucket := tx.Bucket(ImageBucket)
+		accessBucket := tx.Bucket(AccessBucket)
+		for _, bucket := range [][]byte{ImageBucket, AccessBucket, MetadataBucket, HistoryBucket} {
+			if tx.Bucket(bucket) == nil {
+				report.add(bucket, nil, "bucket missing")
+			}
+		}
+		if imageBucket == nil || accessBucket == nil {
+			return nil
+		}
+
+		_ = imageBucket.ForEach(func(k, v []byte) error {
+			report.Images++
+			if !validName(string(k)) {
+				report.add(ImageBucket, k, "image name is not repo:tag")
+			}
+			accessTime := time.Time{}
+			if err := accessTime.UnmarshalText(v); err != nil {
+				report.add(ImageBucket, k, "unparseable access time %q", v)
+				return nil
+			}
+			if name := accessBucket.Get(v); name == nil {
+				report.add(ImageBucket, k, "access time %s missing from access index", v)
+			} else if string(name) != string(k) {
+				report.add(ImageBucket, k, "access time %s indexes %s", v, name)
+			}
+			return nil
+		})
+
+		_ = accessBucket.ForEach(func(k, v []byte) error {
+			report.AccessEntries++
+			accessTime := time.Time{}
+			if err := accessTime.UnmarshalText(k); err != nil {
+				report.add(AccessBucket, k, "unparseable access time")
+			}
+			if !validName(string(v)) {
+				report.add(AccessBucket, k, "image name %q is not repo:tag", v)
+			} else if imageAccess := imageBucket.Get(v); imageAccess == nil {
+				report.add(AccessBucket, k, "indexes %s which is not in the images bucket", v)
+			} else if string(imageAccess) != string(k) {
+				report.add(AccessBucket, k, "indexes %s which was accessed at %s", v, imageAccess)
+			}
+			return nil
+		})
+
+		if b := tx.Bucket(MetadataBucket); b != nil {
+			_ = b.ForEach(func(k, v []byte) error {
+				report.Metadata++
+				metadata := Metadata{}
+				if err := json.Unmarshal(v, &metadata); err != nil {
+					report.add(MetadataBucket, k, "unparseable metadata: %v", err)
+				}
+				if imageBucket.Get(k) == nil {
+					report.add(MetadataBucket, k, "image is not in the images bucket")
+				}
+				return nil
+			})
+		}
+
+		if b := tx.Bucket(HistoryBucket); b != nil {
+			_ = b.ForEach(func(k, v []byte) error {
+				report.CleanupRuns++
+				if _, err := time.Parse(historyKeyFormat, string(k)); err != nil {
+					report.add(HistoryBucket, k, "unparseable start time")
+				}
+				run := CleanupRun{}
+				if err := json.Unmarshal(v, &run); err != nil {
+					report.add(HistoryBucket, k, "unparseable clean cycle: %v", err)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return report, err
+}
+
+// Repair rebuilds the access index from the images bucket and removes entries
+// that do not parse. Access times are stored with second precision, so tags
+// accessed within the same second are moved forward a second at a time until
+// every tag has its own access index entry. It returns the fixes applied.
+func (cache *Cache) Repair() ([]Problem, error) {
+	report := &VerifyReport{Problems: []Problem{}}
+	err := cache.Db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{ImageBucket, MetadataBucket, HistoryBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		imageBucket := tx.Bucket(ImageBucket)
+		metadataBucket := tx.Bucket(MetadataBucket)
+		historyBucket := tx.Bucket(HistoryBucket)
+
+		var images []Image
+		var invalid [][]byte
+		_ = imageBucket.ForEach(func(k, v []byte) error {
+			accessTime := time.Time{}
+			if err := accessTime.UnmarshalText(v); err != nil || !validName(string(k)) {
+				invalid = append(invalid, append([]byte{}, k...))
+				return nil
+			}
+			repo, tag, _ := ParseName(string(k))
+			images = append(images, Image{Repo: repo, Tag: tag, AccessTime: accessTime})
+			return nil
+		})
+		for _, k := range invalid {
+			report.add(ImageBucket, k, "invalid image removed")
+			if err := imageBucket.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		if tx.Bucket(AccessBucket) != nil {
+			if err := tx.DeleteBucket(AccessBucket); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.CreateBucket(AccessBucket); err != nil {
+			return err
+		}
+		sort.SliceStable(images, func(i, j int) bool {
+			return images[i].AccessTime.Before(images[j].AccessTime)
+		})
+		for _, image := range images {
+			accessTime := image.AccessTime
+			if err := indexAccess(tx, &image); err != nil {
+				return err
+			}
+			if !accessTime.Equal(image.AccessTime) {
+				report.add(ImageBucket, []byte(image.Name()), "access time moved from %s to %s",
+					accessTime.Format(time.RFC3339), image.AccessTime.Format(time.RFC3339))
+			}
+		}
+
+		var orphaned [][]byte
+		_ = metadataBucket.ForEach(func(k, v []byte) error {
+			metadata := Metadata{}
+			if imageBucket.Get(k) == nil || json.Unmarshal(v, &metadata) != nil {
+				orphaned = append(orphaned, append([]byte{}, k...))
+			}
+			return nil
+		})
+		for _, k := range orphaned {
+			report.add(MetadataBucket, k, "orphaned or invalid metadata removed")
+			if err := metadataBucket.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		var invalidRuns [][]byte
+		_ = historyBucket.ForEach(func(k, v []byte) error {
+			run := CleanupRun{}
+			if _, err := time.Parse(historyKeyFormat, string(k)); err != nil || json.Unmarshal(v, &run) != nil {
+				invalidRuns = append(invalidRuns, append([]byte{}, k...))
+			}
+			return nil
+		})
+		for _, k := range invalidRuns {
+			report.add(HistoryBucket, k, "invalid clean cycle removed")
+			if err := historyBucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return report.Problems, err
+}
+
+// indexAccess stores the access time of an image in the images bucket and the
+// access index, moving it forward a second at a time past index entries of other images
+func indexAccess(tx *bolt.Tx, image *Image) error {
+	accessBucket := tx.Bucket(AccessBucket)
+	name := []byte(image.Name())
+	for {
+		indexed := accessBucket.Get([]byte(image.AccessTime.Format(time.RFC3339)))
+		if indexed == nil || string(indexed) == string(name) {
+			break
+		}
+		image.AccessTime = image.AccessTime.Add(time.Second)
+	}
+	key := []byte(image.AccessTime.Format(time.RFC3339))
+	if err := accessBucket.Put(key, name); err != nil {
+		return err
+	}
+	return tx.Bucket(ImageBucket).Put(name, key)
+}
+
+// validName reports whether an image name is repo:tag
+func validName(name string) bool {
+	_, _, ok := ParseName(name)
+	return ok
+}
+
+// ParseName splits an image name into its repository and tag
+func ParseName(name string) (string, string, bool) {
+	separator := strings.LastIndex(name, ":")
+	if separator <= 0 || separator == len(name)-1 || strings.Contains(name[separator:], "/") {
+		return "", "", false
+	}
+	return name[:separator], name[separator+1:], true
+}
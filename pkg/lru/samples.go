@@ -0,0 +1,101 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lru
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	SampleBucket = []byte("samples")
+)
+
+// UsageSample records the usage of the registry at a point in time and the bytes
+// pushed through the proxy since the previous sample
+type UsageSample struct {
+	Time        time.Time `json:"time"`
+	UsedBytes   uint64    `json:"usedBytes"`
+	PushedBytes uint64    `json:"pushedBytes"`
+}
+
+func (sample *UsageSample) key() []byte {
+	return []byte(sample.Time.UTC().Format(historyKeyFormat))
+}
+
+// AddUsageSample stores a usage sample in the samples bucket
+func (cache *Cache) AddUsageSample(sample *UsageSample) error {
+	value, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+	return cache.Db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(SampleBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(sample.key(), value)
+	})
+}
+
+// GetUsageSamples returns the usage samples taken at or after since, oldest first
+func (cache *Cache) GetUsageSamples(since time.Time) ([]UsageSample, error) {
+	samples := []UsageSample{}
+	err := cache.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(SampleBucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(since.UTC().Format(historyKeyFormat))); k != nil; k, v = c.Next() {
+			sample := UsageSample{}
+			if err := json.Unmarshal(v, &sample); err != nil {
+				return err
+			}
+			samples = append(samples, sample)
+		}
+		return nil
+	})
+	return samples, err
+}
+
+// PruneUsageSamples removes usage samples taken before the cutoff and returns the number removed
+func (cache *Cache) PruneUsageSamples(cutoff time.Time) (int, error) {
+	pruned := 0
+	err := cache.Db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(SampleBucket)
+		if b == nil {
+			return nil
+		}
+		cutoffKey := []byte(cutoff.UTC().Format(historyKeyFormat))
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < string(cutoffKey); k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			pruned++
+		}
+		return nil
+	})
+	return pruned, err
+}
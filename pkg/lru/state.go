@@ -0,0 +1,113 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lru
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	StateBucket = []byte("state")
+
+	gcInterruptedKey = []byte("gc-interrupted")
+	breakerKey       = []byte("breaker")
+)
+
+// BreakerState is the reason and time the cleanup circuit breaker tripped
+type BreakerState struct {
+	Reason  string    `json:"reason"`
+	Tripped time.Time `json:"tripped"`
+}
+
+// MarkGarbageCollectionStarted persists that garbage collection started, the marker
+// remains when the run is interrupted or fails so the next startup can run it again
+func (cache *Cache) MarkGarbageCollectionStarted(startTime time.Time) error {
+	return cache.Db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(StateBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(gcInterruptedKey, []byte(startTime.Format(time.RFC3339)))
+	})
+}
+
+// MarkGarbageCollectionFinished removes the marker of a garbage collection that succeeded
+func (cache *Cache) MarkGarbageCollectionFinished() error {
+	return cache.Db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(StateBucket)
+		if b == nil {
+			return nil
+		}
+		return b.Delete(gcInterruptedKey)
+	})
+}
+
+// GarbageCollectionInterrupted returns the start time of a garbage collection that did
+// not finish, if any
+func (cache *Cache) GarbageCollectionInterrupted() (time.Time, bool) {
+	startTime := time.Time{}
+	found := false
+	_ = cache.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(StateBucket)
+		if b == nil {
+			return nil
+		}
+		if v := b.Get(gcInterruptedKey); v != nil {
+			found = startTime.UnmarshalText(v) == nil
+		}
+		return nil
+	})
+	return startTime, found
+}
+
+// SetBreaker persists a tripped circuit breaker, nil removes it once the breaker is reset
+func (cache *Cache) SetBreaker(state *BreakerState) error {
+	return cache.Db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(StateBucket)
+		if err != nil {
+			return err
+		}
+		if state == nil {
+			return b.Delete(breakerKey)
+		}
+		value, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		return b.Put(breakerKey, value)
+	})
+}
+
+// Breaker returns the persisted circuit breaker, nil when it is not tripped
+func (cache *Cache) Breaker() (*BreakerState, error) {
+	var state *BreakerState
+	err := cache.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(StateBucket)
+		if b == nil {
+			return nil
+		}
+		if v := b.Get(breakerKey); v != nil {
+			state = &BreakerState{}
+			return json.Unmarshal(v, state)
+		}
+		return nil
+	})
+	return state, err
+}
@@ -0,0 +1,363 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrate
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/scheme"
+	"github.com/regclient/regclient/types/manifest"
+	"github.com/regclient/regclient/types/ref"
+)
+
+const (
+	pageSize = 1000
+)
+
+// Migrator copies tags from a source registry into the target registry and seeds
+// the target cache with their access times
+type Migrator struct {
+	RegClient  *regclient.RegClient
+	SourceHost string
+	TargetHost string
+	// Cache is the target cache seeded with the access time of every copied tag, it is
+	// not used by a dry run
+	Cache *lru.Cache
+	// SourceCache is the usage.db of the source instance, when nil access times
+	// are taken from the image config created time
+	SourceCache *lru.Cache
+	RepoFilter  *regexp.Regexp
+	TagFilter   *regexp.Regexp
+	Concurrency int
+	// StatePath records migrated tags so an interrupted migration resumes where it stopped
+	StatePath string
+	DryRun    bool
+
+	sourceRecords map[string]lru.Record
+	// done maps the tags migrated by previous runs to the digest they were copied at
+	done      map[string]string
+	stateLock sync.Mutex
+	state     *os.File
+}
+
+// Result counts the tags of a migration by outcome
+type Result struct {
+	Copied   int64 `json:"copied"`
+	UpToDate int64 `json:"upToDate"`
+	Resumed  int64 `json:"resumed"`
+	Failed   int64 `json:"failed"`
+}
+
+// stateEntry is a line of the state file
+type stateEntry struct {
+	Image  string `json:"image"`
+	Digest string `json:"digest"`
+}
+
+// Run migrates every tag of the source registry matching the filters
+func (migrator *Migrator) Run(ctx context.Context) (*Result, error) {
+	if err := migrator.loadState(); err != nil {
+		return nil, err
+	}
+	if migrator.state != nil {
+		defer migrator.state.Close()
+	}
+	migrator.sourceRecords = map[string]lru.Record{}
+	if migrator.SourceCache != nil {
+		records, err := migrator.SourceCache.Export()
+		if err != nil {
+			return nil, fmt.Errorf("reading source usage.db: %w", err)
+		}
+		for _, record := range records {
+			migrator.sourceRecords[record.Image] = record
+		}
+	}
+
+	images, err := migrator.listImages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	common.Log.Infof("migrating %d tags from %s to %s", len(images), migrator.SourceHost, migrator.TargetHost)
+
+	result := &Result{}
+	jobs := make(chan lru.Image)
+	var workers sync.WaitGroup
+	concurrency := migrator.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	for worker := 0; worker < concurrency; worker++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for image := range jobs {
+				migrator.migrateTag(ctx, image, result)
+			}
+		}()
+	}
+	for _, image := range images {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- image
+	}
+	close(jobs)
+	workers.Wait()
+	return result, ctx.Err()
+}
+
+// listImages returns the tags of the source registry matching the filters
+func (migrator *Migrator) listImages(ctx context.Context) ([]lru.Image, error) {
+	var repos []string
+	last := ""
+	for {
+		repoList, err := migrator.RegClient.RepoList(ctx, migrator.SourceHost, scheme.WithRepoLimit(pageSize), scheme.WithRepoLast(last))
+		if err != nil {
+			return nil, err
+		}
+		page, err := repoList.GetRepos()
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, page...)
+		if len(page) < pageSize {
+			break
+		}
+		last = page[len(page)-1]
+	}
+
+	var images []lru.Image
+	for _, repo := range repos {
+		if migrator.RepoFilter != nil && !migrator.RepoFilter.MatchString(repo) {
+			continue
+		}
+		tags, err := migrator.listTags(ctx, repo)
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range tags {
+			if migrator.TagFilter != nil && !migrator.TagFilter.MatchString(tag) {
+				continue
+			}
+			images = append(images, lru.Image{Repo: repo, Tag: tag})
+		}
+	}
+	return images, nil
+}
+
+func (migrator *Migrator) listTags(ctx context.Context, repo string) ([]string, error) {
+	r, err := ref.New(fmt.Sprintf("%s/%s", migrator.SourceHost, repo))
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	last := ""
+	for {
+		tagList, err := migrator.RegClient.TagList(ctx, r, scheme.WithTagLimit(pageSize), scheme.WithTagLast(last))
+		if err != nil {
+			return nil, fmt.Errorf("listing tags of %s: %w", repo, err)
+		}
+		page, err := tagList.GetTags()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, page...)
+		if len(page) < pageSize {
+			return tags, nil
+		}
+		last = page[len(page)-1]
+	}
+}
+
+// migrateTag copies a tag unless the target already has the same manifest, then
+// seeds the target cache with its access time
+func (migrator *Migrator) migrateTag(ctx context.Context, image lru.Image, result *Result) {
+	if digest, ok := migrator.done[image.Name()]; ok {
+		resumed, err := migrator.unchanged(ctx, image, digest)
+		if err != nil {
+			common.Log.Errorf("migrating %s: %v", image.Name(), err)
+			atomic.AddInt64(&result.Failed, 1)
+			return
+		}
+		if resumed {
+			common.Log.Debugf("%s already migrated", image.Name())
+			atomic.AddInt64(&result.Resumed, 1)
+			return
+		}
+		common.Log.Infof("%s changed in the source registry since it was migrated", image.Name())
+	}
+	if err := migrator.copyTag(ctx, image, result); err != nil {
+		common.Log.Errorf("migrating %s: %v", image.Name(), err)
+		atomic.AddInt64(&result.Failed, 1)
+	}
+}
+
+// unchanged reports whether the source registry still has a tag at the digest it was migrated at
+func (migrator *Migrator) unchanged(ctx context.Context, image lru.Image, digest string) (bool, error) {
+	source, err := ref.New(image.CanonicalName(migrator.SourceHost))
+	if err != nil {
+		return false, err
+	}
+	m, err := migrator.RegClient.ManifestHead(ctx, source)
+	if err != nil {
+		return false, err
+	}
+	return m.GetDescriptor().Digest.String() == digest, nil
+}
+
+func (migrator *Migrator) copyTag(ctx context.Context, image lru.Image, result *Result) error {
+	source, err := ref.New(image.CanonicalName(migrator.SourceHost))
+	if err != nil {
+		return err
+	}
+	target, err := ref.New(image.CanonicalName(migrator.TargetHost))
+	if err != nil {
+		return err
+	}
+
+	sourceManifest, err := migrator.RegClient.ManifestGet(ctx, source)
+	if err != nil {
+		return err
+	}
+	digest := sourceManifest.GetDescriptor().Digest.String()
+
+	upToDate := false
+	if targetManifest, err := migrator.RegClient.ManifestHead(ctx, target); err == nil {
+		upToDate = targetManifest.GetDescriptor().Digest.String() == digest
+	}
+	if migrator.DryRun {
+		if upToDate {
+			common.Log.Infof("%s is up to date", image.Name())
+			atomic.AddInt64(&result.UpToDate, 1)
+		} else {
+			common.Log.Infof("would copy %s", image.Name())
+			atomic.AddInt64(&result.Copied, 1)
+		}
+		return nil
+	}
+
+	if upToDate {
+		common.Log.Infof("%s is up to date", image.Name())
+		atomic.AddInt64(&result.UpToDate, 1)
+	} else {
+		startTime := time.Now()
+		if err := migrator.RegClient.ImageCopy(ctx, source, target); err != nil {
+			return err
+		}
+		common.Log.Infof("copied %s in %s", image.Name(), time.Since(startTime).Round(time.Millisecond))
+		atomic.AddInt64(&result.Copied, 1)
+	}
+
+	record, ok := migrator.sourceRecords[image.Name()]
+	if !ok {
+		record = lru.Record{Image: image.Name(), AccessTime: migrator.createdTime(ctx, source, sourceManifest)}
+	}
+	record.Digest = digest
+	if _, err := migrator.Cache.Import([]lru.Record{record}, lru.MergeNewest); err != nil {
+		return fmt.Errorf("seeding usage.db: %w", err)
+	}
+	return migrator.saveState(stateEntry{Image: image.Name(), Digest: digest})
+}
+
+// createdTime returns the created time of the image config, of the first platform
+// for an index, falling back to the current time
+func (migrator *Migrator) createdTime(ctx context.Context, r ref.Ref, m manifest.Manifest) time.Time {
+	if index, ok := m.(manifest.Indexer); ok {
+		children, err := index.GetManifestList()
+		if err != nil || len(children) == 0 {
+			return time.Now()
+		}
+		child := r
+		child.Tag = ""
+		child.Digest = children[0].Digest.String()
+		if m, err = migrator.RegClient.ManifestGet(ctx, child); err != nil {
+			return time.Now()
+		}
+	}
+	image, ok := m.(manifest.Imager)
+	if !ok {
+		return time.Now()
+	}
+	descriptor, err := image.GetConfig()
+	if err != nil {
+		return time.Now()
+	}
+	config, err := migrator.RegClient.BlobGetOCIConfig(ctx, r, descriptor)
+	if err != nil || config.GetConfig().Created == nil {
+		common.Log.Debugf("no created time for %s, using the current time", r.CommonName())
+		return time.Now()
+	}
+	return *config.GetConfig().Created
+}
+
+// loadState reads the tags migrated by previous runs and, unless this is a dry run,
+// opens the state file for appending
+func (migrator *Migrator) loadState() error {
+	migrator.done = map[string]string{}
+	if migrator.StatePath == "" {
+		return nil
+	}
+	if file, err := os.Open(migrator.StatePath); err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			entry := stateEntry{}
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+				migrator.done[entry.Image] = entry.Digest
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		common.Log.Infof("resuming migration, %d tags already migrated", len(migrator.done))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if migrator.DryRun {
+		return nil
+	}
+
+	var err error
+	migrator.state, err = os.OpenFile(migrator.StatePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	return err
+}
+
+func (migrator *Migrator) saveState(entry stateEntry) error {
+	if migrator.state == nil {
+		return nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	migrator.stateLock.Lock()
+	defer migrator.stateLock.Unlock()
+	_, err = migrator.state.Write(append(line, '\n'))
+	return err
+}
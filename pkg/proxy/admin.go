@@ -0,0 +1,354 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/api"
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+)
+
+const adminActor = "admin-api"
+
+// adminHandler serves the admin api, every request must present AdminToken as a bearer token
+func (proxy *Proxy) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(api.AdminPrefix+"/cleanup/plan", proxy.adminCleanupPlan)
+	mux.HandleFunc(api.AdminPrefix+"/cleanup/history", proxy.adminCleanupHistory)
+	mux.HandleFunc(api.AdminPrefix+"/cleanup/run", proxy.adminCleanupRun)
+	mux.HandleFunc(api.AdminPrefix+"/cleanup/cancel", proxy.adminCleanupCancel)
+	mux.HandleFunc(api.AdminPrefix+"/cleanup/status", proxy.adminCleanupStatus)
+	mux.HandleFunc(api.AdminPrefix+"/cleanup/reset-breaker", proxy.adminResetBreaker)
+	mux.HandleFunc(api.AdminPrefix+"/tags/evict", proxy.adminEvict)
+	mux.HandleFunc(api.AdminPrefix+"/tags/pin", proxy.adminPin)
+	mux.HandleFunc(api.AdminPrefix+"/tags/lease", proxy.adminLease)
+	mux.HandleFunc(api.AdminPrefix+"/readonly", proxy.adminReadOnly)
+	mux.HandleFunc(api.AdminPrefix+"/db/backup", proxy.adminBackup)
+	mux.HandleFunc(api.AdminPrefix+"/usage/forecast", proxy.adminUsageForecast)
+	mux.HandleFunc(api.AdminPrefix+"/usage/report", proxy.adminUsageReport)
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(proxy.AdminToken)) != 1 {
+			writeAdminError(res, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		mux.ServeHTTP(res, req)
+	})
+}
+
+func (proxy *Proxy) adminCleanupPlan(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeAdminError(res, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(res, http.StatusOK, proxy.Plan(req.Context()))
+}
+
+func (proxy *Proxy) adminUsageForecast(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeAdminError(res, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	forecast, err := proxy.Forecast(req.Context())
+	if err != nil {
+		writeAdminError(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(res, http.StatusOK, forecast)
+}
+
+// adminUsageReport serves a usage report as json or, with format=csv, as csv. the window
+// of the activity defaults to the window of scheduled reports
+func (proxy *Proxy) adminUsageReport(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeAdminError(res, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	query := req.URL.Query()
+	window := proxy.ReportSettings.Window
+	if value := query.Get("window"); value != "" {
+		var err error
+		if window, err = time.ParseDuration(value); err != nil || window < 0 {
+			writeAdminError(res, http.StatusBadRequest, "window must be a positive duration")
+			return
+		}
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = ReportJSON
+	} else if format != ReportJSON && format != ReportCSV {
+		writeAdminError(res, http.StatusBadRequest, "format must be csv or json")
+		return
+	}
+	report, err := proxy.Report(req.Context(), window)
+	if err != nil {
+		writeAdminError(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if format == ReportJSON {
+		writeJSON(res, http.StatusOK, report)
+		return
+	}
+	res.Header().Set("Content-Type", "text/csv")
+	res.WriteHeader(http.StatusOK)
+	common.LogIfError(writeUsageReport(res, report, format))
+}
+
+func (proxy *Proxy) adminCleanupHistory(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeAdminError(res, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	limit := 0
+	if value := req.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			writeAdminError(res, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+	}
+	runs, err := proxy.Cache.GetCleanupRuns(limit)
+	if err != nil {
+		writeAdminError(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(res, http.StatusOK, runs)
+}
+
+func (proxy *Proxy) adminCleanupRun(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeAdminError(res, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if proxy.stopping.Load() {
+		writeAdminError(res, http.StatusServiceUnavailable, "proxy shutting down")
+		return
+	}
+	if !proxy.cleanupLock.TryLock() {
+		writeAdminError(res, http.StatusConflict, "cleanup already running")
+		return
+	}
+	// the goroutine owns the lock, no other trigger can start a cleanup in between
+	go proxy.runLockedCleanup(proxy.ctx, "manual")
+	writeJSON(res, http.StatusAccepted, proxy.cleanupStatus())
+}
+
+func (proxy *Proxy) adminCleanupCancel(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeAdminError(res, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !proxy.running.cancelRun() {
+		writeAdminError(res, http.StatusConflict, "no cleanup running")
+		return
+	}
+	common.Log.Infof("cleanup canceled by admin api")
+	writeJSON(res, http.StatusAccepted, proxy.cleanupStatus())
+}
+
+func (proxy *Proxy) adminCleanupStatus(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeAdminError(res, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(res, http.StatusOK, proxy.cleanupStatus())
+}
+
+func (proxy *Proxy) adminResetBreaker(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeAdminError(res, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	proxy.breaker.reset()
+	writeJSON(res, http.StatusOK, proxy.cleanupStatus())
+}
+
+func (proxy *Proxy) cleanupStatus() api.CleanupStatus {
+	status := api.CleanupStatus{
+		Emergency: proxy.emergency.Load(),
+		ReadOnly:  proxy.readOnly.Load(),
+	}
+	if trigger, startTime, running := proxy.running.get(); running {
+		status.Running = true
+		status.Trigger = trigger
+		status.StartTime = &startTime
+	}
+	status.BreakerReason, status.BreakerOpen = proxy.breaker.open()
+	return status
+}
+
+func (proxy *Proxy) adminEvict(res http.ResponseWriter, req *http.Request) {
+	image, ok := proxy.tagRequest(res, req, &api.TagRequest{})
+	if !ok {
+		return
+	}
+	if !proxy.MaintenanceSemaphore.TryAcquire(1) {
+		writeAdminError(res, http.StatusServiceUnavailable, "garbage collection running, retry later")
+		return
+	}
+	defer proxy.MaintenanceSemaphore.Release(1)
+	status := proxy.tagStatus(image)
+	if err := proxy.evict(req.Context(), image, "evicted by admin api"); err != nil {
+		writeAdminError(res, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeJSON(res, http.StatusOK, status)
+}
+
+func (proxy *Proxy) adminPin(res http.ResponseWriter, req *http.Request) {
+	tagRequest := &api.TagRequest{}
+	image, ok := proxy.tagRequest(res, req, tagRequest)
+	if !ok {
+		return
+	}
+	err := proxy.Cache.UpdateMetadata(image, func(metadata *lru.Metadata) {
+		metadata.Pinned = tagRequest.Pinned
+	})
+	if err != nil {
+		writeAdminError(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+	reason := "unpinned"
+	if tagRequest.Pinned {
+		reason = "pinned"
+	}
+	common.Log.Infof("%s %s", reason, image.Name())
+	proxy.emit(Event{Type: EventPinned, Image: image.Name(), Actor: adminActor, Reason: reason})
+	writeJSON(res, http.StatusOK, proxy.tagStatus(image))
+}
+
+func (proxy *Proxy) adminLease(res http.ResponseWriter, req *http.Request) {
+	tagRequest := &api.TagRequest{}
+	image, ok := proxy.tagRequest(res, req, tagRequest)
+	if !ok {
+		return
+	}
+	duration, err := time.ParseDuration(tagRequest.Duration)
+	if err != nil || duration < 0 {
+		writeAdminError(res, http.StatusBadRequest, "duration must be a positive duration such as 24h")
+		return
+	}
+	var leaseExpiry *time.Time
+	reason := "lease cleared"
+	if duration > 0 {
+		expiry := time.Now().Add(duration)
+		leaseExpiry = &expiry
+		reason = fmt.Sprintf("leased until %s", expiry.Format(time.RFC3339))
+	}
+	err = proxy.Cache.UpdateMetadata(image, func(metadata *lru.Metadata) {
+		metadata.LeaseExpiry = leaseExpiry
+	})
+	if err != nil {
+		writeAdminError(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+	common.Log.Infof("%s %s", image.Name(), reason)
+	proxy.emit(Event{Type: EventPinned, Image: image.Name(), Actor: adminActor, Reason: reason})
+	writeJSON(res, http.StatusOK, proxy.tagStatus(image))
+}
+
+func (proxy *Proxy) adminReadOnly(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		status := api.ReadOnlyStatus{}
+		if err := json.NewDecoder(req.Body).Decode(&status); err != nil {
+			writeAdminError(res, http.StatusBadRequest, err.Error())
+			return
+		}
+		if proxy.readOnly.Swap(status.Enabled) != status.Enabled {
+			common.Log.Warnf("read only mode set to %t by admin api", status.Enabled)
+		}
+	default:
+		writeAdminError(res, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(res, http.StatusOK, api.ReadOnlyStatus{Enabled: proxy.readOnly.Load()})
+}
+
+// adminBackup streams a hot backup of usage.db
+func (proxy *Proxy) adminBackup(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeAdminError(res, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	res.Header().Set("Content-Type", "application/octet-stream")
+	res.Header().Set("Content-Disposition", `attachment; filename="usage.db"`)
+	// clients tell a backup cut short by a failed write from a complete one by its length
+	written, err := proxy.Cache.BackupWithSize(res, func(size int64) {
+		res.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	})
+	if err != nil {
+		common.Log.Errorf("usage.db backup failed after %d bytes: %v", written, err)
+		return
+	}
+	common.Log.Infof("usage.db backup of %d bytes sent to admin api", written)
+}
+
+// tagRequest decodes a tag request posted to the admin api and looks up the
+// cached tag, writing an error response if it is invalid or not cached
+func (proxy *Proxy) tagRequest(res http.ResponseWriter, req *http.Request, tagRequest *api.TagRequest) (*lru.Image, bool) {
+	if req.Method != http.MethodPost {
+		writeAdminError(res, http.StatusMethodNotAllowed, "method not allowed")
+		return nil, false
+	}
+	if err := json.NewDecoder(req.Body).Decode(tagRequest); err != nil {
+		writeAdminError(res, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	repo, tag, ok := lru.ParseName(tagRequest.Image)
+	if !ok {
+		writeAdminError(res, http.StatusBadRequest, "image must be repo:tag")
+		return nil, false
+	}
+	image, ok := proxy.Cache.Get(repo, tag)
+	if !ok {
+		writeAdminError(res, http.StatusNotFound, fmt.Sprintf("%s is not cached", tagRequest.Image))
+		return nil, false
+	}
+	return image, true
+}
+
+func (proxy *Proxy) tagStatus(image *lru.Image) api.TagStatus {
+	metadata := proxy.Cache.GetMetadata(image)
+	return api.TagStatus{
+		Image:       image.Name(),
+		AccessTime:  image.AccessTime,
+		Pinned:      metadata.Pinned,
+		LeaseExpiry: metadata.LeaseExpiry,
+	}
+}
+
+func writeAdminError(res http.ResponseWriter, status int, message string) {
+	writeJSON(res, status, map[string]string{"error": message})
+}
+
+func writeJSON(res http.ResponseWriter, status int, body interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	err := json.NewEncoder(res).Encode(body)
+	common.LogIfError(err)
+}
@@ -0,0 +1,368 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+)
+
+// EventType identifies an event in the audit trail
+type EventType string
+
+const (
+	EventPushed     EventType = "pushed"
+	EventPulled     EventType = "pulled"
+	EventEvicted    EventType = "evicted"
+	EventDeleted    EventType = "deleted"
+	EventPinned     EventType = "pinned"
+	EventGCStarted  EventType = "gc.started"
+	EventGCFinished EventType = "gc.finished"
+
+	eventQueueSize   = 1024
+	signatureHeader  = "X-Dockhand-Signature"
+	cloudEventPrefix = "com.boxboat.dockhand.lru-registry."
+)
+
+// Event is an entry in the audit trail, sent to every configured EventSink
+type Event struct {
+	ID             string        `json:"id"`
+	Type           EventType     `json:"type"`
+	Time           time.Time     `json:"time"`
+	Image          string        `json:"image,omitempty"`
+	Actor          string        `json:"actor,omitempty"`
+	LastAccessor   string        `json:"lastAccessor,omitempty"`
+	LastAccessTime *time.Time    `json:"lastAccessTime,omitempty"`
+	Reason         string        `json:"reason,omitempty"`
+	Duration       time.Duration `json:"duration,omitempty"`
+	Error          string        `json:"error,omitempty"`
+}
+
+// EventSink delivers events to an external destination
+type EventSink interface {
+	Name() string
+	Send(event Event) error
+}
+
+// durableSink is implemented by sinks that must receive every event, their queue
+// grows instead of dropping events
+type durableSink interface {
+	Durable() bool
+}
+
+// eventQueue delivers the events of one sink so a slow sink does not hold up the others
+type eventQueue struct {
+	sink    EventSink
+	durable bool
+	lock    sync.Mutex
+	// pending are the events not sent to the sink yet, at most eventQueueSize unless
+	// the sink is durable
+	pending []Event
+	closed  bool
+	// wake is signaled when an event is queued or the queue is closed
+	wake chan struct{}
+	done chan struct{}
+}
+
+// eventQueues are the queues of the event sinks, closed once the proxy stopped
+type eventQueues struct {
+	lock   sync.RWMutex
+	queues []*eventQueue
+	closed bool
+}
+
+// startEvents starts delivering events to every sink from a queue of its own
+func (proxy *Proxy) startEvents() {
+	for _, sink := range proxy.EventSinks {
+		queue := &eventQueue{
+			sink: sink,
+			wake: make(chan struct{}, 1),
+			done: make(chan struct{}),
+		}
+		if durable, ok := sink.(durableSink); ok {
+			queue.durable = durable.Durable()
+		}
+		proxy.events.queues = append(proxy.events.queues, queue)
+		go queue.deliver()
+	}
+}
+
+// emit queues an event for delivery to the event sinks without waiting for them, events
+// are dropped when the queue of a sink is full unless the sink is durable
+func (proxy *Proxy) emit(event Event) {
+	proxy.events.lock.RLock()
+	defer proxy.events.lock.RUnlock()
+	if len(proxy.events.queues) == 0 || proxy.events.closed {
+		return
+	}
+	event.ID = newEventID()
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for _, queue := range proxy.events.queues {
+		if !queue.push(event) {
+			common.Log.Warnf("event queue of %s full, dropping %s event for %s", queue.sink.Name(), event.Type, event.Image)
+		}
+	}
+}
+
+// push queues an event, it returns false when the queue is full
+func (queue *eventQueue) push(event Event) bool {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if !queue.durable && len(queue.pending) >= eventQueueSize {
+		return false
+	}
+	queue.pending = append(queue.pending, event)
+	queue.signal()
+	return true
+}
+
+// close stops the queue once the queued events are delivered
+func (queue *eventQueue) close() {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.closed = true
+	queue.signal()
+}
+
+func (queue *eventQueue) signal() {
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+}
+
+// remaining returns the number of events not delivered yet
+func (queue *eventQueue) remaining() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return len(queue.pending)
+}
+
+// deliver sends the queued events to the sink until the queue is closed and empty
+func (queue *eventQueue) deliver() {
+	defer close(queue.done)
+	for {
+		queue.lock.Lock()
+		if len(queue.pending) == 0 {
+			closed := queue.closed
+			queue.lock.Unlock()
+			if closed {
+				return
+			}
+			<-queue.wake
+			continue
+		}
+		event := queue.pending[0]
+		queue.pending = queue.pending[1:]
+		queue.lock.Unlock()
+		if err := queue.sink.Send(event); err != nil {
+			common.Log.Warnf("event sink %s: %v", queue.sink.Name(), err)
+		}
+	}
+}
+
+// drainEvents closes the event queues and waits until the queued events are delivered
+// or ctx ends
+func (proxy *Proxy) drainEvents(ctx context.Context) {
+	proxy.events.lock.Lock()
+	queues := proxy.events.queues
+	if proxy.events.closed {
+		queues = nil
+	}
+	proxy.events.closed = true
+	for _, queue := range queues {
+		queue.close()
+	}
+	proxy.events.lock.Unlock()
+
+	for _, queue := range queues {
+		select {
+		case <-queue.done:
+		case <-ctx.Done():
+			common.Log.Warnf("drain timeout exceeded, %d events not delivered to %s", queue.remaining(), queue.sink.Name())
+		}
+	}
+}
+
+func newEventID() string {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	common.LogIfError(err)
+	return hex.EncodeToString(id)
+}
+
+// accessor identifies the client of a request by its basic auth user, falling
+// back to the remote address
+func (proxy *Proxy) accessor(req *http.Request) string {
+	if user, _, ok := req.BasicAuth(); ok && user != "" {
+		return user
+	}
+	if proxy.UseForwardedHeaders {
+		if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// JSONLinesSink appends each event as a line of json to a file
+type JSONLinesSink struct {
+	Path string
+	lock sync.Mutex
+}
+
+func (sink *JSONLinesSink) Name() string {
+	return fmt.Sprintf("jsonl:%s", sink.Path)
+}
+
+// Durable reports that the audit trail in the file must not miss events
+func (sink *JSONLinesSink) Durable() bool {
+	return true
+}
+
+func (sink *JSONLinesSink) Send(event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	file, err := os.OpenFile(sink.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// WebhookSink posts each event as json to a url, signing the body with an
+// HMAC-SHA256 of the secret and retrying failed deliveries with backoff
+type WebhookSink struct {
+	URL     string
+	Secret  string
+	Retries int
+	Client  *http.Client
+}
+
+func (sink *WebhookSink) Name() string {
+	return fmt.Sprintf("webhook:%s", sink.URL)
+}
+
+func (sink *WebhookSink) Send(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		if err = sink.post(body); err == nil || attempt >= sink.Retries {
+			return err
+		}
+		common.Log.Debugf("event sink %s attempt %d failed, retrying in %s: %v", sink.Name(), attempt+1, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (sink *WebhookSink) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, sink.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if sink.Secret != "" {
+		req.Header.Set(signatureHeader, "sha256="+Sign(sink.Secret, body))
+	}
+
+	client := sink.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %s", res.Status)
+	}
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of body with the secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CloudEventsSink writes each event in the CloudEvents 1.0 structured json format
+type CloudEventsSink struct {
+	Writer io.Writer
+	Source string
+	lock   sync.Mutex
+}
+
+func (sink *CloudEventsSink) Name() string {
+	return "cloudevents"
+}
+
+func (sink *CloudEventsSink) Send(event Event) error {
+	cloudEvent := map[string]interface{}{
+		"specversion":     "1.0",
+		"id":              event.ID,
+		"source":          sink.Source,
+		"type":            cloudEventPrefix + string(event.Type),
+		"time":            event.Time.Format(time.RFC3339Nano),
+		"datacontenttype": "application/json",
+		"data":            event,
+	}
+	if event.Image != "" {
+		cloudEvent["subject"] = event.Image
+	}
+	line, err := json.Marshal(cloudEvent)
+	if err != nil {
+		return err
+	}
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	_, err = sink.Writer.Write(append(line, '\n'))
+	return err
+}
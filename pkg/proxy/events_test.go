@@ -0,0 +1,81 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockedSink receives events once it is released
+type blockedSink struct {
+	durable bool
+	release chan struct{}
+	lock    sync.Mutex
+	sent    int
+}
+
+func (sink *blockedSink) Name() string {
+	return "blocked"
+}
+
+func (sink *blockedSink) Durable() bool {
+	return sink.durable
+}
+
+func (sink *blockedSink) Send(Event) error {
+	<-sink.release
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	sink.sent++
+	return nil
+}
+
+func TestEmitDoesNotWaitForSinks(t *testing.T) {
+	durable := &blockedSink{durable: true, release: make(chan struct{})}
+	dropping := &blockedSink{release: make(chan struct{})}
+	proxy := &Proxy{EventSinks: []EventSink{durable, dropping}}
+	proxy.startEvents()
+
+	emitted := make(chan struct{})
+	go func() {
+		defer close(emitted)
+		for i := 0; i < 2*eventQueueSize; i++ {
+			proxy.emit(Event{Type: EventPulled, Image: "app:latest"})
+		}
+	}()
+	select {
+	case <-emitted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("emit waited for a blocked sink")
+	}
+
+	close(durable.release)
+	close(dropping.release)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	proxy.drainEvents(ctx)
+	if durable.sent != 2*eventQueueSize {
+		t.Errorf("expected the durable sink to receive %d events, received %d", 2*eventQueueSize, durable.sent)
+	}
+	// the event being sent when the queue filled up is not queued
+	if dropping.sent < eventQueueSize || dropping.sent > eventQueueSize+1 {
+		t.Errorf("expected the other sink to receive a full queue of events, received %d", dropping.sent)
+	}
+}
@@ -0,0 +1,374 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/api"
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	// minForecastSamples is the number of samples needed to fit a growth rate
+	minForecastSamples = 3
+	// maxHeadroomFraction caps how far headroom lowers the target of a clean cycle
+	maxHeadroomFraction = 0.5
+)
+
+// ForecastSettings configure usage sampling and what the proxy does when usage is
+// forecast to cross the target before the next scheduled clean cycle
+type ForecastSettings struct {
+	// SampleInterval is how often usage is sampled, 0 disables forecasting
+	SampleInterval time.Duration
+	// Window is how far back samples are kept and fitted
+	Window time.Duration
+	// Reschedule starts a clean cycle when usage is forecast to reach the target
+	Reschedule bool
+	// Headroom lowers the target of clean cycles by the growth forecast until the
+	// clean cycle after next
+	Headroom bool
+}
+
+// forecaster holds the latest forecast and the actions taken on it
+type forecaster struct {
+	lock          sync.Mutex
+	latest        *api.Forecast
+	sampledPushes uint64
+	sampledAt     time.Time
+	early         *time.Timer
+	earlyTime     time.Time
+	headroom      uint64
+}
+
+// scheduleSampling samples usage every interval, replacing the previous schedule. the
+// caller holds the settings lock
+func (proxy *Proxy) scheduleSampling(interval time.Duration) error {
+	if proxy.sampleJob != nil {
+		proxy.MaintenanceScheduler.RemoveByReference(proxy.sampleJob)
+		proxy.sampleJob = nil
+	}
+	if interval <= 0 {
+		proxy.applyForecast(nil, CleanSettings{})
+		return nil
+	}
+	job, err := proxy.MaintenanceScheduler.Every(interval).SingletonMode().Do(proxy.sampleUsage)
+	if err != nil {
+		return err
+	}
+	proxy.sampleJob = job
+	return nil
+}
+
+// sampleUsage stores the tracked or last measured usage and the bytes pushed since the
+// previous sample, prunes samples outside the window and acts on the new forecast
+func (proxy *Proxy) sampleUsage() {
+	settings := proxy.settings()
+	sample := lru.UsageSample{}
+	var ok bool
+	sample.UsedBytes, sample.Time, ok = proxy.sampledUsage(settings.Forecast.SampleInterval)
+	if !ok {
+		common.Log.Debugf("no usage measured since the previous usage sample, skipping the sample")
+		return
+	}
+	pushed := proxy.pushedBytes.Load()
+	proxy.forecast.lock.Lock()
+	if !sample.Time.After(proxy.forecast.sampledAt) {
+		proxy.forecast.lock.Unlock()
+		common.Log.Debugf("no usage measured since the previous usage sample, skipping the sample")
+		return
+	}
+	sample.PushedBytes = pushed - proxy.forecast.sampledPushes
+	proxy.forecast.sampledPushes = pushed
+	proxy.forecast.sampledAt = sample.Time
+	proxy.forecast.lock.Unlock()
+
+	if err := proxy.Cache.AddUsageSample(&sample); err != nil {
+		common.LogIfError(err)
+		return
+	}
+	pruned, err := proxy.Cache.PruneUsageSamples(sample.Time.Add(-settings.Forecast.Window))
+	common.LogIfError(err)
+	if pruned > 0 {
+		common.Log.Debugf("pruned %d usage samples", pruned)
+	}
+
+	forecast, err := proxy.Forecast(proxy.ctx)
+	if err != nil {
+		common.LogIfError(err)
+		return
+	}
+	proxy.applyForecast(forecast, settings)
+}
+
+// sampledUsage returns the usage of a sample and when it was measured without measuring
+// the storage, the usage tracked in memory or else the last measurement. a measurement
+// older than the sample interval is refreshed in the background for the next sample
+func (proxy *Proxy) sampledUsage(interval time.Duration) (uint64, time.Time, bool) {
+	if proxy.UsageTracker != nil {
+		if usedBytes, ok := proxy.UsageTracker.Tracked(); ok {
+			return usedBytes, time.Now(), true
+		}
+	}
+	proxy.usageLock.Lock()
+	usedBytes, checkTime := proxy.usageBytes, proxy.usageCheckTime
+	proxy.usageLock.Unlock()
+	if time.Since(checkTime) >= interval {
+		proxy.refreshUsage()
+	}
+	return usedBytes, checkTime, !checkTime.IsZero()
+}
+
+// Forecast fits the growth of usage to the samples in the window. decreases between
+// samples are clean cycles and garbage collection, the bytes pushed in such an interval
+// count as its growth instead. the forecast has no target or full time while usage is
+// not growing
+func (proxy *Proxy) Forecast(ctx context.Context) (*api.Forecast, error) {
+	settings := proxy.settings()
+	now := time.Now()
+	samples, err := proxy.Cache.GetUsageSamples(now.Add(-settings.Forecast.Window))
+	if err != nil {
+		return nil, err
+	}
+	forecast := &api.Forecast{
+		Samples:     len(samples),
+		TargetBytes: settings.TargetUsageBytes,
+	}
+	if next, _, ok := nextCleanups(settings, now); ok {
+		forecast.NextCleanup = &next
+		forecast.HeadroomBytes = proxy.headroom()
+	}
+	if proxy.FreeSpace != nil {
+		if free, err := proxy.FreeSpace.Free(ctx); err == nil {
+			forecast.FreeBytes = &free
+		} else {
+			common.Log.Debugf("unable to measure free space: %v", err)
+		}
+	}
+	proxy.forecast.lock.Lock()
+	if proxy.forecast.early != nil {
+		earlyTime := proxy.forecast.earlyTime
+		forecast.EarlyCleanup = &earlyTime
+	}
+	proxy.forecast.lock.Unlock()
+	if len(samples) == 0 {
+		return forecast, nil
+	}
+
+	last := samples[len(samples)-1]
+	forecast.SampleTime = &last.Time
+	forecast.UsedBytes = last.UsedBytes
+	if len(samples) < minForecastSamples {
+		return forecast, nil
+	}
+	hours := last.Time.Sub(samples[0].Time).Hours()
+	if hours <= 0 {
+		return forecast, nil
+	}
+
+	// fit the cumulative growth with least squares
+	var pushed, growth float64
+	xs := make([]float64, len(samples))
+	ys := make([]float64, len(samples))
+	for i := 1; i < len(samples); i++ {
+		pushed += float64(samples[i].PushedBytes)
+		if samples[i].UsedBytes >= samples[i-1].UsedBytes {
+			growth += float64(samples[i].UsedBytes - samples[i-1].UsedBytes)
+		} else {
+			growth += float64(samples[i].PushedBytes)
+		}
+		xs[i] = samples[i].Time.Sub(samples[0].Time).Hours()
+		ys[i] = growth
+	}
+	forecast.PushedBytesPerHour = pushed / hours
+	forecast.GrowthBytesPerHour = slope(xs, ys)
+	if forecast.GrowthBytesPerHour <= 0 {
+		forecast.GrowthBytesPerHour = 0
+		return forecast, nil
+	}
+
+	targetTime := last.Time
+	if last.UsedBytes < settings.TargetUsageBytes {
+		targetTime = last.Time.Add(hoursDuration(float64(settings.TargetUsageBytes-last.UsedBytes) / forecast.GrowthBytesPerHour))
+	}
+	forecast.TargetTime = &targetTime
+	forecast.TargetBeforeCleanup = forecast.NextCleanup != nil && targetTime.Before(*forecast.NextCleanup)
+	if forecast.FreeBytes != nil {
+		fullTime := last.Time.Add(hoursDuration(float64(*forecast.FreeBytes) / forecast.GrowthBytesPerHour))
+		forecast.FullTime = &fullTime
+	}
+	return forecast, nil
+}
+
+// applyForecast starts a clean cycle at the forecast target time and sets the headroom
+// of clean cycles when the target is forecast to be crossed before the next clean cycle
+func (proxy *Proxy) applyForecast(forecast *api.Forecast, settings CleanSettings) {
+	if forecast != nil {
+		copied := *forecast
+		forecast = &copied
+	}
+	breach := forecast != nil && forecast.TargetBeforeCleanup
+
+	headroom := uint64(0)
+	if breach && settings.Forecast.Headroom {
+		if next, following, ok := nextCleanups(settings, time.Now()); ok && following.After(next) {
+			headroom = uint64(forecast.GrowthBytesPerHour * following.Sub(next).Hours())
+			if maxHeadroom := uint64(float64(settings.TargetUsageBytes) * maxHeadroomFraction); headroom > maxHeadroom {
+				headroom = maxHeadroom
+			}
+		}
+	}
+
+	proxy.forecast.lock.Lock()
+	defer proxy.forecast.lock.Unlock()
+	proxy.forecast.latest = forecast
+	if headroom != proxy.forecast.headroom {
+		common.Log.Infof("clean cycles keep %d bytes of headroom below the target for forecast growth", headroom)
+		proxy.forecast.headroom = headroom
+	}
+	if forecast != nil {
+		forecast.HeadroomBytes = headroom
+	}
+
+	reschedule := breach && settings.Forecast.Reschedule && forecast.UsedBytes < forecast.TargetBytes
+	if !reschedule {
+		if proxy.forecast.early != nil {
+			proxy.forecast.early.Stop()
+			proxy.forecast.early = nil
+			common.Log.Infof("usage no longer forecast to reach the target before the next clean cycle, canceled forecast clean cycle")
+		}
+		if forecast != nil {
+			forecast.EarlyCleanup = nil
+		}
+		return
+	}
+
+	targetTime := *forecast.TargetTime
+	if proxy.forecast.early != nil {
+		proxy.forecast.early.Stop()
+	} else {
+		common.Log.Infof(
+			"usage forecast to reach target %d bytes at %s before the next clean cycle at %s, starting a clean cycle then",
+			forecast.TargetBytes,
+			targetTime.Format(time.RFC3339),
+			forecast.NextCleanup.Format(time.RFC3339))
+	}
+	proxy.forecast.earlyTime = targetTime
+	proxy.forecast.early = time.AfterFunc(time.Until(targetTime), func() {
+		proxy.forecast.lock.Lock()
+		proxy.forecast.early = nil
+		proxy.forecast.lock.Unlock()
+		proxy.runCleanup(proxy.ctx, "forecast")
+	})
+	forecast.EarlyCleanup = &targetTime
+}
+
+// headroom returns the bytes clean cycles free below the target for forecast growth
+func (proxy *Proxy) headroom() uint64 {
+	proxy.forecast.lock.Lock()
+	defer proxy.forecast.lock.Unlock()
+	return proxy.forecast.headroom
+}
+
+// cleanupTarget returns the usage a clean cycle frees space down to, the target less
+// the headroom for forecast growth
+func (proxy *Proxy) cleanupTarget(settings CleanSettings) uint64 {
+	headroom := proxy.headroom()
+	if headroom >= settings.TargetUsageBytes {
+		return 0
+	}
+	return settings.TargetUsageBytes - headroom
+}
+
+// latestForecast returns the forecast of the last usage sample, nil before the first sample
+func (proxy *Proxy) latestForecast() *api.Forecast {
+	proxy.forecast.lock.Lock()
+	defer proxy.forecast.lock.Unlock()
+	return proxy.forecast.latest
+}
+
+// nextCleanups returns the next two runs of the clean cycle schedule
+func nextCleanups(settings CleanSettings, now time.Time) (time.Time, time.Time, bool) {
+	schedule, err := cron.ParseStandard(settings.CronSchedule)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	location, err := time.LoadLocation(settings.TimeZone)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	next := schedule.Next(now.In(location))
+	return next, schedule.Next(next), !next.IsZero()
+}
+
+// slope returns the least squares slope of ys over xs
+func slope(xs []float64, ys []float64) float64 {
+	var meanX, meanY float64
+	for i := range xs {
+		meanX += xs[i]
+		meanY += ys[i]
+	}
+	meanX /= float64(len(xs))
+	meanY /= float64(len(ys))
+	var covariance, variance float64
+	for i := range xs {
+		covariance += (xs[i] - meanX) * (ys[i] - meanY)
+		variance += (xs[i] - meanX) * (xs[i] - meanX)
+	}
+	if variance == 0 {
+		return 0
+	}
+	return covariance / variance
+}
+
+func hoursDuration(hours float64) time.Duration {
+	return time.Duration(hours * float64(time.Hour))
+}
+
+// countPush counts the bytes of blob uploads and manifest pushes as the registry reads them
+func (proxy *Proxy) countPush(req *http.Request, manifest bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	if manifest && req.Method != http.MethodPut {
+		return
+	}
+	if !manifest && (req.Method == http.MethodDelete || !strings.Contains(req.URL.Path, "/blobs/uploads")) {
+		return
+	}
+	req.Body = &countingBody{ReadCloser: req.Body, count: &proxy.pushedBytes}
+}
+
+// countingBody adds the bytes read from a request body to count
+type countingBody struct {
+	io.ReadCloser
+	count *atomic.Uint64
+}
+
+func (body *countingBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.count.Add(uint64(n))
+	return n, err
+}
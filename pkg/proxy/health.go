@@ -0,0 +1,184 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+	"github.com/regclient/regclient/types"
+	"github.com/regclient/regclient/types/ref"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// readinessTimeout bounds each readiness check
+	readinessTimeout = 5 * time.Second
+	// readinessProbeRepo is looked up to check the registry answers manifest requests,
+	// regclient has no ping so a missing manifest stands in for GET /v2/
+	readinessProbeRepo = "dockhand-lru-registry/readyz:probe"
+
+	CheckOK          = "ok"
+	CheckFailed      = "failed"
+	CheckUnavailable = "unavailable"
+)
+
+// HealthCheck is the outcome of a single check of /livez or /readyz
+type HealthCheck struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// HealthStatus is the body of /livez and /readyz
+type HealthStatus struct {
+	Status string `json:"status"`
+	// Writable is reported by /readyz, pushes are rejected when it is false
+	Writable *bool                  `json:"writable,omitempty"`
+	Checks   map[string]HealthCheck `json:"checks"`
+}
+
+// livez reports that the proxy is running, it does not depend on the registry or usage.db
+func (proxy *Proxy) livez(res http.ResponseWriter, _ *http.Request) {
+	writeHealth(res, http.StatusOK, &HealthStatus{
+		Status: CheckOK,
+		Checks: map[string]HealthCheck{
+			"process": {Status: CheckOK},
+		},
+	})
+}
+
+// readyz checks that the registry answers and usage.db responds, and reports whether
+// pushes and deletes are accepted. the proxy is not ready while shutting down, while the
+// registry is offline for garbage collection or, with NotReadyDuringGC, while it runs
+func (proxy *Proxy) readyz(res http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), readinessTimeout)
+	defer cancel()
+
+	checks := map[string]HealthCheck{
+		"database": timeCheck(proxy.checkDatabase),
+		"writes":   proxy.checkWrites(),
+		"deletes":  proxy.checkDeletes(),
+	}
+	if proxy.offline.Load() {
+		checks["registry"] = HealthCheck{Status: CheckUnavailable, Error: "registry offline for garbage collection"}
+	} else {
+		checks["registry"] = timeCheck(func() error { return proxy.checkRegistry(ctx) })
+	}
+	ready := checks["registry"].Status == CheckOK && checks["database"].Status == CheckOK
+	writable := checks["writes"].Status == CheckOK
+	if proxy.stopping.Load() || (proxy.NotReadyDuringGC && proxy.gcRunning.Load()) {
+		ready = false
+	}
+
+	status := &HealthStatus{
+		Status:   CheckOK,
+		Writable: &writable,
+		Checks:   checks,
+	}
+	code := http.StatusOK
+	if !ready {
+		status.Status = CheckUnavailable
+		code = http.StatusServiceUnavailable
+	}
+	writeHealth(res, code, status)
+}
+
+func timeCheck(check func() error) HealthCheck {
+	startTime := time.Now()
+	err := check()
+	result := HealthCheck{
+		Status:   CheckOK,
+		Duration: time.Since(startTime).Round(time.Millisecond).String(),
+	}
+	if err != nil {
+		result.Status = CheckFailed
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// checkRegistry looks up a manifest that does not exist, a not found answer means the
+// registry is up and serving the api
+func (proxy *Proxy) checkRegistry(ctx context.Context) error {
+	image := lru.Image{}
+	image.Repo, image.Tag, _ = lru.ParseName(readinessProbeRepo)
+	r, err := ref.New(image.CanonicalName(proxy.RegistryHost))
+	if err != nil {
+		return err
+	}
+	if _, err = proxy.RegClient.ManifestHead(ctx, r); err != nil && !errors.Is(err, types.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// checkDatabase reads the images bucket of usage.db
+func (proxy *Proxy) checkDatabase() error {
+	return proxy.Cache.Db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(lru.ImageBucket) == nil {
+			return fmt.Errorf("usage.db has no %s bucket", lru.ImageBucket)
+		}
+		return nil
+	})
+}
+
+// checkWrites reports why pushes are rejected, if they are
+func (proxy *Proxy) checkWrites() HealthCheck {
+	reason := ""
+	switch {
+	case proxy.stopping.Load():
+		reason = "proxy shutting down"
+	case proxy.offline.Load():
+		reason = "registry offline for garbage collection"
+	case proxy.readOnly.Load():
+		reason = "read only mode"
+	case proxy.emergency.Load():
+		reason = "above the hard disk limit"
+	case proxy.gcRunning.Load():
+		reason = "garbage collection running"
+	}
+	if reason == "" {
+		return HealthCheck{Status: CheckOK}
+	}
+	return HealthCheck{Status: CheckUnavailable, Error: reason}
+}
+
+// checkDeletes reports whether the registry rejected the delete probe, clean cycles do
+// not free space then but the proxy still serves pulls and pushes
+func (proxy *Proxy) checkDeletes() HealthCheck {
+	if proxy.deletesRejected.Load() {
+		return HealthCheck{Status: CheckFailed, Error: "registry rejects deletes, clean cycles will not free space"}
+	}
+	return HealthCheck{Status: CheckOK}
+}
+
+func writeHealth(res http.ResponseWriter, code int, status *HealthStatus) {
+	body, err := json.Marshal(status)
+	common.LogIfError(err)
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(code)
+	_, err = res.Write(body)
+	common.LogIfError(err)
+}
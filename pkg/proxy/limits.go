@@ -0,0 +1,151 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/api"
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+)
+
+// EvictionLimits caps how much a single cleanup run may delete, a zero value
+// disables the individual limit
+type EvictionLimits struct {
+	MaxTags            int
+	MaxTagsPercentage  float64
+	MaxBytes           uint64
+	MaxBytesPercentage float64
+	Override           bool
+}
+
+// runLimits are the absolute limits for a single cleanup run
+type runLimits struct {
+	maxTags  int
+	maxBytes uint64
+}
+
+// forRun resolves the configured limits against the tags and bytes present
+// when the cleanup run started
+func (limits *EvictionLimits) forRun(totalTags int, usedBytes uint64) runLimits {
+	resolved := runLimits{}
+	if limits.Override {
+		return resolved
+	}
+
+	resolved.maxTags = limits.MaxTags
+	if limits.MaxTagsPercentage > 0 {
+		percentageTags := int(math.Max(math.Round(float64(totalTags)*limits.MaxTagsPercentage), 1))
+		if resolved.maxTags == 0 || percentageTags < resolved.maxTags {
+			resolved.maxTags = percentageTags
+		}
+	}
+
+	resolved.maxBytes = limits.MaxBytes
+	if limits.MaxBytesPercentage > 0 {
+		percentageBytes := uint64(math.Max(math.Round(float64(usedBytes)*limits.MaxBytesPercentage), 1))
+		if resolved.maxBytes == 0 || percentageBytes < resolved.maxBytes {
+			resolved.maxBytes = percentageBytes
+		}
+	}
+	return resolved
+}
+
+// remainingTags returns how many more tags may be evicted, or -1 when unlimited
+func (limits runLimits) remainingTags(evictedTags int) int {
+	if limits.maxTags == 0 {
+		return -1
+	}
+	return int(math.Max(float64(limits.maxTags-evictedTags), 0))
+}
+
+func (limits runLimits) tagsExceeded(evictedTags int) bool {
+	return limits.maxTags > 0 && evictedTags >= limits.maxTags
+}
+
+func (limits runLimits) bytesExceeded(evictedBytes uint64) bool {
+	return limits.maxBytes > 0 && evictedBytes >= limits.maxBytes
+}
+
+// bytesWouldExceed reports whether evicting a tag of size bytes after evictedBytes
+// goes past the byte limit, tags of unknown size are checked after garbage collection
+func (limits runLimits) bytesWouldExceed(evictedBytes uint64, size int64) bool {
+	return limits.maxBytes > 0 && size > 0 && evictedBytes+uint64(size) > limits.maxBytes
+}
+
+// circuitBreaker stops cleanup runs from evicting tags once an eviction limit
+// was hit, until it is reset or the limits are overridden. a tripped breaker is kept
+// in usage.db so it stays open across restarts
+type circuitBreaker struct {
+	lock    sync.Mutex
+	reason  api.StopReason
+	tripped time.Time
+	cache   *lru.Cache
+}
+
+// restore opens the breaker when it tripped before the proxy restarted, trips and
+// resets are persisted to cache from then on
+func (breaker *circuitBreaker) restore(cache *lru.Cache) {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	breaker.cache = cache
+	state, err := cache.Breaker()
+	if err != nil {
+		common.Log.Errorf("unable to read the cleanup circuit breaker from usage.db: %v", err)
+		return
+	}
+	if state != nil {
+		breaker.reason = api.StopReason(state.Reason)
+		breaker.tripped = state.Tripped
+		common.Log.Errorf("ALERT: cleanup circuit breaker tripped at %s: %s - eviction is suspended until the breaker is reset or limits are overridden",
+			state.Tripped.Format(time.RFC3339), state.Reason)
+	}
+}
+
+func (breaker *circuitBreaker) trip(reason api.StopReason) {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	breaker.reason = reason
+	breaker.tripped = time.Now()
+	common.Log.Errorf("ALERT: cleanup circuit breaker tripped: %s - eviction is suspended until the breaker is reset or limits are overridden", reason)
+	if breaker.cache != nil {
+		common.LogIfError(breaker.cache.SetBreaker(&lru.BreakerState{Reason: string(reason), Tripped: breaker.tripped}))
+	}
+}
+
+// open returns the reason the breaker tripped, if it is open
+func (breaker *circuitBreaker) open() (api.StopReason, bool) {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	return breaker.reason, breaker.reason != ""
+}
+
+func (breaker *circuitBreaker) reset() {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	if breaker.reason != "" {
+		common.Log.Infof("cleanup circuit breaker reset, tripped at %s: %s", breaker.tripped.Format(time.RFC3339), breaker.reason)
+	}
+	breaker.reason = ""
+	breaker.tripped = time.Time{}
+	if breaker.cache != nil {
+		common.LogIfError(breaker.cache.SetBreaker(nil))
+	}
+}
@@ -0,0 +1,202 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/api"
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+	"golang.org/x/sync/semaphore"
+)
+
+// memoryBackend is a registry that stores a size for each tag and frees it when the
+// tag is deleted
+type memoryBackend struct {
+	lock  sync.Mutex
+	sizes map[string]uint64
+	// baseBytes is the usage of blobs no tag accounts for
+	baseBytes uint64
+}
+
+func (backend *memoryBackend) Name() string {
+	return "memory"
+}
+
+func (backend *memoryBackend) DeleteTag(_ context.Context, repo string, tag string) error {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	delete(backend.sizes, repo+":"+tag)
+	return nil
+}
+
+func (backend *memoryBackend) GarbageCollect(context.Context) (string, error) {
+	return "", nil
+}
+
+func (backend *memoryBackend) Usage(context.Context) (uint64, error) {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	usedBytes := backend.baseBytes
+	for _, size := range backend.sizes {
+		usedBytes += size
+	}
+	return usedBytes, nil
+}
+
+func (backend *memoryBackend) Catalog(context.Context, func(repo string, tags []string) error) error {
+	return nil
+}
+
+// cleanupProxy caches tags of 10 bytes each, least recently used first, and stores them
+// in a memory backend. recordSizes records their sizes in usage.db
+func cleanupProxy(t *testing.T, tags int, baseBytes uint64, recordSizes bool, settings CleanSettings) (*Proxy, *memoryBackend) {
+	t.Helper()
+	proxy := testProxy(t)
+	backend := &memoryBackend{sizes: map[string]uint64{}, baseBytes: baseBytes}
+	proxy.Backend = backend
+	proxy.MaintenanceSemaphore = semaphore.NewWeighted(writers)
+	proxy.CleanSettings = settings
+	accessTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := 0; i < tags; i++ {
+		image := &lru.Image{Repo: "app", Tag: fmt.Sprintf("%d", i), AccessTime: accessTime.Add(time.Duration(i) * time.Second)}
+		proxy.Cache.AddOrUpdate(image)
+		backend.sizes[image.Name()] = 10
+		if recordSizes {
+			if err := proxy.Cache.SetDigest(image, "sha256:"+image.Tag); err != nil {
+				t.Fatal(err)
+			}
+			if err := proxy.Cache.SetSize(image, "sha256:"+image.Tag, 10); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return proxy, backend
+}
+
+func TestForRunResolvesTheLowerLimit(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		limits   EvictionLimits
+		expected runLimits
+	}{
+		{name: "unlimited", limits: EvictionLimits{}, expected: runLimits{}},
+		{name: "absolute", limits: EvictionLimits{MaxTags: 5, MaxBytes: 500}, expected: runLimits{maxTags: 5, maxBytes: 500}},
+		{name: "percentage", limits: EvictionLimits{MaxTagsPercentage: 0.1, MaxBytesPercentage: 0.25}, expected: runLimits{maxTags: 20, maxBytes: 250}},
+		{name: "lower percentage", limits: EvictionLimits{MaxTags: 50, MaxTagsPercentage: 0.1, MaxBytes: 500, MaxBytesPercentage: 0.25}, expected: runLimits{maxTags: 20, maxBytes: 250}},
+		{name: "lower absolute", limits: EvictionLimits{MaxTags: 5, MaxTagsPercentage: 0.1, MaxBytes: 100, MaxBytesPercentage: 0.25}, expected: runLimits{maxTags: 5, maxBytes: 100}},
+		{name: "at least one", limits: EvictionLimits{MaxTagsPercentage: 0.001, MaxBytesPercentage: 0.0001}, expected: runLimits{maxTags: 1, maxBytes: 1}},
+		{name: "override", limits: EvictionLimits{MaxTags: 5, MaxBytes: 100, Override: true}, expected: runLimits{}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if resolved := test.limits.forRun(200, 1000); resolved != test.expected {
+				t.Errorf("expected %+v, got %+v", test.expected, resolved)
+			}
+		})
+	}
+}
+
+func TestCleanupStopReasons(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		baseBytes   uint64
+		recordSizes bool
+		target      uint64
+		limits      EvictionLimits
+		expected    api.StopReason
+		evicted     int
+		tripped     bool
+	}{
+		{name: "below target", target: 200, expected: api.StopTargetReached},
+		{name: "target reached", target: 20, expected: api.StopTargetReached, evicted: 8},
+		{name: "no tags remaining", baseBytes: 100, target: 20, expected: api.StopNoTagsRemaining, evicted: 10},
+		{name: "tag limit", target: 20, limits: EvictionLimits{MaxTags: 3}, expected: api.StopTagLimit, evicted: 3, tripped: true},
+		{name: "tag percentage limit", target: 20, limits: EvictionLimits{MaxTagsPercentage: 0.2}, expected: api.StopTagLimit, evicted: 2, tripped: true},
+		{name: "recorded byte limit", recordSizes: true, target: 20, limits: EvictionLimits{MaxBytes: 25}, expected: api.StopByteLimit, evicted: 2, tripped: true},
+		{name: "measured byte limit", target: 20, limits: EvictionLimits{MaxBytesPercentage: 0.25}, expected: api.StopByteLimit, evicted: 5, tripped: true},
+		{name: "overridden limit", target: 20, limits: EvictionLimits{MaxTags: 3, Override: true}, expected: api.StopTargetReached, evicted: 8},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			proxy, backend := cleanupProxy(t, 10, test.baseBytes, test.recordSizes, CleanSettings{
+				TargetUsageBytes:    test.target,
+				CleanTagsPercentage: 0.5,
+				EvictionLimits:      test.limits,
+			})
+			run := &lru.CleanupRun{Trigger: "test"}
+			if reason := proxy.cleanup(context.Background(), run); reason != test.expected {
+				t.Errorf("expected cleanup to stop with %q, stopped with %q", test.expected, reason)
+			}
+			if len(run.Evicted) != test.evicted || len(backend.sizes) != 10-test.evicted {
+				t.Errorf("expected %d tags evicted, evicted %d and %d are left in the registry", test.evicted, len(run.Evicted), len(backend.sizes))
+			}
+			if _, open := proxy.breaker.open(); open != test.tripped {
+				t.Errorf("expected the circuit breaker open to be %t", test.tripped)
+			}
+		})
+	}
+}
+
+func TestCleanupCanceled(t *testing.T) {
+	proxy, backend := cleanupProxy(t, 10, 0, false, CleanSettings{CleanTagsPercentage: 0.5})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if reason := proxy.cleanup(ctx, &lru.CleanupRun{Trigger: "test"}); reason != api.StopCanceled {
+		t.Errorf("expected cleanup to stop with %q, stopped with %q", api.StopCanceled, reason)
+	}
+	if len(backend.sizes) != 10 {
+		t.Errorf("expected no tags evicted, %d are left", len(backend.sizes))
+	}
+}
+
+func TestCircuitBreakerStaysOpenAcrossRestarts(t *testing.T) {
+	proxy, backend := cleanupProxy(t, 10, 0, false, CleanSettings{
+		TargetUsageBytes:    20,
+		CleanTagsPercentage: 0.5,
+		EvictionLimits:      EvictionLimits{MaxTags: 3},
+	})
+	proxy.breaker.restore(proxy.Cache)
+	if reason := proxy.cleanup(context.Background(), &lru.CleanupRun{Trigger: "test"}); reason != api.StopTagLimit {
+		t.Fatalf("expected cleanup to stop with %q, stopped with %q", api.StopTagLimit, reason)
+	}
+
+	// a restarted proxy reads the breaker from usage.db
+	restarted := &Proxy{
+		Cache:                proxy.Cache,
+		Backend:              backend,
+		MaintenanceSemaphore: semaphore.NewWeighted(writers),
+		CleanSettings:        proxy.CleanSettings,
+	}
+	restarted.breaker.restore(restarted.Cache)
+	if reason, open := restarted.breaker.open(); !open || reason != api.StopTagLimit {
+		t.Fatalf("expected the breaker open with %q after a restart, got %q", api.StopTagLimit, reason)
+	}
+	if reason := restarted.cleanup(context.Background(), &lru.CleanupRun{Trigger: "test"}); reason != api.StopBreakerOpen {
+		t.Errorf("expected cleanup to stop with %q, stopped with %q", api.StopBreakerOpen, reason)
+	}
+	if len(backend.sizes) != 7 {
+		t.Errorf("expected no tags evicted while the breaker is open, %d are left", len(backend.sizes))
+	}
+
+	restarted.breaker.reset()
+	if state, err := restarted.Cache.Breaker(); err != nil || state != nil {
+		t.Errorf("expected the reset breaker removed from usage.db, got %+v, %v", state, err)
+	}
+}
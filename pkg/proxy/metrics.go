@@ -0,0 +1,102 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+)
+
+// metricsContentType is the prometheus text exposition format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metrics serves the usage, push volume and forecast of the proxy in the prometheus
+// text format. forecast metrics are left out until usage has been sampled, and the
+// target and full times while usage is not growing
+func (proxy *Proxy) metrics(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	settings := proxy.settings()
+	proxy.usageLock.Lock()
+	usedBytes, usageCheckTime := proxy.usageBytes, proxy.usageCheckTime
+	proxy.usageLock.Unlock()
+
+	body := &bytes.Buffer{}
+	metric := func(name string, kind string, help string, value float64) {
+		fmt.Fprintf(body, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, kind, name, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	if !usageCheckTime.IsZero() {
+		metric("lru_registry_used_bytes", "gauge", "bytes used by the registry storage at the last measurement", float64(usedBytes))
+		metric("lru_registry_usage_measured_timestamp_seconds", "gauge", "unix time of the last usage measurement", float64(usageCheckTime.Unix()))
+	}
+	metric("lru_registry_target_bytes", "gauge", "target usage of clean cycles", float64(settings.TargetUsageBytes))
+	metric("lru_registry_cleanup_target_bytes", "gauge", "usage clean cycles free space down to, the target less the headroom for forecast growth", float64(proxy.cleanupTarget(settings)))
+	if settings.HardLimitBytes > 0 {
+		metric("lru_registry_hard_limit_bytes", "gauge", "usage above which blob uploads are rejected", float64(settings.HardLimitBytes))
+	}
+	deletesRejected := 0.0
+	if proxy.deletesRejected.Load() {
+		deletesRejected = 1
+	}
+	metric("lru_registry_deletes_rejected", "gauge", "1 when the registry rejected the delete probe at startup and clean cycles cannot free space", deletesRejected)
+	metric("lru_registry_pushed_bytes_total", "counter", "bytes of blobs and manifests pushed through the proxy since it started", float64(proxy.pushedBytes.Load()))
+
+	if forecast := proxy.latestForecast(); forecast != nil {
+		now := time.Now()
+		metric("lru_registry_forecast_samples", "gauge", "usage samples the forecast is fitted to", float64(forecast.Samples))
+		metric("lru_registry_usage_growth_bytes_per_second", "gauge", "forecast growth of registry usage", forecast.GrowthBytesPerHour/3600)
+		metric("lru_registry_pushed_bytes_per_second", "gauge", "average push volume over the forecast window", forecast.PushedBytesPerHour/3600)
+		if forecast.FreeBytes != nil {
+			metric("lru_registry_free_bytes", "gauge", "bytes left on the disk of the registry storage", float64(*forecast.FreeBytes))
+		}
+		if forecast.TargetTime != nil {
+			metric("lru_registry_forecast_target_seconds", "gauge", "seconds until usage is forecast to reach the target, 0 when above it", secondsUntil(now, *forecast.TargetTime))
+		}
+		if forecast.FullTime != nil {
+			metric("lru_registry_forecast_full_seconds", "gauge", "seconds until the disk of the registry storage is forecast to be full", secondsUntil(now, *forecast.FullTime))
+		}
+		if forecast.NextCleanup != nil {
+			metric("lru_registry_next_cleanup_seconds", "gauge", "seconds until the next scheduled clean cycle", secondsUntil(now, *forecast.NextCleanup))
+		}
+		breach := 0.0
+		if forecast.TargetBeforeCleanup {
+			breach = 1
+		}
+		metric("lru_registry_forecast_target_before_cleanup", "gauge", "1 when usage is forecast to reach the target before the next scheduled clean cycle", breach)
+	}
+
+	res.Header().Set("Content-Type", metricsContentType)
+	res.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodGet {
+		_, err := res.Write(body.Bytes())
+		common.LogIfError(err)
+	}
+}
+
+func secondsUntil(now time.Time, t time.Time) float64 {
+	if t.Before(now) {
+		return 0
+	}
+	return t.Sub(now).Seconds()
+}
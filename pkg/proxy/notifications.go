@@ -0,0 +1,205 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+)
+
+const (
+	notificationPush   = "push"
+	notificationPull   = "pull"
+	notificationDelete = "delete"
+)
+
+// notificationEnvelope is the body of a Distribution notification webhook
+type notificationEnvelope struct {
+	Events []notificationEvent `json:"events"`
+}
+
+type notificationEvent struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Action    string    `json:"action"`
+	Target    struct {
+		MediaType  string `json:"mediaType"`
+		Digest     string `json:"digest"`
+		Repository string `json:"repository"`
+		Tag        string `json:"tag"`
+	} `json:"target"`
+	Request struct {
+		Addr string `json:"addr"`
+	} `json:"request"`
+	Actor struct {
+		Name string `json:"name"`
+	} `json:"actor"`
+}
+
+// isManifest reports whether the event targets a manifest rather than a layer or config blob
+func (event *notificationEvent) isManifest() bool {
+	return strings.Contains(event.Target.MediaType, "manifest") ||
+		strings.Contains(event.Target.MediaType, "image.index")
+}
+
+func (event *notificationEvent) accessor() string {
+	if event.Actor.Name != "" {
+		return event.Actor.Name
+	}
+	return strings.Split(event.Request.Addr, ":")[0]
+}
+
+// evictingWindow is how long notifications for a tag are skipped after the proxy starts
+// evicting it. deleting a tag from Distribution pushes a manifest to the tag and deletes
+// that manifest, the notifications of both are sent back to the proxy
+const evictingWindow = time.Minute
+
+// recentEvents remembers keys for a window of time, it is used to skip
+// notifications for requests the proxy already recorded and redelivered notifications
+type recentEvents struct {
+	lock   sync.Mutex
+	window time.Duration
+	seen   map[string]time.Time
+	// order holds the keys in the order they were added, expired keys are purged
+	// from its front
+	order []recentKey
+}
+
+type recentKey struct {
+	key  string
+	seen time.Time
+}
+
+func (recent *recentEvents) add(key string) {
+	recent.lock.Lock()
+	defer recent.lock.Unlock()
+	if recent.seen == nil {
+		recent.seen = map[string]time.Time{}
+	}
+	now := time.Now()
+	for len(recent.order) > 0 && now.Sub(recent.order[0].seen) > recent.window {
+		expired := recent.order[0]
+		// a key added again since is kept until its latest time expires
+		if recent.seen[expired.key].Equal(expired.seen) {
+			delete(recent.seen, expired.key)
+		}
+		recent.order = recent.order[1:]
+	}
+	recent.seen[key] = now
+	recent.order = append(recent.order, recentKey{key: key, seen: now})
+}
+
+func (recent *recentEvents) contains(key string) bool {
+	recent.lock.Lock()
+	defer recent.lock.Unlock()
+	seen, ok := recent.seen[key]
+	return ok && time.Since(seen) <= recent.window
+}
+
+// receiveNotifications handles Distribution notification webhooks so pushes, pulls and deletes
+// that reach the registry without passing through the proxy still update the cache
+func (proxy *Proxy) receiveNotifications(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(proxy.NotificationSecret)) != 1 {
+		res.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	envelope := notificationEnvelope{}
+	if err := json.NewDecoder(req.Body).Decode(&envelope); err != nil {
+		common.Log.Warnf("unable to decode registry notification: %v", err)
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	for _, event := range envelope.Events {
+		proxy.handleNotification(&event)
+	}
+	res.WriteHeader(http.StatusOK)
+}
+
+func (proxy *Proxy) handleNotification(event *notificationEvent) {
+	// delete events only carry the repository, digest and tag of the target
+	if event.Action == notificationDelete {
+		if proxy.evicting.contains(event.Target.Repository+":"+event.Target.Tag) ||
+			proxy.evicting.contains(event.Target.Repository+"@"+event.Target.Digest) {
+			common.Log.Debugf("skipping delete notification for %s evicted by the proxy", event.Target.Repository)
+			return
+		}
+		if event.Target.Tag != "" {
+			proxy.recordDelete(event.Target.Repository, event.Target.Tag, event.accessor())
+		} else if event.Target.Digest != "" {
+			proxy.recordDelete(event.Target.Repository, event.Target.Digest, event.accessor())
+		}
+		return
+	}
+	if event.Target.Tag == "" || !event.isManifest() {
+		return
+	}
+	if event.ID != "" {
+		if proxy.recent.contains(event.ID) {
+			common.Log.Debugf("skipping redelivered notification %s", event.ID)
+			return
+		}
+		proxy.recent.add(event.ID)
+	}
+
+	image := event.Target.Repository + ":" + event.Target.Tag
+	accessTime := event.Timestamp
+	if accessTime.IsZero() {
+		accessTime = time.Now()
+	}
+	// notifications are retried and may arrive after a later access of the tag
+	if cached, ok := proxy.Cache.Get(event.Target.Repository, event.Target.Tag); ok && !accessTime.After(cached.AccessTime) {
+		common.Log.Debugf("skipping %s notification for %s from %s, the tag was accessed at %s", event.Action, image, accessTime.Format(time.RFC3339), cached.AccessTime.Format(time.RFC3339))
+		return
+	}
+
+	switch event.Action {
+	case notificationPush:
+		if proxy.evicting.contains(image) {
+			common.Log.Debugf("skipping push notification for %s, the tag is being evicted", image)
+			if event.Target.Digest != "" {
+				proxy.evicting.add(event.Target.Repository + "@" + event.Target.Digest)
+			}
+			return
+		}
+		if proxy.recent.contains(string(EventPushed) + image) {
+			return
+		}
+		proxy.recordAccess(EventPushed, event.Target.Repository, event.Target.Tag, event.accessor(), accessTime)
+		if event.Target.Digest != "" {
+			proxy.recordDigest(&lru.Image{Repo: event.Target.Repository, Tag: event.Target.Tag}, event.Target.Digest)
+		}
+	case notificationPull:
+		if proxy.recent.contains(string(EventPulled) + image) {
+			return
+		}
+		proxy.recordAccess(EventPulled, event.Target.Repository, event.Target.Tag, event.accessor(), accessTime)
+	}
+}
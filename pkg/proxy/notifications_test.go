@@ -0,0 +1,102 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+)
+
+// distributionBackend deletes tags the way regclient deletes them from Distribution,
+// pushing a manifest to the tag and deleting its digest, and sends the notifications
+// of both back to the proxy
+type distributionBackend struct {
+	proxy *Proxy
+}
+
+func (backend *distributionBackend) Name() string {
+	return "distribution"
+}
+
+func (backend *distributionBackend) DeleteTag(_ context.Context, repo string, tag string) error {
+	push := &notificationEvent{ID: "push-" + tag, Timestamp: time.Now(), Action: notificationPush}
+	push.Target.MediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	push.Target.Repository = repo
+	push.Target.Tag = tag
+	push.Target.Digest = "sha256:temporary"
+	backend.proxy.handleNotification(push)
+
+	deleted := &notificationEvent{ID: "delete-" + tag, Timestamp: time.Now(), Action: notificationDelete}
+	deleted.Target.Repository = repo
+	deleted.Target.Digest = "sha256:temporary"
+	backend.proxy.handleNotification(deleted)
+	return nil
+}
+
+func (backend *distributionBackend) GarbageCollect(context.Context) (string, error) {
+	return "", nil
+}
+
+func (backend *distributionBackend) Usage(context.Context) (uint64, error) {
+	return 0, nil
+}
+
+func (backend *distributionBackend) Catalog(context.Context, func(repo string, tags []string) error) error {
+	return nil
+}
+
+func TestEvictionSkipsItsOwnNotifications(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.Backend = &distributionBackend{proxy: proxy}
+	proxy.recent.window = time.Minute
+	proxy.evicting.window = evictingWindow
+	image := &lru.Image{Repo: "app", Tag: "old", AccessTime: time.Now().Add(-time.Hour).Truncate(time.Second)}
+	proxy.Cache.AddOrUpdate(image)
+
+	if err := proxy.evict(context.Background(), image, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := proxy.Cache.Get("app", "old"); found {
+		t.Errorf("expected app:old to stay evicted")
+	}
+	// notifications are delivered asynchronously and may arrive after the eviction
+	_ = proxy.Backend.DeleteTag(context.Background(), "app", "old")
+	if _, found := proxy.Cache.Get("app", "old"); found {
+		t.Errorf("expected a late notification to leave app:old evicted")
+	}
+
+	other := &notificationEvent{ID: "push-other", Timestamp: time.Now(), Action: notificationPush}
+	other.Target.MediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	other.Target.Repository = "app"
+	other.Target.Tag = "other"
+	proxy.handleNotification(other)
+	if _, found := proxy.Cache.Get("app", "other"); !found {
+		t.Errorf("expected the push notification of app:other recorded")
+	}
+
+	proxy.flushActivity()
+	activities, err := proxy.Cache.GetActivity(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (lru.Activity{Pushes: 1}); activities["app"] != expected {
+		t.Errorf("expected only the push of app:other counted, got %+v", activities["app"])
+	}
+}
@@ -0,0 +1,203 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/api"
+	"github.com/boxboat/dockhand-lru-registry/pkg/backend"
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+	"github.com/regclient/regclient/types/ref"
+)
+
+// Plan runs the candidate selection of a clean cycle against the current cache and
+// disk usage without deleting tags or running garbage collection. The target is lowered
+// by the headroom kept for forecast growth. Freed bytes are estimated from the blobs
+// referenced by the removed tags, blobs shared with tags that are kept are counted as
+// freed, so the estimate is an upper bound.
+func (proxy *Proxy) Plan(ctx context.Context) *api.CleanupPlan {
+	settings := proxy.settings()
+	usedBytes := proxy.measureUsage(ctx)
+	targetBytes := proxy.cleanupTarget(settings)
+	plan := &api.CleanupPlan{
+		UsedBytes:   usedBytes,
+		TargetBytes: targetBytes,
+		Evictions:   []api.PlannedEviction{},
+		Skipped:     []api.SkippedTag{},
+	}
+	if untracked, err := proxy.untrackedTags(ctx); err == nil {
+		plan.UntrackedTags = &untracked
+	} else {
+		common.Log.Warnf("unable to list the registry catalog: %v", err)
+	}
+	if usedBytes <= targetBytes {
+		plan.StopReason = api.StopTargetReached
+		return plan
+	}
+
+	lruImages, protected := proxy.evictable()
+	plan.Skipped = protected
+	limits := settings.EvictionLimits.forRun(len(lruImages), usedBytes)
+	if reason, open := proxy.breaker.open(); open && !settings.EvictionLimits.Override {
+		skipTags(plan, settings.selectRemovals(lruImages, 0, runLimits{}, 0), string(reason))
+		plan.StopReason = api.StopBreakerOpen
+		return plan
+	}
+
+	countedBlobs := map[string]bool{}
+	currentBytes := usedBytes
+	iteration := 0
+	evictedTags := 0
+	var recordedBytes uint64
+
+	for {
+		if ctx.Err() != nil {
+			plan.StopReason = api.StopCanceled
+			return plan
+		}
+
+		removals := settings.selectRemovals(lruImages, iteration, limits, evictedTags)
+		for i, image := range removals {
+			size := proxy.Cache.GetMetadata(&image).Size
+			if limits.bytesWouldExceed(recordedBytes, size) {
+				skipTags(plan, removals[i:], string(api.StopByteLimit))
+				plan.StopReason = api.StopByteLimit
+				return plan
+			}
+			if size > 0 {
+				recordedBytes += uint64(size)
+			}
+			estimatedBytes := uint64(0)
+			if blobs, err := proxy.imageBlobs(ctx, &image); err == nil {
+				for digest, size := range blobs {
+					if !countedBlobs[digest] {
+						countedBlobs[digest] = true
+						estimatedBytes += uint64(size)
+					}
+				}
+			} else {
+				common.Log.Debugf("unable to estimate size of %s: %v", image.Name(), err)
+				plan.UnknownSizeTags++
+			}
+			plan.Evictions = append(plan.Evictions, api.PlannedEviction{
+				Image:          image.Name(),
+				AccessTime:     image.AccessTime,
+				Iteration:      iteration,
+				EstimatedBytes: estimatedBytes,
+			})
+			plan.EstimatedFreedBytes += estimatedBytes
+		}
+		evictedTags += len(removals)
+		lruImages = lruImages[len(removals):]
+		plan.Iterations++
+
+		currentBytes = 0
+		if plan.EstimatedFreedBytes < usedBytes {
+			currentBytes = usedBytes - plan.EstimatedFreedBytes
+		}
+
+		if currentBytes <= targetBytes {
+			plan.StopReason = api.StopTargetReached
+			return plan
+		} else if len(lruImages) == 0 {
+			plan.StopReason = api.StopNoTagsRemaining
+			return plan
+		} else if limits.tagsExceeded(evictedTags) {
+			skipTags(plan, settings.selectRemovals(lruImages, iteration+1, runLimits{}, 0), string(api.StopTagLimit))
+			plan.StopReason = api.StopTagLimit
+			return plan
+		} else if limits.bytesExceeded(usedBytes - currentBytes) {
+			skipTags(plan, settings.selectRemovals(lruImages, iteration+1, runLimits{}, 0), string(api.StopByteLimit))
+			plan.StopReason = api.StopByteLimit
+			return plan
+		}
+		iteration++
+	}
+}
+
+// untrackedTags counts the tags in the registry catalog that are not in usage.db
+func (proxy *Proxy) untrackedTags(ctx context.Context) (int, error) {
+	untracked := 0
+	err := proxy.Backend.Catalog(ctx, func(repo string, tags []string) error {
+		for _, tag := range tags {
+			if _, ok := proxy.Cache.Get(repo, tag); !ok {
+				untracked++
+			}
+		}
+		return nil
+	})
+	return untracked, err
+}
+
+// skipTags records tags a plan does not remove and why
+func skipTags(plan *api.CleanupPlan, images []lru.Image, reason string) {
+	for _, image := range images {
+		plan.Skipped = append(plan.Skipped, api.SkippedTag{
+			Image:  image.Name(),
+			Reason: reason,
+		})
+	}
+}
+
+// ImageSize returns the summed size of the manifests and blobs referenced by a tag
+func (proxy *Proxy) ImageSize(ctx context.Context, image *lru.Image) (int64, error) {
+	blobs, err := proxy.manifestBlobs(ctx, image, proxy.Cache.GetMetadata(image).Digest)
+	if err != nil {
+		return 0, err
+	}
+	size := int64(0)
+	for _, blobSize := range blobs {
+		size += blobSize
+	}
+	return size, nil
+}
+
+// imageBlobs returns the size of every manifest and blob referenced by a tag,
+// including the platform manifests of an index
+func (proxy *Proxy) imageBlobs(ctx context.Context, image *lru.Image) (map[string]int64, error) {
+	r, err := ref.New(image.CanonicalName(proxy.RegistryHost))
+	if err != nil {
+		return nil, err
+	}
+	blobs := map[string]int64{}
+	return blobs, backend.ManifestBlobs(ctx, proxy.RegClient, r, blobs, nil)
+}
+
+// manifestBlobs returns the blobs referenced by the manifest a tag points to, the blobs
+// of a recorded digest are read by digest and kept in the manifest cache
+func (proxy *Proxy) manifestBlobs(ctx context.Context, image *lru.Image, digest string) (map[string]int64, error) {
+	if digest == "" {
+		return proxy.imageBlobs(ctx, image)
+	}
+	key := image.Repo + "@" + digest
+	if blobs, ok := proxy.manifests.get(key); ok {
+		return blobs, nil
+	}
+	r, err := ref.New(fmt.Sprintf("%s/%s@%s", proxy.RegistryHost, image.Repo, digest))
+	if err != nil {
+		return nil, err
+	}
+	blobs := map[string]int64{}
+	if err = backend.ManifestBlobs(ctx, proxy.RegClient, r, blobs, nil); err != nil {
+		return nil, err
+	}
+	proxy.manifests.put(key, blobs)
+	return blobs, nil
+}
@@ -0,0 +1,82 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/regclient/regclient/types"
+	"github.com/regclient/regclient/types/ref"
+)
+
+const (
+	deleteProbeRepo = "dockhand-lru-registry/preflight"
+	// deleteProbeDigest is a manifest that does not exist, deleting it changes nothing
+	deleteProbeDigest   = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	deleteProbeTimeout  = 30 * time.Second
+	deleteProbeInterval = 10 * time.Second
+)
+
+// errDeleteProbeUnreachable is returned while the registry cannot be reached to probe deletes
+var errDeleteProbeUnreachable = errors.New("registry unreachable")
+
+// runDeleteProbe checks once at startup that the registry accepts deletes, retrying
+// until the registry can be reached
+func (proxy *Proxy) runDeleteProbe() {
+	for {
+		err := proxy.probeDeletes(proxy.ctx)
+		if err == nil {
+			common.Log.Infof("delete probe: registry accepts deletes")
+			return
+		}
+		if !errors.Is(err, errDeleteProbeUnreachable) {
+			proxy.deletesRejected.Store(true)
+			common.Log.Errorf("delete probe: registry rejects deletes, clean cycles will not free space: %v", err)
+			return
+		}
+		common.Log.Debugf("delete probe: %v, retrying in %s", err, deleteProbeInterval)
+		select {
+		case <-proxy.ctx.Done():
+			return
+		case <-time.After(deleteProbeInterval):
+		}
+	}
+}
+
+// probeDeletes deletes a manifest that does not exist, a registry that accepts deletes
+// answers not found, one with deletes disabled or in read only mode answers unsupported
+func (proxy *Proxy) probeDeletes(ctx context.Context) error {
+	r, err := ref.New(fmt.Sprintf("%s/%s@%s", proxy.RegistryHost, deleteProbeRepo, deleteProbeDigest))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, deleteProbeTimeout)
+	defer cancel()
+	err = proxy.RegClient.ManifestDelete(ctx, r)
+	switch {
+	case err == nil, errors.Is(err, types.ErrNotFound):
+		return nil
+	case errors.Is(err, types.ErrHTTPStatus), errors.Is(err, types.ErrHTTPUnauthorized):
+		return err
+	default:
+		return fmt.Errorf("%w: %v", errDeleteProbeUnreachable, err)
+	}
+}
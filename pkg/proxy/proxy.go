@@ -17,60 +17,184 @@ limitations under the License.
 package proxy
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"math"
 	"net/http"
 	"net/http/httputil"
 	"os"
-	"os/exec"
 	"os/signal"
-	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/boxboat/dockhand-lru-registry/pkg/api"
+	"github.com/boxboat/dockhand-lru-registry/pkg/backend"
 	"github.com/boxboat/dockhand-lru-registry/pkg/common"
 	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+	"github.com/boxboat/dockhand-lru-registry/pkg/supervisor"
 	"github.com/go-co-op/gocron"
 	"github.com/regclient/regclient"
-	"github.com/regclient/regclient/types"
-	"github.com/regclient/regclient/types/ref"
 	"golang.org/x/sync/semaphore"
-	"golang.org/x/sys/unix"
 )
 
 var (
-	manifestMatch = regexp.MustCompile(`/v2/(.*)/manifests/(.*)`)
+	manifestMatch   = regexp.MustCompile(`/v2/(.*)/manifests/(.*)`)
+	blobUploadMatch = regexp.MustCompile(`/v2/(.*)/blobs/uploads/?$`)
 )
 
 const (
 	writers int64 = 10000
+	// gcOutputHistoryBytes is how much of the end of garbage collection output the history keeps
+	gcOutputHistoryBytes = 16 << 10
 )
 
 type Proxy struct {
 	Server               *http.Server
 	UseForwardedHeaders  bool
+	NotReadyDuringGC     bool
+	AdminToken           string
+	NotificationSecret   string
+	NotificationWindow   time.Duration
 	RegistryHost         string
 	RegistryProxy        *httputil.ReverseProxy
 	Cache                *lru.Cache
 	RegClient            *regclient.RegClient
+	Backend              backend.Backend
 	CleanSettings        CleanSettings
+	SnapshotSettings     SnapshotSettings
+	ReportSettings       ReportSettings
+	ShutdownSettings     ShutdownSettings
 	MaintenanceSemaphore *semaphore.Weighted
 	MaintenanceScheduler *gocron.Scheduler
+	EventSinks           []EventSink
+	// Certificate is reloaded on SIGHUP when the proxy serves TLS
+	Certificate *Certificate
+	// Reload is called on SIGHUP to reload the configuration
+	Reload func() error
+	// DeleteProbe checks at startup that the registry accepts deletes
+	DeleteProbe bool
+	// Supervisor runs the registry as a child process, nil when the registry runs separately
+	Supervisor *supervisor.Supervisor
+	// RecordSizes stores the size of every tag in usage.db for the cache usage provider
+	// and byte eviction limits, measuring a tag also fills the manifest cache of usage reports
+	RecordSizes bool
+	// UsageTracker keeps the usage of the walk provider in memory, nil when usage is
+	// measured on every request
+	UsageTracker *backend.Tracker
+	// FreeSpace measures the space left on the disk of the registry for the forecast,
+	// nil when the registry storage is not a local filesystem
+	FreeSpace backend.FreeSpace
+
+	ctx             context.Context
+	settingsLock    sync.RWMutex
+	reloadLock      sync.Mutex
+	cleanupJob      *gocron.Job
+	sampleJob       *gocron.Job
+	cleanupLock     sync.Mutex
+	emergency       atomic.Bool
+	readOnly        atomic.Bool
+	stopping        atomic.Bool
+	gcRunning       atomic.Bool
+	offline         atomic.Bool
+	deletesRejected atomic.Bool
+	inFlightPushes  atomic.Int64
+	pushedBytes     atomic.Uint64
+	running         runningCleanup
+	usageLock       sync.Mutex
+	usageCheckTime  time.Time
+	usageBytes      uint64
+	usageRefreshing atomic.Bool
+	breaker         circuitBreaker
+	events          eventQueues
+	recent          recentEvents
+	evicting        recentEvents
+	sizing          sync.Map
+	forecast        forecaster
+	accrual         accrual
+	activity        activityCounts
+	manifests       manifestCache
 }
 
 type CleanSettings struct {
-	RegistryBinary              string
-	RegistryDir                 string
-	RegistryConfig              string
-	TargetUsageBytes            uint64
-	CleanTagsPercentage         float64
-	TimeZone                    string
-	CronSchedule                string
-	UseOptimizedDiskCalculation bool
+	TargetUsageBytes       uint64
+	CleanTagsPercentage    float64
+	TimeZone               string
+	CronSchedule           string
+	HardLimitBytes         uint64
+	HardLimitCheckInterval time.Duration
+	EvictionLimits         EvictionLimits
+	HistoryRetention       time.Duration
+	// HistoryMaxRuns bounds the number of clean cycles kept in the history, 0 keeps every one
+	HistoryMaxRuns int
+	// OfflineGC stops the supervised registry while garbage collection runs
+	OfflineGC bool
+	Forecast  ForecastSettings
+}
+
+// settings returns the clean settings in effect, which may be replaced while the proxy runs
+func (proxy *Proxy) settings() CleanSettings {
+	proxy.settingsLock.RLock()
+	defer proxy.settingsLock.RUnlock()
+	return proxy.CleanSettings
+}
+
+// UpdateCleanSettings replaces the cleanup and policy settings of a running proxy and
+// reschedules the clean cycle when the cron schedule or timezone changed, a clean cycle
+// in progress finishes with the settings it started with
+func (proxy *Proxy) UpdateCleanSettings(settings CleanSettings) error {
+	location, err := time.LoadLocation(settings.TimeZone)
+	if err != nil {
+		return err
+	}
+
+	proxy.settingsLock.Lock()
+	defer proxy.settingsLock.Unlock()
+	previous := proxy.CleanSettings
+
+	if proxy.MaintenanceScheduler != nil &&
+		(settings.CronSchedule != previous.CronSchedule || settings.TimeZone != previous.TimeZone) {
+		if err := proxy.scheduleCleanup(settings.CronSchedule, location); err != nil {
+			return err
+		}
+		common.Log.Infof("clean cycle rescheduled to TZ=%s '%s'", settings.TimeZone, settings.CronSchedule)
+	}
+	if proxy.MaintenanceScheduler != nil && settings.Forecast.SampleInterval != previous.Forecast.SampleInterval {
+		if err := proxy.scheduleSampling(settings.Forecast.SampleInterval); err != nil {
+			return err
+		}
+	}
+	// the latest forecast is acted on again with the new headroom and reschedule settings,
+	// also when the interval changed with them
+	if settings.Forecast != previous.Forecast && settings.Forecast.SampleInterval > 0 {
+		proxy.applyForecast(proxy.latestForecast(), settings)
+	}
+	proxy.CleanSettings = settings
+	return nil
+}
+
+// scheduleCleanup schedules the clean cycle in location, replacing the previous schedule
+// only once the new one is accepted. the location is set on the cron expression unless it
+// has its own, the other jobs of the scheduler keep the location they were scheduled in.
+// the caller holds the settings lock
+func (proxy *Proxy) scheduleCleanup(cronSchedule string, location *time.Location) error {
+	expression := cronSchedule
+	if !strings.HasPrefix(expression, "TZ=") && !strings.HasPrefix(expression, "CRON_TZ=") {
+		expression = fmt.Sprintf("CRON_TZ=%s %s", location.String(), cronSchedule)
+	}
+	job, err := proxy.MaintenanceScheduler.Cron(expression).SingletonMode().Do(func() { proxy.runCleanup(proxy.ctx, "scheduled") })
+	if err != nil {
+		return fmt.Errorf("unable to schedule clean cycle '%s': %w", cronSchedule, err)
+	}
+	if proxy.cleanupJob != nil {
+		proxy.MaintenanceScheduler.RemoveByReference(proxy.cleanupJob)
+	}
+	proxy.cleanupJob = job
+	return nil
 }
 
 func (proxy *Proxy) healthz(res http.ResponseWriter, _ *http.Request) {
@@ -81,33 +205,64 @@ func (proxy *Proxy) healthz(res http.ResponseWriter, _ *http.Request) {
 
 func (proxy *Proxy) serveProxy(res http.ResponseWriter, req *http.Request) {
 
+	if proxy.offline.Load() {
+		writeRegistryError(
+			res,
+			http.StatusServiceUnavailable,
+			"UNAVAILABLE",
+			"registry is offline for garbage collection - retry later")
+		return
+	}
+
 	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		if proxy.readOnly.Load() {
+			writeRegistryError(
+				res,
+				http.StatusServiceUnavailable,
+				"UNAVAILABLE",
+				"registry is in read only mode - retry later")
+			return
+		}
+		if proxy.stopping.Load() {
+			writeRegistryError(
+				res,
+				http.StatusServiceUnavailable,
+				"UNAVAILABLE",
+				"registry is shutting down - retry later")
+			return
+		}
 		if proxy.MaintenanceSemaphore.TryAcquire(1) {
 			defer proxy.MaintenanceSemaphore.Release(1)
+			proxy.inFlightPushes.Add(1)
+			defer proxy.inFlightPushes.Add(-1)
 		} else {
 			res.WriteHeader(http.StatusServiceUnavailable)
 			return
 		}
 	}
 
-	common.Log.Debugf(`%s %s`, req.Method, req.URL)
-	if req.Method == http.MethodHead || req.Method == http.MethodPut {
-		if match := manifestMatch.MatchString(req.URL.Path); match {
-			matches := manifestMatch.FindStringSubmatch(req.URL.Path)
-			repo := matches[1]
-			tag := matches[2]
-			image := fmt.Sprintf(`%s:%s`, repo, tag)
-			if req.Method == http.MethodHead {
-				common.Log.Infof(`pulling %s`, image)
-			} else if req.Method == http.MethodPut {
-				common.Log.Infof(`pushing %s`, image)
-			}
+	if req.Method == http.MethodPost && blobUploadMatch.MatchString(req.URL.Path) && proxy.hardLimitExceeded() {
+		common.Log.Warnf("rejecting blob upload %s, registry is above the hard disk limit", req.URL.Path)
+		writeRegistryError(
+			res,
+			http.StatusInsufficientStorage,
+			"DENIED",
+			"registry storage is full, emergency cleanup in progress - retry later")
+		return
+	}
 
-			proxy.Cache.AddOrUpdate(&lru.Image{
-				Repo:       repo,
-				Tag:        tag,
-				AccessTime: time.Now(),
-			})
+	common.Log.Debugf(`%s %s`, req.Method, req.URL)
+	matches := manifestMatch.FindStringSubmatch(req.URL.Path)
+	proxy.countPush(req, matches != nil)
+	if matches != nil {
+		repo := matches[1]
+		reference := matches[2]
+		if req.Method == http.MethodHead && isDigest(reference) {
+			proxy.recordDigestPull(repo, reference, proxy.accessor(req))
+		} else if req.Method == http.MethodHead {
+			proxy.recordAccess(EventPulled, repo, reference, proxy.accessor(req), time.Now())
+		} else if req.Method == http.MethodPut && !isDigest(reference) {
+			proxy.recordAccess(EventPushed, repo, reference, proxy.accessor(req), time.Now())
 		}
 	}
 
@@ -131,176 +286,676 @@ func (proxy *Proxy) serveProxy(res http.ResponseWriter, req *http.Request) {
 		common.Log.Debugf("using x-forwarded-proto: %s", value)
 	}
 
-	proxy.RegistryProxy.ServeHTTP(res, req)
+	if matches == nil {
+		if repo, blobDigest, ok := blobCommit(req); ok && proxy.accountsPushes() {
+			proxy.serveBlobCommit(res, req, repo, blobDigest)
+			return
+		}
+		proxy.RegistryProxy.ServeHTTP(res, req)
+		return
+	}
+
+	recorder := &responseRecorder{ResponseWriter: res, status: http.StatusOK}
+	proxy.RegistryProxy.ServeHTTP(recorder, req)
+
+	repo := matches[1]
+	reference := matches[2]
+	if req.Method == http.MethodPut && recorder.status == http.StatusCreated && proxy.accountsPushes() {
+		proxy.accountManifest(req, recorder.Header().Get("Docker-Content-Digest"))
+	}
+	if (req.Method == http.MethodHead || req.Method == http.MethodPut) && !isDigest(reference) && recorder.status < 300 {
+		if digest := recorder.Header().Get("Docker-Content-Digest"); digest != "" {
+			proxy.recordDigest(&lru.Image{Repo: repo, Tag: reference}, digest)
+		}
+	} else if req.Method == http.MethodDelete && recorder.status == http.StatusAccepted {
+		proxy.recordDelete(repo, reference, proxy.accessor(req))
+	}
+}
+
+// isDigest reports whether a manifest reference is a digest rather than a tag
+func isDigest(reference string) bool {
+	return strings.Contains(reference, ":")
+}
+
+// recordDigestPull updates the access time of every tag pointing to a pulled digest
+// and counts a single pull for the repository
+func (proxy *Proxy) recordDigestPull(repo string, digest string, accessor string) {
+	images := proxy.Cache.GetTagsByDigest(repo, digest)
+	if len(images) == 0 {
+		return
+	}
+	accessTime := time.Now()
+	proxy.countAccess(repo, false, accessTime)
+	for _, image := range images {
+		proxy.updateAccess(EventPulled, repo, image.Tag, accessor, accessTime)
+	}
 }
 
-func (proxy *Proxy) runGarbageCollection(ctx context.Context) {
+// recordDelete removes a deleted tag from the cache, deleting a digest removes
+// every tag pointing to it
+func (proxy *Proxy) recordDelete(repo string, reference string, accessor string) {
+	var images []lru.Image
+	if isDigest(reference) {
+		images = proxy.Cache.GetTagsByDigest(repo, reference)
+		if len(images) == 0 {
+			go proxy.resolveDeletedTags(repo, reference, accessor)
+		}
+	} else if image, ok := proxy.Cache.Get(repo, reference); ok {
+		images = append(images, *image)
+	}
+
+	for _, image := range images {
+		image := image
+		proxy.removeDeleted(&image, reference, accessor)
+	}
+}
+
+// resolveDeletedTags checks the tags of a repository without a recorded digest against
+// the registry after a digest was deleted, the tags it no longer has pointed to it
+func (proxy *Proxy) resolveDeletedTags(repo string, reference string, accessor string) {
+	for _, image := range proxy.Cache.GetTagsWithoutDigest(repo) {
+		image := image
+		found, err := proxy.resolveDigest(proxy.ctx, &image)
+		if err != nil {
+			common.Log.Debugf("unable to resolve the digest of %s: %v", image.Name(), err)
+		} else if !found {
+			proxy.removeDeleted(&image, reference, accessor)
+		}
+	}
+}
+
+// removeDeleted removes a tag deleted through the registry api from the cache
+func (proxy *Proxy) removeDeleted(image *lru.Image, reference string, accessor string) {
+	common.Log.Infof("deleted %s", image.Name())
+	accessTime := image.AccessTime
+	proxy.emit(Event{
+		Type:           EventDeleted,
+		Image:          image.Name(),
+		Actor:          accessor,
+		LastAccessor:   proxy.Cache.GetMetadata(image).LastAccessor,
+		LastAccessTime: &accessTime,
+		Reason:         fmt.Sprintf("manifest %s deleted", reference),
+	})
+	proxy.Cache.Remove(image)
+}
+
+// responseRecorder captures the status of a proxied response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *responseRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *responseRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (recorder *responseRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+// recordAccess updates the access time of a tag for a push or pull seen by the proxy
+// or reported by a registry notification
+func (proxy *Proxy) recordAccess(eventType EventType, repo string, tag string, accessor string, accessTime time.Time) {
+	proxy.countAccess(repo, eventType == EventPushed, accessTime)
+	proxy.updateAccess(eventType, repo, tag, accessor, accessTime)
+}
+
+// updateAccess updates the access time of a tag without counting the pull or push
+func (proxy *Proxy) updateAccess(eventType EventType, repo string, tag string, accessor string, accessTime time.Time) {
+	image := fmt.Sprintf(`%s:%s`, repo, tag)
+	if eventType == EventPulled {
+		common.Log.Infof(`pulling %s`, image)
+	} else {
+		common.Log.Infof(`pushing %s`, image)
+	}
+	proxy.recent.add(string(eventType) + image)
+	proxy.emit(Event{Type: eventType, Image: image, Actor: accessor})
+
+	proxy.Cache.AddOrUpdate(&lru.Image{
+		Repo:       repo,
+		Tag:        tag,
+		AccessTime: accessTime,
+		Accessor:   accessor,
+	})
+}
+
+func (proxy *Proxy) runGarbageCollection(ctx context.Context, run *lru.CleanupRun) {
+	if proxy.stopping.Load() {
+		// the marker makes the next startup collect the garbage of tags evicted by this run
+		common.Log.Infof("proxy shutting down, skipping garbage collection")
+		common.LogIfError(proxy.Cache.MarkGarbageCollectionStarted(time.Now()))
+		return
+	}
 	if err := proxy.MaintenanceSemaphore.Acquire(ctx, writers); err != nil {
 		common.Log.Warnf("unable to acquire lock skipping garbage collection: %v", err)
 		return
 	}
 	defer proxy.MaintenanceSemaphore.Release(writers)
-	err := proxy.executeGarbageCollection(ctx)
+	startTime := time.Now()
+	proxy.emit(Event{Type: EventGCStarted, Reason: run.Trigger})
+	common.LogIfError(proxy.Cache.MarkGarbageCollectionStarted(startTime))
+	proxy.gcRunning.Store(true)
+	var output string
+	var err error
+	if proxy.Supervisor != nil && proxy.settings().OfflineGC {
+		output, err = proxy.executeOfflineGarbageCollection(ctx)
+	} else {
+		output, err = proxy.Backend.GarbageCollect(ctx)
+	}
+	proxy.gcRunning.Store(false)
 	common.LogIfError(err)
+	// a failed or interrupted collection keeps the marker, the next startup collects again
+	if err == nil && ctx.Err() == nil {
+		common.LogIfError(proxy.Cache.MarkGarbageCollectionFinished())
+	}
+
+	gc := lru.GarbageCollection{
+		StartTime: startTime,
+		Duration:  time.Since(startTime),
+		Output:    historyOutput(output),
+	}
+	if err != nil {
+		gc.Error = err.Error()
+	}
+	run.GarbageCollections = append(run.GarbageCollections, gc)
+	proxy.emit(Event{Type: EventGCFinished, Reason: run.Trigger, Duration: gc.Duration, Error: gc.Error})
+}
+
+// evictable returns the least recently used tags that may be evicted, and the
+// tags protected from eviction by a pin or lease
+func (proxy *Proxy) evictable() ([]lru.Image, []api.SkippedTag) {
+	metadata := proxy.Cache.GetAllMetadata()
+	now := time.Now()
+	var candidates []lru.Image
+	skipped := []api.SkippedTag{}
+	for _, image := range proxy.Cache.GetLruList() {
+		imageMetadata := metadata[image.Name()]
+		if reason, protected := imageMetadata.Protected(now); protected {
+			skipped = append(skipped, api.SkippedTag{Image: image.Name(), Reason: reason})
+			continue
+		}
+		candidates = append(candidates, image)
+	}
+	return candidates, skipped
+}
+
+// selectRemovals returns the least recently used tags removed by an iteration of a clean cycle
+func (settings *CleanSettings) selectRemovals(lruImages []lru.Image, iteration int, limits runLimits, evictedTags int) []lru.Image {
+	return lru.SelectRemovals(lruImages, settings.CleanTagsPercentage, iteration, limits.remainingTags(evictedTags))
+}
+
+// runCleanup starts a cleanup unless one is already running, triggered by
+// the cron schedule, the hard limit or any other source
+func (proxy *Proxy) runCleanup(ctx context.Context, trigger string) bool {
+	if proxy.stopping.Load() {
+		common.Log.Infof("proxy shutting down, skipping %s cleanup", trigger)
+		return false
+	}
+	if !proxy.cleanupLock.TryLock() {
+		common.Log.Infof("cleanup already running, skipping %s cleanup", trigger)
+		return false
+	}
+	proxy.runLockedCleanup(ctx, trigger)
+	return true
+}
+
+// runLockedCleanup runs a cleanup for a caller that acquired cleanupLock, the lock
+// is released once the cleanup stops
+func (proxy *Proxy) runLockedCleanup(ctx context.Context, trigger string) {
+	defer proxy.cleanupLock.Unlock()
+	common.Log.Infof("starting %s cleanup", trigger)
+	run := &lru.CleanupRun{
+		Trigger:   trigger,
+		StartTime: time.Now(),
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	proxy.running.start(trigger, run.StartTime, cancel)
+	defer proxy.running.stop()
+	common.LogIfError(proxy.Cache.BeginRun(lru.JournalRun{Trigger: trigger, StartTime: run.StartTime}))
+	defer func() {
+		common.LogIfError(proxy.Cache.EndRun())
+	}()
+	run.StopReason = string(proxy.cleanup(ctx, run))
+	run.EndTime = time.Now()
+	common.Log.Infof("%s cleanup stopped: %s", trigger, run.StopReason)
+	proxy.recordCleanupRun(run)
 }
 
-func (proxy *Proxy) cleanup(ctx context.Context) {
+// runningCleanup tracks the cleanup in progress so it can be reported and canceled
+type runningCleanup struct {
+	lock      sync.Mutex
+	trigger   string
+	startTime time.Time
+	cancel    context.CancelFunc
+}
+
+func (running *runningCleanup) start(trigger string, startTime time.Time, cancel context.CancelFunc) {
+	running.lock.Lock()
+	defer running.lock.Unlock()
+	running.trigger = trigger
+	running.startTime = startTime
+	running.cancel = cancel
+}
+
+func (running *runningCleanup) stop() {
+	running.start("", time.Time{}, nil)
+}
+
+// get returns the trigger and start time of the cleanup in progress
+func (running *runningCleanup) get() (string, time.Time, bool) {
+	running.lock.Lock()
+	defer running.lock.Unlock()
+	return running.trigger, running.startTime, running.cancel != nil
+}
+
+// cancelRun cancels the cleanup in progress, it reports false if no cleanup is running
+func (running *runningCleanup) cancelRun() bool {
+	running.lock.Lock()
+	defer running.lock.Unlock()
+	if running.cancel == nil {
+		return false
+	}
+	running.cancel()
+	return true
+}
+
+// recordCleanupRun stores a clean cycle in the history and prunes runs older than the
+// retention and beyond the maximum number of runs
+func (proxy *Proxy) recordCleanupRun(run *lru.CleanupRun) {
+	settings := proxy.settings()
+	common.LogIfError(proxy.Cache.AddCleanupRun(run))
+	if settings.HistoryRetention > 0 {
+		pruned, err := proxy.Cache.PruneCleanupRuns(time.Now().Add(-settings.HistoryRetention))
+		common.LogIfError(err)
+		if pruned > 0 {
+			common.Log.Debugf("pruned %d cleanup runs from history", pruned)
+		}
+	}
+	if settings.HistoryMaxRuns > 0 {
+		pruned, err := proxy.Cache.TrimCleanupRuns(settings.HistoryMaxRuns)
+		common.LogIfError(err)
+		if pruned > 0 {
+			common.Log.Debugf("pruned %d cleanup runs beyond %d from history", pruned, settings.HistoryMaxRuns)
+		}
+	}
+}
+
+// historyOutput keeps the last gcOutputHistoryBytes of garbage collection output for
+// the history, starting at a line
+func historyOutput(output string) string {
+	if len(output) <= gcOutputHistoryBytes {
+		return output
+	}
+	tail := output[len(output)-gcOutputHistoryBytes:]
+	if i := strings.IndexByte(tail, '\n'); i >= 0 && i < len(tail)-1 {
+		tail = tail[i+1:]
+	}
+	return fmt.Sprintf("[%d bytes of output truncated]\n%s", len(output)-len(tail), tail)
+}
+
+// evict deletes a tag from the registry and removes it from the cache, tags already
+// missing from the registry are removed from the cache as well
+func (proxy *Proxy) evict(ctx context.Context, image *lru.Image, reason string) error {
+	common.Log.Infof("Removing %s", image.CanonicalName(proxy.RegistryHost))
+	if err := proxy.Cache.JournalEviction(image, reason); err != nil {
+		return err
+	}
+	proxy.evicting.add(image.Name())
+	if err := proxy.Backend.DeleteTag(ctx, image.Repo, image.Tag); err != nil {
+		common.LogIfError(proxy.Cache.RollbackEviction(image))
+		return err
+	}
+	return proxy.completeEviction(image, reason)
+}
+
+// completeEviction removes a tag deleted from the registry from the cache and the journal
+func (proxy *Proxy) completeEviction(image *lru.Image, reason string) error {
+	accessTime := image.AccessTime
+	proxy.emit(Event{
+		Type:           EventEvicted,
+		Image:          image.Name(),
+		LastAccessor:   proxy.Cache.GetMetadata(image).LastAccessor,
+		LastAccessTime: &accessTime,
+		Reason:         reason,
+	})
+	return proxy.Cache.CompleteEviction(image)
+}
+
+func (proxy *Proxy) cleanup(ctx context.Context, run *lru.CleanupRun) api.StopReason {
+	settings := proxy.settings()
 	common.Log.Debugf(
 		"executing scheduled cleanup based on TZ=%s '%s'",
-		proxy.CleanSettings.TimeZone,
-		proxy.CleanSettings.CronSchedule)
+		settings.TimeZone,
+		settings.CronSchedule)
+
+	targetBytes := proxy.cleanupTarget(settings)
+	if targetBytes < settings.TargetUsageBytes {
+		common.Log.Infof("freeing space down to %d bytes, %d bytes of headroom below the target for forecast growth",
+			targetBytes, settings.TargetUsageBytes-targetBytes)
+	}
+
+	proxy.runGarbageCollection(ctx, run)
+	remove, startBytes := proxy.shouldRemoveTags(ctx, targetBytes)
+	run.StartBytes = startBytes
+	run.EndBytes = startBytes
+	if ctx.Err() != nil {
+		return api.StopCanceled
+	}
+	if !remove {
+		return api.StopTargetReached
+	}
+
+	if settings.EvictionLimits.Override {
+		proxy.breaker.reset()
+		common.Log.Warnf("eviction limits overridden, cleanup may remove every tag")
+	} else if reason, open := proxy.breaker.open(); open {
+		common.Log.Errorf("ALERT: registry above target but cleanup circuit breaker is open: %s", reason)
+		return api.StopBreakerOpen
+	}
 
-	proxy.runGarbageCollection(ctx)
-	remove, _ := proxy.shouldRemoveTags()
+	initialImages, _ := proxy.evictable()
+	limits := settings.EvictionLimits.forRun(len(initialImages), startBytes)
 	iteration := 0
+	evictedTags := 0
+	// recordedBytes sums the recorded sizes of the evicted tags, shared blobs are counted
+	// for every tag so it never falls below what the evictions free
+	var recordedBytes uint64
+
+	for {
+		if ctx.Err() != nil {
+			return api.StopCanceled
+		}
+		if proxy.stopping.Load() {
+			return api.StopShutdown
+		}
 
-	for remove {
-		lruImages := proxy.Cache.GetLruList()
-		common.Log.Infof("total tags: %d", len(lruImages))
-		minTagRemoval := math.Min(float64(iteration), 1)
-		percentageTagRemoval := math.Round(float64(len(lruImages)) * proxy.CleanSettings.CleanTagsPercentage)
-		removalTags := int(math.Max(percentageTagRemoval, minTagRemoval))
+		lruImages, protected := proxy.evictable()
+		common.Log.Infof("total tags: %d, protected tags: %d", len(lruImages)+len(protected), len(protected))
+		removals := settings.selectRemovals(lruImages, iteration, limits, evictedTags)
+		removalTags := len(removals)
 		common.Log.Infof("iteration %d: removing %d tags", iteration, removalTags)
 
-		for idx, image := range lruImages {
-			if idx < removalTags {
-				if ref, err := ref.New(image.CanonicalName(proxy.RegistryHost)); err == nil {
-					common.Log.Infof("Removing %s", ref.CommonName())
-					if err = proxy.RegClient.TagDelete(ctx, ref); err == nil {
-						proxy.Cache.Remove(&image)
-					} else if errors.Is(err, types.ErrNotFound) {
-						proxy.Cache.Remove(&image)
-					} else {
-						common.LogIfError(err)
-						if _, err := proxy.RegClient.ManifestGet(ctx, ref); err != nil && errors.Is(err, types.ErrNotFound) {
-							proxy.Cache.Remove(&image)
-						}
-					}
-				} else {
-					common.LogIfError(err)
+		removed := 0
+		byteLimitHit := false
+		reason := fmt.Sprintf(
+			"least recently used, registry using %d bytes above target %d bytes, %s cleanup iteration %d",
+			run.EndBytes,
+			targetBytes,
+			run.Trigger,
+			iteration)
+		for _, image := range removals {
+			size := proxy.Cache.GetMetadata(&image).Size
+			if limits.bytesWouldExceed(recordedBytes, size) {
+				byteLimitHit = true
+				break
+			}
+			if err := proxy.evict(ctx, &image, reason); err == nil {
+				removed++
+				evictedTags++
+				if size > 0 {
+					recordedBytes += uint64(size)
 				}
+				run.Evicted = append(run.Evicted, lru.EvictedTag{
+					Image:      image.Name(),
+					AccessTime: image.AccessTime,
+				})
 			} else {
-				break
+				common.LogIfError(err)
+				run.DeleteFailures = append(run.DeleteFailures, lru.DeleteFailure{
+					Image: image.Name(),
+					Error: err.Error(),
+				})
 			}
 		}
-		proxy.runGarbageCollection(ctx)
-		tryAgain, currentBytes := proxy.shouldRemoveTags()
-		if tryAgain && (len(lruImages)-removalTags) <= 0 {
+		proxy.runGarbageCollection(ctx, run)
+		tryAgain, currentBytes := proxy.shouldRemoveTags(ctx, targetBytes)
+		run.EndBytes = currentBytes
+		run.Iterations = append(run.Iterations, lru.CleanupIteration{
+			Iteration: iteration,
+			Removed:   removed,
+			UsedBytes: currentBytes,
+		})
+		var evictedBytes uint64 = 0
+		if currentBytes < startBytes {
+			evictedBytes = startBytes - currentBytes
+		}
+		if recordedBytes > evictedBytes {
+			evictedBytes = recordedBytes
+		}
+
+		if !tryAgain {
+			return api.StopTargetReached
+		} else if byteLimitHit {
+			proxy.breaker.trip(api.StopByteLimit)
+			common.Log.Warnf("evicting the next tag frees more than the limit of %d bytes after %d bytes - exiting cleanup with %d bytes", limits.maxBytes, recordedBytes, currentBytes)
+			return api.StopByteLimit
+		} else if (len(lruImages) - removalTags) <= 0 {
 			// we have reached a state where we can't remove anymore tags
-			remove = false
-			common.Log.Warnf("unable to reach regisry target %d bytes  - exiting cleanup with %d bytes", proxy.CleanSettings.TargetUsageBytes, currentBytes)
-		} else {
-			remove = tryAgain
+			common.Log.Warnf("unable to reach regisry target %d bytes  - exiting cleanup with %d bytes", targetBytes, currentBytes)
+			return api.StopNoTagsRemaining
+		} else if limits.tagsExceeded(evictedTags) {
+			proxy.breaker.trip(api.StopTagLimit)
+			common.Log.Warnf("evicted %d tags, limit is %d - exiting cleanup with %d bytes", evictedTags, limits.maxTags, currentBytes)
+			return api.StopTagLimit
+		} else if limits.bytesExceeded(evictedBytes) {
+			proxy.breaker.trip(api.StopByteLimit)
+			common.Log.Warnf("evicted %d bytes, limit is %d - exiting cleanup with %d bytes", evictedBytes, limits.maxBytes, currentBytes)
+			return api.StopByteLimit
 		}
 		iteration++
 	}
 }
 
-func (proxy *Proxy) executeGarbageCollection(ctx context.Context) error {
-	gc := exec.CommandContext(
-		ctx,
-		proxy.CleanSettings.RegistryBinary,
-		"garbage-collect",
-		"--delete-untagged",
-		proxy.CleanSettings.RegistryConfig)
+// hardLimitExceeded reports whether the registry is above the hard disk limit,
+// starting an emergency cleanup when the limit is first crossed. it reads the last
+// measured usage and refreshes it in the background once it is older than
+// HardLimitCheckInterval, so uploads never wait for a measurement
+func (proxy *Proxy) hardLimitExceeded() bool {
+	settings := proxy.settings()
+	if settings.HardLimitBytes == 0 {
+		return false
+	}
 
-	var combinedOutput bytes.Buffer
-	gc.Stdout = &combinedOutput
-	gc.Stderr = &combinedOutput
+	proxy.usageLock.Lock()
+	usedBytes := proxy.usageBytes
+	stale := time.Since(proxy.usageCheckTime) >= settings.HardLimitCheckInterval
+	proxy.usageLock.Unlock()
+	if stale {
+		proxy.refreshUsage()
+	}
 
-	if err := gc.Run(); err != nil {
-		common.Log.Warnf("gc: %s", combinedOutput.String())
-		return err
+	if usedBytes < settings.HardLimitBytes {
+		if proxy.emergency.CompareAndSwap(true, false) {
+			common.Log.Infof("registry using %d bytes, below hard limit %d bytes - accepting uploads", usedBytes, settings.HardLimitBytes)
+		}
+		return false
 	}
-	common.Log.Infof("gc: %s", combinedOutput.String())
 
-	return nil
+	if proxy.emergency.CompareAndSwap(false, true) {
+		common.Log.Warnf("registry using %d bytes, above hard limit %d bytes - starting emergency cleanup", usedBytes, settings.HardLimitBytes)
+		go proxy.emergencyCleanup()
+	}
+	return true
 }
 
-func (proxy *Proxy) shouldRemoveTags() (bool, uint64) {
-	var usedBytes uint64 = 0
-	var err error = nil
-	if proxy.CleanSettings.UseOptimizedDiskCalculation {
-		usedBytes, err = sizeOfDisk(proxy.CleanSettings.RegistryDir)
+func (proxy *Proxy) emergencyCleanup() {
+	settings := proxy.settings()
+	proxy.runCleanup(proxy.ctx, "emergency")
+	usedBytes := proxy.measureUsage(proxy.ctx)
+	if usedBytes >= settings.HardLimitBytes {
+		common.Log.Warnf("emergency cleanup unable to reach hard limit %d bytes - registry using %d bytes", settings.HardLimitBytes, usedBytes)
 	} else {
-		usedBytes, err = sizeOfDir(proxy.CleanSettings.RegistryDir)
+		common.Log.Infof("emergency cleanup complete, registry using %d bytes", usedBytes)
 	}
-	common.LogIfError(err)
-
-	common.Log.Debugf("registry using %d bytes", usedBytes)
-	common.Log.Debugf("registry target %d bytes", proxy.CleanSettings.TargetUsageBytes)
-
-	return usedBytes > proxy.CleanSettings.TargetUsageBytes, usedBytes
+	// the next upload above the hard limit starts another emergency cleanup
+	proxy.emergency.Store(false)
 }
 
-func sizeOfDisk(path string) (uint64, error) {
-	var stat unix.Statfs_t
-	if err := unix.Statfs(path, &stat); err != nil {
-		common.LogIfError(err)
-		return 0, err
+// refreshUsage measures usage in the background unless a refresh is already running
+func (proxy *Proxy) refreshUsage() {
+	if !proxy.usageRefreshing.CompareAndSwap(false, true) {
+		return
 	}
+	go func() {
+		defer proxy.usageRefreshing.Store(false)
+		proxy.measureUsage(proxy.ctx)
+	}()
+}
+
+// measureUsage calculates the bytes used by the registry and records the result
+// for the hard limit check
+func (proxy *Proxy) measureUsage(ctx context.Context) uint64 {
+	usedBytes, err := proxy.Backend.Usage(ctx)
+	common.LogIfError(err)
+
+	proxy.usageLock.Lock()
+	proxy.usageBytes = usedBytes
+	proxy.usageCheckTime = time.Now()
+	proxy.usageLock.Unlock()
 
-	usedBytes := (stat.Blocks * uint64(stat.Bsize)) - (stat.Bfree * uint64(stat.Bsize))
-	return usedBytes, nil
+	return usedBytes
 }
 
-func sizeOfDir(path string) (uint64, error) {
-	var size int64 = 0
+func (proxy *Proxy) shouldRemoveTags(ctx context.Context, targetBytes uint64) (bool, uint64) {
+	usedBytes := proxy.measureUsage(ctx)
 
-	readSize := func(path string, file os.FileInfo, err error) error {
-		if !file.IsDir() {
-			size += file.Size()
-		}
-		return nil
-	}
+	common.Log.Debugf("registry using %d bytes", usedBytes)
+	common.Log.Debugf("registry target %d bytes", targetBytes)
 
-	err := filepath.Walk(path, readSize)
+	return usedBytes > targetBytes, usedBytes
+}
 
-	return uint64(size), err
+// writeRegistryError writes an error body in the format defined by the OCI distribution spec
+func writeRegistryError(res http.ResponseWriter, status int, code string, message string) {
+	body, err := json.Marshal(map[string]interface{}{
+		"errors": []map[string]string{
+			{
+				"code":    code,
+				"message": message,
+			},
+		},
+	})
+	common.LogIfError(err)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	_, err = res.Write(body)
+	common.LogIfError(err)
 }
 
 func (proxy *Proxy) listenAndServe() {
+	var err error
 	if proxy.Server.TLSConfig != nil {
-		if err := proxy.Server.ListenAndServeTLS("", ""); err != nil {
-			common.ExitIfError(err)
-		}
+		err = proxy.Server.ListenAndServeTLS("", "")
 	} else {
-		if err := proxy.Server.ListenAndServe(); err != nil {
-			common.ExitIfError(err)
-		}
+		err = proxy.Server.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		common.ExitIfError(err)
 	}
 }
 
 func (proxy *Proxy) RunProxy(ctx context.Context) {
 	proxyCtx, cancel := context.WithCancel(ctx)
+	proxy.ctx = proxyCtx
 
 	proxy.MaintenanceSemaphore = semaphore.NewWeighted(writers)
+	proxy.recent.window = proxy.NotificationWindow
+	proxy.evicting.window = evictingWindow
+	proxy.startEvents()
+	proxy.settingsLock.Lock()
 	location, err := time.LoadLocation(proxy.CleanSettings.TimeZone)
-	if err != nil {
-		common.Log.Warnf("unable to parse timezone %s, falling back to UTC", proxy.CleanSettings.TimeZone)
-		location = time.UTC
-	}
+	common.ExitIfError(err)
 	proxy.MaintenanceScheduler = gocron.NewScheduler(location)
-	proxy.MaintenanceScheduler.Cron(proxy.CleanSettings.CronSchedule).SingletonMode().Do(func() { proxy.cleanup(proxyCtx) })
-	proxy.MaintenanceScheduler.StartAsync()
+	common.ExitIfError(proxy.scheduleCleanup(proxy.CleanSettings.CronSchedule, location))
+	common.ExitIfError(proxy.scheduleSampling(proxy.CleanSettings.Forecast.SampleInterval))
+	proxy.settingsLock.Unlock()
+	if proxy.SnapshotSettings.Dir != "" {
+		_, err = proxy.MaintenanceScheduler.Cron(proxy.SnapshotSettings.CronSchedule).SingletonMode().Do(proxy.snapshot)
+		common.ExitIfError(err)
+	}
+	// the first accrual and flush run an interval after the scheduler starts rather than
+	// fetching every manifest while the proxy starts
+	_, err = proxy.MaintenanceScheduler.Every(accrualInterval).WaitForSchedule().SingletonMode().Do(proxy.accrueByteHours)
+	common.ExitIfError(err)
+	_, err = proxy.MaintenanceScheduler.Every(activityFlushInterval).WaitForSchedule().SingletonMode().Do(proxy.flushActivity)
+	common.ExitIfError(err)
+	if proxy.ReportSettings.Dir != "" {
+		_, err = proxy.MaintenanceScheduler.Cron(proxy.ReportSettings.CronSchedule).SingletonMode().Do(proxy.writeReport)
+		common.ExitIfError(err)
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", proxy.serveProxy)
 	mux.HandleFunc("/healthz", proxy.healthz)
+	mux.HandleFunc("/livez", proxy.livez)
+	mux.HandleFunc("/readyz", proxy.readyz)
+	mux.HandleFunc("/metrics", proxy.metrics)
+	if proxy.AdminToken != "" {
+		mux.Handle("/admin/", proxy.adminHandler())
+	}
+	if proxy.NotificationSecret != "" {
+		mux.HandleFunc("/events", proxy.receiveNotifications)
+	}
 	proxy.Server.Handler = mux
 
-	err = proxy.Cache.Init()
-	common.ExitIfError(err)
+	if err = proxy.Cache.Init(); err != nil {
+		common.ExitIfError(fmt.Errorf("unable to initialize usage.db, check it with db verify: %w", err))
+	}
+	proxy.breaker.restore(proxy.Cache)
+
+	// registered before the registry starts so a shutdown signal stops it
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	if proxy.Supervisor != nil {
+		proxy.startRegistry(proxyCtx, cancel)
+	}
+
+	// jobs start once usage.db is initialized and the supervised registry is up, byte-hours
+	// accrue from here
+	proxy.accrual.lock.Lock()
+	proxy.accrual.last = time.Now()
+	proxy.accrual.lock.Unlock()
+	proxy.MaintenanceScheduler.StartAsync()
+
+	if proxy.UsageTracker != nil {
+		go proxy.UsageTracker.Run(proxyCtx)
+	}
+	if proxy.DeleteProbe {
+		go proxy.runDeleteProbe()
+	}
+	go proxy.recoverInterruptedCleanup()
+	if proxy.settings().HardLimitBytes > 0 {
+		// the hard limit check reads usage measured in the background
+		proxy.refreshUsage()
+	}
+	go func() {
+		proxy.backfillDigests()
+		if proxy.RecordSizes {
+			proxy.backfillSizes()
+		}
+	}()
 
 	go proxy.listenAndServe()
 
-	// listen for shutdown signal
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
-	<-signalChan
-	cancel()
+	// listen for reload, cleanup and diagnostics signals until a shutdown signal
+	proxy.handleSignals(signalChan)
 	common.Log.Infof("received shutdown signal, shutting down proxy")
-	if err := proxy.Server.Shutdown(context.Background()); err != nil {
-		common.Log.Infof("proxy shutdown: %v", err)
-	}
+	go func() {
+		for sig := range signalChan {
+			if sig == syscall.SIGINT || sig == syscall.SIGTERM {
+				common.Log.Warnf("received second shutdown signal, exiting")
+				os.Exit(1)
+			}
+		}
+	}()
+	proxy.shutdown(cancel)
 }
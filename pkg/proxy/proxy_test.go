@@ -0,0 +1,87 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+	bolt "go.etcd.io/bbolt"
+)
+
+func testProxy(t *testing.T) *Proxy {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "usage.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	proxy := &Proxy{Cache: &lru.Cache{Db: db}}
+	if err = proxy.Cache.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return proxy
+}
+
+// lruNames returns the sorted names of images separated by spaces
+func lruNames(images []lru.Image) string {
+	var names []string
+	for _, image := range images {
+		names = append(names, image.Name())
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+func TestDigestPullKeepsEveryTagEvictable(t *testing.T) {
+	proxy := testProxy(t)
+	pushTime := time.Now().Add(-time.Hour)
+	for idx, tag := range []string{"a", "b", "c"} {
+		image := &lru.Image{Repo: "app", Tag: tag, AccessTime: pushTime.Add(time.Duration(idx) * time.Second)}
+		proxy.Cache.AddOrUpdate(image)
+		if err := proxy.Cache.SetDigest(image, "sha256:shared"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	proxy.Cache.AddOrUpdate(&lru.Image{Repo: "app", Tag: "other", AccessTime: time.Now()})
+
+	// the second pull moves the tags again within the same second
+	proxy.recordDigestPull("app", "sha256:shared", "")
+	proxy.recordDigestPull("app", "sha256:shared", "")
+
+	lruImages := proxy.Cache.GetLruList()
+	if names := lruNames(lruImages); names != "app:a app:b app:c app:other" {
+		t.Fatalf("expected every tag in the lru list, got %s", names)
+	}
+	for _, image := range lruImages {
+		image := image
+		if image.Tag != "other" && !image.AccessTime.After(pushTime.Add(time.Minute)) {
+			t.Errorf("expected the access time of %s updated by the pull, got %s", image.Name(), image.AccessTime)
+		}
+		proxy.Cache.Remove(&image)
+		if _, found := proxy.Cache.Get(image.Repo, image.Tag); found {
+			t.Errorf("expected %s evicted", image.Name())
+		}
+	}
+	if lruImages = proxy.Cache.GetLruList(); len(lruImages) != 0 {
+		t.Errorf("expected an empty lru list after evicting every tag, got %s", lruNames(lruImages))
+	}
+}
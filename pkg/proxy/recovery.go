@@ -0,0 +1,156 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/api"
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+	"github.com/regclient/regclient/types"
+	"github.com/regclient/regclient/types/ref"
+)
+
+const (
+	// recoveryCheckTimeout bounds the registry check of a pending eviction
+	recoveryCheckTimeout = 30 * time.Second
+)
+
+// recoverInterruptedCleanup resolves the evictions pending in the journal and runs
+// garbage collection again when a clean cycle or garbage collection was interrupted
+// by a crash or shutdown, once a clean cycle that is already running finishes.
+// evictions the registry could not be checked for stay in the journal until the
+// next startup
+func (proxy *Proxy) recoverInterruptedCleanup() {
+	if !proxy.cleanupInterrupted() {
+		return
+	}
+	if !proxy.cleanupLock.TryLock() {
+		common.Log.Infof("cleanup running, recovering the interrupted cleanup once it finishes")
+		proxy.cleanupLock.Lock()
+	}
+	defer proxy.cleanupLock.Unlock()
+	if proxy.stopping.Load() || proxy.ctx.Err() != nil {
+		common.Log.Infof("proxy shutting down, recovering the interrupted cleanup on the next startup")
+		return
+	}
+
+	// a clean cycle that ran in the meantime may have resolved part of the journal
+	interruptedRun, pending, err := proxy.Cache.Journal()
+	if err != nil {
+		common.Log.Warnf("unable to read the cleanup journal: %v", err)
+		return
+	}
+	gcStartTime, gcInterrupted := proxy.Cache.GarbageCollectionInterrupted()
+	if interruptedRun == nil && len(pending) == 0 && !gcInterrupted {
+		return
+	}
+
+	run := &lru.CleanupRun{
+		Trigger:   "recovery",
+		StartTime: time.Now(),
+	}
+	ctx, cancel := context.WithCancel(proxy.ctx)
+	defer cancel()
+	proxy.running.start(run.Trigger, run.StartTime, cancel)
+	defer proxy.running.stop()
+
+	if interruptedRun != nil {
+		common.Log.Warnf("%s cleanup started at %s was interrupted, recovering", interruptedRun.Trigger, interruptedRun.StartTime.Format(time.RFC3339))
+	}
+	if gcInterrupted {
+		common.Log.Warnf("garbage collection started at %s was interrupted, running it again", gcStartTime.Format(time.RFC3339))
+	}
+
+	for _, entry := range pending {
+		if ctx.Err() != nil {
+			break
+		}
+		if evicted, err := proxy.resolveEviction(ctx, entry); err != nil {
+			common.Log.Warnf("unable to resolve pending eviction of %s, retrying on next startup: %v", entry.Image, err)
+			run.DeleteFailures = append(run.DeleteFailures, lru.DeleteFailure{
+				Image: entry.Image,
+				Error: err.Error(),
+			})
+		} else if evicted {
+			run.Evicted = append(run.Evicted, lru.EvictedTag{
+				Image:      entry.Image,
+				AccessTime: entry.AccessTime,
+			})
+		}
+	}
+
+	if interruptedRun != nil || gcInterrupted || len(run.Evicted) > 0 {
+		proxy.runGarbageCollection(ctx, run)
+	}
+	run.StartBytes = proxy.measureUsage(ctx)
+	run.EndBytes = run.StartBytes
+	run.StopReason = string(api.StopRecovered)
+	if ctx.Err() != nil {
+		run.StopReason = string(api.StopCanceled)
+	} else if interruptedRun != nil {
+		common.LogIfError(proxy.Cache.EndRun())
+	}
+	run.EndTime = time.Now()
+	proxy.recordCleanupRun(run)
+}
+
+// cleanupInterrupted reports whether the journal or the garbage collection marker hold
+// a clean cycle to recover
+func (proxy *Proxy) cleanupInterrupted() bool {
+	interruptedRun, pending, err := proxy.Cache.Journal()
+	if err != nil {
+		common.Log.Warnf("unable to read the cleanup journal: %v", err)
+		return false
+	}
+	_, gcInterrupted := proxy.Cache.GarbageCollectionInterrupted()
+	return interruptedRun != nil || len(pending) > 0 || gcInterrupted
+}
+
+// resolveEviction completes a pending eviction when the tag is gone from the registry
+// and rolls it back when the tag still exists, it reports whether the tag was evicted
+func (proxy *Proxy) resolveEviction(ctx context.Context, entry lru.JournalEntry) (bool, error) {
+	repo, tag, ok := lru.ParseName(entry.Image)
+	if !ok {
+		return false, fmt.Errorf("invalid image name %q", entry.Image)
+	}
+	image, cached := proxy.Cache.Get(repo, tag)
+	r, err := ref.New(image.CanonicalName(proxy.RegistryHost))
+	if err != nil {
+		return false, err
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, recoveryCheckTimeout)
+	defer cancel()
+	_, err = proxy.RegClient.ManifestHead(checkCtx, r)
+	switch {
+	case err == nil:
+		common.Log.Infof("%s is still in the registry, rolling back its eviction", entry.Image)
+		return false, proxy.Cache.RollbackEviction(image)
+	case errors.Is(err, types.ErrNotFound) && !cached:
+		return false, proxy.Cache.RollbackEviction(image)
+	case errors.Is(err, types.ErrNotFound):
+		common.Log.Infof("%s was deleted from the registry, completing its eviction", entry.Image)
+		return true, proxy.completeEviction(image, fmt.Sprintf("completed after restart: %s", entry.Reason))
+	default:
+		return false, err
+	}
+}
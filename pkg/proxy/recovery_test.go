@@ -0,0 +1,60 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRecoveryWaitsForRunningCleanup(t *testing.T) {
+	proxy, _ := cleanupProxy(t, 0, 0, false, CleanSettings{})
+	proxy.ctx = context.Background()
+	if err := proxy.Cache.MarkGarbageCollectionStarted(time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.cleanupLock.Lock()
+	recovered := make(chan struct{})
+	go func() {
+		defer close(recovered)
+		proxy.recoverInterruptedCleanup()
+	}()
+	select {
+	case <-recovered:
+		t.Fatal("expected recovery to wait for the running cleanup")
+	case <-time.After(100 * time.Millisecond):
+	}
+	proxy.cleanupLock.Unlock()
+	select {
+	case <-recovered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected recovery to run once the cleanup finished")
+	}
+
+	if _, interrupted := proxy.Cache.GarbageCollectionInterrupted(); interrupted {
+		t.Errorf("expected the interrupted garbage collection to run again")
+	}
+	runs, err := proxy.Cache.GetCleanupRuns(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].Trigger != "recovery" {
+		t.Errorf("expected a recovery run in the history, got %+v", runs)
+	}
+}
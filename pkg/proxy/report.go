@@ -0,0 +1,407 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/api"
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+)
+
+const (
+	ReportCSV  = "csv"
+	ReportJSON = "json"
+
+	reportPrefix = "usage-report-"
+	// accrualInterval is how often the byte-hours of the cached tags are added to usage.db
+	accrualInterval = 15 * time.Minute
+	// activityFlushInterval is how often the pulls and pushes counted in memory are added to usage.db
+	activityFlushInterval = 10 * time.Second
+)
+
+// ReportFormats are the formats usage reports are written in
+var ReportFormats = []string{ReportCSV, ReportJSON}
+
+// ReportSettings configures scheduled usage reports and how long the activity they are
+// computed from is kept, scheduled reports are disabled when Dir is empty
+type ReportSettings struct {
+	Dir               string
+	CronSchedule      string
+	Window            time.Duration
+	Format            string
+	ActivityRetention time.Duration
+}
+
+// accrual remembers when byte-hours were last added
+type accrual struct {
+	lock sync.Mutex
+	last time.Time
+}
+
+// activityCounts holds the pulls and pushes of each day and repository counted since
+// they were last added to usage.db
+type activityCounts struct {
+	lock   sync.Mutex
+	counts map[time.Time]map[string]lru.Activity
+}
+
+// manifestCache holds the blobs referenced by each manifest, keyed by repository and
+// digest. a manifest never changes, so entries are kept while a cached tag points to them
+type manifestCache struct {
+	lock  sync.Mutex
+	blobs map[string]map[string]int64
+}
+
+func (cache *manifestCache) get(key string) (map[string]int64, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	blobs, ok := cache.blobs[key]
+	return blobs, ok
+}
+
+func (cache *manifestCache) put(key string, blobs map[string]int64) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.blobs == nil {
+		cache.blobs = map[string]map[string]int64{}
+	}
+	cache.blobs[key] = blobs
+}
+
+// retain drops the manifests no cached tag points to anymore
+func (cache *manifestCache) retain(referenced map[string]bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for key := range cache.blobs {
+		if !referenced[key] {
+			delete(cache.blobs, key)
+		}
+	}
+}
+
+// Namespace returns the first path component of a repository, a repository without
+// one is its own namespace
+func Namespace(repo string) string {
+	namespace, _, _ := strings.Cut(repo, "/")
+	return namespace
+}
+
+// Report computes the usage of each namespace and repository from the cached tags and
+// the blobs their manifests reference, and their activity from the day window ago
+func (proxy *Proxy) Report(ctx context.Context, window time.Duration) (*api.UsageReport, error) {
+	now := time.Now()
+	since := now.Add(-window).UTC().Truncate(24 * time.Hour)
+	report := &api.UsageReport{
+		GeneratedAt: now,
+		Since:       since,
+	}
+	repoBlobs, tags, unknown, err := proxy.storedBlobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report.UnknownSizeTags = unknown
+	proxy.flushActivity()
+	activities, err := proxy.Cache.GetActivity(since)
+	if err != nil {
+		return nil, err
+	}
+	buildReport(report, repoBlobs, tags, activities)
+	return report, nil
+}
+
+// storedBlobs returns the blobs and the number of tags of each repository and the number
+// of tags whose manifest could not be read. the blobs of a recorded digest come from the
+// manifest cache, so only manifests not seen by a previous call are fetched
+func (proxy *Proxy) storedBlobs(ctx context.Context) (map[string]map[string]int64, map[string]int, int, error) {
+	metadata := proxy.Cache.GetAllMetadata()
+	repoBlobs := map[string]map[string]int64{}
+	tags := map[string]int{}
+	unknown := 0
+	// tags are read from the images bucket, the access index drops tags accessed in the same second
+	records, err := proxy.Cache.Export()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	referenced := map[string]bool{}
+	failed := map[string]bool{}
+	for _, record := range records {
+		if ctx.Err() != nil {
+			return nil, nil, 0, ctx.Err()
+		}
+		repo, tag, ok := lru.ParseName(record.Image)
+		if !ok {
+			continue
+		}
+		image := lru.Image{Repo: repo, Tag: tag, AccessTime: record.AccessTime}
+		tags[image.Repo]++
+		digest := metadata[image.Name()].Digest
+		key := image.Repo + "@" + digest
+		if digest != "" {
+			referenced[key] = true
+		}
+		if failed[key] {
+			unknown++
+			continue
+		}
+		blobs, err := proxy.manifestBlobs(ctx, &image, digest)
+		if err != nil {
+			common.Log.Debugf("unable to read the blobs of %s: %v", image.Name(), err)
+			if digest != "" {
+				failed[key] = true
+			}
+			unknown++
+			continue
+		}
+		if repoBlobs[image.Repo] == nil {
+			repoBlobs[image.Repo] = map[string]int64{}
+		}
+		for digest, size := range blobs {
+			repoBlobs[image.Repo][digest] = size
+		}
+	}
+	proxy.manifests.retain(referenced)
+	return repoBlobs, tags, unknown, nil
+}
+
+// buildReport adds an entry for each repository with tags or activity and for each of
+// their namespaces. a blob is unique to a repository or namespace when no other one
+// references it
+func buildReport(report *api.UsageReport, repoBlobs map[string]map[string]int64, tags map[string]int, activities map[string]lru.Activity) {
+	report.Namespaces = []api.UsageReportEntry{}
+	report.Repositories = []api.UsageReportEntry{}
+
+	repos := map[string]bool{}
+	for repo := range tags {
+		repos[repo] = true
+	}
+	for repo := range activities {
+		repos[repo] = true
+	}
+
+	// count the repositories and namespaces referencing each blob
+	namespaceBlobs := map[string]map[string]int64{}
+	blobRepos := map[string]int{}
+	blobNamespaces := map[string]map[string]bool{}
+	for repo, blobs := range repoBlobs {
+		namespace := Namespace(repo)
+		if namespaceBlobs[namespace] == nil {
+			namespaceBlobs[namespace] = map[string]int64{}
+		}
+		for digest, size := range blobs {
+			namespaceBlobs[namespace][digest] = size
+			blobRepos[digest]++
+			if blobNamespaces[digest] == nil {
+				blobNamespaces[digest] = map[string]bool{}
+			}
+			blobNamespaces[digest][namespace] = true
+		}
+	}
+
+	namespaces := map[string]*api.UsageReportEntry{}
+	for repo := range repos {
+		entry := api.UsageReportEntry{
+			Name:      repo,
+			Namespace: Namespace(repo),
+			Tags:      tags[repo],
+			Pulls:     activities[repo].Pulls,
+			Pushes:    activities[repo].Pushes,
+			ByteHours: activities[repo].ByteHours,
+		}
+		addBlobs(&entry, repoBlobs[repo], func(digest string) bool { return blobRepos[digest] == 1 })
+		report.Repositories = append(report.Repositories, entry)
+
+		namespace := namespaces[entry.Namespace]
+		if namespace == nil {
+			namespace = &api.UsageReportEntry{Name: entry.Namespace}
+			addBlobs(namespace, namespaceBlobs[entry.Namespace], func(digest string) bool { return len(blobNamespaces[digest]) == 1 })
+			namespaces[entry.Namespace] = namespace
+		}
+		namespace.Tags += entry.Tags
+		namespace.Pulls += entry.Pulls
+		namespace.Pushes += entry.Pushes
+		namespace.ByteHours += entry.ByteHours
+	}
+	for _, namespace := range namespaces {
+		report.Namespaces = append(report.Namespaces, *namespace)
+	}
+	sortEntries(report.Namespaces)
+	sortEntries(report.Repositories)
+}
+
+// addBlobs adds the blobs of a namespace or repository to its stored, unique and shared bytes
+func addBlobs(entry *api.UsageReportEntry, blobs map[string]int64, unique func(digest string) bool) {
+	for digest, size := range blobs {
+		entry.StoredBytes += uint64(size)
+		if unique(digest) {
+			entry.UniqueBytes += uint64(size)
+		} else {
+			entry.SharedBytes += uint64(size)
+		}
+	}
+}
+
+// sortEntries orders entries by stored bytes, largest first
+func sortEntries(entries []api.UsageReportEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].StoredBytes != entries[j].StoredBytes {
+			return entries[i].StoredBytes > entries[j].StoredBytes
+		}
+		return entries[i].Name < entries[j].Name
+	})
+}
+
+// writeUsageReport writes the report as csv or indented json
+func writeUsageReport(w io.Writer, report *api.UsageReport, format string) error {
+	switch format {
+	case ReportJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case ReportCSV:
+		header, rows := report.Records()
+		writer := csv.NewWriter(w)
+		if err := writer.Write(header); err != nil {
+			return err
+		}
+		return writer.WriteAll(rows)
+	default:
+		return fmt.Errorf("unsupported report format %s, must be csv or json", format)
+	}
+}
+
+// writeReport writes a usage report to the report directory, the file is renamed into
+// place once complete
+func (proxy *Proxy) writeReport() {
+	settings := proxy.ReportSettings
+	startTime := time.Now()
+	report, err := proxy.Report(proxy.ctx, settings.Window)
+	if err != nil {
+		common.Log.Errorf("usage report failed: %v", err)
+		return
+	}
+	if err = os.MkdirAll(settings.Dir, 0700); err != nil {
+		common.Log.Errorf("usage report failed: %v", err)
+		return
+	}
+	path := filepath.Join(
+		settings.Dir,
+		fmt.Sprintf("%s%s.%s", reportPrefix, startTime.UTC().Format("20060102T150405Z"), settings.Format))
+	file, err := os.CreateTemp(settings.Dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		common.Log.Errorf("usage report failed: %v", err)
+		return
+	}
+	defer os.Remove(file.Name())
+	err = writeUsageReport(file, report, settings.Format)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		common.Log.Errorf("usage report failed: %v", err)
+		return
+	}
+	common.Log.Infof("wrote usage report %s, %d namespaces and %d repositories in %s",
+		path, len(report.Namespaces), len(report.Repositories), time.Since(startTime).Round(time.Millisecond))
+}
+
+// accrueByteHours adds the stored bytes of each repository times the hours since the
+// previous accrual to usage.db. stored bytes are computed from the same blobs as the
+// stored bytes of usage reports. nothing accrues until the time of a previous accrual
+// is known
+func (proxy *Proxy) accrueByteHours() {
+	repoBlobs, _, _, err := proxy.storedBlobs(proxy.ctx)
+	if err != nil {
+		common.Log.Errorf("unable to accrue byte-hours: %v", err)
+		return
+	}
+	now := time.Now()
+	proxy.accrual.lock.Lock()
+	last := proxy.accrual.last
+	proxy.accrual.last = now
+	proxy.accrual.lock.Unlock()
+	if last.IsZero() {
+		return
+	}
+
+	hours := now.Sub(last).Hours()
+	activities := map[string]lru.Activity{}
+	for repo, blobs := range repoBlobs {
+		stored := int64(0)
+		for _, size := range blobs {
+			stored += size
+		}
+		activities[repo] = lru.Activity{ByteHours: float64(stored) * hours}
+	}
+	common.LogIfError(proxy.Cache.AddActivity(now, activities))
+
+	if proxy.ReportSettings.ActivityRetention > 0 {
+		pruned, err := proxy.Cache.PruneActivity(now.Add(-proxy.ReportSettings.ActivityRetention))
+		common.LogIfError(err)
+		if pruned > 0 {
+			common.Log.Debugf("pruned %d activity entries", pruned)
+		}
+	}
+}
+
+// countAccess counts a pull or push of a repository in memory, flushActivity adds the
+// counts to usage.db so requests do not wait on a write
+func (proxy *Proxy) countAccess(repo string, pushed bool, accessTime time.Time) {
+	day := accessTime.UTC().Truncate(24 * time.Hour)
+	proxy.activity.lock.Lock()
+	defer proxy.activity.lock.Unlock()
+	if proxy.activity.counts == nil {
+		proxy.activity.counts = map[time.Time]map[string]lru.Activity{}
+	}
+	if proxy.activity.counts[day] == nil {
+		proxy.activity.counts[day] = map[string]lru.Activity{}
+	}
+	activity := proxy.activity.counts[day][repo]
+	if pushed {
+		activity.Pushes++
+	} else {
+		activity.Pulls++
+	}
+	proxy.activity.counts[day][repo] = activity
+}
+
+// flushActivity adds the pulls and pushes counted in memory to usage.db
+func (proxy *Proxy) flushActivity() {
+	proxy.activity.lock.Lock()
+	counts := proxy.activity.counts
+	proxy.activity.counts = nil
+	proxy.activity.lock.Unlock()
+	for day, activities := range counts {
+		if err := proxy.Cache.AddActivity(day, activities); err != nil {
+			common.Log.Errorf("unable to record the activity of %s: %v", day.Format("2006-01-02"), err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/api"
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+	bolt "go.etcd.io/bbolt"
+)
+
+func reportEntry(t *testing.T, entries []api.UsageReportEntry, name string) api.UsageReportEntry {
+	t.Helper()
+	for _, entry := range entries {
+		if entry.Name == name {
+			return entry
+		}
+	}
+	t.Fatalf("no entry for %s", name)
+	return api.UsageReportEntry{}
+}
+
+func TestBuildReportSplitsUniqueAndSharedBytes(t *testing.T) {
+	// base is shared by every repository, lib by the repositories of team only
+	repoBlobs := map[string]map[string]int64{
+		"team/app": {"base": 100, "lib": 10, "app": 1},
+		"team/api": {"base": 100, "lib": 10, "api": 2},
+		"other":    {"base": 100, "other": 4},
+	}
+	tags := map[string]int{"team/app": 2, "team/api": 1, "other": 1}
+	activities := map[string]lru.Activity{
+		"team/app": {Pulls: 5, Pushes: 1, ByteHours: 111},
+		"team/api": {Pulls: 1},
+		// evicted repositories are reported with their activity only
+		"team/old": {Pulls: 7},
+	}
+	report := &api.UsageReport{}
+	buildReport(report, repoBlobs, tags, activities)
+
+	for _, expected := range []api.UsageReportEntry{
+		{Name: "team/app", Namespace: "team", StoredBytes: 111, UniqueBytes: 1, SharedBytes: 110, Tags: 2, Pulls: 5, Pushes: 1, ByteHours: 111},
+		{Name: "team/api", Namespace: "team", StoredBytes: 112, UniqueBytes: 2, SharedBytes: 110, Tags: 1, Pulls: 1},
+		{Name: "team/old", Namespace: "team", Pulls: 7},
+		{Name: "other", Namespace: "other", StoredBytes: 104, UniqueBytes: 4, SharedBytes: 100, Tags: 1},
+	} {
+		if entry := reportEntry(t, report.Repositories, expected.Name); entry != expected {
+			t.Errorf("expected repository %+v, got %+v", expected, entry)
+		}
+	}
+	for _, expected := range []api.UsageReportEntry{
+		{Name: "team", StoredBytes: 113, UniqueBytes: 13, SharedBytes: 100, Tags: 3, Pulls: 13, Pushes: 1, ByteHours: 111},
+		{Name: "other", StoredBytes: 104, UniqueBytes: 4, SharedBytes: 100, Tags: 1},
+	} {
+		if entry := reportEntry(t, report.Namespaces, expected.Name); entry != expected {
+			t.Errorf("expected namespace %+v, got %+v", expected, entry)
+		}
+	}
+	if report.Repositories[0].Name != "team/api" || report.Namespaces[0].Name != "team" {
+		t.Errorf("expected entries ordered by stored bytes, got %s and %s first", report.Repositories[0].Name, report.Namespaces[0].Name)
+	}
+}
+
+func TestCountAccessFlushesToActivity(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "usage.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	proxy := &Proxy{Cache: &lru.Cache{Db: db}}
+	day := time.Date(2024, 3, 1, 23, 0, 0, 0, time.UTC)
+	proxy.countAccess("team/app", false, day)
+	proxy.countAccess("team/app", false, day.Add(30*time.Minute))
+	proxy.countAccess("team/app", true, day)
+	// the next day in UTC
+	proxy.countAccess("team/app", false, day.Add(2*time.Hour))
+
+	activities, err := proxy.Cache.GetActivity(day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activities) != 0 {
+		t.Errorf("expected no activity before a flush, got %+v", activities)
+	}
+	proxy.flushActivity()
+	activities, err = proxy.Cache.GetActivity(day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (lru.Activity{Pulls: 3, Pushes: 1}); activities["team/app"] != expected {
+		t.Errorf("expected %+v, got %+v", expected, activities["team/app"])
+	}
+	activities, err = proxy.Cache.GetActivity(day.Add(24 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (lru.Activity{Pulls: 1}); activities["team/app"] != expected {
+		t.Errorf("expected %+v on the next day, got %+v", expected, activities["team/app"])
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+)
+
+// GCShutdownPolicy decides what happens to a running garbage collection on shutdown
+type GCShutdownPolicy string
+
+const (
+	// GCShutdownWait lets the running garbage collection finish within the drain timeout
+	GCShutdownWait GCShutdownPolicy = "wait"
+	// GCShutdownAbort stops the running garbage collection right away
+	GCShutdownAbort GCShutdownPolicy = "abort"
+)
+
+type ShutdownSettings struct {
+	DrainTimeout time.Duration
+	GCPolicy     GCShutdownPolicy
+}
+
+// shutdown stops accepting requests, waits up to the drain timeout for in-flight
+// requests and the running cleanup, and aborts garbage collection that is still running
+func (proxy *Proxy) shutdown(cancel context.CancelFunc) {
+	deadline := time.Now().Add(proxy.ShutdownSettings.DrainTimeout)
+	ctx, cancelDrain := context.WithDeadline(context.Background(), deadline)
+	defer cancelDrain()
+
+	proxy.stopping.Store(true)
+	// stop blocks until running jobs return, which shutdown waits for below
+	go proxy.MaintenanceScheduler.Stop()
+	if pushes := proxy.inFlightPushes.Load(); pushes > 0 {
+		common.Log.Infof("waiting up to %s for %d in-flight pushes", proxy.ShutdownSettings.DrainTimeout, pushes)
+	}
+	if err := proxy.Server.Shutdown(ctx); err != nil {
+		common.Log.Warnf("drain timeout exceeded with %d in-flight pushes, closing connections: %v", proxy.inFlightPushes.Load(), err)
+		common.LogIfError(proxy.Server.Close())
+	}
+
+	if trigger, _, running := proxy.running.get(); running {
+		if proxy.ShutdownSettings.GCPolicy == GCShutdownWait {
+			common.Log.Infof("waiting for the %s cleanup to finish its garbage collection", trigger)
+			if !proxy.waitForCleanup(ctx) {
+				common.Log.Warnf("drain timeout exceeded, aborting the %s cleanup", trigger)
+			}
+		} else {
+			common.Log.Infof("aborting the %s cleanup", trigger)
+		}
+	}
+	cancel()
+	proxy.waitForCleanup(context.Background())
+	if proxy.Supervisor != nil {
+		<-proxy.Supervisor.Done()
+	}
+
+	// the drain timeout starts again so events of the last cleanup are delivered
+	eventsCtx, cancelEvents := context.WithTimeout(context.Background(), proxy.ShutdownSettings.DrainTimeout)
+	defer cancelEvents()
+	proxy.drainEvents(eventsCtx)
+	proxy.flushActivity()
+}
+
+// waitForCleanup waits until no cleanup is running, it reports false if ctx ended first
+func (proxy *Proxy) waitForCleanup(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		proxy.cleanupLock.Lock()
+		proxy.cleanupLock.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"syscall"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/sirupsen/logrus"
+)
+
+// handleSignals reloads, cleans up and dumps diagnostics on signals until a shutdown
+// signal is received. a cleanup started by a signal uses the same singleton lock as
+// the scheduled cleanup
+func (proxy *Proxy) handleSignals(signals <-chan os.Signal) {
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGHUP:
+			common.Log.Infof("received %s, reloading configuration", sig)
+			go proxy.reload()
+		case syscall.SIGUSR1:
+			common.Log.Infof("received %s, starting cleanup", sig)
+			go proxy.runCleanup(proxy.ctx, "signal")
+		case syscall.SIGUSR2:
+			common.Log.Infof("received %s, dumping diagnostics", sig)
+			go proxy.dumpDiagnostics()
+		default:
+			return
+		}
+	}
+}
+
+// reload calls the Reload hook and reloads the TLS certificate, a reload already
+// in progress is not repeated
+func (proxy *Proxy) reload() {
+	if !proxy.reloadLock.TryLock() {
+		common.Log.Infof("reload already running, skipping")
+		return
+	}
+	defer proxy.reloadLock.Unlock()
+
+	if proxy.Reload != nil {
+		if err := proxy.Reload(); err != nil {
+			common.Log.Warnf("unable to reload configuration: %v", err)
+		}
+	}
+	if proxy.Certificate != nil {
+		if err := proxy.Certificate.Reload(); err != nil {
+			common.Log.Warnf("unable to reload tls certificate, serving the previous certificate: %v", err)
+		} else {
+			common.Log.Infof("reloaded tls certificate %s", proxy.Certificate.CertFile)
+		}
+	}
+}
+
+// dumpDiagnostics logs cache statistics, the cleanup state and the stacks of all goroutines
+func (proxy *Proxy) dumpDiagnostics() {
+	tags := len(proxy.Cache.GetLruList())
+	pinned, leased := 0, 0
+	now := time.Now()
+	for _, metadata := range proxy.Cache.GetAllMetadata() {
+		if metadata.Pinned {
+			pinned++
+		} else if _, protected := metadata.Protected(now); protected {
+			leased++
+		}
+	}
+
+	proxy.usageLock.Lock()
+	usageBytes, usageCheckTime := proxy.usageBytes, proxy.usageCheckTime
+	proxy.usageLock.Unlock()
+
+	settings := proxy.settings()
+	common.Log.Infof("cache: %d tags, %d pinned, %d leased", tags, pinned, leased)
+	common.Log.Infof("usage: %d bytes measured at %s, target %d bytes, hard limit %d bytes",
+		usageBytes, usageCheckTime.Format(time.RFC3339), settings.TargetUsageBytes, settings.HardLimitBytes)
+
+	if trigger, startTime, running := proxy.running.get(); running {
+		common.Log.Infof("cleanup: %s cleanup running since %s", trigger, startTime.Format(time.RFC3339))
+	} else {
+		common.Log.Infof("cleanup: not running")
+	}
+	if runs, err := proxy.Cache.GetCleanupRuns(1); err == nil && len(runs) > 0 {
+		common.Log.Infof("last cleanup: %s cleanup at %s stopped: %s, %d tags evicted",
+			runs[0].Trigger, runs[0].StartTime.Format(time.RFC3339), runs[0].StopReason, len(runs[0].Evicted))
+	}
+	breaker := "closed"
+	if reason, open := proxy.breaker.open(); open {
+		breaker = fmt.Sprintf("open: %s", reason)
+	}
+	common.Log.Infof("circuit breaker %s, emergency: %t, read only: %t, registry rejects deletes: %t",
+		breaker, proxy.emergency.Load(), proxy.readOnly.Load(), proxy.deletesRejected.Load())
+	if proxy.Supervisor != nil {
+		status := proxy.Supervisor.Status()
+		common.Log.Infof("registry process: pid %d, %d restarts, stopped: %t", status.Pid, status.Restarts, status.Stopped)
+	}
+
+	// each line of the stacks is logged as an entry
+	common.Log.Infof("%d goroutines:", runtime.NumGoroutine())
+	stacks := common.Log.WriterLevel(logrus.InfoLevel)
+	defer stacks.Close()
+	common.LogIfError(pprof.Lookup("goroutine").WriteTo(stacks, 2))
+}
@@ -0,0 +1,134 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+	"github.com/regclient/regclient/types"
+	"github.com/regclient/regclient/types/ref"
+)
+
+// imageSizeTimeout bounds measuring the size of a single tag
+const imageSizeTimeout = time.Minute
+
+// recordDigest stores the manifest a tag points to and measures its size for the cache
+// usage provider and usage reports
+func (proxy *Proxy) recordDigest(image *lru.Image, digest string) {
+	common.LogIfError(proxy.Cache.SetDigest(image, digest))
+	if proxy.RecordSizes {
+		proxy.recordSize(image)
+	}
+}
+
+// recordSize measures a tag in the background when usage.db has no size for it, a tag
+// is measured once at a time
+func (proxy *Proxy) recordSize(image *lru.Image) {
+	if proxy.Cache.GetMetadata(image).Size > 0 {
+		return
+	}
+	if _, measuring := proxy.sizing.LoadOrStore(image.Name(), true); measuring {
+		return
+	}
+	go func() {
+		defer proxy.sizing.Delete(image.Name())
+		if err := proxy.measureSize(proxy.ctx, image); err != nil {
+			common.Log.Debugf("unable to measure the size of %s: %v", image.Name(), err)
+		}
+	}()
+}
+
+// measureSize stores the summed size of the manifests and blobs of a tag
+func (proxy *Proxy) measureSize(ctx context.Context, image *lru.Image) error {
+	digest := proxy.Cache.GetMetadata(image).Digest
+	ctx, cancel := context.WithTimeout(ctx, imageSizeTimeout)
+	defer cancel()
+	size, err := proxy.ImageSize(ctx, image)
+	if err != nil {
+		return err
+	}
+	return proxy.Cache.SetSize(image, digest, size)
+}
+
+// resolveDigest looks up the manifest digest of a tag in the registry and stores it, it
+// reports false when the registry no longer has the tag
+func (proxy *Proxy) resolveDigest(ctx context.Context, image *lru.Image) (bool, error) {
+	r, err := ref.New(fmt.Sprintf("%s/%s:%s", proxy.RegistryHost, image.Repo, image.Tag))
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, imageSizeTimeout)
+	defer cancel()
+	m, err := proxy.RegClient.ManifestHead(ctx, r)
+	if errors.Is(err, types.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, proxy.Cache.SetDigest(image, m.GetDescriptor().Digest.String())
+}
+
+// backfillDigests resolves the digest of the cached tags usage.db has none for once at
+// startup, tags recorded before digests were stored are otherwise missed by pulls and
+// deletes by digest
+func (proxy *Proxy) backfillDigests() {
+	resolved, failed := 0, 0
+	for _, image := range proxy.Cache.GetTagsWithoutDigest("") {
+		image := image
+		if proxy.ctx.Err() != nil {
+			return
+		}
+		if found, err := proxy.resolveDigest(proxy.ctx, &image); err != nil {
+			common.Log.Debugf("unable to resolve the digest of %s: %v", image.Name(), err)
+			failed++
+		} else if found {
+			resolved++
+		}
+	}
+	if resolved > 0 || failed > 0 {
+		common.Log.Infof("resolved the digest of %d tags, %d could not be resolved", resolved, failed)
+	}
+}
+
+// backfillSizes measures the cached tags without a stored size once at startup, tags
+// pushed before sizes were recorded are otherwise not counted
+func (proxy *Proxy) backfillSizes() {
+	measured, failed := 0, 0
+	for _, image := range proxy.Cache.GetLruList() {
+		image := image
+		if proxy.ctx.Err() != nil {
+			return
+		}
+		if proxy.Cache.GetMetadata(&image).Size > 0 {
+			continue
+		}
+		if err := proxy.measureSize(proxy.ctx, &image); err != nil {
+			common.Log.Debugf("unable to measure the size of %s: %v", image.Name(), err)
+			failed++
+			continue
+		}
+		measured++
+	}
+	if measured > 0 || failed > 0 {
+		common.Log.Infof("measured the size of %d tags, %d could not be measured", measured, failed)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+)
+
+const (
+	snapshotPrefix = "usage-"
+	snapshotSuffix = ".db"
+)
+
+// SnapshotSettings configures scheduled backups of usage.db, snapshots are disabled when Dir is empty
+type SnapshotSettings struct {
+	Dir          string
+	CronSchedule string
+	Keep         int
+}
+
+// snapshot writes a backup of usage.db to the snapshot directory and removes
+// the oldest snapshots beyond the number to keep
+func (proxy *Proxy) snapshot() {
+	path := filepath.Join(
+		proxy.SnapshotSettings.Dir,
+		fmt.Sprintf("%s%s%s", snapshotPrefix, time.Now().UTC().Format("20060102T150405Z"), snapshotSuffix))
+	startTime := time.Now()
+	if err := os.MkdirAll(proxy.SnapshotSettings.Dir, 0700); err != nil {
+		common.Log.Errorf("usage.db snapshot failed: %v", err)
+		return
+	}
+	written, err := proxy.Cache.BackupFile(path)
+	if err != nil {
+		common.Log.Errorf("usage.db snapshot failed: %v", err)
+		return
+	}
+	common.Log.Infof("wrote usage.db snapshot %s, %d bytes in %s", path, written, time.Since(startTime).Round(time.Millisecond))
+
+	if proxy.SnapshotSettings.Keep <= 0 {
+		return
+	}
+	snapshots, err := filepath.Glob(filepath.Join(proxy.SnapshotSettings.Dir, snapshotPrefix+"*"+snapshotSuffix))
+	if err != nil {
+		common.LogIfError(err)
+		return
+	}
+	sort.Strings(snapshots)
+	for len(snapshots) > proxy.SnapshotSettings.Keep {
+		common.Log.Debugf("removing usage.db snapshot %s", snapshots[0])
+		common.LogIfError(os.Remove(snapshots[0]))
+		snapshots = snapshots[1:]
+	}
+}
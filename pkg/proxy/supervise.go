@@ -0,0 +1,64 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+)
+
+// startRegistry starts the supervised registry and waits until it is healthy before
+// the proxy accepts traffic, the proxy exits when the registry does not become healthy
+func (proxy *Proxy) startRegistry(ctx context.Context, cancel context.CancelFunc) {
+	if proxy.Supervisor.Healthy == nil {
+		proxy.Supervisor.Healthy = proxy.checkRegistry
+	}
+	if err := proxy.Supervisor.Start(ctx); err != nil {
+		cancel()
+		<-proxy.Supervisor.Done()
+		common.ExitIfError(err)
+	}
+}
+
+// executeOfflineGarbageCollection stops the supervised registry, runs garbage collection
+// and starts the registry again. requests are rejected while the registry is stopped
+func (proxy *Proxy) executeOfflineGarbageCollection(ctx context.Context) (string, error) {
+	proxy.offline.Store(true)
+	defer proxy.offline.Store(false)
+
+	common.Log.Infof("stopping registry for offline garbage collection")
+	if err := proxy.Supervisor.Stop(); err != nil {
+		return "", fmt.Errorf("unable to stop registry for garbage collection: %w", err)
+	}
+	output, err := proxy.Backend.GarbageCollect(ctx)
+	// a canceled clean cycle still starts the registry, unless the proxy is shutting down
+	if proxy.ctx.Err() != nil {
+		// shutting down, the supervisor stops with the proxy
+		return output, err
+	}
+
+	common.Log.Infof("starting registry after offline garbage collection")
+	if resumeErr := proxy.Supervisor.Resume(proxy.ctx); resumeErr != nil {
+		common.Log.Errorf("registry not healthy after offline garbage collection: %v", resumeErr)
+		if err == nil {
+			err = resumeErr
+		}
+	}
+	return output, err
+}
@@ -0,0 +1,53 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"crypto/tls"
+	"sync/atomic"
+)
+
+// Certificate is a TLS key pair served by the proxy that can be reloaded from disk
+type Certificate struct {
+	CertFile string
+	KeyFile  string
+	pair     atomic.Pointer[tls.Certificate]
+}
+
+// LoadCertificate reads a TLS key pair
+func LoadCertificate(certFile string, keyFile string) (*Certificate, error) {
+	certificate := &Certificate{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}
+	return certificate, certificate.Reload()
+}
+
+// Reload reads the key pair again, the previous pair is kept when it cannot be read
+func (certificate *Certificate) Reload() error {
+	pair, err := tls.LoadX509KeyPair(certificate.CertFile, certificate.KeyFile)
+	if err != nil {
+		return err
+	}
+	certificate.pair.Store(&pair)
+	return nil
+}
+
+// GetCertificate returns the current key pair, for use in tls.Config
+func (certificate *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return certificate.pair.Load(), nil
+}
@@ -0,0 +1,107 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/opencontainers/go-digest"
+	"github.com/regclient/regclient/types"
+	"github.com/regclient/regclient/types/ref"
+)
+
+// blobCommitMatch matches the request that completes a chunked blob upload
+var blobCommitMatch = regexp.MustCompile(`/v2/(.*)/blobs/uploads/[^/]+$`)
+
+// blobSizeTimeout bounds looking up the size of an uploaded blob
+const blobSizeTimeout = 30 * time.Second
+
+// accountsPushes reports whether pushes are added to the usage tracker, it only needs
+// them while it cannot watch the registry storage
+func (proxy *Proxy) accountsPushes() bool {
+	return proxy.UsageTracker != nil && !proxy.UsageTracker.Watching()
+}
+
+// blobCommit returns the repository and digest of a request that stores a blob, mounts
+// from another repository store nothing new
+func blobCommit(req *http.Request) (string, string, bool) {
+	query := req.URL.Query()
+	if query.Get("digest") == "" || query.Get("mount") != "" {
+		return "", "", false
+	}
+	var matches []string
+	switch req.Method {
+	case http.MethodPut:
+		matches = blobCommitMatch.FindStringSubmatch(req.URL.Path)
+	case http.MethodPost:
+		matches = blobUploadMatch.FindStringSubmatch(req.URL.Path)
+	}
+	if matches == nil {
+		return "", "", false
+	}
+	return matches[1], query.Get("digest"), true
+}
+
+// serveBlobCommit proxies a request that stores a blob and adds the size of the blob to
+// the usage tracker once the registry created it
+func (proxy *Proxy) serveBlobCommit(res http.ResponseWriter, req *http.Request, repo string, blobDigest string) {
+	recorder := &responseRecorder{ResponseWriter: res, status: http.StatusOK}
+	proxy.RegistryProxy.ServeHTTP(recorder, req)
+	if recorder.status == http.StatusCreated {
+		go proxy.accountBlob(repo, blobDigest)
+	}
+}
+
+// accountBlob adds the size of a blob to the usage tracker
+func (proxy *Proxy) accountBlob(repo string, blobDigest string) {
+	parsed, err := digest.Parse(blobDigest)
+	if err != nil {
+		common.Log.Debugf("not accounting blob %s: %v", blobDigest, err)
+		return
+	}
+	r, err := ref.New(proxy.RegistryHost + "/" + repo)
+	if err != nil {
+		common.Log.Debugf("not accounting blob %s: %v", blobDigest, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(proxy.ctx, blobSizeTimeout)
+	defer cancel()
+	blob, err := proxy.RegClient.BlobHead(ctx, r, types.Descriptor{Digest: parsed})
+	if err != nil {
+		common.Log.Debugf("unable to look up the size of blob %s: %v", blobDigest, err)
+		return
+	}
+	defer blob.Close()
+	proxy.UsageTracker.Added(blobDigest, blob.GetDescriptor().Size)
+}
+
+// accountManifest adds the size of a pushed manifest stored as blob manifestDigest to
+// the usage tracker
+func (proxy *Proxy) accountManifest(req *http.Request, manifestDigest string) {
+	size := req.ContentLength
+	if size < 0 {
+		size, _ = strconv.ParseInt(req.Header.Get("Content-Length"), 10, 64)
+	}
+	if size > 0 {
+		proxy.UsageTracker.Added(manifestDigest, size)
+	}
+}
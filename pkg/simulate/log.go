@@ -0,0 +1,101 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package simulate
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// textLogMatch matches the access lines of the proxy log in the logrus text format
+	textLogMatch = regexp.MustCompile(`time="([^"]+)".*msg="(pulling|pushing) ([^"\s]+)"`)
+)
+
+// logLine holds the fields of a json log line, an audit event, a CloudEvent or a
+// logrus json entry
+type logLine struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	Image       string    `json:"image"`
+	Msg         string    `json:"msg"`
+	SpecVersion string    `json:"specversion"`
+	Data        *logLine  `json:"data"`
+}
+
+// ParseLog reads pushes and pulls from a proxy log in the logrus text or json format,
+// or from audit events as json lines or CloudEvents. It returns the accesses and the
+// number of lines that are not accesses.
+func ParseLog(r io.Reader) ([]Access, int, error) {
+	var accesses []Access
+	skipped := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if access, ok := parseLine(scanner.Text()); ok {
+			accesses = append(accesses, access)
+		} else {
+			skipped++
+		}
+	}
+	return accesses, skipped, scanner.Err()
+}
+
+func parseLine(text string) (Access, bool) {
+	if strings.HasPrefix(strings.TrimSpace(text), "{") {
+		line := logLine{}
+		if err := json.Unmarshal([]byte(text), &line); err != nil {
+			return Access{}, false
+		}
+		if line.SpecVersion != "" && line.Data != nil {
+			line = *line.Data
+		}
+		if line.Image != "" {
+			return accessFromEvent(line.Time, line.Type, line.Image)
+		}
+		fields := strings.Fields(line.Msg)
+		if len(fields) != 2 {
+			return Access{}, false
+		}
+		return accessFromEvent(line.Time, fields[0], fields[1])
+	}
+
+	matches := textLogMatch.FindStringSubmatch(text)
+	if matches == nil {
+		return Access{}, false
+	}
+	accessTime, err := time.Parse(time.RFC3339, matches[1])
+	if err != nil {
+		return Access{}, false
+	}
+	return accessFromEvent(accessTime, matches[2], matches[3])
+}
+
+func accessFromEvent(accessTime time.Time, eventType string, image string) (Access, bool) {
+	switch eventType {
+	case "pushed", "pushing":
+		return Access{Time: accessTime, Image: image, Push: true}, !accessTime.IsZero()
+	case "pulled", "pulling":
+		return Access{Time: accessTime, Image: image}, !accessTime.IsZero()
+	default:
+		return Access{}, false
+	}
+}
@@ -0,0 +1,234 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package simulate
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Access is a push or pull replayed by the simulator
+type Access struct {
+	Time  time.Time
+	Image string
+	Push  bool
+}
+
+// Policy is a set of clean cycle settings to simulate
+type Policy struct {
+	Name string
+	// Interval is the time between scheduled clean cycles, 0 disables them
+	Interval            time.Duration
+	TargetBytes         uint64
+	HardLimitBytes      uint64
+	CleanTagsPercentage float64
+}
+
+// Report is the outcome of replaying accesses against a policy
+type Report struct {
+	Policy               string  `json:"policy"`
+	Pulls                int     `json:"pulls"`
+	Hits                 int     `json:"hits"`
+	HitRatio             float64 `json:"hitRatio"`
+	Pushes               int     `json:"pushes"`
+	RePushes             int     `json:"rePushes"`
+	EvictedTags          int     `json:"evictedTags"`
+	EvictedBytes         uint64  `json:"evictedBytes"`
+	PeakBytes            uint64  `json:"peakBytes"`
+	FinalBytes           uint64  `json:"finalBytes"`
+	CleanCycles          int     `json:"cleanCycles"`
+	EmergencyCleanCycles int     `json:"emergencyCleanCycles"`
+}
+
+// Simulator replays accesses with a virtual clock against a scratch usage.db, so tags
+// are ranked and selected for eviction by the same code as the proxy.
+//
+// The model leaves out pinned and leased tags, which are evicted like any other tag,
+// and garbage collection, the storage of an evicted tag is freed at once rather than
+// when the registry next collects it. Tags do not share blobs, each is counted with
+// its full size.
+type Simulator struct {
+	// Sizes is the size of each tag by name, tags without a size use DefaultSize
+	Sizes       map[string]int64
+	DefaultSize int64
+	// Seed is the cache content before the first access
+	Seed []lru.Record
+	// TempDir holds the scratch usage.db, the system temp directory when empty
+	TempDir string
+}
+
+// run is the state of a single policy replay
+type run struct {
+	simulator *Simulator
+	policy    Policy
+	cache     *lru.Cache
+	present   map[string]int64
+	evicted   map[string]bool
+	usedBytes uint64
+	report    *Report
+	// accesses counts the accesses recorded in cache, see accessTime
+	accesses int64
+}
+
+// accessEpoch is the start of the access times recorded in the scratch usage.db
+var accessEpoch = time.Unix(0, 0).UTC()
+
+// Run replays accesses, which must be sorted by time, against a policy
+func (simulator *Simulator) Run(accesses []Access, policy Policy) (*Report, error) {
+	dir, err := os.MkdirTemp(simulator.TempDir, "simulate-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "usage.db"), 0600, &bolt.Options{NoSync: true, NoFreelistSync: true})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	state := &run{
+		simulator: simulator,
+		policy:    policy,
+		cache:     &lru.Cache{Db: db},
+		present:   map[string]int64{},
+		evicted:   map[string]bool{},
+		report:    &Report{Policy: policy.Name},
+	}
+	if err := state.cache.Init(); err != nil {
+		return nil, err
+	}
+	seed := append([]lru.Record(nil), simulator.Seed...)
+	sort.SliceStable(seed, func(i, j int) bool {
+		return seed[i].AccessTime.Before(seed[j].AccessTime)
+	})
+	for i := range seed {
+		seed[i].AccessTime = state.accessTime()
+	}
+	if _, err := state.cache.Import(seed, lru.MergeOverwrite); err != nil {
+		return nil, err
+	}
+	for _, record := range seed {
+		state.add(record.Image)
+	}
+
+	var nextCleanup time.Time
+	if len(accesses) > 0 && policy.Interval > 0 {
+		nextCleanup = accesses[0].Time.Truncate(policy.Interval).Add(policy.Interval)
+	}
+	for _, access := range accesses {
+		for policy.Interval > 0 && !access.Time.Before(nextCleanup) {
+			state.cleanup(false)
+			nextCleanup = nextCleanup.Add(policy.Interval)
+		}
+		state.replay(access)
+	}
+
+	state.report.FinalBytes = state.usedBytes
+	if state.report.Pulls > 0 {
+		state.report.HitRatio = float64(state.report.Hits) / float64(state.report.Pulls)
+	}
+	return state.report, nil
+}
+
+func (state *run) size(image string) int64 {
+	if size, ok := state.simulator.Sizes[image]; ok {
+		return size
+	}
+	return state.simulator.DefaultSize
+}
+
+// accessTime returns the time of the next access recorded in cache. usage.db keys tags
+// by access time to the second, so tags accessed in the same second would replace each
+// other; every access is recorded a second after the previous one instead, keeping the
+// order of the replay
+func (state *run) accessTime() time.Time {
+	t := accessEpoch.Add(time.Duration(state.accesses) * time.Second)
+	state.accesses++
+	return t
+}
+
+// add stores a tag in the simulated registry
+func (state *run) add(image string) {
+	if _, ok := state.present[image]; ok {
+		return
+	}
+	size := state.size(image)
+	state.present[image] = size
+	state.usedBytes += uint64(size)
+	if state.usedBytes > state.report.PeakBytes {
+		state.report.PeakBytes = state.usedBytes
+	}
+}
+
+// replay records an access the way the proxy does, pulls of tags that are not in
+// the registry are recorded as well
+func (state *run) replay(access Access) {
+	repo, tag, ok := lru.ParseName(access.Image)
+	if !ok {
+		return
+	}
+	if access.Push {
+		state.report.Pushes++
+		if state.evicted[access.Image] {
+			state.report.RePushes++
+			delete(state.evicted, access.Image)
+		}
+		state.add(access.Image)
+	} else {
+		state.report.Pulls++
+		if _, ok := state.present[access.Image]; ok {
+			state.report.Hits++
+		}
+	}
+	state.cache.AddOrUpdate(&lru.Image{Repo: repo, Tag: tag, AccessTime: state.accessTime()})
+
+	if access.Push && state.policy.HardLimitBytes > 0 && state.usedBytes > state.policy.HardLimitBytes {
+		state.cleanup(true)
+	}
+}
+
+// cleanup runs a clean cycle, removing least recently used tags an iteration at a
+// time until usage is below the target
+func (state *run) cleanup(emergency bool) {
+	if emergency {
+		state.report.EmergencyCleanCycles++
+	} else {
+		state.report.CleanCycles++
+	}
+	for iteration := 0; state.usedBytes > state.policy.TargetBytes; iteration++ {
+		lruImages := state.cache.GetLruList()
+		if len(lruImages) == 0 {
+			return
+		}
+		for _, image := range lru.SelectRemovals(lruImages, state.policy.CleanTagsPercentage, iteration, -1) {
+			image := image
+			state.cache.Remove(&image)
+			if size, ok := state.present[image.Name()]; ok {
+				delete(state.present, image.Name())
+				state.usedBytes -= uint64(size)
+				state.evicted[image.Name()] = true
+				state.report.EvictedTags++
+				state.report.EvictedBytes += uint64(size)
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package simulate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/lru"
+)
+
+func TestRunEvictsTagsAccessedInTheSameSecond(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	simulator := &Simulator{
+		DefaultSize: 10,
+		Seed:        []lru.Record{{Image: "app:seed", AccessTime: start}},
+		TempDir:     t.TempDir(),
+	}
+	accesses := []Access{
+		{Time: start, Image: "app:a", Push: true},
+		{Time: start, Image: "app:b", Push: true},
+		{Time: start, Image: "app:c", Push: true},
+		{Time: start.Add(2 * time.Hour), Image: "app:a"},
+	}
+
+	report, err := simulator.Run(accesses, Policy{Name: "hourly", Interval: time.Hour, CleanTagsPercentage: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.EvictedTags != 4 || report.FinalBytes != 0 {
+		t.Errorf("expected every tag evicted, got %+v", report)
+	}
+	if report.Hits != 0 {
+		t.Errorf("expected the pull after the clean cycle to miss, got %d hits", report.Hits)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supervisor
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+	"github.com/sirupsen/logrus"
+)
+
+// logWriter forwards each line the registry writes to the log at the level of the line
+type logWriter struct {
+	buffer []byte
+}
+
+func (writer *logWriter) Write(p []byte) (int, error) {
+	writer.buffer = append(writer.buffer, p...)
+	for {
+		idx := bytes.IndexByte(writer.buffer, '\n')
+		if idx < 0 {
+			break
+		}
+		logLine(string(writer.buffer[:idx]))
+		writer.buffer = writer.buffer[idx+1:]
+	}
+	return len(p), nil
+}
+
+// logLine logs a registry line, using the level=... field distribution writes
+func logLine(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	level := logrus.InfoLevel
+	for _, candidate := range []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel, logrus.DebugLevel} {
+		name := candidate.String()
+		if candidate == logrus.WarnLevel {
+			name = "warn"
+		}
+		if strings.Contains(line, "level="+name) {
+			level = candidate
+			break
+		}
+	}
+	if level < logrus.ErrorLevel {
+		// a fatal registry line must not exit the proxy
+		level = logrus.ErrorLevel
+	}
+	common.Log.WithField("source", "registry").Log(level, line)
+}
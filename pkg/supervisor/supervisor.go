@@ -0,0 +1,254 @@
+/*
+Copyright © 2021 BoxBoat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/boxboat/dockhand-lru-registry/pkg/common"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+	// stableAfter is how long the registry must run before a crash restarts it without backoff
+	stableAfter = time.Minute
+	// stopGrace is how long the registry may take to exit after SIGTERM before it is killed
+	stopGrace = 30 * time.Second
+	// healthInterval is the time between health checks while waiting for the registry
+	healthInterval = 500 * time.Millisecond
+)
+
+// Supervisor runs the registry as a child process, restarting it with backoff when it exits
+type Supervisor struct {
+	Binary string
+	Config string
+	// Healthy checks that the registry serves requests
+	Healthy func(ctx context.Context) error
+	// StartTimeout is how long Start and Resume wait for the registry to become healthy
+	StartTimeout time.Duration
+
+	stopRequests   chan chan error
+	resumeRequests chan chan error
+	done           chan struct{}
+
+	lock     sync.Mutex
+	pid      int
+	restarts int
+	paused   bool
+}
+
+// Status describes the registry process
+type Status struct {
+	Pid      int  `json:"pid"`
+	Restarts int  `json:"restarts"`
+	Stopped  bool `json:"stopped"`
+}
+
+// Start launches the registry and waits until it is healthy, the registry is stopped
+// when ctx ends
+func (supervisor *Supervisor) Start(ctx context.Context) error {
+	supervisor.stopRequests = make(chan chan error)
+	supervisor.resumeRequests = make(chan chan error)
+	supervisor.done = make(chan struct{})
+	go supervisor.run(ctx)
+	return supervisor.waitHealthy(ctx)
+}
+
+// Stop stops the registry until Resume is called
+func (supervisor *Supervisor) Stop() error {
+	return supervisor.request(supervisor.stopRequests)
+}
+
+// Resume starts the registry after Stop and waits until it is healthy
+func (supervisor *Supervisor) Resume(ctx context.Context) error {
+	if err := supervisor.request(supervisor.resumeRequests); err != nil {
+		return err
+	}
+	return supervisor.waitHealthy(ctx)
+}
+
+// Done is closed once the registry stopped after ctx of Start ended
+func (supervisor *Supervisor) Done() <-chan struct{} {
+	return supervisor.done
+}
+
+// Status returns the pid, restart count and whether the registry is stopped
+func (supervisor *Supervisor) Status() Status {
+	supervisor.lock.Lock()
+	defer supervisor.lock.Unlock()
+	return Status{
+		Pid:      supervisor.pid,
+		Restarts: supervisor.restarts,
+		Stopped:  supervisor.paused,
+	}
+}
+
+func (supervisor *Supervisor) request(requests chan chan error) error {
+	reply := make(chan error, 1)
+	select {
+	case requests <- reply:
+		return <-reply
+	case <-supervisor.done:
+		return fmt.Errorf("registry supervisor is not running")
+	}
+}
+
+func (supervisor *Supervisor) waitHealthy(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, supervisor.StartTimeout)
+	defer cancel()
+	for {
+		err := supervisor.Healthy(ctx)
+		if err == nil {
+			common.Log.Infof("registry is healthy")
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return ctx.Err()
+			}
+			return fmt.Errorf("registry not healthy after %s: %w", supervisor.StartTimeout, err)
+		case <-time.After(healthInterval):
+		}
+	}
+}
+
+// run owns the registry process, it serializes crashes, restarts, stop and resume requests
+func (supervisor *Supervisor) run(ctx context.Context) {
+	defer close(supervisor.done)
+
+	var (
+		cmd       *exec.Cmd
+		exited    chan error
+		restart   <-chan time.Time
+		startTime time.Time
+		backoff   = minBackoff
+	)
+	start := func() {
+		var err error
+		cmd, exited, err = supervisor.spawn()
+		startTime = time.Now()
+		if err != nil {
+			common.Log.Errorf("unable to start registry, retrying in %s: %v", backoff, err)
+			restart = time.After(backoff)
+			backoff = nextBackoff(backoff)
+		}
+	}
+	stop := func() {
+		if cmd != nil {
+			terminate(cmd, exited)
+			cmd, exited = nil, nil
+			supervisor.setPid(0)
+		}
+	}
+
+	start()
+	for {
+		select {
+		case <-ctx.Done():
+			stop()
+			common.Log.Infof("registry stopped")
+			return
+		case err := <-exited:
+			cmd, exited = nil, nil
+			supervisor.setPid(0)
+			if time.Since(startTime) >= stableAfter {
+				backoff = minBackoff
+			}
+			common.Log.Errorf("registry exited: %v - restarting in %s", err, backoff)
+			supervisor.lock.Lock()
+			supervisor.restarts++
+			supervisor.lock.Unlock()
+			restart = time.After(backoff)
+			backoff = nextBackoff(backoff)
+		case <-restart:
+			restart = nil
+			start()
+		case reply := <-supervisor.stopRequests:
+			restart = nil
+			stop()
+			supervisor.setPaused(true)
+			common.Log.Infof("registry stopped")
+			reply <- nil
+		case reply := <-supervisor.resumeRequests:
+			if cmd == nil && restart == nil {
+				supervisor.setPaused(false)
+				backoff = minBackoff
+				start()
+			}
+			reply <- nil
+		}
+	}
+}
+
+// spawn starts the registry in its own process group with its output forwarded to the log
+func (supervisor *Supervisor) spawn() (*exec.Cmd, chan error, error) {
+	cmd := exec.Command(supervisor.Binary, "serve", supervisor.Config)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Stdout = &logWriter{}
+	cmd.Stderr = &logWriter{}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	common.Log.Infof("started registry %s serve %s, pid %d", supervisor.Binary, supervisor.Config, cmd.Process.Pid)
+	supervisor.setPid(cmd.Process.Pid)
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	return cmd, exited, nil
+}
+
+func (supervisor *Supervisor) setPid(pid int) {
+	supervisor.lock.Lock()
+	defer supervisor.lock.Unlock()
+	supervisor.pid = pid
+}
+
+func (supervisor *Supervisor) setPaused(paused bool) {
+	supervisor.lock.Lock()
+	defer supervisor.lock.Unlock()
+	supervisor.paused = paused
+}
+
+// terminate sends SIGTERM to the process group of the registry and kills it when it
+// has not exited after stopGrace
+func terminate(cmd *exec.Cmd, exited chan error) {
+	common.LogIfError(syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM))
+	select {
+	case <-exited:
+	case <-time.After(stopGrace):
+		common.Log.Warnf("registry did not exit within %s, killing it", stopGrace)
+		common.LogIfError(syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL))
+		<-exited
+	}
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff*2 > maxBackoff {
+		return maxBackoff
+	}
+	return backoff * 2
+}